@@ -3,8 +3,9 @@ document.addEventListener('DOMContentLoaded', () => {
     loadCart();
 });
 
-// Carga y dibuja el contenido del carrito.
-async function loadCart() {
+// Carga y dibuja el contenido del carrito. extraChanges son avisos de cambios recibidos
+// en otra respuesta (p. ej. al intentar comprar) que se muestran junto a los del carrito.
+async function loadCart(extraChanges = []) {
     const cartContainer = document.getElementById('cart-container');
     const cartTotalElement = document.getElementById('cart-total');
     const checkoutContainer = document.getElementById('checkout-container');
@@ -14,7 +15,8 @@ async function loadCart() {
         cartContainer.innerHTML = '<p>Tu carrito está vacío.</p>';
         return;
     }
-    const apiUrl = `http://localhost:8080/api/cart/${cartId}`;
+    // expand=products trae en cada línea los datos del producto y su subtotal.
+    const apiUrl = `http://localhost:8080/api/cart/${cartId}?expand=products`;
     try {
         const response = await fetch(apiUrl);
         if (response.status === 404) { // El carrito ya no existe.
@@ -27,52 +29,118 @@ async function loadCart() {
         if (!response.ok) throw new Error('No se pudo cargar el carrito.');
         
         const cart = await response.json();
+        const productMap = new Map(cart.items.filter(item => item.product).map(item => [item.productId, item.product]));
+        // Avisos de precios actualizados, productos retirados o stock insuficiente.
+        const changesHtml = changeNotices([...extraChanges, ...(cart.changes || [])], productMap, cart.currency);
         if (!cart.items || cart.items.length === 0) {
-            cartContainer.innerHTML = '<p>Tu carrito está vacío.</p>';
+            cartContainer.innerHTML = changesHtml + '<p>Tu carrito está vacío.</p>';
             return;
         }
 
         // Construye la tabla del carrito dinámicamente.
-        let tableHtml = `<table><thead><tr><th>Producto</th><th>Cantidad</th><th>Precio Unitario</th><th>Subtotal</th><th>Acción</th></tr></thead><tbody>`;
-        const productsResponse = await fetch('http://localhost:8080/api/products');
-        const products = await productsResponse.json();
-        const productMap = new Map(products.map(p => [p.id, p.name]));
+        let tableHtml = changesHtml + `<table><thead><tr><th>Producto</th><th>Cantidad</th><th>Precio Unitario</th><th>Subtotal</th><th>Acción</th></tr></thead><tbody>`;
         cart.items.forEach(item => {
-            const productName = productMap.get(item.productId) || 'Producto no encontrado';
+            const product = item.product;
+            const variantLabel = item.variantId && product ? ` (${Object.values(product.options || {}).join(' / ') || product.sku})` : '';
+            const productName = product ? product.name + variantLabel : 'Producto no encontrado';
             const price = item.price.toLocaleString('es-EC', { style: 'currency', currency: 'USD' });
-            const subtotal = (item.price * item.quantity).toLocaleString('es-EC', { style: 'currency', currency: 'USD' });
+            const subtotal = item.subtotal.toLocaleString('es-EC', { style: 'currency', currency: 'USD' });
             tableHtml += `
-                <tr id="item-${item.productId}">
+                <tr id="item-${item.productId}-${item.variantId || ''}">
                     <td>${productName}</td>
-                    <td>${item.quantity}</td>
+                    <td><input type="number" class="quantity-input" min="0" value="${item.quantity}" data-product-id="${item.productId}" data-variant-id="${item.variantId || ''}"></td>
                     <td>${price}</td>
                     <td>${subtotal}</td>
-                    <td><button class="delete-item-btn" data-product-id="${item.productId}">Eliminar</button></td>
+                    <td><button class="delete-item-btn" data-product-id="${item.productId}" data-variant-id="${item.variantId || ''}">Eliminar</button></td>
                 </tr>`;
         });
         tableHtml += `</tbody></table>`;
         cartContainer.innerHTML = tableHtml;
 
-        // Muestra el total y el botón de comprar.
-        const total = cart.total.toLocaleString('es-EC', { style: 'currency', currency: 'USD' });
-        cartTotalElement.innerHTML = `<strong>Total: ${total}</strong>`;
-        checkoutContainer.innerHTML = `<button id="checkout-btn" class="submit-btn">Realizar Compra</button>`;
+        // Muestra subtotal, descuentos, total y el botón de comprar.
+        const money = amount => amount.toLocaleString('es-EC', { style: 'currency', currency: cart.currency || 'USD' });
+        let totalsHtml = `<p>Subtotal: ${money(cart.subtotal)}</p>`;
+        (cart.discounts || []).forEach(discount => {
+            totalsHtml += `<p>${discount.code} (${discount.description}): -${money(discount.amount)}</p>`;
+        });
+        (cart.taxes || []).forEach(tax => {
+            const label = tax.inclusive ? `${tax.name} ${tax.rate}% (incluido)` : `${tax.name} ${tax.rate}%`;
+            totalsHtml += `<p>${label}: ${money(tax.amount)}</p>`;
+        });
+        if (cart.couponError) {
+            totalsHtml += `<p class="coupon-error">Cupón ${cart.couponCode}: ${cart.couponError}</p>`;
+        }
+        totalsHtml += `<strong>Total: ${money(cart.total)}</strong>`;
+        totalsHtml += `
+            <form id="coupon-form">
+                <input type="text" id="coupon-code" placeholder="Código de cupón" value="${cart.couponCode || ''}">
+                <button type="submit">Aplicar</button>
+            </form>`;
+        cartTotalElement.innerHTML = totalsHtml;
+        checkoutContainer.innerHTML = `
+            <form id="shipping-form">
+                <h3>Dirección de envío</h3>
+                <input type="text" id="ship-recipient" placeholder="Nombre de quien recibe" required>
+                <input type="text" id="ship-line1" placeholder="Calle y número" required>
+                <input type="text" id="ship-city" placeholder="Ciudad" required>
+                <input type="text" id="ship-state" placeholder="Provincia/estado (código ISO, opcional)">
+                <input type="text" id="ship-country" placeholder="País (p. ej. EC)" maxlength="2" required>
+                <button type="submit">Calcular envío</button>
+                <select id="shipping-method" disabled><option value="">Calcula el envío primero</option></select>
+                <h3>Pago</h3>
+                <input type="text" id="card-number" placeholder="Número de tarjeta" autocomplete="cc-number">
+                <input type="text" id="card-expiry" placeholder="Vencimiento (MM/AA)" autocomplete="cc-exp">
+                <input type="text" id="card-cvc" placeholder="CVC" maxlength="4" autocomplete="cc-csc">
+            </form>
+            <button id="checkout-btn" class="submit-btn" disabled>Realizar Compra</button>`;
 
-        // Asigna eventos a los botones de eliminar y comprar.
+        // Asigna eventos a las cantidades y a los botones de eliminar y comprar.
+        document.querySelectorAll('.quantity-input').forEach(input => {
+            input.addEventListener('change', () => { updateItemQuantity(cartId, input.dataset.productId, input.dataset.variantId, input.value); });
+        });
         document.querySelectorAll('.delete-item-btn').forEach(button => {
-            button.addEventListener('click', () => { removeItemFromCart(cartId, button.dataset.productId); });
+            button.addEventListener('click', () => { removeItemFromCart(cartId, button.dataset.productId, button.dataset.variantId); });
         });
         document.getElementById('checkout-btn').addEventListener('click', () => { checkout(cartId); });
+        document.getElementById('shipping-form').addEventListener('submit', event => {
+            event.preventDefault();
+            loadShippingRates(cartId, money);
+        });
+        document.getElementById('coupon-form').addEventListener('submit', event => {
+            event.preventDefault();
+            applyCoupon(cartId, document.getElementById('coupon-code').value);
+        });
     } catch (error) {
         console.error('Error:', error);
         cartContainer.innerHTML = '<p>Error al cargar el carrito.</p>';
     }
 }
 
+// Arma la lista de avisos para los cambios que la API detectó al conciliar el carrito.
+function changeNotices(changes, productMap, currency) {
+    if (changes.length === 0) return '';
+    const money = amount => amount.toLocaleString('es-EC', { style: 'currency', currency: currency || 'USD' });
+    const items = changes.map(change => {
+        const name = productMap.get(change.productId)?.name || 'Un producto';
+        switch (change.type) {
+        case 'price_changed':
+            return `<li>El precio de ${name} cambió de ${money(change.oldPrice)} a ${money(change.newPrice)}.</li>`;
+        case 'removed':
+            return `<li>${name} ya no está disponible y se quitó del carrito.</li>`;
+        case 'insufficient_stock':
+            return `<li>Solo quedan ${change.available} unidades de ${name}; ajusta la cantidad.</li>`;
+        default:
+            return '';
+        }
+    });
+    return `<ul class="cart-changes">${items.join('')}</ul>`;
+}
+
 // Llama a la API para quitar un ítem del carrito.
-async function removeItemFromCart(cartId, productId) {
+async function removeItemFromCart(cartId, productId, variantId) {
     if (!confirm('¿Quitar este producto del carrito?')) return;
-    const apiUrl = `http://localhost:8080/api/cart/${cartId}/item/${productId}`;
+    const query = variantId ? `?variantId=${encodeURIComponent(variantId)}` : '';
+    const apiUrl = `http://localhost:8080/api/cart/${cartId}/item/${productId}${query}`;
     try {
         const response = await fetch(apiUrl, { method: 'DELETE' });
         if (!response.ok) throw new Error('No se pudo eliminar el producto');
@@ -83,12 +151,137 @@ async function removeItemFromCart(cartId, productId) {
     }
 }
 
-// Llama a la API para finalizar la compra.
+// Fija la cantidad de una línea del carrito; 0 la quita.
+async function updateItemQuantity(cartId, productId, variantId, value) {
+    const quantity = parseInt(value, 10);
+    if (!Number.isInteger(quantity) || quantity < 0) {
+        alert('Indica una cantidad válida.');
+        loadCart();
+        return;
+    }
+    const query = variantId ? `?variantId=${encodeURIComponent(variantId)}` : '';
+    const apiUrl = `http://localhost:8080/api/cart/${cartId}/item/${productId}${query}`;
+    try {
+        const response = await fetch(apiUrl, { method: 'PUT', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ quantity }) });
+        if (response.status === 409) {
+            const { error, items } = await response.json();
+            const available = items?.[0]?.available;
+            alert(available !== undefined ? `${error}: solo quedan ${available} unidades.` : error);
+        } else if (!response.ok) {
+            throw new Error('No se pudo actualizar la cantidad');
+        }
+    } catch (error) {
+        console.error('Error al actualizar:', error);
+        alert('Error al actualizar la cantidad.');
+    }
+    loadCart(); // Recarga el carrito para mostrar la cantidad vigente.
+}
+
+// Aplica un cupón al carrito; con el código vacío quita el actual.
+async function applyCoupon(cartId, code) {
+    const apiUrl = `http://localhost:8080/api/cart/${cartId}/coupon`;
+    try {
+        const response = code.trim()
+            ? await fetch(apiUrl, { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ code }) })
+            : await fetch(apiUrl, { method: 'DELETE' });
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+        loadCart();
+    } catch (error) {
+        console.error('Error al aplicar el cupón:', error);
+        alert('Error al aplicar el cupón.');
+    }
+}
+
+// Lee la dirección escrita en el formulario de envío.
+function shippingAddress() {
+    const value = id => document.getElementById(id).value.trim();
+    return {
+        recipient: value('ship-recipient'),
+        line1: value('ship-line1'),
+        city: value('ship-city'),
+        state: value('ship-state'),
+        country: value('ship-country'),
+    };
+}
+
+// Lee los datos de la tarjeta; el vencimiento se escribe como MM/AA.
+function paymentCard() {
+    const [month, year] = document.getElementById('card-expiry').value.split('/').map(part => parseInt(part, 10));
+    return {
+        number: document.getElementById('card-number').value,
+        expMonth: month || 0,
+        expYear: year < 100 ? 2000 + year : (year || 0),
+        cvc: document.getElementById('card-cvc').value.trim(),
+    };
+}
+
+// Consulta los métodos de envío disponibles para la dirección y llena el selector.
+async function loadShippingRates(cartId, money) {
+    const apiUrl = `http://localhost:8080/api/cart/${cartId}/shipping-rates`;
+    const select = document.getElementById('shipping-method');
+    try {
+        const response = await fetch(apiUrl, { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ address: shippingAddress() }) });
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+        const rates = await response.json();
+        if (rates.length === 0) {
+            select.innerHTML = '<option value="">No hay envíos disponibles para esta dirección</option>';
+            select.disabled = true;
+            document.getElementById('checkout-btn').disabled = true;
+            return;
+        }
+        select.innerHTML = rates.map(rate => `<option value="${rate.id}">${rate.name}: ${money(rate.amount)}</option>`).join('');
+        select.disabled = false;
+        document.getElementById('checkout-btn').disabled = false;
+    } catch (error) {
+        console.error('Error al calcular el envío:', error);
+        alert('Error al calcular el envío.');
+    }
+}
+
+// checkoutKey identifica el intento de compra en curso (cabecera Idempotency-Key): si la
+// respuesta no llega, el reintento reusa la clave y el servidor no crea una segunda orden.
+let checkoutKey = null;
+
+// Llama a la API para finalizar la compra con la dirección, el método de envío y la tarjeta.
 async function checkout(cartId) {
     if (!confirm('¿Finalizar la compra? Esto vaciará tu carrito y registrará la venta.')) return;
     const apiUrl = `http://localhost:8080/api/cart/${cartId}/checkout`;
+    const body = { address: shippingAddress(), shippingMethod: document.getElementById('shipping-method').value, payment: paymentCard() };
+    checkoutKey = checkoutKey || crypto.randomUUID();
+    const request = { method: 'POST', headers: { 'Content-Type': 'application/json', 'Idempotency-Key': checkoutKey }, body: JSON.stringify(body) };
     try {
-        const response = await fetch(apiUrl, { method: 'POST' });
+        let response;
+        try {
+            response = await fetch(apiUrl, request);
+        } catch (networkError) { // Sin respuesta: se reintenta una vez con la misma clave.
+            response = await fetch(apiUrl, request);
+        }
+        checkoutKey = null; // Hubo respuesta: el próximo intento es una compra nueva.
+        if (response.status === 400) {
+            alert(await response.text());
+            return;
+        }
+        if (response.status === 402) { // Tarjeta rechazada: el carrito se conserva.
+            const { error } = await response.json();
+            alert(error);
+            return;
+        }
+        if (response.status === 409 && !response.headers.get('Content-Type').includes('json')) {
+            alert(await response.text()); // Compra ya en curso o carrito modificado.
+            return;
+        }
+        if (response.status === 409) {
+            const { error, changes } = await response.json();
+            alert(error);
+            loadCart(changes || []); // Muestra el carrito actualizado con los cambios de precio.
+            return;
+        }
         if (!response.ok) throw new Error('No se pudo procesar la compra');
         alert('¡Gracias por tu compra!');
         localStorage.removeItem('cartId'); // Limpia el carrito del navegador.
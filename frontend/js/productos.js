@@ -27,11 +27,12 @@ async function createNewCart() {
 // Obtiene y muestra todos los productos en tarjetas.
 async function fetchProducts() {
     const productListContainer = document.getElementById('product-list');
-    const apiUrl = 'http://localhost:8080/api/products';
+    // La API devuelve los productos paginados y ordenados por nombre.
+    const apiUrl = 'http://localhost:8080/api/products?sort=name&limit=100';
     try {
         const response = await fetch(apiUrl);
         if (!response.ok) throw new Error(`Error HTTP: ${response.status}`);
-        const products = await response.json();
+        const { products } = await response.json();
         productListContainer.innerHTML = ''; // Limpia el mensaje "Cargando...".
         if (!products || products.length === 0) {
             productListContainer.innerHTML = '<p>No hay productos disponibles.</p>';
@@ -44,19 +45,24 @@ async function fetchProducts() {
             productCard.id = `product-${product.id}`;
             const formattedPrice = product.price.toLocaleString('es-EC', { style: 'currency', currency: 'USD' });
             productCard.innerHTML = `
+                ${productThumbnail(product)}
                 <h2>${product.name}</h2>
                 <p class="description">${product.description}</p>
                 <div class="price-stock-container">
                     <span class="price">${formattedPrice}</span>
                     <span class="stock">Stock: ${product.stock}</span>
                 </div>
+                ${variantSelect(product)}
                 <div class="card-buttons">
                     <button class="add-to-cart-btn">Añadir al Carrito</button>
                     <button class="delete-btn">Eliminar</button>
                 </div>
             `;
             // Asigna los eventos a los botones.
-            productCard.querySelector('.add-to-cart-btn').addEventListener('click', () => { addProductToCart(product.id); });
+            productCard.querySelector('.add-to-cart-btn').addEventListener('click', () => {
+                const variantId = productCard.querySelector('.variant-select')?.value || '';
+                addProductToCart(product.id, variantId);
+            });
             productCard.querySelector('.delete-btn').addEventListener('click', () => { deleteProduct(product.id); });
             productListContainer.appendChild(productCard);
         });
@@ -66,13 +72,23 @@ async function fetchProducts() {
     }
 }
 
+// Genera el selector de variantes (talla, color...) si el producto las tiene.
+function variantSelect(product) {
+    if (!product.variants || product.variants.length === 0) return '';
+    const options = product.variants.map(v => {
+        const label = Object.values(v.options || {}).join(' / ') || v.sku;
+        return `<option value="${v.id}" ${v.stock > 0 ? '' : 'disabled'}>${label} (stock: ${v.stock})</option>`;
+    }).join('');
+    return `<select class="variant-select">${options}</select>`;
+}
+
 // Lógica para añadir un producto al carrito, con auto-reparación de ID.
-async function addProductToCart(productId) {
+async function addProductToCart(productId, variantId = '') {
     if (!currentCartId) { await createNewCart(); } // Asegura tener un ID de carrito.
     if (!currentCartId) { alert("Error crítico: No se pudo obtener un ID de carrito."); return; }
     
     const apiUrl = `http://localhost:8080/api/cart/${currentCartId}/add`;
-    const productToAdd = { productId: productId, quantity: 1 };
+    const productToAdd = { productId: productId, variantId: variantId, quantity: 1 };
     try {
         const response = await fetch(apiUrl, {
             method: 'POST',
@@ -84,7 +100,7 @@ async function addProductToCart(productId) {
             if (response.status === 404) {
                 localStorage.removeItem('cartId');
                 const newId = await createNewCart();
-                if (newId) { addProductToCart(productId); } // Reintenta la operación.
+                if (newId) { addProductToCart(productId, variantId); } // Reintenta la operación.
                 return;
             }
             throw new Error(`Error del servidor: ${response.status}`);
@@ -112,4 +128,11 @@ async function deleteProduct(productId) {
         console.error('Error al eliminar el producto:', error);
         alert('Hubo un error al eliminar el producto.');
     }
-}
\ No newline at end of file
+}
+
+// Muestra la miniatura de la imagen principal del producto, si tiene imágenes.
+function productThumbnail(product) {
+    if (!product.images || product.images.length === 0) return '';
+    const [image] = product.images;
+    return `<img class="product-thumbnail" src="http://localhost:8080${image.thumbnailUrl}" alt="${product.name}" loading="lazy">`;
+}
@@ -16,13 +16,14 @@ async function generateReport() {
             return;
         }
         // Construye la tabla del reporte dinámicamente.
-        let tableHtml = `<table><thead><tr><th>Producto</th><th>Descripción</th><th>Cantidad Vendida</th></tr></thead><tbody>`;
+        let tableHtml = `<table><thead><tr><th>Producto</th><th>Descripción</th><th>Cantidad Vendida</th><th>Devueltas</th></tr></thead><tbody>`;
         reportData.forEach(item => {
             tableHtml += `
                 <tr>
                     <td>${item.product.name}</td>
                     <td>${item.product.description}</td>
                     <td><strong>${item.quantity_sold}</strong></td>
+                    <td>${item.quantity_returned || 0}</td>
                 </tr>`;
         });
         tableHtml += `</tbody></table>`;
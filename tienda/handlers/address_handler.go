@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"tienda/models"
+	"tienda/storage"
+	"tienda/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// AddressHandlers maneja las direcciones de envío guardadas en el perfil del usuario.
+type AddressHandlers struct {
+	store storage.AddressStorer
+}
+
+// NewAddressHandlers es el constructor para los handlers de direcciones.
+func NewAddressHandlers(s storage.AddressStorer) *AddressHandlers {
+	return &AddressHandlers{store: s}
+}
+
+// GetAddressesHandler devuelve las direcciones del usuario autenticado.
+func (h *AddressHandlers) GetAddressesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	addresses, err := h.store.GetAddresses(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Error interno al obtener las direcciones", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addresses)
+}
+
+// GetAddressHandler obtiene una dirección del usuario autenticado.
+func (h *AddressHandlers) GetAddressHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	address, err := h.store.GetAddress(r.Context(), user.ID, mux.Vars(r)["id"])
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(address)
+}
+
+// CreateAddressHandler guarda una nueva dirección en el perfil del usuario autenticado.
+func (h *AddressHandlers) CreateAddressHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	address, ok := decodeAddress(w, r)
+	if !ok {
+		return
+	}
+	address.UserID = user.ID
+	created, err := h.store.CreateAddress(r.Context(), address)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// UpdateAddressHandler reemplaza una dirección. Las órdenes ya creadas conservan su copia.
+func (h *AddressHandlers) UpdateAddressHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	address, ok := decodeAddress(w, r)
+	if !ok {
+		return
+	}
+	updated, err := h.store.UpdateAddress(r.Context(), user.ID, mux.Vars(r)["id"], address)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteAddressHandler elimina una dirección del perfil del usuario autenticado.
+func (h *AddressHandlers) DeleteAddressHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	if err := h.store.DeleteAddress(r.Context(), user.ID, mux.Vars(r)["id"]); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeAddress lee, normaliza y valida una dirección. Si falla, ya escribió la respuesta.
+func decodeAddress(w http.ResponseWriter, r *http.Request) (models.Address, bool) {
+	var a models.Address
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return models.Address{}, false
+	}
+	a.Normalize()
+	if err := a.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return models.Address{}, false
+	}
+	return a, true
+}
+
+// writeAddressError traduce los errores del almacén de direcciones a códigos HTTP.
+func writeAddressError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrAddressNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, "Error interno al procesar la dirección", http.StatusInternalServerError)
+}
@@ -1,30 +1,72 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"slices"
 	"tienda/models"
+	"tienda/payment"
+	"tienda/shipping"
 	"tienda/storage"
+	"tienda/utils"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-// CartHandlers necesita dependencias de carritos, productos y órdenes.
+// CartHandlers necesita dependencias de carritos, productos, inventario, cupones, impuestos y
+// direcciones, los métodos de envío configurados, el proveedor de pagos, y transacciones
+// para que la compra (que también crea la orden) se confirme o se descarte completa.
 type CartHandlers struct {
-	cartStore    storage.CartStorer
-	productStore storage.ProductStorer
-	orderStore   storage.OrderStorer
+	tx              storage.Transactor
+	cartStore       storage.CartStorer
+	productStore    storage.ProductStorer
+	inventoryStore  storage.InventoryStorer
+	addressStore    storage.AddressStorer
+	pricer          cartPricer
+	shippingMethods shipping.Methods
+	payments        paymentProcessor
+	reservationTTL  time.Duration // Si es mayor que 0, añadir al carrito reserva stock durante este tiempo.
 }
 
 // NewCartHandlers es el constructor que inyecta todas las dependencias.
-func NewCartHandlers(cs storage.CartStorer, ps storage.ProductStorer, os storage.OrderStorer) *CartHandlers {
-	return &CartHandlers{cartStore: cs, productStore: ps, orderStore: os}
+func NewCartHandlers(tx storage.Transactor, cs storage.CartStorer, ps storage.ProductStorer, is storage.InventoryStorer, cps storage.CouponStorer, cts storage.CategoryStorer, ts storage.TaxStorer, as storage.AddressStorer, methods shipping.Methods, provider payment.Provider, reservationTTL time.Duration) *CartHandlers {
+	return &CartHandlers{
+		tx:              tx,
+		cartStore:       cs,
+		productStore:    ps,
+		inventoryStore:  is,
+		addressStore:    as,
+		pricer:          cartPricer{coupons: cps, products: ps, categories: cts, taxes: ts},
+		shippingMethods: methods,
+		payments:        paymentProcessor{provider: provider},
+		reservationTTL:  reservationTTL,
+	}
 }
 
 // CreateCartHandler crea un nuevo carrito de compras vacío.
+// Si el usuario está autenticado, el carrito queda a su nombre y se reutiliza su carrito activo.
 func (h *CartHandlers) CreateCartHandler(w http.ResponseWriter, r *http.Request) {
-	newCart := models.Cart{Items: []models.CartItem{}, Total: 0}
-	createdCart, err := h.cartStore.CreateCart(newCart)
+	if user, ok := utils.UserFromContext(r.Context()); ok {
+		cart, created, err := h.userCart(r.Context(), user.ID)
+		if err != nil {
+			http.Error(w, "Error al crear el carrito", http.StatusInternalServerError)
+			return
+		}
+		if !created {
+			h.writePricedCart(w, r, cart)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(cart)
+		return
+	}
+	createdCart, err := h.cartStore.CreateCart(r.Context(), newEmptyCart(""))
 	if err != nil {
 		http.Error(w, "Error al crear el carrito", http.StatusInternalServerError)
 		return
@@ -34,25 +76,311 @@ func (h *CartHandlers) CreateCartHandler(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(createdCart)
 }
 
-// GetCartHandler obtiene el contenido de un carrito.
+// GetMyCartHandler devuelve el carrito activo del usuario autenticado, creándolo si no existe.
+func (h *CartHandlers) GetMyCartHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	cart, _, err := h.userCart(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Error al crear el carrito", http.StatusInternalServerError)
+		return
+	}
+	h.writePricedCart(w, r, cart)
+}
+
+// userCart devuelve el carrito activo del usuario o le crea uno vacío (created es true).
+// La búsqueda y la creación van en una transacción para que dos peticiones simultáneas
+// no le creen dos carritos.
+func (h *CartHandlers) userCart(ctx context.Context, userID string) (cart models.Cart, created bool, err error) {
+	err = h.tx.WithTx(ctx, func(tx storage.Storer) error {
+		var err error
+		if cart, err = tx.GetCartByUserID(ctx, userID); err == nil {
+			return nil
+		}
+		cart, err = tx.CreateCart(ctx, newEmptyCart(userID))
+		created = err == nil
+		return err
+	})
+	return cart, created, err
+}
+
+// newEmptyCart arma un carrito sin líneas para el usuario (vacío si es de invitado).
+func newEmptyCart(userID string) models.Cart {
+	return models.Cart{UserID: userID, Items: []models.CartItem{}, Subtotal: models.NewMoney(0), Tax: models.NewMoney(0), Total: models.NewMoney(0), Currency: models.DefaultCurrency}
+}
+
+// GetCartHandler obtiene el contenido de un carrito. Con ?expand=products cada línea incluye
+// su subtotal y el nombre, la descripción, el precio vigente y el stock de su producto.
 func (h *CartHandlers) GetCartHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	cartId := vars["cartId"]
-	cart, err := h.cartStore.GetCartByID(cartId)
+	cart, ok := h.authorizedCart(w, r, cartId)
+	if !ok {
+		return
+	}
+	h.writePricedCart(w, r, cart)
+}
+
+// writePricedCart recalcula descuentos y total antes de responder, porque la validez del
+// cupón depende de la fecha y de los usos registrados desde la última modificación.
+// También concilia el carrito con el catálogo y, si cambió alguna línea, lo guarda.
+// Con ?expand=products responde la representación expandida (ver expandCart).
+func (h *CartHandlers) writePricedCart(w http.ResponseWriter, r *http.Request, cart models.Cart) {
+	expand, err := expandProducts(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.pricer.price(r.Context(), &cart); err != nil {
+		log.Printf("Error al calcular el total del carrito %s: %v", cart.ID, err)
+		http.Error(w, "Error al calcular el total del carrito", http.StatusInternalServerError)
+		return
+	}
+	if slices.ContainsFunc(cart.Changes, models.CartChange.Modifies) {
+		updated, err := storeCart(r.Context(), h.cartStore, cart)
+		if err != nil {
+			log.Printf("Error al guardar el carrito conciliado %s: %v", cart.ID, err)
+			http.Error(w, "Error al actualizar el carrito", http.StatusInternalServerError)
+			return
+		}
+		cart = updated
+	}
+	if !expand {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cart)
+		return
+	}
+	view, err := expandCart(r.Context(), h.productStore, cart)
+	if err != nil {
+		log.Printf("Error al expandir los productos del carrito %s: %v", cart.ID, err)
+		http.Error(w, "Error al obtener los productos del carrito", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+// ApplyCouponHandler aplica un código de cupón al carrito. Recibe { "code": "..." } y
+// reemplaza el cupón anterior, si lo había. Si el cupón no aplica, el carrito no cambia.
+func (h *CartHandlers) ApplyCouponHandler(w http.ResponseWriter, r *http.Request) {
+	cartId := mux.Vars(r)["cartId"]
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Datos inválidos", http.StatusBadRequest)
+		return
+	}
+	code := models.NormalizeCouponCode(req.Code)
+	if code == "" {
+		http.Error(w, "Indique el código del cupón", http.StatusBadRequest)
+		return
+	}
+	h.updateCart(w, r, cartId, func(tx storage.Storer, cart *models.Cart) error {
+		cart.CouponCode = code
+		return pricerFor(tx).priceStrict(r.Context(), cart)
+	})
+}
+
+// SetCartRegionHandler fija la región de destino con la que se calculan los impuestos.
+// Recibe { "region": "EC" } (país o subdivisión ISO); vacía vuelve a la región por defecto.
+func (h *CartHandlers) SetCartRegionHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Region string `json:"region"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Datos inválidos", http.StatusBadRequest)
+		return
+	}
+	region := models.NormalizeRegion(req.Region)
+	if region != "" && !models.ValidRegion(region) {
+		http.Error(w, "Región inválida: use un código ISO como EC o US-CA", http.StatusBadRequest)
+		return
+	}
+	h.updateCart(w, r, mux.Vars(r)["cartId"], func(tx storage.Storer, cart *models.Cart) error {
+		cart.Region = region
+		return nil
+	})
+}
+
+// shippingDestination es el destino del envío: una dirección guardada del usuario
+// autenticado (addressId) o una dirección completa (address), p. ej. de un invitado.
+type shippingDestination struct {
+	AddressID string          `json:"addressId"`
+	Address   *models.Address `json:"address"`
+}
+
+// resolveAddress obtiene y valida la dirección de destino. Si falla, ya escribió la respuesta.
+func (h *CartHandlers) resolveAddress(w http.ResponseWriter, r *http.Request, dest shippingDestination) (models.Address, bool) {
+	switch {
+	case dest.AddressID != "":
+		user, ok := utils.UserFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Inicia sesión para usar una dirección guardada", http.StatusUnauthorized)
+			return models.Address{}, false
+		}
+		address, err := h.addressStore.GetAddress(r.Context(), user.ID, dest.AddressID)
+		if err != nil {
+			writeAddressError(w, err)
+			return models.Address{}, false
+		}
+		return address, true
+	case dest.Address != nil:
+		address := *dest.Address
+		address.ID, address.UserID, address.CreatedAt = "", "", time.Time{}
+		address.Normalize()
+		if err := address.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return models.Address{}, false
+		}
+		return address, true
+	}
+	http.Error(w, "Indique la dirección de envío (addressId o address)", http.StatusBadRequest)
+	return models.Address{}, false
+}
+
+// ShippingRatesHandler devuelve los métodos de envío disponibles para el carrito y su costo.
+// Recibe { "addressId": "..." } o { "address": {...} }; no modifica el carrito.
+func (h *CartHandlers) ShippingRatesHandler(w http.ResponseWriter, r *http.Request) {
+	var dest shippingDestination
+	if err := json.NewDecoder(r.Body).Decode(&dest); err != nil {
+		http.Error(w, "Datos inválidos", http.StatusBadRequest)
+		return
+	}
+	cart, ok := h.authorizedCart(w, r, mux.Vars(r)["cartId"])
+	if !ok {
+		return
+	}
+	address, ok := h.resolveAddress(w, r, dest)
+	if !ok {
+		return
+	}
+	if err := h.pricer.price(r.Context(), &cart); err != nil {
+		log.Printf("Error al calcular el total del carrito %s: %v", cart.ID, err)
+		http.Error(w, "Error al calcular las tarifas de envío", http.StatusInternalServerError)
+		return
+	}
+	quotes, err := h.shippingMethods.Quotes(newShipment(r.Context(), h.productStore, cart, address))
+	if err != nil {
+		log.Printf("Error al calcular las tarifas de envío del carrito %s: %v", cart.ID, err)
+		http.Error(w, "Error al calcular las tarifas de envío", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cart)
+	json.NewEncoder(w).Encode(quotes)
+}
+
+// newShipment reúne los datos del envío de un carrito ya calculado: el subtotal tras los
+// descuentos y el peso de todas las unidades. Los productos que ya no existen no pesan.
+func newShipment(ctx context.Context, ps storage.ProductStorer, cart models.Cart, address models.Address) shipping.Shipment {
+	s := shipping.Shipment{Destination: address, Subtotal: cart.Subtotal}
+	for _, d := range cart.Discounts {
+		s.Subtotal = s.Subtotal.Sub(d.Amount)
+	}
+	for _, item := range cart.Items {
+		if product, err := ps.GetProductByID(ctx, item.ProductID); err == nil {
+			s.WeightGrams += product.WeightGrams * item.Quantity
+		}
+	}
+	return s
+}
+
+// RemoveCouponHandler quita el cupón aplicado al carrito.
+func (h *CartHandlers) RemoveCouponHandler(w http.ResponseWriter, r *http.Request) {
+	h.updateCart(w, r, mux.Vars(r)["cartId"], func(tx storage.Storer, cart *models.Cart) error {
+		cart.CouponCode = ""
+		return nil
+	})
+}
+
+// errCartNotFound indica que el carrito no existe (p. ej. porque se eliminó al comprar).
+var errCartNotFound = errors.New("carrito no encontrado")
+
+// errLineNotFound indica que el carrito no tiene la línea que se quiere cambiar o quitar.
+var errLineNotFound = errors.New("producto no encontrado en el carrito")
+
+// updateCart aplica fn al carrito y lo guarda recalculado en una sola transacción. El
+// carrito se vuelve a leer dentro de ella, de modo que dos cambios simultáneos no se pisen
+// y las reservas de stock que haga fn con tx correspondan a las líneas guardadas. Conserva
+// los cambios de líneas de un cálculo hecho por fn (p. ej. al aplicar un cupón); los avisos
+// de stock se vuelven a calcular. Antes verifica que quien llama pueda usar el carrito.
+// Responde con el carrito guardado o, si algo falla, con writeCartError.
+func (h *CartHandlers) updateCart(w http.ResponseWriter, r *http.Request, cartId string, fn func(tx storage.Storer, cart *models.Cart) error) {
+	if _, ok := h.authorizedCart(w, r, cartId); !ok {
+		return
+	}
+	var updated models.Cart
+	err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		cart, err := tx.GetCartByID(r.Context(), cartId)
+		if err != nil {
+			return errCartNotFound
+		}
+		if err := fn(tx, &cart); err != nil {
+			return err
+		}
+		var previous []models.CartChange
+		for _, change := range cart.Changes {
+			if change.Modifies() {
+				previous = append(previous, change)
+			}
+		}
+		if err := pricerFor(tx).price(r.Context(), &cart); err != nil {
+			return err
+		}
+		cart.Changes = append(previous, cart.Changes...)
+		updated, err = storeCart(r.Context(), tx, cart)
+		return err
+	})
+	if err != nil {
+		writeCartError(w, cartId, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// writeCartError traduce los errores de un cambio del carrito a códigos HTTP.
+func writeCartError(w http.ResponseWriter, cartId string, err error) {
+	var stockErr *storage.InsufficientStockError
+	var rejection *couponRejection
+	switch {
+	case errors.Is(err, errCartNotFound):
+		http.Error(w, "Carrito no encontrado", http.StatusNotFound)
+	case errors.Is(err, errLineNotFound):
+		http.Error(w, "Producto no encontrado en el carrito", http.StatusNotFound)
+	case errors.As(err, &stockErr):
+		writeStockError(w, err)
+	case errors.Is(err, storage.ErrCouponNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.As(err, &rejection):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Error al actualizar el carrito %s: %v", cartId, err)
+		http.Error(w, "Error al actualizar el carrito", http.StatusInternalServerError)
+	}
+}
+
+// storeCart guarda un carrito ya calculado. Los avisos de Changes no se guardan, pero se
+// devuelven en el carrito resultante para incluirlos en la respuesta.
+func storeCart(ctx context.Context, cs storage.CartStorer, cart models.Cart) (models.Cart, error) {
+	changes := cart.Changes
+	cart.Changes = nil
+	updated, err := cs.UpdateCart(ctx, cart.ID, cart)
+	updated.Changes = changes
+	return updated, err
 }
 
 // AddItemToCartHandler añade un producto a un carrito.
+// Los productos con variantes exigen indicar variantId; cada variante ocupa su propia línea.
 func (h *CartHandlers) AddItemToCartHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	cartId := vars["cartId"]
 	var req struct {
 		ProductID string `json:"productId"`
+		VariantID string `json:"variantId"`
 		Quantity  int    `json:"quantity"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -63,112 +391,645 @@ func (h *CartHandlers) AddItemToCartHandler(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "La cantidad debe ser positiva", http.StatusBadRequest)
 		return
 	}
-	product, err := h.productStore.GetProductByID(req.ProductID)
-	if err != nil {
-		http.Error(w, "Producto no encontrado", http.StatusNotFound)
+	product, ok := h.cartProduct(w, r, req.ProductID, req.VariantID)
+	if !ok {
 		return
 	}
-	cart, err := h.cartStore.GetCartByID(cartId)
-	if err != nil {
-		http.Error(w, "Carrito no encontrado", http.StatusNotFound)
+	h.updateCart(w, r, cartId, func(tx storage.Storer, cart *models.Cart) error {
+		// Lógica para añadir ítem o actualizar cantidad.
+		lineIndex := findLine(cart.Items, req.ProductID, req.VariantID)
+		newQuantity := req.Quantity
+		if lineIndex >= 0 {
+			newQuantity += cart.Items[lineIndex].Quantity
+		}
+		// Verifica (y opcionalmente reserva) el stock para la cantidad total de la línea.
+		if err := h.reserveLine(r.Context(), tx, cartId, product, req.VariantID, newQuantity); err != nil {
+			return err
+		}
+		if lineIndex >= 0 {
+			cart.Items[lineIndex].Quantity = newQuantity
+		} else {
+			newItem := models.CartItem{ProductID: product.ID, VariantID: req.VariantID, Quantity: req.Quantity, Price: product.PriceFor(req.VariantID)}
+			cart.Items = append(cart.Items, newItem)
+		}
+		return nil
+	})
+}
+
+// UpdateItemQuantityHandler fija la cantidad de una línea del carrito ({ "quantity": 3 }),
+// validando el stock. Con ?variantId= se elige la variante. Una cantidad 0 quita la línea;
+// si la línea no existe y la cantidad es positiva, se añade con el precio actual.
+func (h *CartHandlers) UpdateItemQuantityHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cartId, productId := vars["cartId"], vars["productId"]
+	variantId := r.URL.Query().Get("variantId")
+	var req struct {
+		Quantity *int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Datos inválidos", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity == nil || *req.Quantity < 0 {
+		http.Error(w, "Indique una cantidad mayor o igual a 0", http.StatusBadRequest)
 		return
 	}
-	// Lógica para añadir ítem o actualizar cantidad.
-	found := false
-	for i, item := range cart.Items {
-		if item.ProductID == req.ProductID {
-			cart.Items[i].Quantity += req.Quantity
-			found = true
-			break
+	quantity := *req.Quantity
+	var product models.Product
+	if quantity > 0 {
+		var ok bool
+		if product, ok = h.cartProduct(w, r, productId, variantId); !ok {
+			return
+		}
+	}
+	h.updateCart(w, r, cartId, func(tx storage.Storer, cart *models.Cart) error {
+		lineIndex := findLine(cart.Items, productId, variantId)
+		if quantity == 0 {
+			if lineIndex < 0 {
+				return errLineNotFound
+			}
+			cart.Items = slices.Delete(cart.Items, lineIndex, lineIndex+1)
+			return tx.ReserveStock(r.Context(), cartId, productId, variantId, 0, time.Time{})
+		}
+		if err := h.reserveLine(r.Context(), tx, cartId, product, variantId, quantity); err != nil {
+			return err
+		}
+		if lineIndex >= 0 {
+			cart.Items[lineIndex].Quantity = quantity
+		} else {
+			cart.Items = append(cart.Items, models.CartItem{ProductID: product.ID, VariantID: variantId, Quantity: quantity, Price: product.PriceFor(variantId)})
 		}
+		return nil
+	})
+}
+
+// ReplaceItemsHandler reemplaza todas las líneas del carrito de una vez
+// ({ "items": [{ "productId", "variantId", "quantity" }] }). Las líneas con cantidad 0 se
+// omiten y las que ya estaban conservan su precio. Si alguna no tiene stock responde 409
+// con todas las faltantes y el carrito no cambia.
+func (h *CartHandlers) ReplaceItemsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cartId := vars["cartId"]
+	var req struct {
+		Items []struct {
+			ProductID string `json:"productId"`
+			VariantID string `json:"variantId"`
+			Quantity  int    `json:"quantity"`
+		} `json:"items"`
 	}
-	if !found {
-		newItem := models.CartItem{ProductID: product.ID, Quantity: req.Quantity, Price: product.Price}
-		cart.Items = append(cart.Items, newItem)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Datos inválidos", http.StatusBadRequest)
+		return
 	}
-	// Recalcular total.
-	var total float64
-	for _, item := range cart.Items {
-		total += item.Price * float64(item.Quantity)
+	items := []models.CartItem{}
+	seen := []models.CartItem{} // Todas las líneas pedidas, incluidas las de cantidad 0.
+	products := make(map[string]models.Product)
+	for _, line := range req.Items {
+		if line.Quantity < 0 {
+			http.Error(w, "La cantidad no puede ser negativa", http.StatusBadRequest)
+			return
+		}
+		if findLine(seen, line.ProductID, line.VariantID) >= 0 {
+			http.Error(w, fmt.Sprintf("El producto %s aparece más de una vez", line.ProductID), http.StatusBadRequest)
+			return
+		}
+		seen = append(seen, models.CartItem{ProductID: line.ProductID, VariantID: line.VariantID})
+		if line.Quantity == 0 {
+			continue
+		}
+		product, ok := h.cartProduct(w, r, line.ProductID, line.VariantID)
+		if !ok {
+			return
+		}
+		products[product.ID] = product
+		items = append(items, models.CartItem{ProductID: product.ID, VariantID: line.VariantID, Quantity: line.Quantity, Price: product.PriceFor(line.VariantID)})
 	}
-	cart.Total = total
-	updatedCart, err := h.cartStore.UpdateCart(cartId, cart)
+
+	h.updateCart(w, r, cartId, func(tx storage.Storer, cart *models.Cart) error {
+		// Se revisan todas las líneas antes de fallar, para informar todas las faltantes.
+		var shortages []storage.StockShortage
+		for i, item := range items {
+			if j := findLine(cart.Items, item.ProductID, item.VariantID); j >= 0 {
+				items[i].Price = cart.Items[j].Price
+			}
+			err := h.reserveLine(r.Context(), tx, cartId, products[item.ProductID], item.VariantID, item.Quantity)
+			var stockErr *storage.InsufficientStockError
+			if errors.As(err, &stockErr) {
+				shortages = append(shortages, stockErr.Items...)
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(shortages) > 0 {
+			return &storage.InsufficientStockError{Items: shortages}
+		}
+		for _, old := range cart.Items {
+			if findLine(items, old.ProductID, old.VariantID) < 0 {
+				if err := tx.ReserveStock(r.Context(), cartId, old.ProductID, old.VariantID, 0, time.Time{}); err != nil {
+					return err
+				}
+			}
+		}
+		cart.Items = items
+		return nil
+	})
+}
+
+// cartProduct busca el producto (y la variante) de una línea. Si no existe o falta la
+// variante, ya escribió la respuesta.
+func (h *CartHandlers) cartProduct(w http.ResponseWriter, r *http.Request, productID, variantID string) (models.Product, bool) {
+	product, err := h.productStore.GetProductByID(r.Context(), productID)
 	if err != nil {
-		http.Error(w, "Error al actualizar el carrito", http.StatusInternalServerError)
-		return
+		http.Error(w, "Producto no encontrado", http.StatusNotFound)
+		return models.Product{}, false
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updatedCart)
+	if _, ok := product.StockFor(variantID); !ok {
+		if variantID == "" {
+			http.Error(w, "Este producto tiene variantes: indique variantId", http.StatusBadRequest)
+		} else {
+			http.Error(w, "Variante no encontrada", http.StatusNotFound)
+		}
+		return models.Product{}, false
+	}
+	return product, true
 }
 
-// RemoveItemFromCartHandler elimina un producto del carrito.
+// reserveLine verifica que haya stock para quantity unidades de la línea y, si las
+// reservas están activas, las reserva para el carrito hasta que venzan.
+func (h *CartHandlers) reserveLine(ctx context.Context, is storage.InventoryStorer, cartID string, product models.Product, variantID string, quantity int) error {
+	if h.reservationTTL > 0 {
+		return is.ReserveStock(ctx, cartID, product.ID, variantID, quantity, time.Now().Add(h.reservationTTL))
+	}
+	if stock, _ := product.StockFor(variantID); quantity > stock {
+		return &storage.InsufficientStockError{Items: []storage.StockShortage{
+			{ProductID: product.ID, VariantID: variantID, Requested: quantity, Available: stock},
+		}}
+	}
+	return nil
+}
+
+// findLine devuelve la posición de la línea con ese producto y variante, o -1.
+func findLine(items []models.CartItem, productID, variantID string) int {
+	for i, item := range items {
+		if item.ProductID == productID && item.VariantID == variantID {
+			return i
+		}
+	}
+	return -1
+}
+
+// RemoveItemFromCartHandler elimina un producto del carrito. Con ?variantId= solo quita
+// esa variante; sin él quita todas las líneas del producto.
 func (h *CartHandlers) RemoveItemFromCartHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	cartId, productId := vars["cartId"], vars["productId"]
-	cart, err := h.cartStore.GetCartByID(cartId)
-	if err != nil {
-		http.Error(w, "Carrito no encontrado", http.StatusNotFound)
+	variantId := r.URL.Query().Get("variantId")
+	h.updateCart(w, r, cartId, func(tx storage.Storer, cart *models.Cart) error {
+		// Lógica para quitar el ítem del slice.
+		removed := []models.CartItem{}
+		newItems := []models.CartItem{}
+		for _, item := range cart.Items {
+			if item.ProductID == productId && (variantId == "" || item.VariantID == variantId) {
+				removed = append(removed, item)
+			} else {
+				newItems = append(newItems, item)
+			}
+		}
+		if len(removed) == 0 {
+			return errLineNotFound
+		}
+		cart.Items = newItems
+		for _, item := range removed {
+			if err := tx.ReserveStock(r.Context(), cartId, item.ProductID, item.VariantID, 0, time.Time{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CheckoutHandler finaliza la compra. Recibe el destino ({ "addressId" } o { "address" }),
+// el método de envío ({ "shippingMethod": "standard" }) y la tarjeta ({ "payment": {...} });
+// todos son obligatorios. Los impuestos se calculan para la región de la dirección de envío.
+//
+// El total se autoriza antes de crear la orden: si el proveedor rechaza la tarjeta se
+// responde 402, el carrito se conserva y el intento queda registrado en él. Con la
+// autorización se crea la orden en una transacción y después se captura el cobro.
+func (h *CartHandlers) CheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cartId := vars["cartId"]
+	var req struct {
+		shippingDestination
+		ShippingMethod string        `json:"shippingMethod"`
+		Payment        *payment.Card `json:"payment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Indique la dirección, el método de envío y los datos de pago", http.StatusBadRequest)
 		return
 	}
-	// Lógica para quitar el ítem del slice.
-	itemFound := false
-	newItems := []models.CartItem{}
-	for _, item := range cart.Items {
-		if item.ProductID == productId {
-			itemFound = true
-		} else {
-			newItems = append(newItems, item)
+	cart, ok := h.authorizedCart(w, r, cartId)
+	if !ok {
+		return
+	}
+	address, ok := h.resolveAddress(w, r, req.shippingDestination)
+	if !ok {
+		return
+	}
+	if req.ShippingMethod == "" {
+		http.Error(w, "Indique el método de envío (shippingMethod)", http.StatusBadRequest)
+		return
+	}
+	method, ok := h.shippingMethods.Find(req.ShippingMethod)
+	if !ok {
+		http.Error(w, "Método de envío desconocido: "+req.ShippingMethod, http.StatusBadRequest)
+		return
+	}
+	if req.Payment == nil {
+		http.Error(w, "Indique los datos de la tarjeta (payment)", http.StatusBadRequest)
+		return
+	}
+	card := *req.Payment
+	card.Normalize()
+	if err := card.Validate(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// El carrito se marca como activo para que el barrido de carritos inactivos no lo
+	// elimine mientras se autoriza el pago.
+	if err := h.cartStore.TouchCart(r.Context(), cartId); err != nil {
+		writeCheckoutError(w, cartId, method, err)
+		return
+	}
+
+	// Antes de cobrar se concilia el carrito con el catálogo: si cambió un precio o se quitó
+	// un producto, se guarda el carrito actualizado y se responde 409 con los cambios para
+	// que el comprador revise el nuevo total.
+	if err := h.pricer.price(r.Context(), &cart); err != nil {
+		writeCheckoutError(w, cartId, method, err)
+		return
+	}
+	if slices.ContainsFunc(cart.Changes, models.CartChange.Modifies) {
+		updated, err := storeCart(r.Context(), h.cartStore, cart)
+		if err != nil {
+			writeCheckoutError(w, cartId, method, err)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   errCartChanged.Error(),
+			"changes": updated.Changes,
+			"cart":    updated,
+		})
+		return
 	}
-	if !itemFound {
-		http.Error(w, "Producto no encontrado en el carrito", http.StatusNotFound)
+
+	// Se autoriza el total calculado ahora; dentro de la transacción se verifica que no cambió.
+	preview, err := checkoutOrder(r.Context(), h.pricer, h.productStore, cart, address, method)
+	if err != nil {
+		writeCheckoutError(w, cartId, method, err)
 		return
 	}
-	cart.Items = newItems
-	// Recalcular total.
-	var total float64
-	for _, item := range cart.Items {
-		total += item.Price * float64(item.Quantity)
+	auth, err := h.payments.authorize(r.Context(), preview.Total, card, cartId)
+	if err != nil {
+		if _, declined := payment.IsDecline(err); declined {
+			cart.PaymentAttempts = append(cart.PaymentAttempts, auth)
+			if _, err := storeCart(r.Context(), h.cartStore, cart); err != nil {
+				log.Printf("Error al registrar el pago rechazado del carrito %s: %v", cartId, err)
+			}
+		}
+		writePaymentError(w, auth, err)
+		return
 	}
-	cart.Total = total
-	updatedCart, err := h.cartStore.UpdateCart(cartId, cart)
+
+	// Descontar stock, registrar la orden y eliminar el carrito forman una sola transacción:
+	// si cualquier paso falla no queda stock descontado ni una orden a medias.
+	var order models.Order
+	err = h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		// Se relee el carrito dentro de la transacción por si cambió desde la autorización.
+		cart, err := tx.GetCartByID(r.Context(), cartId)
+		if err != nil {
+			return err
+		}
+		// El descuento se recalcula con los datos de la transacción: un cupón que dejó de
+		// aplicar impide la compra en lugar de cobrarse sin avisar.
+		newOrder, err := checkoutOrder(r.Context(), pricerFor(tx), tx, cart, address, method)
+		if err != nil {
+			return err
+		}
+		if newOrder.Total != auth.Amount {
+			return errTotalChanged
+		}
+		newOrder.RecordPayment(auth)
+		// La orden nace con el cobro reservado para que nadie la marque pagada mientras se captura.
+		newOrder.PendingStatus, newOrder.PendingUntil = models.OrderPaid, time.Now().Add(settlementTimeout)
+		// Si alguna línea no tiene stock suficiente no se descuenta ninguna.
+		if err := tx.CommitStock(r.Context(), cartId, cart.Items); err != nil {
+			return err
+		}
+		// Registra la orden con una copia de las líneas del carrito.
+		if order, err = tx.CreateOrder(r.Context(), newOrder); err != nil {
+			return err
+		}
+		for _, discount := range order.Discounts {
+			redemption := models.CouponRedemption{CouponID: discount.CouponID, UserID: order.UserID, OrderID: order.ID, CreatedAt: order.CreatedAt}
+			if err := tx.RedeemCoupon(r.Context(), redemption); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteCart(r.Context(), cartId)
+	})
 	if err != nil {
-		http.Error(w, "Error al actualizar el carrito", http.StatusInternalServerError)
+		// Sin orden no se cobra: se libera el monto reservado en la tarjeta.
+		if _, voidErr := h.payments.voidAuthorization(r.Context(), auth, auth.TransactionID+":void"); voidErr != nil {
+			log.Printf("Error al anular la autorización %s del carrito %s: %v", auth.TransactionID, cartId, voidErr)
+		}
+		writeCheckoutError(w, cartId, method, err)
 		return
 	}
+
+	// Si el cobro falla la orden queda pendiente con el pago autorizado; el personal puede
+	// capturarlo más tarde marcándola como pagada.
+	message := "¡Compra realizada con éxito!"
+	capture, captureErr := h.payments.capture(r.Context(), order)
+	if captureErr != nil {
+		log.Printf("Error al capturar el pago de la orden %s: %v", order.ID, captureErr)
+		message = "Compra registrada; el cobro quedó pendiente"
+	}
+	err = h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		updated, err := tx.RecordPayment(r.Context(), order.ID, capture)
+		if err == nil && captureErr == nil {
+			updated, err = tx.UpdateOrderStatus(r.Context(), order.ID, models.OrderPaid)
+		} else if err == nil {
+			updated, err = tx.ReleaseOrderStatus(r.Context(), order.ID)
+		}
+		if err == nil {
+			order = updated
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("Error al registrar el cobro de la orden %s: %v", order.ID, err)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updatedCart)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": message, "order": order})
 }
 
-// CheckoutHandler finaliza la compra.
-func (h *CartHandlers) CheckoutHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	cartId := vars["cartId"]
-	cart, err := h.cartStore.GetCartByID(cartId)
+// checkoutOrder calcula el carrito para la dirección de envío, cotiza el método elegido y
+// arma la orden resultante. Si al conciliar con el catálogo cambia alguna línea devuelve
+// errCartChanged. No modifica el almacén.
+func checkoutOrder(ctx context.Context, p cartPricer, ps storage.ProductStorer, cart models.Cart, address models.Address, method shipping.Method) (models.Order, error) {
+	if len(cart.Items) == 0 {
+		return models.Order{}, errEmptyCart
+	}
+	cart.Region = address.Region()
+	if err := p.priceStrict(ctx, &cart); err != nil {
+		return models.Order{}, err
+	}
+	if slices.ContainsFunc(cart.Changes, models.CartChange.Modifies) {
+		return models.Order{}, errCartChanged
+	}
+	cost, err := method.Quote(newShipment(ctx, ps, cart, address))
 	if err != nil {
-		http.Error(w, "Carrito no encontrado", http.StatusNotFound)
-		return
+		return models.Order{}, err
 	}
-	// Guarda el carrito en el historial de órdenes.
-	if err := h.orderStore.CreateOrderFromCart(cart); err != nil {
+	return buildOrder(ctx, ps, cart, orderShipping{address, method.ID, cost}), nil
+}
+
+// writeCheckoutError traduce los errores de la compra a códigos HTTP.
+func writeCheckoutError(w http.ResponseWriter, cartId string, method shipping.Method, err error) {
+	var stockErr *storage.InsufficientStockError
+	var rejection *couponRejection
+	switch {
+	case errors.As(err, &stockErr):
+		writeStockError(w, err)
+	case errors.As(err, &rejection), errors.Is(err, storage.ErrCouponUsageLimit):
+		http.Error(w, "No se puede aplicar el cupón: "+err.Error(), http.StatusConflict)
+	case errors.Is(err, errEmptyCart):
+		http.Error(w, "El carrito está vacío", http.StatusBadRequest)
+	case errors.Is(err, shipping.ErrUnavailable):
+		http.Error(w, "El método de envío "+method.ID+" no está disponible para este pedido", http.StatusBadRequest)
+	case errors.Is(err, errTotalChanged), errors.Is(err, errCartChanged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Error al procesar la compra del carrito %s: %v", cartId, err)
 		http.Error(w, "Error al procesar la orden", http.StatusInternalServerError)
-		return
 	}
-	// Elimina el carrito activo.
-	if err := h.cartStore.DeleteCart(cartId); err != nil {
-		// No es un error crítico, se puede loguear para mantenimiento.
+}
+
+// errTotalChanged indica que el carrito cambió entre la autorización del pago y la compra.
+var errTotalChanged = errors.New("el total del carrito cambió durante la compra, vuelva a intentarlo")
+
+// errCartChanged indica que los precios o productos del carrito cambiaron en el catálogo.
+var errCartChanged = errors.New("el carrito cambió: revise los precios y productos antes de comprar")
+
+// errEmptyCart indica que se intentó comprar un carrito sin productos.
+var errEmptyCart = errors.New("el carrito está vacío")
+
+// orderShipping es el envío elegido al comprar.
+type orderShipping struct {
+	address models.Address
+	method  string
+	cost    models.Money
+}
+
+// buildOrder convierte un carrito ya calculado en una orden pendiente, copiando nombre y
+// precio de cada línea, los descuentos aplicados, el desglose de impuestos, el envío y
+// los pagos rechazados antes de la compra.
+// El envío se suma al total sin impuestos.
+func buildOrder(ctx context.Context, ps storage.ProductStorer, cart models.Cart, ship orderShipping) models.Order {
+	order := models.Order{
+		UserID:          cart.UserID,
+		Items:           make([]models.OrderItem, 0, len(cart.Items)),
+		Subtotal:        models.NewMoney(0),
+		CouponCode:      cart.CouponCode,
+		Discounts:       cart.Discounts,
+		Taxes:           cart.Taxes,
+		Tax:             cart.Tax,
+		Shipping:        ship.cost,
+		ShippingMethod:  ship.method,
+		ShippingAddress: &ship.address,
+		Payments:        cart.PaymentAttempts,
+		Currency:        models.DefaultCurrency,
+		Status:          models.OrderPending,
+	}
+	for _, item := range cart.Items {
+		line := models.OrderItem{
+			ProductID: item.ProductID,
+			VariantID: item.VariantID,
+			Quantity:  item.Quantity,
+			UnitPrice: item.Price,
+			Subtotal:  item.Price.Mul(item.Quantity),
+		}
+		if product, err := ps.GetProductByID(ctx, item.ProductID); err == nil {
+			line.Name = product.Name
+			if variant, ok := product.Variant(item.VariantID); ok {
+				line.SKU, line.Options = variant.SKU, variant.Options
+			}
+		}
+		order.Items = append(order.Items, line)
+		order.Subtotal = order.Subtotal.Add(line.Subtotal)
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "¡Compra realizada con éxito!"})
+	order.Total = order.Subtotal
+	for _, discount := range order.Discounts {
+		order.Total = order.Total.Sub(discount.Amount)
+	}
+	for _, tax := range order.Taxes {
+		if !tax.Inclusive {
+			order.Total = order.Total.Add(tax.Amount)
+		}
+	}
+	order.Total = order.Total.Add(order.Shipping)
+	return order
 }
 
 // DeleteCartHandler vacía un carrito sin completar la compra.
 func (h *CartHandlers) DeleteCartHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	cartId := vars["cartId"]
-	if err := h.cartStore.DeleteCart(cartId); err != nil {
+	if _, ok := h.authorizedCart(w, r, cartId); !ok {
+		return
+	}
+	if err := h.cartStore.DeleteCart(r.Context(), cartId); err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// authorizedCart obtiene un carrito y verifica que quien llama pueda usarlo.
+// Los carritos de invitado se acceden con su ID; los de un usuario solo por su dueño
+// o por personal con permiso para gestionar carritos. Si falla, ya escribió la respuesta.
+func (h *CartHandlers) authorizedCart(w http.ResponseWriter, r *http.Request, cartId string) (models.Cart, bool) {
+	cart, err := h.cartStore.GetCartByID(r.Context(), cartId)
+	if err != nil {
+		http.Error(w, "Carrito no encontrado", http.StatusNotFound)
+		return models.Cart{}, false
+	}
+	if cart.UserID == "" {
+		return cart, true
+	}
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return models.Cart{}, false
+	}
+	if user.ID != cart.UserID && !utils.HasPermission(user.Role, utils.PermCartsManage) {
+		http.Error(w, "No tienes permisos sobre este carrito", http.StatusForbidden)
+		return models.Cart{}, false
+	}
+	return cart, true
+}
+
+// writeStockError responde 409 con las líneas sin stock suficiente, o 500 ante otros errores.
+func writeStockError(w http.ResponseWriter, err error) {
+	var stockErr *storage.InsufficientStockError
+	if !errors.As(err, &stockErr) {
+		http.Error(w, "Error al verificar el stock", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": "Stock insuficiente",
+		"items": stockErr.Items,
+	})
+}
+
+// mergeGuestCart traspasa un carrito de invitado al usuario que acaba de iniciar sesión.
+// Si el usuario no tiene carrito, el de invitado pasa a ser suyo; si ya tiene uno,
+// se suman las cantidades de cada producto y el carrito de invitado se elimina; el cupón
+// del usuario tiene prioridad sobre el del invitado. Las cantidades sumadas se limitan al
+// stock disponible y, si las reservas están activas, las del invitado pasan al carrito del
+// usuario.
+// Debe llamarse dentro de una transacción para no dejar ambos carritos a medio fusionar.
+func mergeGuestCart(ctx context.Context, cs storage.Storer, guestCartID, userID string, reservationTTL time.Duration) (models.Cart, error) {
+	guest, err := cs.GetCartByID(ctx, guestCartID)
+	if err != nil {
+		return models.Cart{}, err
+	}
+	if guest.UserID != "" {
+		if guest.UserID == userID {
+			return guest, nil
+		}
+		return models.Cart{}, fmt.Errorf("el carrito %s pertenece a otro usuario", guestCartID)
+	}
+	userCart, err := cs.GetCartByUserID(ctx, userID)
+	if err != nil {
+		guest.UserID = userID
+		if err := pricerFor(cs).price(ctx, &guest); err != nil {
+			return models.Cart{}, err
+		}
+		return storeCart(ctx, cs, guest)
+	}
+	// Se liberan primero las reservas del invitado para que cuenten como stock disponible
+	// al reservar las cantidades sumadas en el carrito del usuario.
+	for _, guestItem := range guest.Items {
+		if err := cs.ReserveStock(ctx, guest.ID, guestItem.ProductID, guestItem.VariantID, 0, time.Time{}); err != nil {
+			return models.Cart{}, err
+		}
+	}
+	for _, guestItem := range guest.Items {
+		i := findLine(userCart.Items, guestItem.ProductID, guestItem.VariantID)
+		if i < 0 {
+			userCart.Items = append(userCart.Items, guestItem)
+			i = len(userCart.Items) - 1
+		} else {
+			userCart.Items[i].Quantity += guestItem.Quantity
+		}
+		quantity, err := claimStock(ctx, cs, userCart.ID, userCart.Items[i], reservationTTL)
+		if err != nil {
+			return models.Cart{}, err
+		}
+		userCart.Items[i].Quantity = quantity
+	}
+	userCart.Items = slices.DeleteFunc(userCart.Items, func(item models.CartItem) bool { return item.Quantity == 0 })
+	if userCart.CouponCode == "" {
+		userCart.CouponCode = guest.CouponCode
+	}
+	if err := pricerFor(cs).price(ctx, &userCart); err != nil {
+		return models.Cart{}, err
+	}
+	merged, err := storeCart(ctx, cs, userCart)
+	if err != nil {
+		return models.Cart{}, err
+	}
+	if err := cs.DeleteCart(ctx, guest.ID); err != nil {
+		return models.Cart{}, err
+	}
+	return merged, nil
+}
+
+// claimStock asegura hasta item.Quantity unidades de la línea para el carrito y devuelve
+// cuántas consiguió: todas, o las disponibles si no alcanzan. Con reservas activas las
+// reserva. Un producto que ya no existe conserva su cantidad; lo quita la conciliación.
+func claimStock(ctx context.Context, cs storage.Storer, cartID string, item models.CartItem, reservationTTL time.Duration) (int, error) {
+	product, err := cs.GetProductByID(ctx, item.ProductID)
+	if errors.Is(err, storage.ErrProductNotFound) {
+		return item.Quantity, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	stock, ok := product.StockFor(item.VariantID)
+	if !ok {
+		return item.Quantity, nil
+	}
+	if reservationTTL <= 0 {
+		return min(item.Quantity, max(stock, 0)), nil
+	}
+	quantity := item.Quantity
+	expiresAt := time.Now().Add(reservationTTL)
+	err = cs.ReserveStock(ctx, cartID, item.ProductID, item.VariantID, quantity, expiresAt)
+	var stockErr *storage.InsufficientStockError
+	if errors.As(err, &stockErr) {
+		quantity = stockErr.Items[0].Available
+		err = cs.ReserveStock(ctx, cartID, item.ProductID, item.VariantID, quantity, expiresAt)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return quantity, nil
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"tienda/models"
+	"tienda/payment"
+	"tienda/shipping"
+	"tienda/storage"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testBackends abre un almacén vacío de cada tipo.
+var testBackends = []struct {
+	name string
+	open func(t *testing.T) storage.Storer
+}{
+	{name: "memoria", open: func(t *testing.T) storage.Storer { return storage.NewMemoryStore() }},
+	{name: "sqlite", open: func(t *testing.T) storage.Storer {
+		s, err := storage.NewSQLiteStore(filepath.Join(t.TempDir(), "tienda.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}},
+}
+
+func TestMergeGuestCart(t *testing.T) {
+	tests := []struct {
+		name           string
+		stock          int
+		userQuantity   int
+		guestQuantity  int
+		otherReserved  int // Unidades reservadas por un tercer carrito.
+		stockAfter     int // Si es mayor que 0, stock del producto al iniciar sesión.
+		reservationTTL time.Duration
+		want           int // Cantidad final de la línea; 0 si se quita.
+	}{
+		{name: "sin reservas, alcanza el stock", stock: 10, userQuantity: 2, guestQuantity: 3, want: 5},
+		{name: "sin reservas, se limita al stock", stock: 4, userQuantity: 2, guestQuantity: 3, want: 4},
+		{name: "sin stock se quita la línea", stock: 0, userQuantity: 0, guestQuantity: 3, want: 0},
+		{name: "con reservas, alcanza el stock", stock: 10, userQuantity: 2, guestQuantity: 3, reservationTTL: time.Hour, want: 5},
+		{name: "con reservas, descuenta las de otros carritos", stock: 6, stockAfter: 5, userQuantity: 2, guestQuantity: 3, otherReserved: 1, reservationTTL: time.Hour, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			product, err := store.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: tt.stock})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expiresAt := time.Now().Add(time.Hour)
+			newCart := func(userID string, quantity int) models.Cart {
+				t.Helper()
+				cart := newEmptyCart(userID)
+				if quantity > 0 {
+					cart.Items = []models.CartItem{{ProductID: product.ID, Quantity: quantity, Price: product.Price}}
+				}
+				cart, err := store.CreateCart(ctx, cart)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.reservationTTL > 0 && quantity > 0 {
+					if err := store.ReserveStock(ctx, cart.ID, product.ID, "", quantity, expiresAt); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return cart
+			}
+			if tt.otherReserved > 0 {
+				newCart("", tt.otherReserved)
+			}
+			newCart("u1", tt.userQuantity)
+			guest := newCart("", tt.guestQuantity)
+			stock := tt.stock
+			if tt.stockAfter > 0 {
+				stock = tt.stockAfter
+				product.Stock = stock
+				if _, err := store.UpdateProduct(ctx, product.ID, product); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var merged models.Cart
+			err = store.WithTx(ctx, func(tx storage.Storer) error {
+				merged, err = mergeGuestCart(ctx, tx, guest.ID, "u1", tt.reservationTTL)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := 0
+			if i := findLine(merged.Items, product.ID, ""); i >= 0 {
+				got = merged.Items[i].Quantity
+			}
+			if got != tt.want {
+				t.Errorf("cantidad = %d, se esperaba %d", got, tt.want)
+			}
+			if _, err := store.GetCartByID(ctx, guest.ID); err == nil {
+				t.Error("el carrito de invitado no se eliminó")
+			}
+			if tt.reservationTTL > 0 {
+				// Las unidades fusionadas quedan reservadas por el carrito del usuario.
+				free := stock - tt.otherReserved - tt.want
+				if err := store.ReserveStock(ctx, "otro", product.ID, "", free+1, expiresAt); err == nil {
+					t.Errorf("se pudieron reservar %d unidades; la reserva fusionada no se registró", free+1)
+				}
+			}
+		})
+	}
+}
+
+func TestUserCartCreatesOnce(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	h := &CartHandlers{tx: store, cartStore: store}
+	first, created, err := h.userCart(ctx, "u1")
+	if err != nil || !created {
+		t.Fatalf("userCart() = %v, %v; se esperaba un carrito nuevo", created, err)
+	}
+	second, created, err := h.userCart(ctx, "u1")
+	if err != nil || created || second.ID != first.ID {
+		t.Fatalf("userCart() = %s, %v, %v; se esperaba reutilizar %s", second.ID, created, err, first.ID)
+	}
+}
+
+func TestConcurrentCartUpdates(t *testing.T) {
+	const requests = 20
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := backend.open(t)
+			product, err := store.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: requests})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cart, err := store.CreateCart(ctx, newEmptyCart(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := NewCartHandlers(store, store, store, store, store, store, store, store, shipping.DefaultMethods(), payment.NewFakeProvider(nil), time.Hour)
+
+			var wg sync.WaitGroup
+			for range requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := httptest.NewRequest(http.MethodPost, "/api/cart/"+cart.ID+"/add", strings.NewReader(`{"productId":"`+product.ID+`","quantity":1}`))
+					req = mux.SetURLVars(req, map[string]string{"cartId": cart.ID})
+					rec := httptest.NewRecorder()
+					h.AddItemToCartHandler(rec, req)
+					if rec.Code != http.StatusOK {
+						t.Errorf("código = %d: %s", rec.Code, rec.Body)
+					}
+				}()
+			}
+			wg.Wait()
+
+			got, err := store.GetCartByID(ctx, cart.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Items) != 1 || got.Items[0].Quantity != requests {
+				t.Fatalf("líneas = %+v, se esperaba una con %d unidades", got.Items, requests)
+			}
+			// La reserva debe cubrir todas las unidades del carrito: no queda stock para otro.
+			if err := store.ReserveStock(ctx, "otro", product.ID, "", 1, time.Now().Add(time.Hour)); err == nil {
+				t.Error("la reserva no coincide con las unidades del carrito")
+			}
+		})
+	}
+}
+
+func TestConcurrentQuantityUpdates(t *testing.T) {
+	const stock = 10
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := backend.open(t)
+			product, err := store.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: stock})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cart, err := store.CreateCart(ctx, newEmptyCart(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := NewCartHandlers(store, store, store, store, store, store, store, store, shipping.DefaultMethods(), payment.NewFakeProvider(nil), time.Hour)
+
+			var wg sync.WaitGroup
+			for quantity := range stock + 1 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := httptest.NewRequest(http.MethodPut, "/api/cart/"+cart.ID+"/item/"+product.ID, strings.NewReader(fmt.Sprintf(`{"quantity":%d}`, quantity)))
+					req = mux.SetURLVars(req, map[string]string{"cartId": cart.ID, "productId": product.ID})
+					h.UpdateItemQuantityHandler(httptest.NewRecorder(), req)
+				}()
+			}
+			wg.Wait()
+
+			got, err := store.GetCartByID(ctx, cart.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			quantity := 0
+			if i := findLine(got.Items, product.ID, ""); i >= 0 {
+				quantity = got.Items[i].Quantity
+			}
+			// Otro carrito puede reservar exactamente lo que no reservó este.
+			expiresAt := time.Now().Add(time.Hour)
+			if err := store.ReserveStock(ctx, "otro", product.ID, "", stock-quantity+1, expiresAt); err == nil {
+				t.Errorf("la reserva es menor que las %d unidades del carrito", quantity)
+			}
+			if err := store.ReserveStock(ctx, "otro", product.ID, "", stock-quantity, expiresAt); err != nil && quantity < stock {
+				t.Errorf("la reserva es mayor que las %d unidades del carrito: %v", quantity, err)
+			}
+		})
+	}
+}
+
+func TestReplaceItemsRejectsDuplicates(t *testing.T) {
+	tests := []struct {
+		name     string
+		items    string // Líneas pedidas; %s es el producto.
+		wantCode int
+		want     int // Cantidad final de la línea.
+	}{
+		{name: "una línea", items: `[{"productId":"%s","quantity":3}]`, wantCode: http.StatusOK, want: 3},
+		{name: "repetida", items: `[{"productId":"%[1]s","quantity":1},{"productId":"%[1]s","quantity":3}]`, wantCode: http.StatusBadRequest, want: 2},
+		{name: "repetida con cantidad 0 primero", items: `[{"productId":"%[1]s","quantity":0},{"productId":"%[1]s","quantity":3}]`, wantCode: http.StatusBadRequest, want: 2},
+		{name: "repetida con cantidad 0 después", items: `[{"productId":"%[1]s","quantity":3},{"productId":"%[1]s","quantity":0}]`, wantCode: http.StatusBadRequest, want: 2},
+		{name: "cantidad 0 quita la línea", items: `[{"productId":"%s","quantity":0}]`, wantCode: http.StatusOK, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			product, err := store.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cart := newEmptyCart("")
+			cart.Items = []models.CartItem{{ProductID: product.ID, Quantity: 2, Price: product.Price}}
+			if cart, err = store.CreateCart(ctx, cart); err != nil {
+				t.Fatal(err)
+			}
+			h := NewCartHandlers(store, store, store, store, store, store, store, store, shipping.DefaultMethods(), payment.NewFakeProvider(nil), 0)
+
+			body := `{"items":` + fmt.Sprintf(tt.items, product.ID) + `}`
+			req := httptest.NewRequest(http.MethodPut, "/api/cart/"+cart.ID+"/items", strings.NewReader(body))
+			req = mux.SetURLVars(req, map[string]string{"cartId": cart.ID})
+			rec := httptest.NewRecorder()
+			h.ReplaceItemsHandler(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("código = %d, se esperaba %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			got, err := store.GetCartByID(ctx, cart.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			quantity := 0
+			if i := findLine(got.Items, product.ID, ""); i >= 0 {
+				quantity = got.Items[i].Quantity
+			}
+			if quantity != tt.want {
+				t.Errorf("cantidad = %d, se esperaba %d", quantity, tt.want)
+			}
+		})
+	}
+}
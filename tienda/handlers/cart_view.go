@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"tienda/models"
+	"tienda/storage"
+)
+
+// expandedCart es la representación de un carrito con ?expand=products: cada línea lleva
+// los datos vigentes de su producto, para que el cliente no tenga que pedir el catálogo.
+type expandedCart struct {
+	models.Cart
+	Items []expandedCartItem `json:"items"` // Reemplaza a Cart.Items en el JSON.
+}
+
+// expandedCartItem es una línea del carrito con su subtotal y su producto.
+type expandedCartItem struct {
+	models.CartItem
+	Subtotal models.Money     `json:"subtotal"` // Precio por cantidad, antes de descuentos e impuestos.
+	Product  *cartProductView `json:"product,omitempty"`
+}
+
+// cartProductView resume el producto (y la variante) de una línea del carrito.
+type cartProductView struct {
+	ID          string               `json:"id"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	SKU         string               `json:"sku,omitempty"`
+	Options     map[string]string    `json:"options,omitempty"` // Opciones de la variante, p. ej. {"talla": "M"}.
+	Price       models.Money         `json:"price"`             // Precio vigente de la variante o del producto.
+	Stock       int                  `json:"stock"`
+	Available   bool                 `json:"available"` // Hay stock para la cantidad de la línea.
+	Image       *models.ProductImage `json:"image,omitempty"`
+}
+
+// errUnknownExpand indica un valor de ?expand= que la API no sabe expandir.
+var errUnknownExpand = errors.New("valor de expand no soportado: use expand=products")
+
+// expandProducts interpreta ?expand= (valores separados por comas) e indica si se pidió
+// expandir los productos.
+func expandProducts(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("expand")
+	if value == "" {
+		return false, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) != "products" {
+			return false, errUnknownExpand
+		}
+	}
+	return true, nil
+}
+
+// expandCart arma la representación expandida de un carrito ya calculado. Las líneas cuyo
+// producto ya no existe quedan sin product.
+func expandCart(ctx context.Context, ps storage.ProductStorer, cart models.Cart) (expandedCart, error) {
+	view := expandedCart{Cart: cart, Items: make([]expandedCartItem, 0, len(cart.Items))}
+	for _, item := range cart.Items {
+		line := expandedCartItem{CartItem: item, Subtotal: item.Price.Mul(item.Quantity)}
+		product, err := ps.GetProductByID(ctx, item.ProductID)
+		switch {
+		case err == nil:
+			stock, _ := product.StockFor(item.VariantID)
+			line.Product = &cartProductView{
+				ID:          product.ID,
+				Name:        product.Name,
+				Description: product.Description,
+				Price:       product.PriceFor(item.VariantID),
+				Stock:       stock,
+				Available:   item.Quantity <= stock,
+			}
+			if variant, ok := product.Variant(item.VariantID); ok {
+				line.Product.SKU, line.Product.Options = variant.SKU, variant.Options
+			}
+			if len(product.Images) > 0 {
+				line.Product.Image = &product.Images[0]
+			}
+		case !errors.Is(err, storage.ErrProductNotFound):
+			return expandedCart{}, err
+		}
+		view.Items = append(view.Items, line)
+	}
+	return view, nil
+}
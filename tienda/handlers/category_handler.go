@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"tienda/models"
+	"tienda/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// CategoryHandlers maneja el árbol de categorías del catálogo.
+type CategoryHandlers struct {
+	store storage.CategoryStorer
+}
+
+// NewCategoryHandlers es el constructor para los handlers de categorías.
+func NewCategoryHandlers(s storage.CategoryStorer) *CategoryHandlers {
+	return &CategoryHandlers{store: s}
+}
+
+// categoryRequest es el cuerpo aceptado al crear o actualizar una categoría.
+type categoryRequest struct {
+	Name     string `json:"name"`
+	Slug     string `json:"slug"` // Si se omite, se genera a partir del nombre.
+	ParentID string `json:"parentId"`
+	Position int    `json:"position"`
+}
+
+// GetCategoriesHandler devuelve el árbol completo de categorías.
+// Con ?flat=true devuelve la lista plana.
+func (h *CategoryHandlers) GetCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	categories, err := h.store.GetCategories(r.Context())
+	if err != nil {
+		http.Error(w, "Error interno al obtener categorías", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("flat") == "true" {
+		json.NewEncoder(w).Encode(categories)
+		return
+	}
+	json.NewEncoder(w).Encode(models.BuildCategoryTree(categories))
+}
+
+// GetCategoryHandler obtiene una categoría por su ID o su slug.
+func (h *CategoryHandlers) GetCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	category, err := findCategory(r, h.store, mux.Vars(r)["id"])
+	if err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(category)
+}
+
+// CreateCategoryHandler crea una categoría, opcionalmente dentro de otra.
+func (h *CategoryHandlers) CreateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	category, ok := decodeCategory(w, r)
+	if !ok {
+		return
+	}
+	created, err := h.store.CreateCategory(r.Context(), category)
+	if err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// UpdateCategoryHandler reemplaza los datos de una categoría; cambiar parentId la mueve en el árbol.
+func (h *CategoryHandlers) UpdateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	category, ok := decodeCategory(w, r)
+	if !ok {
+		return
+	}
+	updated, err := h.store.UpdateCategory(r.Context(), mux.Vars(r)["id"], category)
+	if err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteCategoryHandler elimina una categoría sin subcategorías.
+func (h *CategoryHandlers) DeleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if err := h.store.DeleteCategory(r.Context(), mux.Vars(r)["id"]); err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeCategory lee y valida el cuerpo de la petición. Si falla, ya escribió la respuesta.
+func decodeCategory(w http.ResponseWriter, r *http.Request) (models.Category, bool) {
+	var req categoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return models.Category{}, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "El nombre de la categoría es obligatorio", http.StatusBadRequest)
+		return models.Category{}, false
+	}
+	if req.Slug == "" {
+		req.Slug = models.Slugify(req.Name)
+	}
+	if !models.ValidSlug(req.Slug) {
+		http.Error(w, "Slug inválido: use minúsculas, números y guiones", http.StatusBadRequest)
+		return models.Category{}, false
+	}
+	return models.Category{Name: req.Name, Slug: req.Slug, ParentID: req.ParentID, Position: req.Position}, true
+}
+
+// findCategory busca una categoría por ID y, si no existe, por slug.
+func findCategory(r *http.Request, store storage.CategoryStorer, idOrSlug string) (models.Category, error) {
+	category, err := store.GetCategoryByID(r.Context(), idOrSlug)
+	if errors.Is(err, storage.ErrCategoryNotFound) {
+		return store.GetCategoryBySlug(r.Context(), idOrSlug)
+	}
+	return category, err
+}
+
+// writeCategoryError traduce los errores del almacén de categorías a códigos HTTP.
+func writeCategoryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrCategoryNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrParentCategoryNotFound), errors.Is(err, storage.ErrCategoryCycle):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrCategorySlugTaken), errors.Is(err, storage.ErrCategoryHasChildren):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Error interno al procesar la categoría", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"tienda/models"
+	"tienda/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// CouponHandlers maneja la administración de cupones de descuento.
+type CouponHandlers struct {
+	store         storage.CouponStorer
+	productStore  storage.ProductStorer
+	categoryStore storage.CategoryStorer
+}
+
+// NewCouponHandlers es el constructor para los handlers de cupones.
+func NewCouponHandlers(s storage.CouponStorer, ps storage.ProductStorer, cs storage.CategoryStorer) *CouponHandlers {
+	return &CouponHandlers{store: s, productStore: ps, categoryStore: cs}
+}
+
+// couponCodePattern define los códigos aceptados, ya normalizados a mayúsculas.
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// GetCouponsHandler devuelve todos los cupones, ordenados por código.
+func (h *CouponHandlers) GetCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	coupons, err := h.store.GetCoupons(r.Context())
+	if err != nil {
+		http.Error(w, "Error interno al obtener cupones", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coupons)
+}
+
+// GetCouponHandler obtiene un cupón por su ID.
+func (h *CouponHandlers) GetCouponHandler(w http.ResponseWriter, r *http.Request) {
+	coupon, err := h.store.GetCouponByID(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeCouponError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coupon)
+}
+
+// CreateCouponHandler crea un cupón.
+func (h *CouponHandlers) CreateCouponHandler(w http.ResponseWriter, r *http.Request) {
+	coupon, ok := h.decodeCoupon(w, r)
+	if !ok {
+		return
+	}
+	created, err := h.store.CreateCoupon(r.Context(), coupon)
+	if err != nil {
+		writeCouponError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// UpdateCouponHandler reemplaza la configuración de un cupón; conserva sus usos registrados.
+func (h *CouponHandlers) UpdateCouponHandler(w http.ResponseWriter, r *http.Request) {
+	coupon, ok := h.decodeCoupon(w, r)
+	if !ok {
+		return
+	}
+	updated, err := h.store.UpdateCoupon(r.Context(), mux.Vars(r)["id"], coupon)
+	if err != nil {
+		writeCouponError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteCouponHandler elimina un cupón. Las órdenes que lo usaron conservan sus descuentos.
+func (h *CouponHandlers) DeleteCouponHandler(w http.ResponseWriter, r *http.Request) {
+	if err := h.store.DeleteCoupon(r.Context(), mux.Vars(r)["id"]); err != nil {
+		writeCouponError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeCoupon lee y valida el cuerpo de la petición. Si falla, ya escribió la respuesta.
+func (h *CouponHandlers) decodeCoupon(w http.ResponseWriter, r *http.Request) (models.Coupon, bool) {
+	var c models.Coupon
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return models.Coupon{}, false
+	}
+	c.Code = models.NormalizeCouponCode(c.Code)
+	if err := validateCoupon(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return models.Coupon{}, false
+	}
+	for _, id := range c.ProductIDs {
+		if _, err := h.productStore.GetProductByID(r.Context(), id); err != nil {
+			http.Error(w, fmt.Sprintf("Producto %s no encontrado", id), http.StatusBadRequest)
+			return models.Coupon{}, false
+		}
+	}
+	for _, id := range c.CategoryIDs {
+		if _, err := h.categoryStore.GetCategoryByID(r.Context(), id); err != nil {
+			http.Error(w, fmt.Sprintf("Categoría %s no encontrada", id), http.StatusBadRequest)
+			return models.Coupon{}, false
+		}
+	}
+	return c, true
+}
+
+// validateCoupon comprueba que la configuración del cupón sea coherente.
+func validateCoupon(c models.Coupon) error {
+	if !couponCodePattern.MatchString(c.Code) {
+		return errors.New("código inválido: use de 3 a 32 letras, números, guiones o guiones bajos")
+	}
+	switch c.Type {
+	case models.CouponPercentage:
+		if c.Percent < 1 || c.Percent > 100 || c.Amount != nil {
+			return errors.New("un cupón 'percentage' requiere percent entre 1 y 100 y no admite amount")
+		}
+	case models.CouponFixed:
+		if c.Amount == nil || c.Amount.Amount <= 0 || c.Percent != 0 {
+			return errors.New("un cupón 'fixed' requiere amount mayor que 0 y no admite percent")
+		}
+	default:
+		return errors.New("type debe ser 'percentage' o 'fixed'")
+	}
+	if c.MinSubtotal != nil && c.MinSubtotal.IsNegative() {
+		return errors.New("minSubtotal no puede ser negativo")
+	}
+	if c.MaxUses < 0 || c.MaxUsesPerUser < 0 {
+		return errors.New("los límites de uso no pueden ser negativos")
+	}
+	if c.StartsAt != nil && c.EndsAt != nil && !c.EndsAt.After(*c.StartsAt) {
+		return errors.New("endsAt debe ser posterior a startsAt")
+	}
+	return nil
+}
+
+// writeCouponError traduce los errores del almacén de cupones a códigos HTTP.
+func writeCouponError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrCouponNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrCouponCodeTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Error interno al procesar el cupón", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"slices"
+	"tienda/models"
+	"tienda/storage"
+	"tienda/utils"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// imageURLPrefix es la ruta pública desde la que se sirven los archivos de imagen.
+	imageURLPrefix = "/api/images/"
+	// maxImageUploadBytes limita el tamaño total de una petición de subida.
+	maxImageUploadBytes = 20 << 20
+	// maxImageFileBytes limita el tamaño de cada imagen dentro de la petición.
+	maxImageFileBytes = 10 << 20
+)
+
+// ImageHandlers maneja la subida, el orden y la entrega de las imágenes de producto.
+type ImageHandlers struct {
+	tx            storage.Transactor
+	store         storage.ProductStorer
+	blobs         storage.BlobStore
+	thumbnailSize int
+}
+
+// NewImageHandlers es el constructor para los handlers de imágenes.
+// thumbnailSize es el lado mayor, en píxeles, de las miniaturas generadas.
+func NewImageHandlers(tx storage.Transactor, s storage.ProductStorer, blobs storage.BlobStore, thumbnailSize int) *ImageHandlers {
+	return &ImageHandlers{tx: tx, store: s, blobs: blobs, thumbnailSize: thumbnailSize}
+}
+
+// UploadProductImagesHandler recibe uno o varios archivos en el campo multipart "image",
+// guarda el original y su miniatura, y los añade al final de las imágenes del producto.
+func (h *ImageHandlers) UploadProductImagesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := h.store.GetProductByID(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageUploadBytes)
+	if err := r.ParseMultipartForm(maxImageFileBytes); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "La petición supera el tamaño máximo permitido", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Se esperaba un formulario multipart con el campo 'image'", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	files := r.MultipartForm.File["image"]
+	if len(files) == 0 {
+		http.Error(w, "Se esperaba un formulario multipart con el campo 'image'", http.StatusBadRequest)
+		return
+	}
+
+	var images []models.ProductImage
+	for _, fh := range files {
+		if fh.Size > maxImageFileBytes {
+			deleteImageBlobs(r.Context(), h.blobs, images)
+			http.Error(w, fmt.Sprintf("La imagen %s supera los 10 MB", fh.Filename), http.StatusRequestEntityTooLarge)
+			return
+		}
+		img, status, err := h.storeImage(r.Context(), fh)
+		if err != nil {
+			deleteImageBlobs(r.Context(), h.blobs, images)
+			if status == http.StatusInternalServerError {
+				log.Printf("Error al guardar la imagen %s: %v", fh.Filename, err)
+				http.Error(w, "Error interno al guardar la imagen", status)
+				return
+			}
+			http.Error(w, fmt.Sprintf("%s: %v", fh.Filename, err), status)
+			return
+		}
+		images = append(images, img)
+	}
+
+	var product models.Product
+	err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		current, err := tx.GetProductByID(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		product, err = tx.SetProductImages(r.Context(), id, slices.Concat(current.Images, images))
+		return err
+	})
+	if err != nil {
+		// El producto pudo eliminarse mientras se procesaban los archivos.
+		deleteImageBlobs(r.Context(), h.blobs, images)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(product)
+}
+
+// storeImage valida un archivo subido y guarda el original y su miniatura en el almacén.
+// Devuelve el código HTTP adecuado si falla.
+func (h *ImageHandlers) storeImage(ctx context.Context, fh *multipart.FileHeader) (models.ProductImage, int, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return models.ProductImage{}, http.StatusBadRequest, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return models.ProductImage{}, http.StatusBadRequest, err
+	}
+	decoded, err := utils.DecodeImage(data)
+	if errors.Is(err, utils.ErrImageTooLarge) {
+		return models.ProductImage{}, http.StatusRequestEntityTooLarge, err
+	}
+	if err != nil {
+		return models.ProductImage{}, http.StatusBadRequest, err
+	}
+	thumbnail, err := utils.Thumbnail(decoded.Image, h.thumbnailSize)
+	if err != nil {
+		return models.ProductImage{}, http.StatusInternalServerError, err
+	}
+
+	imageID := uuid.NewString()
+	key := imageID + utils.ImageFormats[decoded.ContentType]
+	thumbKey := imageID + "-thumb.jpg"
+	if err := h.blobs.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return models.ProductImage{}, http.StatusInternalServerError, err
+	}
+	if err := h.blobs.Put(ctx, thumbKey, bytes.NewReader(thumbnail)); err != nil {
+		h.blobs.Delete(ctx, key)
+		return models.ProductImage{}, http.StatusInternalServerError, err
+	}
+	bounds := decoded.Image.Bounds()
+	return models.ProductImage{
+		ID:           imageID,
+		URL:          imageURLPrefix + key,
+		ThumbnailURL: imageURLPrefix + thumbKey,
+		ContentType:  decoded.ContentType,
+		Width:        bounds.Dx(),
+		Height:       bounds.Dy(),
+	}, http.StatusCreated, nil
+}
+
+// DeleteProductImageHandler quita una imagen del producto y borra sus archivos.
+func (h *ImageHandlers) DeleteProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var product models.Product
+	var removed models.ProductImage
+	err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		current, err := tx.GetProductByID(r.Context(), vars["id"])
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(current.Images, func(img models.ProductImage) bool { return img.ID == vars["imageId"] })
+		if i < 0 {
+			return errImageNotFound
+		}
+		removed = current.Images[i]
+		product, err = tx.SetProductImages(r.Context(), current.ID, slices.Delete(slices.Clone(current.Images), i, i+1))
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	deleteImageBlobs(r.Context(), h.blobs, []models.ProductImage{removed})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
+// errImageNotFound se usa cuando la imagen no pertenece al producto indicado.
+var errImageNotFound = errors.New("imagen no encontrada")
+
+// ReorderProductImagesHandler recibe { "imageIds": [...] } con todas las imágenes del
+// producto en el nuevo orden.
+func (h *ImageHandlers) ReorderProductImagesHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ImageIDs []string `json:"imageIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return
+	}
+	var product models.Product
+	err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		current, err := tx.GetProductByID(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+		ordered, err := reorderImages(current.Images, req.ImageIDs)
+		if err != nil {
+			return err
+		}
+		product, err = tx.SetProductImages(r.Context(), current.ID, ordered)
+		return err
+	})
+	if errors.Is(err, errInvalidImageOrder) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
+// errInvalidImageOrder indica que la lista recibida no contiene exactamente las imágenes del producto.
+var errInvalidImageOrder = errors.New("imageIds debe incluir cada imagen del producto exactamente una vez")
+
+// reorderImages ordena las imágenes según ids, que debe ser una permutación de las existentes.
+func reorderImages(images []models.ProductImage, ids []string) ([]models.ProductImage, error) {
+	if len(ids) != len(images) {
+		return nil, errInvalidImageOrder
+	}
+	byID := make(map[string]models.ProductImage, len(images))
+	for _, img := range images {
+		byID[img.ID] = img
+	}
+	ordered := make([]models.ProductImage, 0, len(ids))
+	for _, id := range ids {
+		img, ok := byID[id]
+		if !ok {
+			return nil, errInvalidImageOrder
+		}
+		delete(byID, id)
+		ordered = append(ordered, img)
+	}
+	return ordered, nil
+}
+
+// ServeImageHandler entrega un archivo de imagen. Las claves nunca se reutilizan, así que
+// el contenido es inmutable y puede guardarse en caché indefinidamente.
+func (h *ImageHandlers) ServeImageHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	f, info, err := h.blobs.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrBlobNotFound) {
+		http.Error(w, "Imagen no encontrada", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error al leer la imagen %s: %v", key, err)
+		http.Error(w, "Error interno al leer la imagen", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+key+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// ServeContent deduce el Content-Type por la extensión y responde a If-None-Match y Range.
+	http.ServeContent(w, r, key, info.ModTime, f)
+}
+
+// deleteImageBlobs borra los archivos de las imágenes indicadas. Es de mejor esfuerzo:
+// un archivo huérfano no afecta al catálogo, así que los fallos solo se registran.
+func deleteImageBlobs(ctx context.Context, blobs storage.BlobStore, images []models.ProductImage) {
+	for _, img := range images {
+		for _, url := range []string{img.URL, img.ThumbnailURL} {
+			if err := blobs.Delete(ctx, path.Base(url)); err != nil {
+				log.Printf("Error al borrar la imagen %s: %v", url, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"tienda/models"
+	"tienda/payment"
+	"tienda/storage"
+	"tienda/utils"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OrderHandlers maneja el ciclo de vida de las órdenes y los pagos que lo acompañan.
+type OrderHandlers struct {
+	tx         storage.Transactor
+	orderStore storage.OrderStorer
+	payments   paymentProcessor
+}
+
+// NewOrderHandlers es el constructor para los handlers de órdenes.
+func NewOrderHandlers(tx storage.Transactor, os storage.OrderStorer, provider payment.Provider) *OrderHandlers {
+	return &OrderHandlers{tx: tx, orderStore: os, payments: paymentProcessor{provider: provider}}
+}
+
+// UpdateOrderStatusHandler cambia el estado de una orden (personal autorizado).
+func (h *OrderHandlers) UpdateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	var req struct {
+		Status models.OrderStatus `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return
+	}
+	if !req.Status.Valid() {
+		http.Error(w, "Estado de orden inválido", http.StatusBadRequest)
+		return
+	}
+	h.transition(w, r, id, req.Status)
+}
+
+// CancelOrderHandler permite al dueño cancelar su propia orden mientras no haya sido enviada.
+func (h *OrderHandlers) CancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	order, err := h.orderStore.GetOrderByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, "Orden no encontrada", http.StatusNotFound)
+		return
+	}
+	if order.UserID != user.ID && !utils.HasPermission(user.Role, utils.PermOrdersManage) {
+		http.Error(w, "No tienes permisos sobre esta orden", http.StatusForbidden)
+		return
+	}
+	h.transition(w, r, id, models.OrderCancelled)
+}
+
+// transition aplica el cambio de estado y responde con la orden actualizada.
+// Primero reserva el cambio en la orden, de modo que una segunda petición concurrente (o
+// un reembolso de devolución en curso) recibe 409 en lugar de volver a cobrar o
+// reembolsar; luego liquida el pago con el proveedor (captura al pagar, anulación o
+// reembolso al cancelar o reembolsar) y por último registra el pago y aplica el cambio en
+// una transacción. Si el proveedor falla se libera la reserva y la orden no cambia de
+// estado. Al cancelar, las unidades vuelven al inventario en la misma transacción.
+// Si el pago se liquida pero no se puede registrar, el reintento lo pide con la misma clave
+// de idempotencia y el proveedor no lo repite.
+func (h *OrderHandlers) transition(w http.ResponseWriter, r *http.Request, id string, status models.OrderStatus) {
+	var order models.Order
+	err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		now := time.Now()
+		if err := checkRefundInProgress(r.Context(), tx, id, now); err != nil {
+			return err
+		}
+		var err error
+		order, err = tx.ClaimOrderStatus(r.Context(), id, status, now.Add(settlementTimeout))
+		return err
+	})
+	if err != nil {
+		writeOrderError(w, id, err)
+		return
+	}
+	attempt, settleErr := h.payments.settle(r.Context(), order, status)
+	if settleErr != nil && !errors.Is(settleErr, errNothingToSettle) {
+		// El intento se registra aunque haya fallado, para dejar constancia en la orden.
+		err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+			if _, err := tx.RecordPayment(r.Context(), id, attempt); err != nil {
+				return err
+			}
+			_, err := tx.ReleaseOrderStatus(r.Context(), id)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error al registrar el pago de la orden %s: %v", id, err)
+		}
+		if decline, ok := payment.IsDecline(settleErr); ok {
+			http.Error(w, "El proveedor de pagos rechazó la operación: "+decline.Message, http.StatusConflict)
+			return
+		}
+		log.Printf("Error del proveedor de pagos con la orden %s: %v", id, settleErr)
+		http.Error(w, "No se pudo contactar al proveedor de pagos, intente de nuevo", http.StatusBadGateway)
+		return
+	}
+	err = h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		if settleErr == nil {
+			if _, err := tx.RecordPayment(r.Context(), id, attempt); err != nil {
+				return err
+			}
+		}
+		var err error
+		if order, err = tx.UpdateOrderStatus(r.Context(), id, status); err != nil {
+			return err
+		}
+		if status == models.OrderCancelled {
+			return tx.RestockItems(r.Context(), orderCartItems(order))
+		}
+		return nil
+	})
+	if err != nil {
+		// Al vencer la reserva, el reintento usa la misma clave de idempotencia (ver
+		// settlementKey) y el proveedor devuelve este mismo pago sin repetirlo.
+		if settleErr == nil {
+			log.Printf("Pago %s de la orden %s liquidado sin registrar: %v", attempt.TransactionID, id, err)
+		}
+		writeOrderError(w, id, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// writeOrderError traduce los errores del almacén de órdenes a códigos HTTP.
+func writeOrderError(w http.ResponseWriter, id string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrOrderNotFound):
+		http.Error(w, "Orden no encontrada", http.StatusNotFound)
+	case errors.Is(err, storage.ErrInvalidTransition), errors.Is(err, storage.ErrOrderBusy), errors.Is(err, errRefundInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Error al actualizar la orden %s: %v", id, err)
+		http.Error(w, "Error al actualizar la orden", http.StatusInternalServerError)
+	}
+}
+
+// orderCartItems convierte las líneas de una orden al formato usado por el inventario.
+func orderCartItems(order models.Order) []models.CartItem {
+	items := make([]models.CartItem, 0, len(order.Items))
+	for _, item := range order.Items {
+		items = append(items, models.CartItem{ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity, Price: item.UnitPrice})
+	}
+	return items
+}
+
+// GetMyOrdersHandler devuelve el historial de órdenes del usuario autenticado.
+func (h *OrderHandlers) GetMyOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	filter, page, limit, err := parseOrderFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserID = user.ID // Un cliente solo ve sus propias órdenes.
+	h.writeOrderPage(w, r, filter, page, limit)
+}
+
+// GetOrdersHandler lista todas las órdenes con filtros por estado, usuario y fechas (personal autorizado).
+func (h *OrderHandlers) GetOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	filter, page, limit, err := parseOrderFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserID = r.URL.Query().Get("userId")
+	h.writeOrderPage(w, r, filter, page, limit)
+}
+
+// GetOrderHandler obtiene una orden por su ID; solo su dueño o el personal pueden verla.
+func (h *OrderHandlers) GetOrderHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	order, err := h.orderStore.GetOrderByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, "Orden no encontrada", http.StatusNotFound)
+		return
+	}
+	if order.UserID != user.ID && !utils.HasPermission(user.Role, utils.PermOrdersManage) {
+		http.Error(w, "No tienes permisos sobre esta orden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// writeOrderPage consulta el almacén y responde con la página solicitada.
+func (h *OrderHandlers) writeOrderPage(w http.ResponseWriter, r *http.Request, filter storage.OrderFilter, page, limit int) {
+	orders, total, err := h.orderStore.QueryOrders(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Error al obtener órdenes", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"orders": orders,
+		"total":  total,
+		"page":   page,
+		"limit":  limit,
+	})
+}
+
+// parseOrderFilter lee los parámetros status, from, to, page y limit de la URL.
+// Las fechas aceptan RFC 3339 o AAAA-MM-DD; en este último caso "to" incluye todo ese día.
+func parseOrderFilter(r *http.Request) (storage.OrderFilter, int, int, error) {
+	q := r.URL.Query()
+	var filter storage.OrderFilter
+	if status := q.Get("status"); status != "" {
+		filter.Status = models.OrderStatus(status)
+		if !filter.Status.Valid() {
+			return filter, 0, 0, errors.New("estado de orden inválido")
+		}
+	}
+	var err error
+	if filter.From, err = parseDateParam(q.Get("from"), false); err != nil {
+		return filter, 0, 0, errors.New("parámetro 'from' inválido")
+	}
+	if filter.To, err = parseDateParam(q.Get("to"), true); err != nil {
+		return filter, 0, 0, errors.New("parámetro 'to' inválido")
+	}
+	page, limit, err := parsePagination(r)
+	if err != nil {
+		return filter, 0, 0, err
+	}
+	filter.Offset, filter.Limit = (page-1)*limit, limit
+	return filter, page, limit, nil
+}
+
+// parseDateParam interpreta una fecha de la URL; con endOfDay, una fecha sin hora avanza al día siguiente.
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"tienda/models"
+	"tienda/payment"
+	"tienda/storage"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testProvider envuelve al proveedor falso: cuenta las capturas, anulaciones y reembolsos,
+// guarda sus claves de idempotencia, puede fallar con err, ejecuta onCall si no es nil y, si
+// block no es nil, avisa en entered y espera en block antes de responder.
+type testProvider struct {
+	*payment.FakeProvider
+	err     error
+	onCall  func()
+	entered chan struct{}
+	block   chan struct{}
+	calls   atomic.Int32
+
+	mu   sync.Mutex
+	keys []string
+}
+
+func (p *testProvider) wait(key string) error {
+	p.calls.Add(1)
+	p.mu.Lock()
+	p.keys = append(p.keys, key)
+	p.mu.Unlock()
+	if p.onCall != nil {
+		p.onCall()
+	}
+	if p.block != nil {
+		p.entered <- struct{}{}
+		<-p.block
+	}
+	return p.err
+}
+
+func (p *testProvider) Capture(ctx context.Context, authorizationID string, amount models.Money, key string) (payment.Transaction, error) {
+	if err := p.wait(key); err != nil {
+		return payment.Transaction{}, err
+	}
+	return p.FakeProvider.Capture(ctx, authorizationID, amount, key)
+}
+
+func (p *testProvider) Void(ctx context.Context, authorizationID string, key string) (payment.Transaction, error) {
+	if err := p.wait(key); err != nil {
+		return payment.Transaction{}, err
+	}
+	return p.FakeProvider.Void(ctx, authorizationID, key)
+}
+
+func (p *testProvider) Refund(ctx context.Context, captureID string, amount models.Money, key string) (payment.Transaction, error) {
+	if err := p.wait(key); err != nil {
+		return payment.Transaction{}, err
+	}
+	return p.FakeProvider.Refund(ctx, captureID, amount, key)
+}
+
+// createPaidOrder registra una orden con el total autorizado y, si captured, cobrado.
+func createPaidOrder(t *testing.T, store storage.Storer, status models.OrderStatus, captured bool) models.Order {
+	t.Helper()
+	total := models.NewMoney(2000)
+	order := models.Order{
+		Items:    []models.OrderItem{{ProductID: "p1", Name: "Taza", Quantity: 2, UnitPrice: models.NewMoney(1000), Subtotal: total}},
+		Subtotal: total,
+		Total:    total,
+		Status:   status,
+	}
+	order.RecordPayment(models.PaymentAttempt{Operation: models.PaymentAuthorize, Status: models.AttemptSucceeded, Amount: total, TransactionID: "fake_auth_1"})
+	if captured {
+		order.RecordPayment(models.PaymentAttempt{Operation: models.PaymentCapture, Status: models.AttemptSucceeded, Amount: total, TransactionID: "fake_cap_1"})
+	}
+	order, err := store.CreateOrder(context.Background(), order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// putOrderStatus llama a PUT /api/orders/{id}/status y devuelve la respuesta.
+func putOrderStatus(h *OrderHandlers, id string, status models.OrderStatus) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, "/api/orders/"+id+"/status", strings.NewReader(`{"status":"`+string(status)+`"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	rec := httptest.NewRecorder()
+	h.UpdateOrderStatusHandler(rec, req)
+	return rec
+}
+
+func TestOrderTransitionSettlesPayment(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      models.OrderStatus
+		captured    bool
+		busy        bool // Otra petición tiene reservada la orden.
+		providerErr error
+		next        models.OrderStatus
+		wantCode    int
+		wantStatus  models.OrderStatus
+		wantPayment models.PaymentStatus
+		wantCalls   int32
+	}{
+		{name: "pagar captura", status: models.OrderPending, next: models.OrderPaid, wantCode: http.StatusOK, wantStatus: models.OrderPaid, wantPayment: models.PaymentCaptured, wantCalls: 1},
+		{name: "cancelar sin cobro anula", status: models.OrderPending, next: models.OrderCancelled, wantCode: http.StatusOK, wantStatus: models.OrderCancelled, wantPayment: models.PaymentVoided, wantCalls: 1},
+		{name: "cancelar pagada reembolsa", status: models.OrderPaid, captured: true, next: models.OrderCancelled, wantCode: http.StatusOK, wantStatus: models.OrderCancelled, wantPayment: models.PaymentRefunded, wantCalls: 1},
+		{name: "reembolsar", status: models.OrderPaid, captured: true, next: models.OrderRefunded, wantCode: http.StatusOK, wantStatus: models.OrderRefunded, wantPayment: models.PaymentRefunded, wantCalls: 1},
+		{name: "enviar no toca el pago", status: models.OrderPaid, captured: true, next: models.OrderShipped, wantCode: http.StatusOK, wantStatus: models.OrderShipped, wantPayment: models.PaymentCaptured},
+		{name: "transición no permitida", status: models.OrderPending, next: models.OrderShipped, wantCode: http.StatusConflict, wantStatus: models.OrderPending, wantPayment: models.PaymentAuthorized},
+		{name: "orden reservada por otra petición", status: models.OrderPaid, captured: true, busy: true, next: models.OrderRefunded, wantCode: http.StatusConflict, wantStatus: models.OrderPaid, wantPayment: models.PaymentCaptured},
+		{name: "rechazo del proveedor", status: models.OrderPaid, captured: true, providerErr: &payment.DeclineError{Code: "card_declined", Message: "rechazado"}, next: models.OrderRefunded, wantCode: http.StatusConflict, wantStatus: models.OrderPaid, wantPayment: models.PaymentCaptured, wantCalls: 1},
+		{name: "proveedor caído", status: models.OrderPending, providerErr: errors.New("timeout"), next: models.OrderPaid, wantCode: http.StatusBadGateway, wantStatus: models.OrderPending, wantPayment: models.PaymentAuthorized, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			provider := &testProvider{FakeProvider: payment.NewFakeProvider(nil), err: tt.providerErr}
+			h := NewOrderHandlers(store, store, provider)
+			order := createPaidOrder(t, store, tt.status, tt.captured)
+			if tt.busy {
+				if _, err := store.ClaimOrderStatus(ctx, order.ID, models.OrderCancelled, time.Now().Add(time.Minute)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := putOrderStatus(h, order.ID, tt.next)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("código = %d, se esperaba %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			got, err := store.GetOrderByID(ctx, order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.wantStatus || got.PaymentStatus != tt.wantPayment {
+				t.Errorf("orden %s con pago %s, se esperaba %s con pago %s", got.Status, got.PaymentStatus, tt.wantStatus, tt.wantPayment)
+			}
+			if calls := provider.calls.Load(); calls != tt.wantCalls {
+				t.Errorf("llamadas al proveedor = %d, se esperaban %d", calls, tt.wantCalls)
+			}
+			if busy := got.Busy(time.Now()); busy != tt.busy {
+				t.Errorf("reserva vigente = %v (%q), se esperaba %v", busy, got.PendingStatus, tt.busy)
+			}
+			if tt.providerErr != nil && got.Payments[len(got.Payments)-1].Status == models.AttemptSucceeded {
+				t.Error("el intento fallido no quedó registrado")
+			}
+		})
+	}
+}
+
+func TestOrderTransitionSettlesOnce(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			provider := &testProvider{FakeProvider: payment.NewFakeProvider(nil), entered: make(chan struct{}), block: make(chan struct{})}
+			h := NewOrderHandlers(store, store, provider)
+			order := createPaidOrder(t, store, models.OrderPaid, true)
+
+			// La primera petición queda esperando al proveedor con la orden reservada.
+			first := make(chan *httptest.ResponseRecorder)
+			go func() { first <- putOrderStatus(h, order.ID, models.OrderRefunded) }()
+			<-provider.entered
+			if rec := putOrderStatus(h, order.ID, models.OrderCancelled); rec.Code != http.StatusConflict {
+				t.Errorf("petición concurrente: código = %d, se esperaba 409: %s", rec.Code, rec.Body)
+			}
+			close(provider.block)
+			if rec := <-first; rec.Code != http.StatusOK {
+				t.Fatalf("primera petición: código = %d: %s", rec.Code, rec.Body)
+			}
+			if calls := provider.calls.Load(); calls != 1 {
+				t.Errorf("reembolsos emitidos = %d, se esperaba 1", calls)
+			}
+		})
+	}
+}
+
+func TestOrderTransitionRetryAfterLostRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tienda.db")
+	store, err := storage.NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := createPaidOrder(t, store, models.OrderPaid, true)
+
+	// El proveedor reembolsa, pero el almacén falla antes de registrarlo.
+	provider := &testProvider{FakeProvider: payment.NewFakeProvider(nil), onCall: func() { store.Close() }}
+	if rec := putOrderStatus(NewOrderHandlers(store, store, provider), order.ID, models.OrderRefunded); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("primera petición: código = %d, se esperaba 500: %s", rec.Code, rec.Body)
+	}
+
+	store, err = storage.NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// La reserva vence y otra petición reintenta el cambio.
+	if _, err := store.ReleaseOrderStatus(ctx, order.ID); err != nil {
+		t.Fatal(err)
+	}
+	provider.onCall = nil
+	if rec := putOrderStatus(NewOrderHandlers(store, store, provider), order.ID, models.OrderRefunded); rec.Code != http.StatusOK {
+		t.Fatalf("reintento: código = %d: %s", rec.Code, rec.Body)
+	}
+	if len(provider.keys) != 2 || provider.keys[0] != provider.keys[1] {
+		t.Errorf("claves de idempotencia = %q, el reintento debe repetir la primera", provider.keys)
+	}
+}
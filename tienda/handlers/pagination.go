@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// parsePagination lee los parámetros page y limit (por defecto 1 y 20, máximo 100).
+func parsePagination(r *http.Request) (page, limit int, err error) {
+	q := r.URL.Query()
+	page, limit = 1, defaultPageSize
+	if v := q.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, errors.New("parámetro 'page' inválido")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, 0, errors.New("parámetro 'limit' inválido")
+		}
+		limit = min(limit, maxPageSize)
+	}
+	return page, limit, nil
+}
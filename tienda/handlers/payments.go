@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"tienda/models"
+	"tienda/payment"
+	"tienda/storage"
+	"time"
+)
+
+// paymentProcessor llama al proveedor de pagos y convierte cada llamada en un intento de
+// pago listo para registrarse en la orden, tanto si tuvo éxito como si no.
+type paymentProcessor struct {
+	provider payment.Provider
+}
+
+// errNothingToSettle indica que la orden no tiene un pago que capturar, anular o reembolsar.
+var errNothingToSettle = errors.New("la orden no tiene un pago pendiente de esa operación")
+
+// errRefundInProgress indica que una devolución de la orden se está reembolsando.
+var errRefundInProgress = errors.New("la orden tiene un reembolso de devolución en curso")
+
+// checkRefundInProgress devuelve errRefundInProgress si alguna devolución de la orden tiene
+// un reembolso en curso, para no liquidar a la vez dos pagos de la misma orden.
+func checkRefundInProgress(ctx context.Context, rs storage.ReturnStorer, orderID string, now time.Time) error {
+	returns, _, err := rs.QueryReturns(ctx, storage.ReturnFilter{OrderID: orderID, Status: models.ReturnRefunding})
+	if err != nil {
+		return err
+	}
+	for _, ret := range returns {
+		if ret.Refunding(now) {
+			return errRefundInProgress
+		}
+	}
+	return nil
+}
+
+// settlementTimeout es cuánto dura la reserva de un cambio de estado mientras se liquida el
+// pago con el proveedor. Si la petición no termina (p. ej. porque el proceso se detuvo), la
+// reserva vence y otra petición puede reintentar el cambio; si el pago ya se había
+// liquidado, la clave de idempotencia (ver settlementKey) evita que se repita.
+const settlementTimeout = 2 * time.Minute
+
+// authorize reserva amount en la tarjeta. Devuelve el intento y, si no tuvo éxito, el error.
+func (p paymentProcessor) authorize(ctx context.Context, amount models.Money, card payment.Card, reference string) (models.PaymentAttempt, error) {
+	tx, err := p.provider.Authorize(ctx, payment.AuthorizeRequest{Amount: amount, Card: card, Reference: reference})
+	attempt := p.attempt(models.PaymentAuthorize, amount, tx, err)
+	attempt.CardBrand, attempt.CardLast4 = card.Brand(), card.Last4()
+	return attempt, err
+}
+
+// settlementKey arma la clave de idempotencia con que se pide al proveedor la operación op
+// sobre el pago de la orden. Incluye los intentos ya registrados en la orden: si un pago se
+// liquidó pero no se pudo registrar, el reintento repite la clave y el proveedor devuelve
+// el mismo resultado sin volver a cobrar o reembolsar; tras un intento fallido registrado la
+// clave cambia y el proveedor lo intenta de nuevo.
+func settlementKey(order models.Order, op string) string {
+	return fmt.Sprintf("%s:%s:%d", order.ID, op, len(order.Payments))
+}
+
+// capture cobra la autorización de la orden por el monto autorizado.
+func (p paymentProcessor) capture(ctx context.Context, order models.Order) (models.PaymentAttempt, error) {
+	auth, ok := order.SuccessfulPayment(models.PaymentAuthorize)
+	if !ok || order.PaymentStatus != models.PaymentAuthorized {
+		return models.PaymentAttempt{}, errNothingToSettle
+	}
+	tx, err := p.provider.Capture(ctx, auth.TransactionID, auth.Amount, settlementKey(order, string(models.PaymentCapture)))
+	attempt := p.attempt(models.PaymentCapture, auth.Amount, tx, err)
+	attempt.CardBrand, attempt.CardLast4 = auth.CardBrand, auth.CardLast4
+	return attempt, err
+}
+
+// void anula la autorización de la orden si todavía no se capturó.
+func (p paymentProcessor) void(ctx context.Context, order models.Order) (models.PaymentAttempt, error) {
+	auth, ok := order.SuccessfulPayment(models.PaymentAuthorize)
+	if !ok || order.PaymentStatus != models.PaymentAuthorized {
+		return models.PaymentAttempt{}, errNothingToSettle
+	}
+	return p.voidAuthorization(ctx, auth, settlementKey(order, string(models.PaymentVoid)))
+}
+
+// voidAuthorization anula una autorización que aún no forma parte de una orden. key es la
+// clave de idempotencia de la operación (ver settlementKey).
+func (p paymentProcessor) voidAuthorization(ctx context.Context, auth models.PaymentAttempt, key string) (models.PaymentAttempt, error) {
+	tx, err := p.provider.Void(ctx, auth.TransactionID, key)
+	attempt := p.attempt(models.PaymentVoid, auth.Amount, tx, err)
+	attempt.CardBrand, attempt.CardLast4 = auth.CardBrand, auth.CardLast4
+	return attempt, err
+}
+
+// refund devuelve amount de lo cobrado en la orden, sin superar lo que queda por reembolsar.
+// key es la clave de idempotencia de la operación (ver settlementKey).
+func (p paymentProcessor) refund(ctx context.Context, order models.Order, amount models.Money, key string) (models.PaymentAttempt, error) {
+	capture, ok := order.SuccessfulPayment(models.PaymentCapture)
+	if !ok || amount.Amount <= 0 || amount.Amount > order.RefundableAmount().Amount {
+		return models.PaymentAttempt{}, errNothingToSettle
+	}
+	tx, err := p.provider.Refund(ctx, capture.TransactionID, amount, key)
+	attempt := p.attempt(models.PaymentRefund, amount, tx, err)
+	attempt.CardBrand, attempt.CardLast4 = capture.CardBrand, capture.CardLast4
+	return attempt, err
+}
+
+// settle hace con el pago lo que corresponde al nuevo estado de la orden: capturar al
+// marcarla pagada, anular o reembolsar al cancelarla y reembolsar al marcarla reembolsada.
+// Devuelve errNothingToSettle si no hay nada que hacer (p. ej. órdenes sin pago registrado).
+func (p paymentProcessor) settle(ctx context.Context, order models.Order, status models.OrderStatus) (models.PaymentAttempt, error) {
+	switch status {
+	case models.OrderPaid:
+		return p.capture(ctx, order)
+	case models.OrderCancelled:
+		if order.PaymentStatus == models.PaymentAuthorized {
+			return p.void(ctx, order)
+		}
+		return p.refund(ctx, order, order.RefundableAmount(), settlementKey(order, string(models.PaymentRefund)))
+	case models.OrderRefunded:
+		return p.refund(ctx, order, order.RefundableAmount(), settlementKey(order, string(models.PaymentRefund)))
+	}
+	return models.PaymentAttempt{}, errNothingToSettle
+}
+
+// attempt arma el registro de una llamada al proveedor a partir de su resultado.
+func (p paymentProcessor) attempt(op models.PaymentOperation, amount models.Money, tx payment.Transaction, err error) models.PaymentAttempt {
+	a := models.PaymentAttempt{
+		Operation:     op,
+		Status:        models.AttemptSucceeded,
+		Provider:      p.provider.Name(),
+		Amount:        amount,
+		TransactionID: tx.ID,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if decline, ok := payment.IsDecline(err); ok {
+		a.Status, a.Code, a.Message = models.AttemptDeclined, decline.Code, decline.Message
+	} else if err != nil {
+		a.Status, a.Message = models.AttemptFailed, err.Error()
+	}
+	return a
+}
+
+// writePaymentError responde a un pago que no se completó: 402 si el proveedor lo rechazó
+// (con el intento registrado) y 502 si no se pudo comunicar con él.
+func writePaymentError(w http.ResponseWriter, attempt models.PaymentAttempt, err error) {
+	if decline, ok := payment.IsDecline(err); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "Pago rechazado: " + decline.Message,
+			"payment": attempt,
+		})
+		return
+	}
+	log.Printf("Error del proveedor de pagos (%s): %v", attempt.Operation, err)
+	http.Error(w, "No se pudo contactar al proveedor de pagos, intente de nuevo", http.StatusBadGateway)
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"tienda/models"
+	"tienda/storage"
+	"time"
+)
+
+// cartPricer calcula el subtotal, los descuentos, los impuestos y el total de un carrito.
+type cartPricer struct {
+	coupons    storage.CouponStorer
+	products   storage.ProductStorer
+	categories storage.CategoryStorer
+	taxes      storage.TaxStorer
+}
+
+// pricerFor crea un cartPricer que lee del almacén indicado, p. ej. una transacción.
+func pricerFor(s storage.Storer) cartPricer {
+	return cartPricer{coupons: s, products: s, categories: s, taxes: s}
+}
+
+// errCouponLoginRequired indica que el cupón limita los usos por usuario y el carrito es de invitado.
+var errCouponLoginRequired = errors.New("inicia sesión para usar este cupón")
+
+// price concilia el carrito con el catálogo (ver models.Cart.Reconcile, los avisos quedan
+// en Changes) y lo recalcula de forma exacta. Si tiene un cupón que ya no aplica, lo
+// conserva sin descuento y deja el motivo en CouponError. Solo devuelve error si
+// falla el almacenamiento.
+func (p cartPricer) price(ctx context.Context, cart *models.Cart) error {
+	err := p.priceStrict(ctx, cart)
+	var reason *couponRejection
+	if errors.As(err, &reason) {
+		cart.CouponError = reason.Error()
+		return nil
+	}
+	return err
+}
+
+// priceStrict es como price, pero si el cupón no aplica devuelve un *couponRejection
+// con el motivo (y el carrito queda calculado sin descuento).
+func (p cartPricer) priceStrict(ctx context.Context, cart *models.Cart) error {
+	// Los productos se leen una vez; los que ya no existen quedan fuera del mapa y sus
+	// líneas se quitan al conciliar.
+	products := make(map[string]models.Product, len(cart.Items))
+	for _, item := range cart.Items {
+		product, err := p.products.GetProductByID(ctx, item.ProductID)
+		switch {
+		case err == nil:
+			products[item.ProductID] = product
+		case !errors.Is(err, storage.ErrProductNotFound):
+			return err
+		}
+	}
+	cart.Changes = cart.Reconcile(products)
+
+	amounts := make([]int64, len(cart.Items))
+	subtotal := models.NewMoney(0)
+	for i, item := range cart.Items {
+		line := item.Price.Mul(item.Quantity)
+		amounts[i] = line.Amount
+		subtotal = subtotal.Add(line)
+	}
+	cart.Subtotal, cart.Currency = subtotal, subtotal.Currency
+	cart.Discounts, cart.CouponError, cart.Taxes = nil, "", nil
+
+	// Descuento asignado a cada línea, para calcular los impuestos sobre lo que se cobra.
+	lineDiscounts := make([]int64, len(cart.Items))
+	var rejection error
+	if cart.CouponCode != "" {
+		line, eligible, err := p.discount(ctx, *cart, products, time.Now())
+		var reason *couponRejection
+		switch {
+		case errors.As(err, &reason):
+			rejection = err
+		case err != nil:
+			return err
+		default:
+			cart.Discounts = []models.DiscountLine{line}
+			allocateDiscount(lineDiscounts, amounts, eligible, line.Amount.Amount)
+		}
+	}
+
+	total := subtotal
+	for _, d := range cart.Discounts {
+		total = total.Sub(d.Amount)
+	}
+	rules, err := p.taxes.GetTaxRules(ctx)
+	if err != nil {
+		return err
+	}
+	cart.Taxes = computeTaxes(rules, cart.TaxRegion(), cart.Items, products, amounts, lineDiscounts)
+	cart.Tax = models.NewMoney(0)
+	for _, tax := range cart.Taxes {
+		cart.Tax = cart.Tax.Add(tax.Amount)
+		if !tax.Inclusive {
+			total = total.Add(tax.Amount)
+		}
+	}
+	cart.Total = total
+	return rejection
+}
+
+// couponRejection envuelve los motivos por los que un cupón no aplica al carrito,
+// para distinguirlos de los errores del almacenamiento.
+type couponRejection struct{ err error }
+
+func (e *couponRejection) Error() string { return e.err.Error() }
+func (e *couponRejection) Unwrap() error { return e.err }
+
+// discount valida el cupón del carrito y calcula su descuento. También indica qué
+// líneas son elegibles, para repartir el descuento entre ellas.
+func (p cartPricer) discount(ctx context.Context, cart models.Cart, products map[string]models.Product, now time.Time) (models.DiscountLine, []bool, error) {
+	coupon, err := p.coupons.GetCouponByCode(ctx, cart.CouponCode)
+	if errors.Is(err, storage.ErrCouponNotFound) {
+		return models.DiscountLine{}, nil, &couponRejection{err}
+	}
+	if err != nil {
+		return models.DiscountLine{}, nil, err
+	}
+	if err := coupon.CheckValidity(now); err != nil {
+		return models.DiscountLine{}, nil, &couponRejection{err}
+	}
+	if coupon.MaxUses > 0 && coupon.Uses >= coupon.MaxUses {
+		return models.DiscountLine{}, nil, &couponRejection{storage.ErrCouponUsageLimit}
+	}
+	if coupon.MaxUsesPerUser > 0 {
+		if cart.UserID == "" {
+			return models.DiscountLine{}, nil, &couponRejection{errCouponLoginRequired}
+		}
+		uses, err := p.coupons.CountCouponUses(ctx, coupon.ID, cart.UserID)
+		if err != nil {
+			return models.DiscountLine{}, nil, err
+		}
+		if uses >= coupon.MaxUsesPerUser {
+			return models.DiscountLine{}, nil, &couponRejection{storage.ErrCouponUsageLimit}
+		}
+	}
+	eligible, err := p.eligibleLines(ctx, coupon, cart.Items, products)
+	if err != nil {
+		return models.DiscountLine{}, nil, err
+	}
+	eligibleSubtotal := models.NewMoney(0)
+	for i, item := range cart.Items {
+		if eligible[i] {
+			eligibleSubtotal = eligibleSubtotal.Add(item.Price.Mul(item.Quantity))
+		}
+	}
+	line, err := coupon.Discount(cart.Subtotal, eligibleSubtotal)
+	if err != nil {
+		return models.DiscountLine{}, nil, &couponRejection{err}
+	}
+	return line, eligible, nil
+}
+
+// eligibleLines indica a qué líneas aplica el cupón: todas si no está limitado,
+// o las de sus productos y las de sus categorías (incluidas las subcategorías).
+func (p cartPricer) eligibleLines(ctx context.Context, coupon models.Coupon, items []models.CartItem, products map[string]models.Product) ([]bool, error) {
+	eligible := make([]bool, len(items))
+	if !coupon.Scoped() {
+		for i := range eligible {
+			eligible[i] = true
+		}
+		return eligible, nil
+	}
+	categories := map[string]bool{}
+	if len(coupon.CategoryIDs) > 0 {
+		all, err := p.categories.GetCategories(ctx)
+		if err != nil {
+			return nil, err
+		}
+		categories = categoryDescendants(all, coupon.CategoryIDs)
+	}
+	for i, item := range items {
+		for _, id := range coupon.ProductIDs {
+			eligible[i] = eligible[i] || id == item.ProductID
+		}
+		// Si el producto ya no existe, su línea no cuenta para las categorías del cupón.
+		for _, id := range products[item.ProductID].CategoryIDs {
+			eligible[i] = eligible[i] || categories[id]
+		}
+	}
+	return eligible, nil
+}
+
+// allocateDiscount reparte amount entre las líneas elegibles en proporción a su monto.
+// El resto del redondeo va a la última línea elegible, así la suma es exacta.
+func allocateDiscount(dst, amounts []int64, eligible []bool, amount int64) {
+	var base int64
+	last := -1
+	for i, ok := range eligible {
+		if ok {
+			base += amounts[i]
+			last = i
+		}
+	}
+	if base <= 0 {
+		return
+	}
+	remaining := amount
+	for i, ok := range eligible {
+		if !ok || i == last {
+			continue
+		}
+		dst[i] = amount * amounts[i] / base
+		remaining -= dst[i]
+	}
+	dst[last] = remaining
+}
+
+// computeTaxes agrupa las líneas por la regla que les corresponde según su clase de
+// impuesto y la región, y calcula el impuesto de cada grupo sobre el monto ya descontado.
+// Redondear por grupo y no por línea evita acumular diferencias de centavos.
+func computeTaxes(rules []models.TaxRule, region string, items []models.CartItem, products map[string]models.Product, amounts, discounts []int64) []models.TaxLine {
+	var lines []models.TaxLine
+	matched := make(map[string]models.TaxRule)
+	index := make(map[string]int)
+	for i, item := range items {
+		rule, ok := models.FindTaxRule(rules, products[item.ProductID].EffectiveTaxClass(), region)
+		if !ok {
+			continue
+		}
+		j, seen := index[rule.ID]
+		if !seen {
+			j = len(lines)
+			index[rule.ID], matched[rule.ID] = j, rule
+			lines = append(lines, models.TaxLine{
+				RuleID:    rule.ID,
+				Name:      rule.Name,
+				TaxClass:  rule.TaxClass,
+				Region:    region,
+				Rate:      rule.Rate,
+				Inclusive: rule.Inclusive,
+				Taxable:   models.NewMoney(0),
+			})
+		}
+		lines[j].Taxable = lines[j].Taxable.Add(models.NewMoney(amounts[i] - discounts[i]))
+	}
+	for j := range lines {
+		lines[j].Amount = matched[lines[j].RuleID].Compute(lines[j].Taxable)
+	}
+	return lines
+}
+
+// categoryDescendants devuelve los IDs de las categorías indicadas y de todas sus descendientes.
+func categoryDescendants(all []models.Category, roots []string) map[string]bool {
+	children := make(map[string][]string)
+	for _, c := range all {
+		children[c.ParentID] = append(children[c.ParentID], c.ID)
+	}
+	result := make(map[string]bool)
+	pending := append([]string(nil), roots...)
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if result[id] {
+			continue
+		}
+		result[id] = true
+		pending = append(pending, children[id]...)
+	}
+	return result
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+	"tienda/models"
+)
+
+func TestAllocateDiscount(t *testing.T) {
+	tests := []struct {
+		name     string
+		amounts  []int64
+		eligible []bool
+		discount int64
+		want     []int64
+	}{
+		{name: "proporcional", amounts: []int64{1000, 3000}, eligible: []bool{true, true}, discount: 400, want: []int64{100, 300}},
+		{name: "el resto va a la última elegible", amounts: []int64{1000, 1000, 1000}, eligible: []bool{true, true, true}, discount: 100, want: []int64{33, 33, 34}},
+		{name: "solo líneas elegibles", amounts: []int64{1000, 2000, 500}, eligible: []bool{false, true, false}, discount: 250, want: []int64{0, 250, 0}},
+		{name: "sin líneas elegibles", amounts: []int64{1000}, eligible: []bool{false}, discount: 100, want: []int64{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]int64, len(tt.amounts))
+			allocateDiscount(got, tt.amounts, tt.eligible, tt.discount)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("allocateDiscount() = %v, se esperaba %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeTaxes(t *testing.T) {
+	products := map[string]models.Product{
+		"camisa": {ID: "camisa"},
+		"libro":  {ID: "libro", TaxClass: "books"},
+		"pan":    {ID: "pan", TaxClass: "food"},
+	}
+	rules := []models.TaxRule{
+		{ID: "iva", Name: "IVA", TaxClass: "standard", Rate: 1500},
+		{ID: "iva-libros", Name: "IVA libros", TaxClass: "books", Region: "EC", Rate: 500},
+		{ID: "vat", Name: "VAT", TaxClass: "standard", Region: "GB", Rate: 2000, Inclusive: true},
+	}
+	tests := []struct {
+		name      string
+		region    string
+		items     []string // Productos de cada línea.
+		amounts   []int64
+		discounts []int64
+		want      map[string][2]int64 // Regla -> base imponible e impuesto.
+	}{
+		{
+			name:    "una regla por clase",
+			region:  "EC",
+			items:   []string{"camisa", "libro", "pan"},
+			amounts: []int64{10000, 2000, 300}, discounts: []int64{0, 0, 0},
+			want: map[string][2]int64{"iva": {10000, 1500}, "iva-libros": {2000, 100}},
+		},
+		{
+			name:    "se redondea por grupo y no por línea",
+			region:  "EC",
+			items:   []string{"camisa", "camisa", "camisa"},
+			amounts: []int64{333, 333, 333}, discounts: []int64{0, 0, 0},
+			want: map[string][2]int64{"iva": {999, 150}},
+		},
+		{
+			name:    "la base descuenta el cupón",
+			region:  "EC",
+			items:   []string{"camisa", "libro"},
+			amounts: []int64{10000, 2000}, discounts: []int64{1000, 200},
+			want: map[string][2]int64{"iva": {9000, 1350}, "iva-libros": {1800, 90}},
+		},
+		{
+			name:    "impuesto incluido y regla más específica",
+			region:  "GB",
+			items:   []string{"camisa", "libro"},
+			amounts: []int64{12000, 2000}, discounts: []int64{0, 0},
+			want: map[string][2]int64{"vat": {12000, 2000}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := make([]models.CartItem, len(tt.items))
+			for i, id := range tt.items {
+				items[i] = models.CartItem{ProductID: id, Quantity: 1}
+			}
+			lines := computeTaxes(rules, tt.region, items, products, tt.amounts, tt.discounts)
+			got := make(map[string][2]int64)
+			for _, line := range lines {
+				got[line.RuleID] = [2]int64{line.Taxable.Amount, line.Amount.Amount}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("computeTaxes() = %v, se esperaba %v", got, tt.want)
+			}
+			for id, want := range tt.want {
+				if got[id] != want {
+					t.Errorf("regla %s: base e impuesto = %v, se esperaba %v", id, got[id], want)
+				}
+			}
+		})
+	}
+}
@@ -2,7 +2,12 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"tienda/models"
 	"tienda/storage"
 
@@ -11,32 +16,106 @@ import (
 
 // ProductHandlers maneja la lógica de productos.
 type ProductHandlers struct {
-	store storage.ProductStorer
+	store         storage.ProductStorer
+	categoryStore storage.CategoryStorer
+	blobs         storage.BlobStore // Para borrar las imágenes de los productos eliminados.
 }
 
 // NewProductHandlers es el constructor para los handlers de producto.
-func NewProductHandlers(s storage.ProductStorer) *ProductHandlers {
-	return &ProductHandlers{store: s}
+func NewProductHandlers(s storage.ProductStorer, cs storage.CategoryStorer, blobs storage.BlobStore) *ProductHandlers {
+	return &ProductHandlers{store: s, categoryStore: cs, blobs: blobs}
 }
 
-// GetProductsHandler obtiene todos los productos.
+// GetProductsHandler busca productos con filtros, orden y paginación.
+// Responde { products, total, page, limit }.
 func (h *ProductHandlers) GetProductsHandler(w http.ResponseWriter, r *http.Request) {
-	products, err := h.store.GetProducts()
+	filter, page, limit, err := parseProductFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// La categoría se acepta por ID o por slug; el filtro incluye sus subcategorías.
+	if filter.Category != "" {
+		category, err := findCategory(r, h.categoryStore, filter.Category)
+		if err != nil {
+			http.Error(w, "Categoría no encontrada", http.StatusBadRequest)
+			return
+		}
+		filter.Category = category.ID
+	}
+	products, total, err := h.store.QueryProducts(r.Context(), filter)
 	if err != nil {
 		http.Error(w, "Error interno al obtener productos", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"products": products,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+// parseProductFilter lee los parámetros q, category, minPrice, maxPrice, inStock, sort, order, page y limit.
+func parseProductFilter(r *http.Request) (storage.ProductFilter, int, int, error) {
+	q := r.URL.Query()
+	filter := storage.ProductFilter{Query: strings.TrimSpace(q.Get("q")), Category: q.Get("category"), Sort: storage.SortByName}
+	var err error
+	if filter.MinPrice, err = parsePriceParam(q.Get("minPrice")); err != nil {
+		return filter, 0, 0, errors.New("parámetro 'minPrice' inválido")
+	}
+	if filter.MaxPrice, err = parsePriceParam(q.Get("maxPrice")); err != nil {
+		return filter, 0, 0, errors.New("parámetro 'maxPrice' inválido")
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && filter.MinPrice.Amount > filter.MaxPrice.Amount {
+		return filter, 0, 0, errors.New("'minPrice' no puede ser mayor que 'maxPrice'")
+	}
+	if v := q.Get("inStock"); v != "" {
+		if filter.InStock, err = strconv.ParseBool(v); err != nil {
+			return filter, 0, 0, errors.New("parámetro 'inStock' inválido")
+		}
+	}
+	if v := q.Get("sort"); v != "" {
+		filter.Sort = storage.ProductSort(v)
+		if !filter.Sort.Valid() {
+			return filter, 0, 0, errors.New("parámetro 'sort' inválido (name, price o stock)")
+		}
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, 0, 0, errors.New("parámetro 'order' inválido (asc o desc)")
+	}
+	page, limit, err := parsePagination(r)
+	if err != nil {
+		return filter, 0, 0, err
+	}
+	filter.Offset, filter.Limit = (page-1)*limit, limit
+	return filter, page, limit, nil
+}
+
+// parsePriceParam interpreta un precio opcional de la URL; vacío significa sin límite.
+func parsePriceParam(value string) (*models.Money, error) {
+	if value == "" {
+		return nil, nil
+	}
+	price, err := models.ParseMoney(value, models.DefaultCurrency)
+	if err != nil || price.IsNegative() {
+		return nil, errors.New("precio inválido")
+	}
+	return &price, nil
 }
 
 // GetProductHandler obtiene un producto por su ID.
 func (h *ProductHandlers) GetProductHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	product, err := h.store.GetProductByID(id)
+	product, err := h.store.GetProductByID(r.Context(), id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeProductError(w, id, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -50,7 +129,14 @@ func (h *ProductHandlers) CreateProductHandler(w http.ResponseWriter, r *http.Re
 		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
 		return
 	}
-	createdProduct, err := h.store.CreateProduct(product)
+	if err := validateProduct(&product); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	createdProduct, err := h.store.CreateProduct(r.Context(), product)
+	if writeCatalogError(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error interno al crear el producto", http.StatusInternalServerError)
 		return
@@ -69,9 +155,13 @@ func (h *ProductHandlers) UpdateProductHandler(w http.ResponseWriter, r *http.Re
 		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
 		return
 	}
-	updatedProduct, err := h.store.UpdateProduct(id, product)
+	if err := validateProduct(&product); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updatedProduct, err := h.store.UpdateProduct(r.Context(), id, product)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeProductError(w, id, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -82,10 +172,16 @@ func (h *ProductHandlers) UpdateProductHandler(w http.ResponseWriter, r *http.Re
 func (h *ProductHandlers) DeleteProductHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	if err := h.store.DeleteProduct(id); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	product, err := h.store.GetProductByID(r.Context(), id)
+	if err != nil {
+		writeProductError(w, id, err)
 		return
 	}
+	if err := h.store.DeleteProduct(r.Context(), id); err != nil {
+		writeProductError(w, id, err)
+		return
+	}
+	deleteImageBlobs(r.Context(), h.blobs, product.Images)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -96,7 +192,16 @@ func (h *ProductHandlers) CreateProductsBatchHandler(w http.ResponseWriter, r *h
 		http.Error(w, "Datos inválidos, el formato JSON del array es incorrecto", http.StatusBadRequest)
 		return
 	}
-	createdProducts, err := h.store.CreateBatchProducts(newProducts)
+	for i := range newProducts {
+		if err := validateProduct(&newProducts[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	createdProducts, err := h.store.CreateBatchProducts(r.Context(), newProducts)
+	if writeCatalogError(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error interno del servidor al crear productos", http.StatusInternalServerError)
 		return
@@ -105,3 +210,62 @@ func (h *ProductHandlers) CreateProductsBatchHandler(w http.ResponseWriter, r *h
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(createdProducts)
 }
+
+// validateProduct exige SKU en cada variante y que precio y stock no sean negativos.
+// También normaliza la clase de impuesto, que por defecto es la estándar, y rechaza pesos negativos.
+func validateProduct(p *models.Product) error {
+	p.TaxClass = strings.ToLower(strings.TrimSpace(p.TaxClass))
+	if p.TaxClass == "" {
+		p.TaxClass = models.DefaultTaxClass
+	}
+	if !models.ValidSlug(p.TaxClass) {
+		return errors.New("taxClass inválida: use minúsculas, números y guiones")
+	}
+	if p.WeightGrams < 0 {
+		return errors.New("weightGrams no puede ser negativo")
+	}
+	if p.Price.IsNegative() {
+		return errors.New("el precio no puede ser negativo")
+	}
+	if p.Stock < 0 {
+		return errors.New("el stock no puede ser negativo")
+	}
+	for _, v := range p.Variants {
+		if strings.TrimSpace(v.SKU) == "" {
+			return errors.New("cada variante debe tener un SKU")
+		}
+		if v.Stock < 0 {
+			return fmt.Errorf("la variante %s tiene stock negativo", v.SKU)
+		}
+		if v.Price != nil && v.Price.IsNegative() {
+			return fmt.Errorf("la variante %s tiene precio negativo", v.SKU)
+		}
+	}
+	return nil
+}
+
+// writeCatalogError responde a los errores de validación del almacén de productos.
+// Devuelve false si el error no es de ese tipo y el llamador debe manejarlo.
+func writeCatalogError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, storage.ErrCategoryNotFound):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrDuplicateSKU):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		return false
+	}
+	return true
+}
+
+// writeProductError traduce los errores del almacén al leer o modificar un producto.
+func writeProductError(w http.ResponseWriter, id string, err error) {
+	switch {
+	case writeCatalogError(w, err):
+	case errors.Is(err, storage.ErrProductNotFound):
+		http.Error(w, "Producto no encontrado", http.StatusNotFound)
+	default:
+		log.Printf("Error al procesar el producto %s: %v", id, err)
+		http.Error(w, "Error interno al procesar el producto", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tienda/models"
+	"tienda/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidateProduct(t *testing.T) {
+	negative := models.NewMoney(-100)
+	tests := []struct {
+		name    string
+		product models.Product
+		wantErr bool
+	}{
+		{name: "válido", product: models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: 3}},
+		{name: "precio negativo", product: models.Product{Name: "Taza", Price: models.NewMoney(-500), Stock: 3}, wantErr: true},
+		{name: "stock negativo", product: models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: -1}, wantErr: true},
+		{name: "peso negativo", product: models.Product{Name: "Taza", Price: models.NewMoney(500), WeightGrams: -1}, wantErr: true},
+		{name: "variante sin SKU", product: models.Product{Name: "Taza", Price: models.NewMoney(500), Variants: []models.ProductVariant{{Stock: 1}}}, wantErr: true},
+		{name: "variante con precio negativo", product: models.Product{Name: "Taza", Price: models.NewMoney(500), Variants: []models.ProductVariant{{SKU: "T-1", Price: &negative}}}, wantErr: true},
+		{name: "variante con stock negativo", product: models.Product{Name: "Taza", Price: models.NewMoney(500), Variants: []models.ProductVariant{{SKU: "T-1", Stock: -1}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateProduct(&tt.product); (err != nil) != tt.wantErr {
+				t.Errorf("validateProduct() = %v, se esperaba error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMissingProduct(t *testing.T) {
+	for _, backend := range testBackends {
+		store := backend.open(t)
+		h := NewProductHandlers(store, store, nil)
+		tests := []struct {
+			method  string
+			body    string
+			handler http.HandlerFunc
+		}{
+			{method: http.MethodGet, handler: h.GetProductHandler},
+			{method: http.MethodPut, body: `{"name":"Taza","price":5}`, handler: h.UpdateProductHandler},
+			{method: http.MethodDelete, handler: h.DeleteProductHandler},
+		}
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.method, func(t *testing.T) {
+				req := httptest.NewRequest(tt.method, "/api/products/nada", strings.NewReader(tt.body))
+				req = mux.SetURLVars(req, map[string]string{"id": "nada"})
+				rec := httptest.NewRecorder()
+				tt.handler(rec, req)
+				if rec.Code != http.StatusNotFound {
+					t.Errorf("código = %d, se esperaba %d: %s", rec.Code, http.StatusNotFound, rec.Body)
+				}
+			})
+		}
+		ctx := context.Background()
+		if _, err := store.UpdateProduct(ctx, "nada", models.Product{Name: "Taza"}); !errors.Is(err, storage.ErrProductNotFound) {
+			t.Errorf("%s: UpdateProduct() = %v, se esperaba ErrProductNotFound", backend.name, err)
+		}
+		if err := store.DeleteProduct(ctx, "nada"); !errors.Is(err, storage.ErrProductNotFound) {
+			t.Errorf("%s: DeleteProduct() = %v, se esperaba ErrProductNotFound", backend.name, err)
+		}
+	}
+}
@@ -8,45 +8,82 @@ import (
 	"tienda/storage"
 )
 
-// ReportHandlers depende del almacén de órdenes y productos.
+// ReportHandlers depende del almacén de órdenes, productos y carritos.
 type ReportHandlers struct {
 	orderStore   storage.OrderStorer
 	productStore storage.ProductStorer
+	cartStore    storage.CartStorer
 }
 
 // NewReportHandlers es el constructor para los handlers de reporte.
-func NewReportHandlers(os storage.OrderStorer, ps storage.ProductStorer) *ReportHandlers {
-	return &ReportHandlers{orderStore: os, productStore: ps}
+func NewReportHandlers(os storage.OrderStorer, ps storage.ProductStorer, cs storage.CartStorer) *ReportHandlers {
+	return &ReportHandlers{orderStore: os, productStore: ps, cartStore: cs}
 }
 
 // TopSellingHandler genera el reporte de los productos más vendidos.
 func (h *ReportHandlers) TopSellingHandler(w http.ResponseWriter, r *http.Request) {
 	// Lee del historial de órdenes completadas.
-	orders, err := h.orderStore.GetAllOrders()
+	orders, err := h.orderStore.GetAllOrders(r.Context())
 	if err != nil {
 		http.Error(w, "Error al obtener órdenes", http.StatusInternalServerError)
 		return
 	}
-	// Agrega las cantidades de cada producto vendido.
+	// Agrega las cantidades vendidas por variante y por producto.
+	// Las unidades devueltas y reembolsadas se descuentan de las vendidas.
 	productCounts := make(map[string]int)
+	returnedCounts := make(map[string]int)
+	variantCounts := make(map[string]map[string]int) // productID -> variantID -> cantidad.
 	for _, order := range orders {
+		// Las órdenes canceladas o reembolsadas no cuentan como ventas.
+		if order.Status == models.OrderCancelled || order.Status == models.OrderRefunded {
+			continue
+		}
 		for _, item := range order.Items {
-			productCounts[item.ProductID] += item.Quantity
+			sold := item.Quantity - item.Returned
+			returnedCounts[item.ProductID] += item.Returned
+			if sold <= 0 {
+				continue
+			}
+			productCounts[item.ProductID] += sold
+			if item.VariantID != "" {
+				if variantCounts[item.ProductID] == nil {
+					variantCounts[item.ProductID] = make(map[string]int)
+				}
+				variantCounts[item.ProductID][item.VariantID] += sold
+			}
 		}
 	}
+	type VariantReportItem struct {
+		VariantID string            `json:"variantId"`
+		SKU       string            `json:"sku,omitempty"`
+		Options   map[string]string `json:"options,omitempty"`
+		Quantity  int               `json:"quantity_sold"`
+	}
 	type ReportItem struct {
-		Product  models.Product `json:"product"`
-		Quantity int            `json:"quantity_sold"`
+		Product  models.Product      `json:"product"`
+		Quantity int                 `json:"quantity_sold"`
+		Returned int                 `json:"quantity_returned,omitempty"`
+		Variants []VariantReportItem `json:"variants,omitempty"` // Desglose de la cantidad del producto.
 	}
 	reportData := make([]ReportItem, 0, len(productCounts))
-	// Enriquece el reporte con los datos de cada producto.
+	// Enriquece el reporte con los datos de cada producto y variante.
 	for productID, quantity := range productCounts {
-		if product, err := h.productStore.GetProductByID(productID); err == nil {
-			reportData = append(reportData, ReportItem{
-				Product:  product,
-				Quantity: quantity,
-			})
+		product, err := h.productStore.GetProductByID(r.Context(), productID)
+		if err != nil {
+			continue
+		}
+		item := ReportItem{Product: product, Quantity: quantity, Returned: returnedCounts[productID]}
+		for variantID, variantQuantity := range variantCounts[productID] {
+			line := VariantReportItem{VariantID: variantID, Quantity: variantQuantity}
+			if variant, ok := product.Variant(variantID); ok {
+				line.SKU, line.Options = variant.SKU, variant.Options
+			}
+			item.Variants = append(item.Variants, line)
 		}
+		sort.Slice(item.Variants, func(i, j int) bool {
+			return item.Variants[i].Quantity > item.Variants[j].Quantity
+		})
+		reportData = append(reportData, item)
 	}
 	// Ordena el reporte de más a menos vendido.
 	sort.Slice(reportData, func(i, j int) bool {
@@ -56,3 +93,60 @@ func (h *ReportHandlers) TopSellingHandler(w http.ResponseWriter, r *http.Reques
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(reportData)
 }
+
+// AbandonedCartsHandler resume los carritos de invitado que expiraron sin comprarse:
+// cuántos fueron, cuánto sumaban y qué productos quedaron en ellos, de más a menos
+// unidades. Con from y to (RFC 3339 o AAAA-MM-DD) se limita a los que expiraron en ese rango.
+func (h *ReportHandlers) AbandonedCartsHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := parseDateParam(r.URL.Query().Get("from"), false)
+	if err != nil {
+		http.Error(w, "parámetro 'from' inválido", http.StatusBadRequest)
+		return
+	}
+	to, err := parseDateParam(r.URL.Query().Get("to"), true)
+	if err != nil {
+		http.Error(w, "parámetro 'to' inválido", http.StatusBadRequest)
+		return
+	}
+	carts, err := h.cartStore.QueryAbandonedCarts(r.Context(), from, to)
+	if err != nil {
+		http.Error(w, "Error al obtener los carritos abandonados", http.StatusInternalServerError)
+		return
+	}
+	type ProductReportItem struct {
+		ProductID string       `json:"productId"`
+		Name      string       `json:"name,omitempty"` // Vacío si el producto ya no existe.
+		Quantity  int          `json:"quantity_abandoned"`
+		Value     models.Money `json:"value"`
+	}
+	value := models.NewMoney(0)
+	byProduct := make(map[string]*ProductReportItem)
+	for _, cart := range carts {
+		value = value.Add(cart.Subtotal)
+		for _, item := range cart.Items {
+			line, ok := byProduct[item.ProductID]
+			if !ok {
+				line = &ProductReportItem{ProductID: item.ProductID, Value: models.NewMoney(0)}
+				byProduct[item.ProductID] = line
+			}
+			line.Quantity += item.Quantity
+			line.Value = line.Value.Add(item.Price.Mul(item.Quantity))
+		}
+	}
+	products := make([]ProductReportItem, 0, len(byProduct))
+	for _, line := range byProduct {
+		if product, err := h.productStore.GetProductByID(r.Context(), line.ProductID); err == nil {
+			line.Name = product.Name
+		}
+		products = append(products, *line)
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return products[i].Quantity > products[j].Quantity
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":    len(carts),
+		"value":    value,
+		"products": products,
+	})
+}
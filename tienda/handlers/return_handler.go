@@ -0,0 +1,502 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"tienda/models"
+	"tienda/payment"
+	"tienda/storage"
+	"tienda/utils"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ReturnHandlers maneja las devoluciones: el cliente las solicita y el personal las
+// aprueba o rechaza, registra la recepción de la mercancía y emite el reembolso.
+type ReturnHandlers struct {
+	tx          storage.Transactor
+	returnStore storage.ReturnStorer
+	orderStore  storage.OrderStorer
+	payments    paymentProcessor
+}
+
+// NewReturnHandlers es el constructor para los handlers de devoluciones.
+func NewReturnHandlers(tx storage.Transactor, rs storage.ReturnStorer, os storage.OrderStorer, provider payment.Provider) *ReturnHandlers {
+	return &ReturnHandlers{tx: tx, returnStore: rs, orderStore: os, payments: paymentProcessor{provider: provider}}
+}
+
+// errOrderNotReturnable indica que la orden todavía no se entregó o ya se reembolsó.
+var errOrderNotReturnable = errors.New("solo se pueden devolver órdenes entregadas")
+
+// returnItemError describe una línea de la solicitud que no se puede devolver o un monto
+// de reembolso fuera de rango.
+type returnItemError struct {
+	message string
+}
+
+func (e *returnItemError) Error() string { return e.message }
+
+// RequestReturnHandler registra una solicitud de devolución de líneas de una orden entregada.
+// Solo el dueño de la orden (o el personal) puede solicitarla.
+func (h *ReturnHandlers) RequestReturnHandler(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Items []struct {
+			ProductID string `json:"productId"`
+			VariantID string `json:"variantId"`
+			Quantity  int    `json:"quantity"`
+		} `json:"items"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "Indique el motivo de la devolución", http.StatusBadRequest)
+		return
+	}
+	if len(req.Items) == 0 {
+		http.Error(w, "Indique las líneas a devolver", http.StatusBadRequest)
+		return
+	}
+	order, err := h.orderStore.GetOrderByID(r.Context(), orderID)
+	if err != nil {
+		http.Error(w, "Orden no encontrada", http.StatusNotFound)
+		return
+	}
+	if order.UserID != user.ID && !utils.HasPermission(user.Role, utils.PermOrdersManage) {
+		http.Error(w, "No tienes permisos sobre esta orden", http.StatusForbidden)
+		return
+	}
+
+	var created models.Return
+	err = h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		// La orden y las devoluciones abiertas se leen dentro de la transacción para que
+		// dos solicitudes simultáneas no devuelvan más unidades de las compradas.
+		order, err := tx.GetOrderByID(r.Context(), orderID)
+		if err != nil {
+			return err
+		}
+		if order.Status != models.OrderDelivered {
+			return errOrderNotReturnable
+		}
+		open, _, err := tx.QueryReturns(r.Context(), storage.ReturnFilter{OrderID: orderID})
+		if err != nil {
+			return err
+		}
+		pending := make([]int, len(order.Items)) // Unidades de cada línea en devoluciones abiertas.
+		for _, ret := range open {
+			if !ret.Status.Open() {
+				continue
+			}
+			for _, item := range ret.Items {
+				if i := order.OrderItemIndex(item.ProductID, item.VariantID); i >= 0 {
+					pending[i] += item.Quantity
+				}
+			}
+		}
+		ret := models.Return{OrderID: orderID, UserID: order.UserID, Reason: req.Reason}
+		for _, line := range req.Items {
+			i := order.OrderItemIndex(line.ProductID, line.VariantID)
+			if i < 0 {
+				return &returnItemError{fmt.Sprintf("la orden no incluye el producto %s", line.ProductID)}
+			}
+			item := order.Items[i]
+			available := item.Quantity - item.Returned - pending[i]
+			if line.Quantity <= 0 || line.Quantity > available {
+				return &returnItemError{fmt.Sprintf("cantidad inválida para %s: se pueden devolver %d", item.Name, available)}
+			}
+			pending[i] += line.Quantity
+			ret.Items = append(ret.Items, models.ReturnItem{
+				ProductID: item.ProductID,
+				VariantID: item.VariantID,
+				Name:      item.Name,
+				Quantity:  line.Quantity,
+				UnitPrice: item.UnitPrice,
+				Subtotal:  item.UnitPrice.Mul(line.Quantity),
+			})
+		}
+		created, err = tx.CreateReturn(r.Context(), ret)
+		return err
+	})
+	var itemErr *returnItemError
+	switch {
+	case errors.As(err, &itemErr):
+		http.Error(w, itemErr.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errOrderNotReturnable):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		writeReturnError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// GetOrderReturnsHandler lista las devoluciones de una orden (su dueño o el personal).
+func (h *ReturnHandlers) GetOrderReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	order, err := h.orderStore.GetOrderByID(r.Context(), orderID)
+	if err != nil {
+		http.Error(w, "Orden no encontrada", http.StatusNotFound)
+		return
+	}
+	if order.UserID != user.ID && !utils.HasPermission(user.Role, utils.PermOrdersManage) {
+		http.Error(w, "No tienes permisos sobre esta orden", http.StatusForbidden)
+		return
+	}
+	returns, _, err := h.returnStore.QueryReturns(r.Context(), storage.ReturnFilter{OrderID: orderID})
+	if err != nil {
+		http.Error(w, "Error al obtener las devoluciones", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(returns)
+}
+
+// GetMyReturnsHandler devuelve las devoluciones del usuario autenticado.
+func (h *ReturnHandlers) GetMyReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	filter, page, limit, err := parseReturnFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserID = user.ID // Un cliente solo ve sus propias devoluciones.
+	h.writeReturnPage(w, r, filter, page, limit)
+}
+
+// GetReturnsHandler lista todas las devoluciones con filtros por estado, usuario y orden (personal autorizado).
+func (h *ReturnHandlers) GetReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, page, limit, err := parseReturnFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserID = r.URL.Query().Get("userId")
+	filter.OrderID = r.URL.Query().Get("orderId")
+	h.writeReturnPage(w, r, filter, page, limit)
+}
+
+// GetReturnHandler obtiene una devolución; solo el dueño de la orden o el personal pueden verla.
+func (h *ReturnHandlers) GetReturnHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	ret, err := h.returnStore.GetReturnByID(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeReturnError(w, err)
+		return
+	}
+	if ret.UserID != user.ID && !utils.HasPermission(user.Role, utils.PermOrdersManage) {
+		http.Error(w, "No tienes permisos sobre esta devolución", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// ApproveReturnHandler acepta una devolución solicitada; la nota es opcional.
+func (h *ReturnHandlers) ApproveReturnHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Note string `json:"note"`
+	}
+	if !decodeOptionalBody(w, r, &req) {
+		return
+	}
+	h.update(w, r, func(tx storage.Storer, ret *models.Return) error {
+		ret.Status = models.ReturnApproved
+		ret.Note = strings.TrimSpace(req.Note)
+		return nil
+	})
+}
+
+// RejectReturnHandler rechaza una devolución en curso indicando el motivo en la nota.
+func (h *ReturnHandlers) RejectReturnHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Note string `json:"note"`
+	}
+	if !decodeOptionalBody(w, r, &req) {
+		return
+	}
+	if req.Note = strings.TrimSpace(req.Note); req.Note == "" {
+		http.Error(w, "Indique el motivo del rechazo en 'note'", http.StatusBadRequest)
+		return
+	}
+	h.update(w, r, func(tx storage.Storer, ret *models.Return) error {
+		ret.Status = models.ReturnRejected
+		ret.Note = req.Note
+		return nil
+	})
+}
+
+// ReceiveReturnHandler registra que la mercancía llegó. Con restock las unidades vuelven
+// al inventario en la misma transacción.
+func (h *ReturnHandlers) ReceiveReturnHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Restock bool `json:"restock"`
+	}
+	if !decodeOptionalBody(w, r, &req) {
+		return
+	}
+	h.update(w, r, func(tx storage.Storer, ret *models.Return) error {
+		ret.Status = models.ReturnReceived
+		if !req.Restock {
+			return nil
+		}
+		ret.Restocked = true
+		items := make([]models.CartItem, 0, len(ret.Items))
+		for _, item := range ret.Items {
+			items = append(items, models.CartItem{ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity, Price: item.UnitPrice})
+		}
+		return tx.RestockItems(r.Context(), items)
+	})
+}
+
+// RefundReturnHandler reembolsa una devolución recibida con el proveedor de pagos. Sin
+// amount se reembolsa lo que el cliente pagó por las líneas devueltas (ver
+// models.Order.ReturnValue), sin superar lo que queda por reembolsar en la orden; si con
+// ella se devuelven todas las unidades, se reembolsa todo lo pendiente.
+// Antes de llamar al proveedor la devolución pasa a refunding en una transacción, de modo
+// que una segunda petición concurrente recibe 409 en lugar de reembolsar otra vez; si el
+// proveedor falla vuelve a received. Si el reembolso se emite pero no se puede registrar, la
+// devolución queda en refunding y, al vencer, el reintento pide el mismo monto con la misma
+// clave de idempotencia, de modo que el proveedor no lo emite dos veces. Al terminar, las unidades se marcan como devueltas en
+// la orden, que pasa a refunded cuando se devolvieron todas.
+func (h *ReturnHandlers) RefundReturnHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req struct {
+		Amount *models.Money `json:"amount"`
+	}
+	if !decodeOptionalBody(w, r, &req) {
+		return
+	}
+	var (
+		ret    models.Return
+		order  models.Order
+		amount models.Money
+	)
+	now := time.Now()
+	err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		var err error
+		if ret, err = tx.GetReturnByID(r.Context(), id); err != nil {
+			return err
+		}
+		if ret.Refunding(now) {
+			return errRefundInProgress
+		}
+		// Un reembolso abandonado (refunding vencido) puede reintentarse.
+		if ret.Status != models.ReturnRefunding && !ret.Status.CanTransitionTo(models.ReturnRefunding) {
+			return fmt.Errorf("%w: de %s a %s", storage.ErrInvalidTransition, ret.Status, models.ReturnRefunded)
+		}
+		if order, err = tx.GetOrderByID(r.Context(), ret.OrderID); err != nil {
+			return err
+		}
+		if order.Busy(now) {
+			return fmt.Errorf("%w: hacia %s", storage.ErrOrderBusy, order.PendingStatus)
+		}
+		if err := checkRefundInProgress(r.Context(), tx, order.ID, now); err != nil {
+			return err
+		}
+		refundable := order.RefundableAmount()
+		if refundable.Amount <= 0 {
+			return errNothingToSettle
+		}
+		if ret.Status == models.ReturnRefunding && ret.Refunded.Amount > 0 {
+			// Se reintenta el mismo monto: si el proveedor ya lo había reembolsado, la misma
+			// clave de idempotencia devuelve ese reembolso en lugar de emitir otro.
+			amount = ret.Refunded
+		} else {
+			amount = order.ReturnValue(ret.Items)
+			if after := order; after.AddReturned(ret.Items) && after.FullyReturned() {
+				amount = refundable // La última devolución reembolsa también el envío y los redondeos.
+			}
+			if req.Amount != nil {
+				amount = *req.Amount
+				if amount.Amount <= 0 || amount.Amount > refundable.Amount {
+					return &returnItemError{fmt.Sprintf("El monto a reembolsar debe ser mayor que 0 y no superar %s", refundable)}
+				}
+			}
+			amount.Amount = min(amount.Amount, refundable.Amount)
+		}
+		ret.Status, ret.Refunded, ret.RefundUntil = models.ReturnRefunding, amount, now.Add(settlementTimeout)
+		ret, err = tx.UpdateReturn(r.Context(), id, ret)
+		return err
+	})
+	var itemErr *returnItemError
+	switch {
+	case errors.As(err, &itemErr):
+		http.Error(w, itemErr.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errNothingToSettle):
+		http.Error(w, "La orden no tiene cobros pendientes de reembolso", http.StatusConflict)
+		return
+	case err != nil:
+		writeReturnError(w, err)
+		return
+	}
+
+	attempt, refundErr := h.payments.refund(r.Context(), order, amount, settlementKey(order, "return-"+ret.ID))
+	if refundErr != nil {
+		// La devolución vuelve a received; el intento se registra aunque haya fallado, para
+		// dejar constancia en la orden.
+		err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+			if !errors.Is(refundErr, errNothingToSettle) {
+				if _, err := tx.RecordPayment(r.Context(), order.ID, attempt); err != nil {
+					return err
+				}
+			}
+			ret.Status, ret.Refunded, ret.RefundUntil = models.ReturnReceived, models.Money{}, time.Time{}
+			_, err := tx.UpdateReturn(r.Context(), id, ret)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error al liberar el reembolso de la devolución %s: %v", id, err)
+		}
+		if errors.Is(refundErr, errNothingToSettle) {
+			http.Error(w, "La orden no tiene cobros pendientes de reembolso", http.StatusConflict)
+			return
+		}
+		if decline, ok := payment.IsDecline(refundErr); ok {
+			http.Error(w, "El proveedor de pagos rechazó el reembolso: "+decline.Message, http.StatusConflict)
+			return
+		}
+		log.Printf("Error del proveedor de pagos con la orden %s: %v", order.ID, refundErr)
+		http.Error(w, "No se pudo contactar al proveedor de pagos, intente de nuevo", http.StatusBadGateway)
+		return
+	}
+
+	err = h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		if _, err := tx.RecordPayment(r.Context(), order.ID, attempt); err != nil {
+			return err
+		}
+		order, err := tx.RecordReturnedItems(r.Context(), ret.OrderID, ret.Items)
+		if err != nil {
+			return err
+		}
+		ret.Status, ret.Refunded, ret.RefundID, ret.RefundUntil = models.ReturnRefunded, amount, attempt.TransactionID, time.Time{}
+		if ret, err = tx.UpdateReturn(r.Context(), id, ret); err != nil {
+			return err
+		}
+		if order.FullyReturned() && order.Status.CanTransitionTo(models.OrderRefunded) {
+			_, err = tx.UpdateOrderStatus(r.Context(), order.ID, models.OrderRefunded)
+		}
+		return err
+	})
+	if err != nil {
+		// La devolución sigue en refunding; al vencer, el reintento pide el mismo monto con la
+		// misma clave de idempotencia (ver settlementKey) y el proveedor no lo repite.
+		log.Printf("Reembolso %s emitido pero no se pudo cerrar la devolución %s: %v", attempt.TransactionID, id, err)
+		writeReturnError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// update aplica fn a la devolución y la guarda en una transacción; UpdateReturn valida
+// el cambio de estado. Responde con la devolución actualizada.
+func (h *ReturnHandlers) update(w http.ResponseWriter, r *http.Request, fn func(tx storage.Storer, ret *models.Return) error) {
+	id := mux.Vars(r)["id"]
+	var updated models.Return
+	err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+		ret, err := tx.GetReturnByID(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx, &ret); err != nil {
+			return err
+		}
+		updated, err = tx.UpdateReturn(r.Context(), id, ret)
+		return err
+	})
+	if err != nil {
+		writeReturnError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// writeReturnPage consulta el almacén y responde con la página solicitada.
+func (h *ReturnHandlers) writeReturnPage(w http.ResponseWriter, r *http.Request, filter storage.ReturnFilter, page, limit int) {
+	returns, total, err := h.returnStore.QueryReturns(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Error al obtener las devoluciones", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"returns": returns,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+	})
+}
+
+// parseReturnFilter lee los parámetros status, page y limit de la URL.
+func parseReturnFilter(r *http.Request) (storage.ReturnFilter, int, int, error) {
+	var filter storage.ReturnFilter
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter.Status = models.ReturnStatus(status)
+		if !filter.Status.Valid() {
+			return filter, 0, 0, errors.New("estado de devolución inválido")
+		}
+	}
+	page, limit, err := parsePagination(r)
+	if err != nil {
+		return filter, 0, 0, err
+	}
+	filter.Offset, filter.Limit = (page-1)*limit, limit
+	return filter, page, limit, nil
+}
+
+// decodeOptionalBody lee un cuerpo JSON que puede omitirse. Si es inválido, ya escribió la respuesta.
+func decodeOptionalBody(w http.ResponseWriter, r *http.Request, dst any) bool {
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeReturnError traduce los errores del almacén de devoluciones a códigos HTTP.
+func writeReturnError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrReturnNotFound), errors.Is(err, storage.ErrOrderNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrInvalidTransition), errors.Is(err, storage.ErrReturnQuantity),
+		errors.Is(err, storage.ErrOrderBusy), errors.Is(err, errRefundInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Error al procesar la devolución: %v", err)
+		http.Error(w, "Error interno al procesar la devolución", http.StatusInternalServerError)
+	}
+}
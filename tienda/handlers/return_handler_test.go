@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tienda/models"
+	"tienda/payment"
+	"tienda/storage"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// createReturn registra una devolución de quantity unidades de la orden de createPaidOrder.
+func createReturn(t *testing.T, store storage.Storer, orderID string, quantity int, status models.ReturnStatus, refundUntil time.Time) models.Return {
+	t.Helper()
+	ret, err := store.CreateReturn(context.Background(), models.Return{
+		OrderID:     orderID,
+		Items:       []models.ReturnItem{{ProductID: "p1", Name: "Taza", Quantity: quantity, UnitPrice: models.NewMoney(1000), Subtotal: models.NewMoney(1000).Mul(quantity)}},
+		Reason:      "llegó rota",
+		Status:      status,
+		RefundUntil: refundUntil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// postRefund llama a POST /api/returns/{id}/refund y devuelve la respuesta.
+func postRefund(h *ReturnHandlers, id, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/returns/"+id+"/refund", strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	rec := httptest.NewRecorder()
+	h.RefundReturnHandler(rec, req)
+	return rec
+}
+
+func TestRefundReturn(t *testing.T) {
+	tests := []struct {
+		name        string
+		quantity    int
+		status      models.ReturnStatus
+		refundUntil time.Duration // Vencimiento de un reembolso en curso, relativo a ahora.
+		orderBusy   bool
+		body        string
+		providerErr error
+		wantCode    int
+		wantStatus  models.ReturnStatus
+		wantAmount  int64 // Reembolsado en la devolución.
+		wantOrder   models.OrderStatus
+		wantCalls   int32
+	}{
+		{name: "reembolso parcial", quantity: 1, status: models.ReturnReceived, wantCode: http.StatusOK, wantStatus: models.ReturnRefunded, wantAmount: 1000, wantOrder: models.OrderDelivered, wantCalls: 1},
+		{name: "la última devolución cierra la orden", quantity: 2, status: models.ReturnReceived, wantCode: http.StatusOK, wantStatus: models.ReturnRefunded, wantAmount: 2000, wantOrder: models.OrderRefunded, wantCalls: 1},
+		{name: "monto indicado", quantity: 1, status: models.ReturnReceived, body: `{"amount":5}`, wantCode: http.StatusOK, wantStatus: models.ReturnRefunded, wantAmount: 500, wantOrder: models.OrderDelivered, wantCalls: 1},
+		{name: "monto mayor que lo cobrado", quantity: 1, status: models.ReturnReceived, body: `{"amount":50}`, wantCode: http.StatusBadRequest, wantStatus: models.ReturnReceived, wantOrder: models.OrderDelivered},
+		{name: "mercancía sin recibir", quantity: 1, status: models.ReturnApproved, wantCode: http.StatusConflict, wantStatus: models.ReturnApproved, wantOrder: models.OrderDelivered},
+		{name: "reembolso en curso", quantity: 1, status: models.ReturnRefunding, refundUntil: time.Minute, wantCode: http.StatusConflict, wantStatus: models.ReturnRefunding, wantOrder: models.OrderDelivered},
+		{name: "reembolso abandonado se reintenta", quantity: 1, status: models.ReturnRefunding, refundUntil: -time.Minute, wantCode: http.StatusOK, wantStatus: models.ReturnRefunded, wantAmount: 1000, wantOrder: models.OrderDelivered, wantCalls: 1},
+		{name: "orden con otro cambio en curso", quantity: 1, status: models.ReturnReceived, orderBusy: true, wantCode: http.StatusConflict, wantStatus: models.ReturnReceived, wantOrder: models.OrderDelivered},
+		{name: "rechazo del proveedor", quantity: 1, status: models.ReturnReceived, providerErr: &payment.DeclineError{Code: "card_declined", Message: "rechazado"}, wantCode: http.StatusConflict, wantStatus: models.ReturnReceived, wantOrder: models.OrderDelivered, wantCalls: 1},
+		{name: "proveedor caído", quantity: 1, status: models.ReturnReceived, providerErr: errors.New("timeout"), wantCode: http.StatusBadGateway, wantStatus: models.ReturnReceived, wantOrder: models.OrderDelivered, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			provider := &testProvider{FakeProvider: payment.NewFakeProvider(nil), err: tt.providerErr}
+			h := NewReturnHandlers(store, store, store, provider)
+			order := createPaidOrder(t, store, models.OrderDelivered, true)
+			var refundUntil time.Time
+			if tt.refundUntil != 0 {
+				refundUntil = time.Now().Add(tt.refundUntil)
+			}
+			ret := createReturn(t, store, order.ID, tt.quantity, tt.status, refundUntil)
+			if tt.orderBusy {
+				if _, err := store.ClaimOrderStatus(ctx, order.ID, models.OrderRefunded, time.Now().Add(time.Minute)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := postRefund(h, ret.ID, tt.body)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("código = %d, se esperaba %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			got, err := store.GetReturnByID(ctx, ret.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.wantStatus || got.Refunded.Amount != tt.wantAmount {
+				t.Errorf("devolución %s con %d reembolsado, se esperaba %s con %d", got.Status, got.Refunded.Amount, tt.wantStatus, tt.wantAmount)
+			}
+			gotOrder, err := store.GetOrderByID(ctx, order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotOrder.Status != tt.wantOrder {
+				t.Errorf("orden %s, se esperaba %s", gotOrder.Status, tt.wantOrder)
+			}
+			if refunded := gotOrder.Total.Amount - gotOrder.RefundableAmount().Amount; refunded != tt.wantAmount {
+				t.Errorf("la orden registra %d reembolsado, se esperaba %d", refunded, tt.wantAmount)
+			}
+			if calls := provider.calls.Load(); calls != tt.wantCalls {
+				t.Errorf("llamadas al proveedor = %d, se esperaban %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRefundReturnRefundsOnce(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			provider := &testProvider{FakeProvider: payment.NewFakeProvider(nil), entered: make(chan struct{}), block: make(chan struct{})}
+			h := NewReturnHandlers(store, store, store, provider)
+			orders := NewOrderHandlers(store, store, provider)
+			order := createPaidOrder(t, store, models.OrderDelivered, true)
+			ret := createReturn(t, store, order.ID, 1, models.ReturnReceived, time.Time{})
+			other := createReturn(t, store, order.ID, 1, models.ReturnReceived, time.Time{})
+
+			// La primera petición queda esperando al proveedor con la devolución en refunding.
+			first := make(chan *httptest.ResponseRecorder)
+			go func() { first <- postRefund(h, ret.ID, "") }()
+			<-provider.entered
+			if rec := postRefund(h, ret.ID, ""); rec.Code != http.StatusConflict {
+				t.Errorf("misma devolución: código = %d, se esperaba 409: %s", rec.Code, rec.Body)
+			}
+			if rec := postRefund(h, other.ID, ""); rec.Code != http.StatusConflict {
+				t.Errorf("otra devolución de la orden: código = %d, se esperaba 409: %s", rec.Code, rec.Body)
+			}
+			if rec := putOrderStatus(orders, order.ID, models.OrderRefunded); rec.Code != http.StatusConflict {
+				t.Errorf("reembolso de la orden: código = %d, se esperaba 409: %s", rec.Code, rec.Body)
+			}
+			close(provider.block)
+			if rec := <-first; rec.Code != http.StatusOK {
+				t.Fatalf("primera petición: código = %d: %s", rec.Code, rec.Body)
+			}
+			if calls := provider.calls.Load(); calls != 1 {
+				t.Errorf("reembolsos emitidos = %d, se esperaba 1", calls)
+			}
+		})
+	}
+}
+
+func TestRefundReturnRetryAfterLostRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tienda.db")
+	store, err := storage.NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := createPaidOrder(t, store, models.OrderDelivered, true)
+	ret := createReturn(t, store, order.ID, 1, models.ReturnReceived, time.Time{})
+
+	// El proveedor reembolsa, pero el almacén falla antes de cerrar la devolución.
+	provider := &testProvider{FakeProvider: payment.NewFakeProvider(nil), onCall: func() { store.Close() }}
+	if rec := postRefund(NewReturnHandlers(store, store, store, provider), ret.ID, `{"amount":5}`); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("primera petición: código = %d, se esperaba 500: %s", rec.Code, rec.Body)
+	}
+
+	store, err = storage.NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// El reembolso en curso vence y otra petición lo reintenta, sin indicar el monto.
+	stale, err := store.GetReturnByID(ctx, ret.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.RefundUntil = time.Now().Add(-time.Minute)
+	if _, err := store.UpdateReturn(ctx, ret.ID, stale); err != nil {
+		t.Fatal(err)
+	}
+	provider.onCall = nil
+	rec := postRefund(NewReturnHandlers(store, store, store, provider), ret.ID, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reintento: código = %d: %s", rec.Code, rec.Body)
+	}
+	if len(provider.keys) != 2 || provider.keys[0] != provider.keys[1] {
+		t.Errorf("claves de idempotencia = %q, el reintento debe repetir la primera", provider.keys)
+	}
+	got, err := store.GetReturnByID(ctx, ret.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != models.ReturnRefunded || got.Refunded.Amount != 500 {
+		t.Errorf("devolución %s con %d reembolsado, se esperaba refunded con 500", got.Status, got.Refunded.Amount)
+	}
+}
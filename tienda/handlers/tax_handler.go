@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"tienda/models"
+	"tienda/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// TaxHandlers maneja la administración de las reglas de impuestos.
+type TaxHandlers struct {
+	store storage.TaxStorer
+}
+
+// NewTaxHandlers es el constructor para los handlers de impuestos.
+func NewTaxHandlers(s storage.TaxStorer) *TaxHandlers {
+	return &TaxHandlers{store: s}
+}
+
+// GetTaxRulesHandler devuelve todas las reglas, ordenadas por clase y región.
+func (h *TaxHandlers) GetTaxRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := h.store.GetTaxRules(r.Context())
+	if err != nil {
+		http.Error(w, "Error interno al obtener las reglas de impuestos", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// GetTaxRuleHandler obtiene una regla por su ID.
+func (h *TaxHandlers) GetTaxRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule, err := h.store.GetTaxRuleByID(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeTaxError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// CreateTaxRuleHandler crea una regla de impuesto.
+func (h *TaxHandlers) CreateTaxRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule, ok := decodeTaxRule(w, r)
+	if !ok {
+		return
+	}
+	created, err := h.store.CreateTaxRule(r.Context(), rule)
+	if err != nil {
+		writeTaxError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// UpdateTaxRuleHandler reemplaza una regla. Las órdenes ya creadas conservan su desglose.
+func (h *TaxHandlers) UpdateTaxRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule, ok := decodeTaxRule(w, r)
+	if !ok {
+		return
+	}
+	updated, err := h.store.UpdateTaxRule(r.Context(), mux.Vars(r)["id"], rule)
+	if err != nil {
+		writeTaxError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteTaxRuleHandler elimina una regla de impuesto.
+func (h *TaxHandlers) DeleteTaxRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if err := h.store.DeleteTaxRule(r.Context(), mux.Vars(r)["id"]); err != nil {
+		writeTaxError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeTaxRule lee y valida el cuerpo de la petición. Si falla, ya escribió la respuesta.
+func decodeTaxRule(w http.ResponseWriter, r *http.Request) (models.TaxRule, bool) {
+	var t models.TaxRule
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return models.TaxRule{}, false
+	}
+	t.Name = strings.TrimSpace(t.Name)
+	t.TaxClass = strings.ToLower(strings.TrimSpace(t.TaxClass))
+	if t.TaxClass == "" {
+		t.TaxClass = models.DefaultTaxClass
+	}
+	t.Region = models.NormalizeRegion(t.Region)
+	switch {
+	case t.Name == "":
+		http.Error(w, "El nombre del impuesto es obligatorio", http.StatusBadRequest)
+	case !models.ValidSlug(t.TaxClass):
+		http.Error(w, "taxClass inválida: use minúsculas, números y guiones", http.StatusBadRequest)
+	case t.Region != "" && !models.ValidRegion(t.Region):
+		http.Error(w, "Región inválida: use un código ISO como EC o US-CA, o déjela vacía", http.StatusBadRequest)
+	case t.Rate < 0 || t.Rate > 10000:
+		http.Error(w, "La tasa debe estar entre 0 y 100", http.StatusBadRequest)
+	default:
+		return t, true
+	}
+	return models.TaxRule{}, false
+}
+
+// writeTaxError traduce los errores del almacén de impuestos a códigos HTTP.
+func writeTaxError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrTaxRuleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrTaxRuleConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Error interno al procesar la regla de impuesto", http.StatusInternalServerError)
+	}
+}
@@ -1,38 +1,58 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"tienda/models"
 	"tienda/storage"
 	"tienda/utils"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 // UserHandlers maneja la lógica de usuarios.
 type UserHandlers struct {
-	store storage.UserStorer
+	tx             storage.Transactor
+	store          storage.UserStorer
+	refreshStore   storage.RefreshTokenStorer
+	tokens         *utils.TokenManager
+	reservationTTL time.Duration // Duración de las reservas de stock al fusionar carritos; 0 si no se reserva.
 }
 
 // NewUserHandlers es el constructor para los handlers de usuario.
-func NewUserHandlers(s storage.UserStorer) *UserHandlers {
-	return &UserHandlers{store: s}
+func NewUserHandlers(tx storage.Transactor, s storage.UserStorer, rs storage.RefreshTokenStorer, tm *utils.TokenManager, reservationTTL time.Duration) *UserHandlers {
+	return &UserHandlers{tx: tx, store: s, refreshStore: rs, tokens: tm, reservationTTL: reservationTTL}
 }
 
 // RegisterHandler crea nuevas cuentas de usuario.
 func (h *UserHandlers) RegisterHandler(w http.ResponseWriter, r *http.Request) {
-	var user models.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	// models.User oculta la contraseña en JSON, por eso se decodifica en una estructura propia.
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
 		return
 	}
+	if req.Username == "" || req.Password == "" {
+		http.Error(w, "El usuario y la contraseña son obligatorios", http.StatusBadRequest)
+		return
+	}
 	// Hashear la contraseña antes de guardarla.
-	hashedPassword, err := utils.HashPassword(user.Password)
+	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
 		http.Error(w, "Error al procesar la contraseña", http.StatusInternalServerError)
 		return
 	}
-	user.Password = hashedPassword
-	createdUser, err := h.store.CreateUser(user)
+	// Los registros públicos siempre crean clientes; los roles se asignan por un administrador.
+	user := models.User{Username: req.Username, Password: hashedPassword, Role: models.RoleCustomer}
+	createdUser, err := h.store.CreateUser(r.Context(), user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusConflict) // Usuario ya existe.
 		return
@@ -43,21 +63,176 @@ func (h *UserHandlers) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(createdUser)
 }
 
-// LoginHandler verifica las credenciales de un usuario.
+// LoginHandler verifica las credenciales de un usuario y emite un token de acceso.
+// Si se envía el ID de un carrito de invitado, se fusiona con el carrito del usuario.
 func (h *UserHandlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var credentials struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		CartID   string `json:"cartId"` // Carrito de invitado opcional.
 	}
 	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
 		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
 		return
 	}
-	user, err := h.store.GetUserByUsername(credentials.Username)
+	user, err := h.store.GetUserByUsername(r.Context(), credentials.Username)
 	if err != nil || !utils.CheckPasswordHash(credentials.Password, user.Password) {
 		http.Error(w, "Credenciales incorrectas", http.StatusUnauthorized)
 		return
 	}
+	// Cada inicio de sesión abre una nueva familia de tokens de refresco.
+	response, err := h.issueTokens(r.Context(), user, uuid.NewString())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response["message"] = "Inicio de sesión exitoso"
+	if credentials.CartID != "" {
+		// Un carrito de invitado inválido no impide iniciar sesión.
+		var cart models.Cart
+		err := h.tx.WithTx(r.Context(), func(tx storage.Storer) error {
+			var err error
+			cart, err = mergeGuestCart(r.Context(), tx, credentials.CartID, user.ID, h.reservationTTL)
+			return err
+		})
+		if err == nil {
+			response["cartId"] = cart.ID
+		} else {
+			log.Printf("No se pudo fusionar el carrito %s: %v", credentials.CartID, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RefreshHandler canjea un token de refresco por un nuevo par de tokens (rotación).
+// Si se presenta un token ya usado, se revoca toda su familia.
+func (h *UserHandlers) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return
+	}
+	old, err := h.refreshStore.ConsumeRefreshToken(r.Context(), utils.HashRefreshToken(req.RefreshToken))
+	if errors.Is(err, storage.ErrRefreshTokenReused) {
+		// Posible robo del token: se invalidan todas las sesiones derivadas.
+		if revokeErr := h.refreshStore.RevokeRefreshTokenFamily(r.Context(), old.FamilyID); revokeErr != nil {
+			log.Printf("Error al revocar la familia de tokens %s: %v", old.FamilyID, revokeErr)
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	user, err := h.store.GetUserByID(r.Context(), old.UserID)
+	if err != nil {
+		http.Error(w, "Usuario no encontrado", http.StatusUnauthorized)
+		return
+	}
+	response, err := h.issueTokens(r.Context(), user, old.FamilyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response["message"] = "Token renovado"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// LogoutHandler revoca el token de refresco presentado y toda su familia.
+func (h *UserHandlers) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return
+	}
+	token, err := h.refreshStore.ConsumeRefreshToken(r.Context(), utils.HashRefreshToken(req.RefreshToken))
+	if errors.Is(err, storage.ErrRefreshTokenNotFound) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	// Un token usado o expirado aún identifica a su familia, que se revoca igualmente.
+	if err := h.refreshStore.RevokeRefreshTokenFamily(r.Context(), token.FamilyID); err != nil {
+		http.Error(w, "Error al cerrar la sesión", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// issueTokens emite un token de acceso y uno de refresco dentro de la familia indicada
+// y devuelve el cuerpo de respuesta correspondiente.
+func (h *UserHandlers) issueTokens(ctx context.Context, user models.User, familyID string) (map[string]interface{}, error) {
+	accessToken, expiresAt, err := h.tokens.GenerateAccessToken(user)
+	if err != nil {
+		return nil, errors.New("error al generar el token de acceso")
+	}
+	refreshToken, refreshHash, refreshExpiresAt, err := h.tokens.NewRefreshToken()
+	if err != nil {
+		return nil, errors.New("error al generar el token de refresco")
+	}
+	err = h.refreshStore.SaveRefreshToken(ctx, models.RefreshToken{
+		TokenHash: refreshHash,
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		ExpiresAt: refreshExpiresAt,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, errors.New("error al guardar el token de refresco")
+	}
+	return map[string]interface{}{
+		"accessToken":      accessToken,
+		"tokenType":        "Bearer",
+		"expiresAt":        expiresAt,
+		"refreshToken":     refreshToken,
+		"refreshExpiresAt": refreshExpiresAt,
+	}, nil
+}
+
+// MeHandler devuelve el perfil del usuario autenticado.
+func (h *UserHandlers) MeHandler(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.store.GetUserByUsername(r.Context(), authUser.Username)
+	if err != nil || user.ID != authUser.ID {
+		http.Error(w, "Usuario no encontrado", http.StatusNotFound)
+		return
+	}
+	user.Password = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// UpdateUserRoleHandler cambia el rol de un usuario (solo administradores).
+func (h *UserHandlers) UpdateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	var req struct {
+		Role models.Role `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+		return
+	}
+	if !req.Role.Valid() {
+		http.Error(w, "Rol inválido", http.StatusBadRequest)
+		return
+	}
+	updatedUser, err := h.store.UpdateUserRole(r.Context(), id, req.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	updatedUser.Password = ""
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Inicio de sesión exitoso"})
+	json.NewEncoder(w).Encode(updatedUser)
 }
@@ -1,50 +1,257 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"tienda/handlers"
+	"tienda/models"
+	"tienda/payment"
 	"tienda/routes"
+	"tienda/shipping"
 	"tienda/storage"
+	"tienda/utils"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
 func main() {
-	// 1. Inicializa la capa de almacenamiento
-	store := storage.NewMemoryStore()
+	// Todos los montos de la tienda se expresan en CURRENCY (código ISO 4217).
+	models.DefaultCurrency = strings.ToUpper(getEnv("CURRENCY", "USD"))
+	if !models.ValidCurrency(models.DefaultCurrency) {
+		log.Fatalf("CURRENCY inválida: %q", models.DefaultCurrency)
+	}
+	// Los impuestos se calculan para TAX_REGION salvo que el carrito indique otra región.
+	models.DefaultRegion = models.NormalizeRegion(os.Getenv("TAX_REGION"))
+	if models.DefaultRegion != "" && !models.ValidRegion(models.DefaultRegion) {
+		log.Fatalf("TAX_REGION inválida: %q", models.DefaultRegion)
+	}
+
+	// 1. Inicializa la capa de almacenamiento elegida con STORAGE_BACKEND ("memory" o "sqlite").
+	store, closeStore, err := newStore(getEnv("STORAGE_BACKEND", "memory"))
+	if err != nil {
+		log.Fatal("Error al inicializar el almacenamiento: ", err)
+	}
+
+	// 2. Configura la emisión de tokens JWT a partir de variables de entorno.
+	tokenManager, err := utils.NewTokenManager(utils.AuthConfig{
+		Secret:          getEnv("JWT_SECRET", "cambia-esta-clave-en-produccion"),
+		Issuer:          getEnv("JWT_ISSUER", "tienda-api"),
+		AccessTokenTTL:  getEnvDuration("JWT_EXPIRY", 15*time.Minute),
+		RefreshTokenTTL: getEnvDuration("JWT_REFRESH_EXPIRY", 7*24*time.Hour),
+	})
+	if err != nil {
+		log.Fatal("Error en la configuración de autenticación: ", err)
+	}
+	if os.Getenv("JWT_SECRET") == "" {
+		log.Println("⚠️  JWT_SECRET no definido, se usa una clave de desarrollo")
+	}
+
+	// Crea el administrador inicial si se definieron sus credenciales.
+	if err := seedAdmin(context.Background(), store, os.Getenv("ADMIN_USERNAME"), os.Getenv("ADMIN_PASSWORD")); err != nil {
+		log.Fatal("Error al crear el administrador inicial: ", err)
+	}
+
+	// Las imágenes de producto se guardan en disco, en IMAGE_DIR.
+	blobs, err := storage.NewLocalBlobStore(getEnv("IMAGE_DIR", "imagenes"))
+	if err != nil {
+		log.Fatal("Error al inicializar el almacén de imágenes: ", err)
+	}
+
+	// Los métodos de envío se leen de SHIPPING_CONFIG; sin él se usan los predeterminados.
+	// Se cargan después de fijar CURRENCY porque los montos se interpretan en esa moneda.
+	shippingMethods, err := shipping.LoadMethods(os.Getenv("SHIPPING_CONFIG"))
+	if err != nil {
+		log.Fatal("Error en la configuración de envíos: ", err)
+	}
 
-	// 2. Crea las instancias de los manejadores
-	productHandlers := handlers.NewProductHandlers(store)
-	userHandlers := handlers.NewUserHandlers(store)
-	cartHandlers := handlers.NewCartHandlers(store, store, store)
-	reportHandlers := handlers.NewReportHandlers(store, store)
+	// Proveedor de pagos elegido con PAYMENT_PROVIDER; por ahora solo existe el falso ("fake"),
+	// que rechaza las tarjetas de PAYMENT_DECLINE_CARDS (o las de prueba predeterminadas).
+	paymentProvider, err := newPaymentProvider(getEnv("PAYMENT_PROVIDER", "fake"))
+	if err != nil {
+		log.Fatal("Error en la configuración de pagos: ", err)
+	}
+
+	// 3. Crea las instancias de los manejadores
+	reservationTTL := getEnvDuration("STOCK_RESERVATION_TTL", 0)
+	productHandlers := handlers.NewProductHandlers(store, store, blobs)
+	imageHandlers := handlers.NewImageHandlers(store, store, blobs, getEnvInt("THUMBNAIL_SIZE", 300))
+	categoryHandlers := handlers.NewCategoryHandlers(store)
+	userHandlers := handlers.NewUserHandlers(store, store, store, tokenManager, reservationTTL)
+	couponHandlers := handlers.NewCouponHandlers(store, store, store)
+	taxHandlers := handlers.NewTaxHandlers(store)
+	addressHandlers := handlers.NewAddressHandlers(store)
+	cartHandlers := handlers.NewCartHandlers(store, store, store, store, store, store, store, store, shippingMethods, paymentProvider, reservationTTL)
+	reportHandlers := handlers.NewReportHandlers(store, store, store)
+	orderHandlers := handlers.NewOrderHandlers(store, store, paymentProvider)
+	returnHandlers := handlers.NewReturnHandlers(store, store, store, paymentProvider)
 
-	// 3. Crea el enrutador principal
+	// 4. Crea el enrutador principal
 	r := mux.NewRouter()
 
-	// 4. Se elimina r.Use(CORSMiddleware). La configuración se hará de otra forma.
+	// 5. Se elimina r.Use(CORSMiddleware). La configuración se hará de otra forma.
 
-	// 5. Registra todas las rutas de la API (sin cambios).
-	routes.RegisterRoutes(r, productHandlers, cartHandlers, userHandlers, reportHandlers)
+	// 6. Registra todas las rutas de la API (sin cambios).
+	//    Los POST con cabecera Idempotency-Key guardan su respuesta durante IDEMPOTENCY_TTL.
+	idempotent := utils.IdempotencyMiddleware(store, getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour))
+	routes.RegisterRoutes(r, productHandlers, imageHandlers, categoryHandlers, couponHandlers, taxHandlers, addressHandlers, cartHandlers, userHandlers, reportHandlers, orderHandlers, returnHandlers, store, tokenManager, idempotent)
 
-	// 6. Configura CORS usando la librería 'rs/cors'.
+	// 7. Configura CORS usando la librería 'rs/cors'.
 	//    Esto es más seguro que usar "*", ya que solo permite tu frontend.
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:8001"}, // El origen de tu app web
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", utils.IdempotencyKeyHeader},
+		ExposedHeaders:   []string{utils.IdempotentReplayedHeader},
 		AllowCredentials: true,
 		Debug:            true, // Muy útil para depurar problemas de CORS
 	})
 
-	// 7. Crea el manejador final envolviendo el enrutador con el middleware de CORS.
+	// 8. Crea el manejador final envolviendo el enrutador con el middleware de CORS.
 	handler := c.Handler(r)
 
-	// 8. Inicia el servidor de la API con el manejador que incluye CORS.
-	log.Println("🚀 Servidor API iniciado en http://localhost:8080")
-	if err := http.ListenAndServe(":8080", handler); err != nil {
-		log.Fatal("Error al iniciar el servidor API: ", err)
+	// Los carritos de invitado sin cambios durante CART_TTL se eliminan en segundo plano cada
+	// CART_SWEEP_INTERVAL y quedan registrados como abandonados. CART_TTL=0 lo desactiva.
+	var sweeper *storage.CartSweeper
+	if ttl := getEnvDuration("CART_TTL", 72*time.Hour); ttl > 0 {
+		sweeper = storage.StartCartSweeper(store, ttl, getEnvDuration("CART_SWEEP_INTERVAL", 10*time.Minute))
+	}
+
+	// 9. Inicia el servidor de la API con el manejador que incluye CORS.
+	server := &http.Server{Addr: ":8080", Handler: handler}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		log.Println("🚀 Servidor API iniciado en http://localhost:8080")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Error al iniciar el servidor API: ", err)
+		}
+	}()
+
+	// 10. Al recibir Ctrl+C o SIGTERM, termina las peticiones en curso, detiene el barrido de
+	//     carritos y cierra el almacenamiento.
+	<-ctx.Done()
+	log.Println("Deteniendo el servidor...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error al detener el servidor: %v", err)
+	}
+	if sweeper != nil {
+		sweeper.Stop()
+	}
+	if err := closeStore(); err != nil {
+		log.Printf("Error al cerrar el almacenamiento: %v", err)
+	}
+}
+
+// newStore crea el backend de almacenamiento indicado y devuelve la función para cerrarlo.
+func newStore(backend string) (storage.Storer, func() error, error) {
+	switch backend {
+	case "memory":
+		// Con MEMORY_DATA_DIR los datos en memoria se respaldan en un journal y snapshots en disco.
+		dir := getEnv("MEMORY_DATA_DIR", "")
+		if dir == "" {
+			return storage.NewMemoryStore(), func() error { return nil }, nil
+		}
+		store, err := storage.NewPersistentMemoryStore(storage.PersistenceOptions{
+			Dir:             dir,
+			CompactInterval: getEnvDuration("MEMORY_COMPACT_INTERVAL", 5*time.Minute),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("💾 Usando memoria con journal en %s", dir)
+		return store, store.Close, nil
+	case "sqlite":
+		path := getEnv("SQLITE_PATH", "tienda.db")
+		store, err := storage.NewSQLiteStore(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("💾 Usando SQLite en %s", path)
+		return store, store.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("backend de almacenamiento desconocido: %q", backend)
+	}
+}
+
+// newPaymentProvider crea el proveedor de pagos indicado.
+func newPaymentProvider(name string) (payment.Provider, error) {
+	switch name {
+	case "fake":
+		var declines map[string]string
+		if cards := os.Getenv("PAYMENT_DECLINE_CARDS"); cards != "" {
+			var err error
+			if declines, err = payment.ParseDeclineCards(cards); err != nil {
+				return nil, fmt.Errorf("PAYMENT_DECLINE_CARDS: %w", err)
+			}
+		}
+		log.Println("💳 Usando el proveedor de pagos de prueba; no se hacen cobros reales")
+		return payment.NewFakeProvider(declines), nil
+	default:
+		return nil, fmt.Errorf("proveedor de pagos desconocido: %q", name)
+	}
+}
+
+// getEnv devuelve el valor de una variable de entorno o un valor por defecto.
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvDuration interpreta una variable de entorno como time.Duration (p. ej. "15m").
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Valor inválido para %s (%q), se usa %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getEnvInt interpreta una variable de entorno como entero positivo.
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Valor inválido para %s (%q), se usa %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// seedAdmin registra un usuario administrador; si ya existe lo promueve a ese rol.
+func seedAdmin(ctx context.Context, store storage.UserStorer, username, password string) error {
+	if username == "" || password == "" {
+		return nil
+	}
+	if existing, err := store.GetUserByUsername(ctx, username); err == nil {
+		_, err = store.UpdateUserRole(ctx, existing.ID, models.RoleAdmin)
+		return err
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("error al procesar la contraseña: %w", err)
 	}
+	_, err = store.CreateUser(ctx, models.User{Username: username, Password: hashedPassword, Role: models.RoleAdmin})
+	return err
 }
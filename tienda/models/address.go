@@ -0,0 +1,58 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Address es una dirección de envío guardada en el perfil de un usuario, o indicada
+// directamente al comprar como invitado.
+type Address struct {
+	ID         string    `json:"id,omitempty"`
+	UserID     string    `json:"userId,omitempty"`
+	Label      string    `json:"label,omitempty"` // Nombre corto, p. ej. "Casa" u "Oficina".
+	Recipient  string    `json:"recipient"`       // Persona que recibe el envío.
+	Line1      string    `json:"line1"`
+	Line2      string    `json:"line2,omitempty"`
+	City       string    `json:"city"`
+	State      string    `json:"state,omitempty"` // Subdivisión ISO 3166-2 sin el país, p. ej. "CA" o "P".
+	PostalCode string    `json:"postalCode,omitempty"`
+	Country    string    `json:"country"` // ISO 3166-1 alfa-2, p. ej. "EC".
+	Phone      string    `json:"phone,omitempty"`
+	CreatedAt  time.Time `json:"createdAt,omitzero"`
+}
+
+// Normalize quita espacios sobrantes y pasa país y subdivisión a mayúsculas.
+func (a *Address) Normalize() {
+	for _, field := range []*string{&a.Label, &a.Recipient, &a.Line1, &a.Line2, &a.City, &a.PostalCode, &a.Phone} {
+		*field = strings.TrimSpace(*field)
+	}
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	a.State = strings.ToUpper(strings.TrimSpace(a.State))
+}
+
+// Validate comprueba los datos mínimos para poder entregar un envío.
+func (a Address) Validate() error {
+	switch {
+	case a.Recipient == "":
+		return errors.New("la dirección debe indicar quién recibe el envío")
+	case a.Line1 == "":
+		return errors.New("la dirección debe indicar calle y número (line1)")
+	case a.City == "":
+		return errors.New("la dirección debe indicar la ciudad")
+	case !ValidRegion(a.Country) || strings.Contains(a.Country, "-"):
+		return errors.New("country debe ser un código ISO de dos letras, p. ej. EC")
+	case a.State != "" && !ValidRegion(a.Region()):
+		return errors.New("state debe ser el código ISO de la subdivisión, p. ej. CA")
+	}
+	return nil
+}
+
+// Region devuelve la región de destino para impuestos y envíos: "US-CA", o solo el país.
+func (a Address) Region() string {
+	if a.State == "" {
+		return a.Country
+	}
+	return a.Country + "-" + a.State
+}
@@ -1,15 +1,117 @@
 package models
 
+import "time"
+
 // CartItem representa un artículo dentro de un carrito.
+// Una línea se identifica por el producto y, si lo tiene, la variante elegida.
 type CartItem struct {
-	ProductID string  `json:"productId"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"` // Precio del producto al momento de añadirlo.
+	ProductID string `json:"productId"`
+	VariantID string `json:"variantId,omitempty"`
+	Quantity  int    `json:"quantity"`
+	Price     Money  `json:"price"` // Precio unitario; se actualiza al conciliar el carrito con el catálogo.
 }
 
 // Cart representa el carrito de compras.
+// Un carrito sin UserID es un carrito de invitado, accesible solo con su ID.
+// Si el cupón aplicado deja de cumplir sus condiciones se conserva en CouponCode,
+// pero no descuenta nada y CouponError explica el motivo.
 type Cart struct {
-	ID    string     `json:"id"`
-	Items []CartItem `json:"items"`
-	Total float64    `json:"total"`
+	ID          string         `json:"id"`
+	UserID      string         `json:"userId,omitempty"` // Dueño del carrito; vacío para invitados.
+	Items       []CartItem     `json:"items"`
+	Region      string         `json:"region,omitempty"` // Destino para calcular impuestos; vacío usa DefaultRegion.
+	Subtotal    Money          `json:"subtotal"`         // Suma de las líneas, antes de descuentos.
+	CouponCode  string         `json:"couponCode,omitempty"`
+	CouponError string         `json:"couponError,omitempty"`
+	Discounts   []DiscountLine `json:"discounts,omitempty"`
+	Taxes       []TaxLine      `json:"taxes,omitempty"`
+	Tax         Money          `json:"tax"`      // Suma de los impuestos, incluidos o no en los precios.
+	Total       Money          `json:"total"`    // Subtotal menos descuentos más impuestos no incluidos.
+	Currency    string         `json:"currency"` // Moneda de todos los montos del carrito.
+	// Pagos rechazados al intentar comprar; pasan a la orden cuando la compra se completa.
+	PaymentAttempts []PaymentAttempt `json:"paymentAttempts,omitempty"`
+	CreatedAt       time.Time        `json:"createdAt,omitzero"`
+	UpdatedAt       time.Time        `json:"updatedAt,omitzero"` // Última modificación; los carritos de invitado expiran por inactividad.
+	// Changes avisa de lo que cambió al comparar el carrito con el catálogo en esta
+	// respuesta. No se guarda: cada respuesta informa solo lo detectado en ella.
+	Changes []CartChange `json:"changes,omitempty"`
+}
+
+// CartChangeType indica qué se detectó en una línea al compararla con el catálogo.
+type CartChangeType string
+
+const (
+	CartPriceChanged      CartChangeType = "price_changed"      // El precio cambió; la línea ya tiene el nuevo.
+	CartItemRemoved       CartChangeType = "removed"            // El producto o la variante ya no existe; se quitó la línea.
+	CartInsufficientStock CartChangeType = "insufficient_stock" // Hay menos stock que la cantidad pedida; la línea se conserva.
+)
+
+// CartChange describe un cambio en una línea del carrito para avisar al comprador.
+type CartChange struct {
+	Type      CartChangeType `json:"type"`
+	ProductID string         `json:"productId"`
+	VariantID string         `json:"variantId,omitempty"`
+	OldPrice  Money          `json:"oldPrice,omitzero"`
+	NewPrice  Money          `json:"newPrice,omitzero"`
+	Quantity  int            `json:"quantity"`
+	Available *int           `json:"available,omitempty"` // Stock disponible, en los avisos de stock.
+}
+
+// Modifies indica si el cambio alteró las líneas del carrito (y hay que guardarlo), a
+// diferencia de un aviso de stock, que no modifica nada.
+func (c CartChange) Modifies() bool {
+	return c.Type != CartInsufficientStock
+}
+
+// Reconcile compara las líneas con el catálogo (products, por ID): actualiza los precios,
+// quita las líneas cuyo producto o variante ya no existe y avisa de las que piden más
+// unidades que el stock. Devuelve los cambios en el orden de las líneas.
+func (c *Cart) Reconcile(products map[string]Product) []CartChange {
+	var changes []CartChange
+	items := make([]CartItem, 0, len(c.Items))
+	for _, item := range c.Items {
+		change := CartChange{ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity}
+		product, ok := products[item.ProductID]
+		stock, variantOK := product.StockFor(item.VariantID)
+		if !ok || !variantOK {
+			change.Type, change.OldPrice = CartItemRemoved, item.Price
+			changes = append(changes, change)
+			continue
+		}
+		if price := product.PriceFor(item.VariantID); price.Amount != item.Price.Amount || price.CurrencyCode() != item.Price.CurrencyCode() {
+			change.Type, change.OldPrice, change.NewPrice = CartPriceChanged, item.Price, price
+			changes = append(changes, change)
+			item.Price = price
+		}
+		if item.Quantity > stock {
+			available := max(stock, 0)
+			changes = append(changes, CartChange{Type: CartInsufficientStock, ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity, Available: &available})
+		}
+		items = append(items, item)
+	}
+	c.Items = items
+	return changes
+}
+
+// AbandonedCart registra un carrito de invitado que expiró sin comprarse, para los reportes.
+type AbandonedCart struct {
+	CartID    string     `json:"cartId"`
+	Items     []CartItem `json:"items"`
+	Subtotal  Money      `json:"subtotal"` // Subtotal del carrito en su último cálculo.
+	CreatedAt time.Time  `json:"createdAt,omitzero"`
+	UpdatedAt time.Time  `json:"updatedAt,omitzero"` // Última actividad del comprador.
+	ExpiredAt time.Time  `json:"expiredAt"`
+}
+
+// NewAbandonedCart crea el registro de un carrito que expiró en expiredAt.
+func NewAbandonedCart(c Cart, expiredAt time.Time) AbandonedCart {
+	return AbandonedCart{CartID: c.ID, Items: c.Items, Subtotal: c.Subtotal, CreatedAt: c.CreatedAt, UpdatedAt: c.UpdatedAt, ExpiredAt: expiredAt}
+}
+
+// TaxRegion devuelve la región de destino con la que se calculan los impuestos.
+func (c Cart) TaxRegion() string {
+	if c.Region == "" {
+		return DefaultRegion
+	}
+	return c.Region
 }
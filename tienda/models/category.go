@@ -0,0 +1,71 @@
+package models
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Category es un nodo del árbol de categorías del catálogo.
+type Category struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`               // Identificador legible y único, usado en URLs.
+	ParentID string `json:"parentId,omitempty"` // Vacío en las categorías raíz.
+	Position int    `json:"position"`           // Orden de aparición entre categorías hermanas.
+}
+
+// CategoryNode es una categoría con sus subcategorías, para devolver el árbol completo.
+type CategoryNode struct {
+	Category
+	Children []CategoryNode `json:"children"`
+}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// ValidSlug indica si el slug solo contiene minúsculas, dígitos y guiones simples.
+func ValidSlug(slug string) bool {
+	return slugPattern.MatchString(slug)
+}
+
+// Slugify genera un slug a partir de un nombre, quitando tildes y signos.
+func Slugify(name string) string {
+	replacer := strings.NewReplacer("á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u", "ü", "u", "ñ", "n")
+	var b strings.Builder
+	dash := false
+	for _, r := range replacer.Replace(strings.ToLower(name)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// BuildCategoryTree arma el árbol a partir de la lista plana, ordenando cada nivel
+// por posición y luego por nombre.
+func BuildCategoryTree(categories []Category) []CategoryNode {
+	children := make(map[string][]Category)
+	for _, c := range categories {
+		children[c.ParentID] = append(children[c.ParentID], c)
+	}
+	var build func(parentID string) []CategoryNode
+	build = func(parentID string) []CategoryNode {
+		level := children[parentID]
+		slices.SortFunc(level, func(a, b Category) int {
+			return cmp.Or(cmp.Compare(a.Position, b.Position), cmp.Compare(a.Name, b.Name))
+		})
+		nodes := make([]CategoryNode, 0, len(level))
+		for _, c := range level {
+			nodes = append(nodes, CategoryNode{Category: c, Children: build(c.ID)})
+		}
+		return nodes
+	}
+	return build("")
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CouponType indica cómo calcula el descuento un cupón.
+type CouponType string
+
+const (
+	CouponPercentage CouponType = "percentage" // Descuenta un porcentaje de los productos elegibles.
+	CouponFixed      CouponType = "fixed"      // Descuenta un monto fijo, sin superar el de los productos elegibles.
+)
+
+// Coupon es un código promocional que los clientes aplican a su carrito.
+type Coupon struct {
+	ID             string     `json:"id"`
+	Code           string     `json:"code"` // Se guarda en mayúsculas; se acepta sin distinguir mayúsculas.
+	Type           CouponType `json:"type"`
+	Percent        int        `json:"percent,omitempty"`        // Para "percentage": de 1 a 100.
+	Amount         *Money     `json:"amount,omitempty"`         // Para "fixed": monto a descontar.
+	MinSubtotal    *Money     `json:"minSubtotal,omitempty"`    // Gasto mínimo del carrito para aplicarlo.
+	ProductIDs     []string   `json:"productIds,omitempty"`     // Si se indican, solo descuenta estos productos
+	CategoryIDs    []string   `json:"categoryIds,omitempty"`    // o los de estas categorías y sus subcategorías.
+	MaxUses        int        `json:"maxUses,omitempty"`        // Usos totales permitidos; 0 es sin límite.
+	MaxUsesPerUser int        `json:"maxUsesPerUser,omitempty"` // Usos por usuario; 0 es sin límite. Exige iniciar sesión.
+	Uses           int        `json:"uses"`                     // Compras confirmadas con este cupón.
+	StartsAt       *time.Time `json:"startsAt,omitempty"`
+	EndsAt         *time.Time `json:"endsAt,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+// CouponRedemption registra el uso de un cupón en una compra.
+type CouponRedemption struct {
+	CouponID  string    `json:"couponId"`
+	UserID    string    `json:"userId,omitempty"`
+	OrderID   string    `json:"orderId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DiscountLine es un descuento aplicado al carrito o a la orden.
+type DiscountLine struct {
+	CouponID    string `json:"couponId,omitempty"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Amount      Money  `json:"amount"`
+}
+
+// Motivos por los que un cupón válido no se puede aplicar a un carrito.
+var (
+	ErrCouponNotStarted    = errors.New("el cupón aún no está vigente")
+	ErrCouponExpired       = errors.New("el cupón ha expirado")
+	ErrCouponMinSubtotal   = errors.New("el carrito no alcanza el gasto mínimo del cupón")
+	ErrCouponNotApplicable = errors.New("el cupón no aplica a ningún producto del carrito")
+)
+
+// NormalizeCouponCode quita espacios y pasa el código a mayúsculas.
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Scoped indica si el cupón se limita a ciertos productos o categorías.
+func (c Coupon) Scoped() bool {
+	return len(c.ProductIDs) > 0 || len(c.CategoryIDs) > 0
+}
+
+// CheckValidity verifica que el cupón esté dentro de su ventana de validez.
+func (c Coupon) CheckValidity(now time.Time) error {
+	if c.StartsAt != nil && now.Before(*c.StartsAt) {
+		return ErrCouponNotStarted
+	}
+	if c.EndsAt != nil && !now.Before(*c.EndsAt) {
+		return ErrCouponExpired
+	}
+	return nil
+}
+
+// Discount calcula el descuento a partir del subtotal del carrito, que se compara con
+// el gasto mínimo, y del subtotal de las líneas elegibles, sobre el que se descuenta.
+func (c Coupon) Discount(subtotal, eligible Money) (DiscountLine, error) {
+	if c.MinSubtotal != nil && subtotal.Amount < c.MinSubtotal.Amount {
+		return DiscountLine{}, fmt.Errorf("%w (%s %s)", ErrCouponMinSubtotal, c.MinSubtotal, c.MinSubtotal.CurrencyCode())
+	}
+	if eligible.Amount <= 0 {
+		return DiscountLine{}, ErrCouponNotApplicable
+	}
+	line := DiscountLine{CouponID: c.ID, Code: c.Code}
+	switch c.Type {
+	case CouponPercentage:
+		// Redondea a la unidad mínima más cercana, con las mitades hacia arriba.
+		line.Amount = Money{Amount: (eligible.Amount*int64(c.Percent) + 50) / 100, Currency: eligible.CurrencyCode()}
+		line.Description = fmt.Sprintf("%d%% de descuento", c.Percent)
+	case CouponFixed:
+		line.Amount = *c.Amount
+		if line.Amount.Amount > eligible.Amount {
+			line.Amount = eligible
+		}
+		line.Description = fmt.Sprintf("Descuento de %s %s", c.Amount, c.Amount.CurrencyCode())
+	}
+	return line, nil
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCouponDiscount(t *testing.T) {
+	amount := func(a int64) *Money { m := NewMoney(a); return &m }
+	tests := []struct {
+		name     string
+		coupon   Coupon
+		subtotal int64
+		eligible int64
+		want     int64
+		wantErr  error
+	}{
+		{name: "porcentaje", coupon: Coupon{Type: CouponPercentage, Percent: 10}, subtotal: 5000, eligible: 5000, want: 500},
+		{name: "porcentaje redondea la mitad hacia arriba", coupon: Coupon{Type: CouponPercentage, Percent: 15}, subtotal: 1010, eligible: 1010, want: 152},
+		{name: "porcentaje solo de lo elegible", coupon: Coupon{Type: CouponPercentage, Percent: 50}, subtotal: 5000, eligible: 1000, want: 500},
+		{name: "monto fijo", coupon: Coupon{Type: CouponFixed, Amount: amount(700)}, subtotal: 5000, eligible: 5000, want: 700},
+		{name: "monto fijo no supera lo elegible", coupon: Coupon{Type: CouponFixed, Amount: amount(700)}, subtotal: 5000, eligible: 300, want: 300},
+		{name: "gasto mínimo alcanzado", coupon: Coupon{Type: CouponFixed, Amount: amount(100), MinSubtotal: amount(2000)}, subtotal: 2000, eligible: 2000, want: 100},
+		{name: "gasto mínimo no alcanzado", coupon: Coupon{Type: CouponFixed, Amount: amount(100), MinSubtotal: amount(2000)}, subtotal: 1999, eligible: 1999, wantErr: ErrCouponMinSubtotal},
+		{name: "sin productos elegibles", coupon: Coupon{Type: CouponPercentage, Percent: 10, ProductIDs: []string{"p1"}}, subtotal: 5000, eligible: 0, wantErr: ErrCouponNotApplicable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, err := tt.coupon.Discount(NewMoney(tt.subtotal), NewMoney(tt.eligible))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Discount() error = %v, se esperaba %v", err, tt.wantErr)
+			}
+			if err == nil && line.Amount.Amount != tt.want {
+				t.Errorf("descuento = %d, se esperaba %d", line.Amount.Amount, tt.want)
+			}
+		})
+	}
+}
+
+func TestCouponCheckValidity(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time { t := now.Add(d); return &t }
+	tests := []struct {
+		name   string
+		coupon Coupon
+		want   error
+	}{
+		{name: "sin fechas", coupon: Coupon{}},
+		{name: "vigente", coupon: Coupon{StartsAt: at(-time.Hour), EndsAt: at(time.Hour)}},
+		{name: "aún no empieza", coupon: Coupon{StartsAt: at(time.Hour)}, want: ErrCouponNotStarted},
+		{name: "termina justo ahora", coupon: Coupon{EndsAt: at(0)}, want: ErrCouponExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.coupon.CheckValidity(now); !errors.Is(err, tt.want) {
+				t.Errorf("CheckValidity() = %v, se esperaba %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// IdempotencyRecord guarda la respuesta a una petición enviada con la cabecera
+// Idempotency-Key, para repetirla si el cliente reintenta la misma petición.
+type IdempotencyRecord struct {
+	Scope       string    `json:"scope"`       // Dueño de la clave: el usuario autenticado o, para invitados, su carrito.
+	Key         string    `json:"key"`         // Valor de la cabecera Idempotency-Key.
+	Fingerprint string    `json:"fingerprint"` // Hash del método, la ruta y el cuerpo de la petición original.
+	Completed   bool      `json:"completed"`   // false mientras la petición original sigue en curso.
+	StatusCode  int       `json:"statusCode,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// ExpiresAt es cuándo se libera la clave. Mientras la petición está en curso es un plazo
+	// corto, para que una reserva abandonada (p. ej. por una caída) no bloquee la clave.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Expired indica si la clave ya puede reutilizarse.
+func (r IdempotencyRecord) Expired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency es la moneda de la tienda (código ISO 4217). Se usa para los montos
+// que llegan en JSON sin moneda y para los que se crean con Money{}. Los almacenes
+// registran con qué moneda guardaron sus montos y no arrancan si no coincide con esta.
+var DefaultCurrency = "USD"
+
+// currencyDigits indica los decimales de las monedas que no usan dos.
+var currencyDigits = map[string]int{
+	"BHD": 3, "CLP": 0, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0,
+	"KWD": 3, "OMR": 3, "PYG": 0, "TND": 3, "UGX": 0, "VND": 0,
+}
+
+// decimalPattern acepta números decimales en el formato de JSON, con exponente acotado.
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]{1,3})?$`)
+
+// ErrInvalidMoney indica que un monto no tiene el formato decimal esperado.
+var ErrInvalidMoney = errors.New("monto inválido")
+
+// Money es un monto exacto expresado en unidades mínimas de su moneda
+// (centavos para USD). Nunca se usa float64 para sumar o multiplicar montos.
+type Money struct {
+	Amount   int64  // Unidades mínimas, p. ej. 1250 = 12.50 USD.
+	Currency string // Código ISO 4217; vacío equivale a DefaultCurrency.
+}
+
+// ValidCurrency indica si el código tiene la forma de un código ISO 4217.
+func ValidCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// CurrencyDigits devuelve el número de decimales de la moneda.
+func CurrencyDigits(currency string) int {
+	if digits, ok := currencyDigits[currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+// NewMoney crea un monto a partir de unidades mínimas en la moneda por defecto.
+func NewMoney(amount int64) Money {
+	return Money{Amount: amount, Currency: DefaultCurrency}
+}
+
+// ParseMoney interpreta un decimal ("12.5", "12.50", "1e2") en la moneda indicada.
+// Los decimales que sobran respecto a la moneda se redondean al más cercano
+// (las mitades, alejándose de cero).
+func ParseMoney(s, currency string) (Money, error) {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	amount, err := parseDecimal(s, CurrencyDigits(currency))
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %v", ErrInvalidMoney, err)
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// parseDecimal convierte un decimal en un entero escalado por 10^digits, redondeando
+// los decimales que sobran al más cercano (las mitades, alejándose de cero).
+func parseDecimal(s string, digits int) (int64, error) {
+	s = strings.TrimSpace(s)
+	if !decimalPattern.MatchString(s) {
+		return 0, fmt.Errorf("%q no es un número decimal", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("%q no es un número decimal", s)
+	}
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	r.Mul(r, new(big.Rat).SetInt(scale))
+	// Redondeo exacto: se suma (o resta) un medio y se trunca hacia cero.
+	half := big.NewRat(1, 2)
+	if r.Sign() < 0 {
+		half.Neg(half)
+	}
+	r.Add(r, half)
+	n := new(big.Int).Quo(r.Num(), r.Denom())
+	if !n.IsInt64() {
+		return 0, fmt.Errorf("%q fuera de rango", s)
+	}
+	return n.Int64(), nil
+}
+
+// unquoteNumber devuelve el texto de un número JSON, escrito como número o entre comillas.
+func unquoteNumber(data []byte) (string, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+	return string(data), nil
+}
+
+// CurrencyCode devuelve la moneda del monto, resolviendo el valor vacío.
+func (m Money) CurrencyCode() string {
+	if m.Currency == "" {
+		return DefaultCurrency
+	}
+	return m.Currency
+}
+
+// Add suma dos montos de la misma moneda. Todos los montos de la tienda están en
+// DefaultCurrency (los almacenes no abren datos guardados en otra moneda), así que sumar
+// monedas distintas es un error de programación y provoca un panic.
+func (m Money) Add(other Money) Money {
+	if m.CurrencyCode() != other.CurrencyCode() {
+		panic(fmt.Sprintf("no se pueden sumar montos en %s y %s", m.CurrencyCode(), other.CurrencyCode()))
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.CurrencyCode()}
+}
+
+// Sub resta otro monto de la misma moneda.
+func (m Money) Sub(other Money) Money {
+	return m.Add(Money{Amount: -other.Amount, Currency: other.Currency})
+}
+
+// Mul multiplica el monto por una cantidad entera, p. ej. precio unitario por unidades.
+func (m Money) Mul(quantity int) Money {
+	return Money{Amount: m.Amount * int64(quantity), Currency: m.CurrencyCode()}
+}
+
+// IsNegative indica si el monto es menor que cero.
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// String devuelve el monto como decimal con los dígitos de su moneda, p. ej. "12.50".
+func (m Money) String() string {
+	digits := CurrencyDigits(m.CurrencyCode())
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if digits == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	s := fmt.Sprintf("%0*d", digits+1, amount)
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+// MarshalJSON escribe el monto como número JSON con sus decimales exactos (12.50), de modo
+// que los clientes que esperaban un float64 siguen funcionando.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON acepta tanto un número (12.5) como un decimal entre comillas ("12.50").
+// El texto se interpreta sin pasar por float64; la moneda es la de la tienda.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	s, err := unquoteNumber(data)
+	if err != nil {
+		return err
+	}
+	parsed, err := ParseMoney(s, DefaultCurrency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
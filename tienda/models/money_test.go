@@ -0,0 +1,123 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		input    string
+		currency string
+		want     int64
+		wantErr  bool
+	}{
+		{input: "12.5", currency: "USD", want: 1250},
+		{input: "12.50", currency: "USD", want: 1250},
+		{input: "0.1", currency: "USD", want: 10},
+		{input: "1e2", currency: "USD", want: 10000},
+		{input: "0.005", currency: "USD", want: 1},
+		{input: "0.004", currency: "USD", want: 0},
+		{input: "-0.005", currency: "USD", want: -1},
+		{input: "1234", currency: "JPY", want: 1234},
+		{input: "1234.5", currency: "JPY", want: 1235},
+		{input: "1.2345", currency: "KWD", want: 1235},
+		{input: "abc", currency: "USD", wantErr: true},
+		{input: "1e999", currency: "USD", wantErr: true},
+		{input: "99999999999999999999", currency: "USD", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input+" "+tt.currency, func(t *testing.T) {
+			got, err := ParseMoney(tt.input, tt.currency)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidMoney) {
+					t.Fatalf("ParseMoney() error = %v, se esperaba ErrInvalidMoney", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Amount != tt.want || got.Currency != tt.currency {
+				t.Errorf("ParseMoney() = %d %s, se esperaba %d %s", got.Amount, got.Currency, tt.want, tt.currency)
+			}
+		})
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	usd := func(amount int64) Money { return Money{Amount: amount, Currency: "USD"} }
+	tests := []struct {
+		name string
+		got  Money
+		want Money
+	}{
+		{name: "suma", got: usd(1050).Add(usd(250)), want: usd(1300)},
+		{name: "resta", got: usd(1050).Sub(usd(2000)), want: usd(-950)},
+		{name: "multiplicación", got: usd(333).Mul(3), want: usd(999)},
+		{name: "la moneda vacía es la de la tienda", got: Money{Amount: 100}.Add(NewMoney(1)), want: NewMoney(101)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("= %+v, se esperaba %+v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyAddDifferentCurrenciesPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("sumar USD y EUR no provocó un panic")
+		}
+	}()
+	Money{Amount: 1, Currency: "USD"}.Add(Money{Amount: 1, Currency: "EUR"})
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{Money{Amount: 1250, Currency: "USD"}, "12.50"},
+		{Money{Amount: 5, Currency: "USD"}, "0.05"},
+		{Money{Amount: -5, Currency: "USD"}, "-0.05"},
+		{Money{Amount: 1250, Currency: "JPY"}, "1250"},
+		{Money{Amount: 1250, Currency: "KWD"}, "1.250"},
+	}
+	for _, tt := range tests {
+		if got := tt.money.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, se esperaba %q", tt.money, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{input: `12.5`, want: 1250},
+		{input: `"12.50"`, want: 1250},
+		{input: `0.07`, want: 7},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := json.Unmarshal([]byte(tt.input), &m); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", tt.input, err)
+		}
+		if m.Amount != tt.want {
+			t.Errorf("Unmarshal(%s) = %d, se esperaba %d", tt.input, m.Amount, tt.want)
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var back Money
+		if err := json.Unmarshal(data, &back); err != nil || back != m {
+			t.Errorf("ida y vuelta de %s = %s (%+v), se esperaba %+v", tt.input, data, back, m)
+		}
+	}
+}
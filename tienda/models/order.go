@@ -0,0 +1,84 @@
+package models
+
+import "time"
+
+// OrderStatus representa la etapa del ciclo de vida de una orden.
+type OrderStatus string
+
+const (
+	OrderPending   OrderStatus = "pending"   // Creada en el checkout, a la espera del pago.
+	OrderPaid      OrderStatus = "paid"      // Pago confirmado.
+	OrderShipped   OrderStatus = "shipped"   // Enviada al cliente.
+	OrderDelivered OrderStatus = "delivered" // Entregada.
+	OrderCancelled OrderStatus = "cancelled" // Cancelada antes del envío.
+	OrderRefunded  OrderStatus = "refunded"  // Reembolsada tras el pago.
+)
+
+// orderTransitions define los cambios de estado permitidos desde cada estado.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderShipped, OrderCancelled, OrderRefunded},
+	OrderShipped:   {OrderDelivered},
+	OrderDelivered: {OrderRefunded},
+	OrderCancelled: {},
+	OrderRefunded:  {},
+}
+
+// Valid indica si el estado es uno de los reconocidos.
+func (s OrderStatus) Valid() bool {
+	_, ok := orderTransitions[s]
+	return ok
+}
+
+// CanTransitionTo indica si la orden puede pasar del estado actual al siguiente.
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderItem es una copia de una línea del carrito al momento de la compra.
+type OrderItem struct {
+	ProductID string            `json:"productId"`
+	VariantID string            `json:"variantId,omitempty"`
+	SKU       string            `json:"sku,omitempty"`
+	Options   map[string]string `json:"options,omitempty"`
+	Name      string            `json:"name"`
+	Quantity  int               `json:"quantity"`
+	UnitPrice Money             `json:"unitPrice"`
+	Subtotal  Money             `json:"subtotal"`
+	Returned  int               `json:"returned,omitempty"` // Unidades devueltas y reembolsadas.
+}
+
+// Order representa una compra confirmada.
+type Order struct {
+	ID              string           `json:"id"`
+	UserID          string           `json:"userId,omitempty"` // Vacío si la compra la hizo un invitado.
+	Items           []OrderItem      `json:"items"`
+	Subtotal        Money            `json:"subtotal"`
+	CouponCode      string           `json:"couponCode,omitempty"`
+	Discounts       []DiscountLine   `json:"discounts,omitempty"`
+	Taxes           []TaxLine        `json:"taxes,omitempty"` // Desglose de impuestos al momento de la compra.
+	Tax             Money            `json:"tax"`             // Suma de los impuestos, incluidos o no en los precios.
+	Shipping        Money            `json:"shipping"`        // Costo del envío, sin impuestos.
+	ShippingMethod  string           `json:"shippingMethod,omitempty"`
+	ShippingAddress *Address         `json:"shippingAddress,omitempty"` // Copia de la dirección al momento de la compra.
+	Total           Money            `json:"total"`
+	Currency        string           `json:"currency"` // Moneda de todos los montos de la orden.
+	Status          OrderStatus      `json:"status"`
+	PaymentStatus   PaymentStatus    `json:"paymentStatus,omitempty"`
+	Payments        []PaymentAttempt `json:"payments,omitempty"`      // Intentos de pago, en orden; incluye los rechazados.
+	PendingStatus   OrderStatus      `json:"pendingStatus,omitempty"` // Estado reservado mientras se liquida el pago.
+	PendingUntil    time.Time        `json:"pendingUntil,omitzero"`   // Vencimiento de la reserva de PendingStatus.
+	CreatedAt       time.Time        `json:"createdAt"`
+	UpdatedAt       time.Time        `json:"updatedAt"`
+}
+
+// Busy indica si otra petición reservó un cambio de estado de la orden (ver PendingStatus)
+// y la reserva sigue vigente en now.
+func (o Order) Busy(now time.Time) bool {
+	return o.PendingStatus != "" && now.Before(o.PendingUntil)
+}
@@ -0,0 +1,96 @@
+package models
+
+import "time"
+
+// PaymentOperation es una operación con el proveedor de pagos.
+type PaymentOperation string
+
+const (
+	PaymentAuthorize PaymentOperation = "authorize" // Reserva el monto en la tarjeta.
+	PaymentCapture   PaymentOperation = "capture"   // Cobra lo autorizado.
+	PaymentVoid      PaymentOperation = "void"      // Anula una autorización sin cobrar.
+	PaymentRefund    PaymentOperation = "refund"    // Devuelve total o parcialmente lo cobrado.
+)
+
+// AttemptStatus es el resultado de un intento de pago.
+type AttemptStatus string
+
+const (
+	AttemptSucceeded AttemptStatus = "succeeded"
+	AttemptDeclined  AttemptStatus = "declined" // El proveedor rechazó la operación.
+	AttemptFailed    AttemptStatus = "failed"   // No se pudo completar la llamada al proveedor.
+)
+
+// PaymentStatus resume el estado del pago de una orden.
+type PaymentStatus string
+
+const (
+	PaymentAuthorized        PaymentStatus = "authorized"
+	PaymentCaptured          PaymentStatus = "captured"
+	PaymentVoided            PaymentStatus = "voided"
+	PaymentPartiallyRefunded PaymentStatus = "partially_refunded"
+	PaymentRefunded          PaymentStatus = "refunded"
+)
+
+// PaymentAttempt registra una llamada al proveedor de pagos, exitosa o no.
+type PaymentAttempt struct {
+	Operation     PaymentOperation `json:"operation"`
+	Status        AttemptStatus    `json:"status"`
+	Provider      string           `json:"provider"`
+	Amount        Money            `json:"amount"`
+	TransactionID string           `json:"transactionId,omitempty"` // ID del proveedor; vacío si no tuvo éxito.
+	CardBrand     string           `json:"cardBrand,omitempty"`
+	CardLast4     string           `json:"cardLast4,omitempty"`
+	Code          string           `json:"code,omitempty"`    // Código de rechazo del proveedor.
+	Message       string           `json:"message,omitempty"` // Motivo del rechazo o del error.
+	CreatedAt     time.Time        `json:"createdAt"`
+}
+
+// RecordPayment añade un intento de pago a la orden y, si tuvo éxito, actualiza PaymentStatus.
+func (o *Order) RecordPayment(a PaymentAttempt) {
+	o.Payments = append(o.Payments, a)
+	if a.Status != AttemptSucceeded {
+		return
+	}
+	switch a.Operation {
+	case PaymentAuthorize:
+		o.PaymentStatus = PaymentAuthorized
+	case PaymentCapture:
+		o.PaymentStatus = PaymentCaptured
+	case PaymentVoid:
+		o.PaymentStatus = PaymentVoided
+	case PaymentRefund:
+		if o.RefundableAmount().Amount > 0 {
+			o.PaymentStatus = PaymentPartiallyRefunded
+		} else {
+			o.PaymentStatus = PaymentRefunded
+		}
+	}
+}
+
+// SuccessfulPayment devuelve el último intento exitoso de la operación indicada.
+func (o Order) SuccessfulPayment(op PaymentOperation) (PaymentAttempt, bool) {
+	for i := len(o.Payments) - 1; i >= 0; i-- {
+		if a := o.Payments[i]; a.Operation == op && a.Status == AttemptSucceeded {
+			return a, true
+		}
+	}
+	return PaymentAttempt{}, false
+}
+
+// RefundableAmount devuelve lo cobrado que todavía no se ha reembolsado.
+func (o Order) RefundableAmount() Money {
+	refundable := NewMoney(0)
+	for _, a := range o.Payments {
+		if a.Status != AttemptSucceeded {
+			continue
+		}
+		switch a.Operation {
+		case PaymentCapture:
+			refundable = refundable.Add(a.Amount)
+		case PaymentRefund:
+			refundable = refundable.Sub(a.Amount)
+		}
+	}
+	return refundable
+}
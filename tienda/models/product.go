@@ -1,10 +1,92 @@
 package models
 
 // Product define la estructura de un producto.
+// Si tiene variantes, el stock se lleva por variante y Stock es la suma de todas.
 type Product struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Stock       int     `json:"stock"`
+	ID          string           `json:"id"`
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Price       Money            `json:"price"`
+	Stock       int              `json:"stock"`
+	TaxClass    string           `json:"taxClass,omitempty"`    // Clase de impuesto; vacía equivale a DefaultTaxClass.
+	WeightGrams int              `json:"weightGrams,omitempty"` // Peso unitario para calcular el envío.
+	CategoryIDs []string         `json:"categoryIds,omitempty"` // Categorías a las que pertenece.
+	Variants    []ProductVariant `json:"variants,omitempty"`
+	Images      []ProductImage   `json:"images,omitempty"` // En el orden en que se muestran; la primera es la principal.
+}
+
+// ProductVariant es una combinación vendible de un producto (por ejemplo, talla y color).
+type ProductVariant struct {
+	ID      string            `json:"id"`
+	SKU     string            `json:"sku"`
+	Options map[string]string `json:"options,omitempty"` // Valores de opción, p. ej. {"talla": "M"}.
+	Price   *Money            `json:"price,omitempty"`   // Si se omite, se usa el precio del producto.
+	Stock   int               `json:"stock"`
+}
+
+// ProductImage es una imagen subida para un producto, con su miniatura.
+// Solo se modifican a través de los endpoints de imágenes.
+type ProductImage struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+	ContentType  string `json:"contentType"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// Variant busca una variante por su ID.
+func (p Product) Variant(id string) (ProductVariant, bool) {
+	for _, v := range p.Variants {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return ProductVariant{}, false
+}
+
+// PriceFor devuelve el precio de la variante indicada, o el del producto si no tiene precio propio.
+func (p Product) PriceFor(variantID string) Money {
+	if v, ok := p.Variant(variantID); ok && v.Price != nil {
+		return *v.Price
+	}
+	return p.Price
+}
+
+// StockFor devuelve el stock de la variante indicada o, sin variante, el del producto.
+func (p Product) StockFor(variantID string) (int, bool) {
+	if variantID == "" {
+		return p.Stock, len(p.Variants) == 0
+	}
+	v, ok := p.Variant(variantID)
+	return v.Stock, ok
+}
+
+// AdjustStock suma delta al stock de la variante (o del producto si variantID está vacío)
+// y mantiene el stock del producto como suma de sus variantes.
+func (p *Product) AdjustStock(variantID string, delta int) {
+	if variantID == "" {
+		p.Stock += delta
+		return
+	}
+	variants := make([]ProductVariant, len(p.Variants))
+	copy(variants, p.Variants)
+	for i := range variants {
+		if variants[i].ID == variantID {
+			variants[i].Stock += delta
+		}
+	}
+	p.Variants = variants
+	p.SyncStock()
+}
+
+// SyncStock recalcula el stock del producto a partir de sus variantes, si las tiene.
+func (p *Product) SyncStock() {
+	if len(p.Variants) == 0 {
+		return
+	}
+	p.Stock = 0
+	for _, v := range p.Variants {
+		p.Stock += v.Stock
+	}
 }
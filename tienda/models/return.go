@@ -0,0 +1,130 @@
+package models
+
+import "time"
+
+// ReturnStatus representa la etapa de una devolución.
+type ReturnStatus string
+
+const (
+	ReturnRequested ReturnStatus = "requested" // Solicitada por el cliente, pendiente de revisión.
+	ReturnApproved  ReturnStatus = "approved"  // Aceptada por el personal; se espera la mercancía.
+	ReturnRejected  ReturnStatus = "rejected"  // Rechazada por el personal.
+	ReturnReceived  ReturnStatus = "received"  // La mercancía llegó a la tienda.
+	ReturnRefunding ReturnStatus = "refunding" // Reembolso en curso con el proveedor de pagos.
+	ReturnRefunded  ReturnStatus = "refunded"  // Reembolso emitido; la devolución terminó.
+)
+
+// returnTransitions define los cambios de estado permitidos desde cada estado.
+var returnTransitions = map[ReturnStatus][]ReturnStatus{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived, ReturnRejected},
+	ReturnReceived:  {ReturnRefunding, ReturnRejected},
+	ReturnRefunding: {ReturnRefunded, ReturnReceived}, // Vuelve a received si el reembolso falla.
+	ReturnRejected:  {},
+	ReturnRefunded:  {},
+}
+
+// Valid indica si el estado es uno de los reconocidos.
+func (s ReturnStatus) Valid() bool {
+	_, ok := returnTransitions[s]
+	return ok
+}
+
+// CanTransitionTo indica si la devolución puede pasar del estado actual al siguiente.
+func (s ReturnStatus) CanTransitionTo(next ReturnStatus) bool {
+	for _, allowed := range returnTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Open indica si la devolución sigue en curso, es decir, si sus unidades no pueden
+// incluirse en otra solicitud.
+func (s ReturnStatus) Open() bool {
+	return s == ReturnRequested || s == ReturnApproved || s == ReturnReceived || s == ReturnRefunding
+}
+
+// ReturnItem es una línea de la orden que se devuelve, con el precio al que se compró.
+type ReturnItem struct {
+	ProductID string `json:"productId"`
+	VariantID string `json:"variantId,omitempty"`
+	Name      string `json:"name"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice Money  `json:"unitPrice"`
+	Subtotal  Money  `json:"subtotal"`
+}
+
+// Return es una solicitud de devolución de unidades de una orden (RMA).
+type Return struct {
+	ID          string       `json:"id"`
+	OrderID     string       `json:"orderId"`
+	UserID      string       `json:"userId,omitempty"`
+	Items       []ReturnItem `json:"items"`
+	Reason      string       `json:"reason"`
+	Status      ReturnStatus `json:"status"`
+	Note        string       `json:"note,omitempty"`       // Comentario del personal al aprobar o rechazar.
+	Restocked   bool         `json:"restocked"`            // Las unidades recibidas volvieron al inventario.
+	Refunded    Money        `json:"refunded,omitzero"`    // En refunding, el monto que se está reembolsando.
+	RefundID    string       `json:"refundId,omitempty"`   // Transacción del reembolso en el proveedor de pagos.
+	RefundUntil time.Time    `json:"refundUntil,omitzero"` // Vencimiento del reembolso en curso; luego puede reintentarse.
+	CreatedAt   time.Time    `json:"createdAt"`
+	UpdatedAt   time.Time    `json:"updatedAt"`
+}
+
+// Refunding indica si la devolución tiene un reembolso en curso que no venció en now.
+func (r Return) Refunding(now time.Time) bool {
+	return r.Status == ReturnRefunding && now.Before(r.RefundUntil)
+}
+
+// OrderItemIndex devuelve la posición de la línea de la orden con ese producto y variante.
+func (o Order) OrderItemIndex(productID, variantID string) int {
+	for i, item := range o.Items {
+		if item.ProductID == productID && item.VariantID == variantID {
+			return i
+		}
+	}
+	return -1
+}
+
+// FullyReturned indica si se devolvieron todas las unidades de la orden.
+func (o Order) FullyReturned() bool {
+	for _, item := range o.Items {
+		if item.Returned < item.Quantity {
+			return false
+		}
+	}
+	return len(o.Items) > 0
+}
+
+// ReturnValue calcula cuánto pagó el cliente por las líneas devueltas: su parte del total
+// de la orden sin el envío, en proporción a su precio, de modo que incluye los descuentos
+// y los impuestos que se cobraron. Redondea hacia abajo.
+func (o Order) ReturnValue(items []ReturnItem) Money {
+	var value int64
+	for _, item := range items {
+		value += item.Subtotal.Amount
+	}
+	paid := o.Total.Sub(o.Shipping)
+	if o.Subtotal.Amount <= 0 {
+		return Money{Currency: paid.CurrencyCode()}
+	}
+	return Money{Amount: paid.Amount * value / o.Subtotal.Amount, Currency: paid.CurrencyCode()}
+}
+
+// AddReturned suma las unidades devueltas a las líneas de la orden. Devuelve false, sin
+// modificar la orden, si alguna línea no existe o quedaría con más devueltas que compradas.
+func (o *Order) AddReturned(items []ReturnItem) bool {
+	updated := make([]OrderItem, len(o.Items))
+	copy(updated, o.Items)
+	for _, item := range items {
+		i := o.OrderItemIndex(item.ProductID, item.VariantID)
+		if i < 0 || item.Quantity <= 0 || updated[i].Returned+item.Quantity > updated[i].Quantity {
+			return false
+		}
+		updated[i].Returned += item.Quantity
+	}
+	o.Items = updated
+	return true
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultTaxClass es la clase de impuesto de los productos que no indican otra.
+const DefaultTaxClass = "standard"
+
+// DefaultRegion es la región de destino que se usa para los impuestos cuando el carrito
+// no indica una (código ISO 3166-1 o 3166-2, p. ej. "EC" o "US-CA"). Vacía, solo se
+// aplican las reglas sin región.
+var DefaultRegion = ""
+
+// regionPattern acepta códigos ISO 3166-1 alfa-2 y subdivisiones ISO 3166-2.
+var regionPattern = regexp.MustCompile(`^[A-Z]{2}(-[A-Z0-9]{1,3})?$`)
+
+// NormalizeRegion quita espacios y pasa la región a mayúsculas.
+func NormalizeRegion(region string) string {
+	return strings.ToUpper(strings.TrimSpace(region))
+}
+
+// ValidRegion indica si el código tiene la forma de un país o una subdivisión ISO.
+func ValidRegion(region string) bool {
+	return regionPattern.MatchString(region)
+}
+
+// ErrInvalidTaxRate indica que una tasa no es un porcentaje decimal válido.
+var ErrInvalidTaxRate = errors.New("tasa de impuesto inválida")
+
+// TaxRate es un porcentaje exacto expresado en centésimas de punto: 1500 = 15 %.
+type TaxRate int64
+
+// ParseTaxRate interpreta un porcentaje decimal ("15", "12.5"); admite hasta dos decimales.
+func ParseTaxRate(s string) (TaxRate, error) {
+	rate, err := parseDecimal(s, 2)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidTaxRate, err)
+	}
+	return TaxRate(rate), nil
+}
+
+// String devuelve el porcentaje sin ceros sobrantes, p. ej. "15" o "12.5".
+func (r TaxRate) String() string {
+	sign, n := "", int64(r)
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	s := strings.TrimRight(fmt.Sprintf("%d.%02d", n/100, n%100), "0")
+	return sign + strings.TrimSuffix(s, ".")
+}
+
+// MarshalJSON escribe la tasa como número JSON (15 o 12.5).
+func (r TaxRate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalJSON acepta la tasa como número o como decimal entre comillas.
+func (r *TaxRate) UnmarshalJSON(data []byte) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	s, err := unquoteNumber(data)
+	if err != nil {
+		return err
+	}
+	parsed, err := ParseTaxRate(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// TaxRule define el impuesto de una clase de productos en una región de destino.
+type TaxRule struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`      // Nombre visible, p. ej. "IVA".
+	TaxClass  string  `json:"taxClass"`  // Clase de impuesto de los productos a los que aplica.
+	Region    string  `json:"region"`    // País ("EC"), subdivisión ("US-CA") o vacío para cualquier destino.
+	Rate      TaxRate `json:"rate"`      // Porcentaje, p. ej. 15 o 12.5.
+	Inclusive bool    `json:"inclusive"` // Si los precios del catálogo ya incluyen el impuesto.
+}
+
+// TaxLine es el impuesto calculado para una regla sobre las líneas de un carrito u orden.
+type TaxLine struct {
+	RuleID    string  `json:"ruleId"`
+	Name      string  `json:"name"`
+	TaxClass  string  `json:"taxClass"`
+	Region    string  `json:"region,omitempty"` // Región de destino usada para el cálculo.
+	Rate      TaxRate `json:"rate"`
+	Inclusive bool    `json:"inclusive"`
+	Taxable   Money   `json:"taxable"` // Base tras descuentos; incluye el impuesto si Inclusive.
+	Amount    Money   `json:"amount"`
+}
+
+// MatchesRegion indica si la regla aplica al destino: una regla de país aplica también
+// a sus subdivisiones y una regla sin región aplica a cualquier destino.
+func (t TaxRule) MatchesRegion(region string) bool {
+	return t.Region == "" || t.Region == region || strings.HasPrefix(region, t.Region+"-")
+}
+
+// Compute calcula el impuesto sobre base, redondeado a la unidad mínima más cercana.
+// Si la regla es inclusiva, el impuesto se extrae de base en lugar de sumarse.
+func (t TaxRule) Compute(base Money) Money {
+	divisor := int64(10000)
+	if t.Inclusive {
+		divisor += int64(t.Rate)
+	}
+	amount := (base.Amount*int64(t.Rate) + divisor/2) / divisor
+	return Money{Amount: amount, Currency: base.CurrencyCode()}
+}
+
+// FindTaxRule elige la regla más específica para la clase y la región de destino:
+// la subdivisión antes que el país, y el país antes que la regla sin región.
+func FindTaxRule(rules []TaxRule, taxClass, region string) (TaxRule, bool) {
+	var best TaxRule
+	found := false
+	for _, rule := range rules {
+		if rule.TaxClass != taxClass || !rule.MatchesRegion(region) {
+			continue
+		}
+		if !found || len(rule.Region) > len(best.Region) {
+			best, found = rule, true
+		}
+	}
+	return best, found
+}
+
+// EffectiveTaxClass devuelve la clase de impuesto del producto, o la estándar si no tiene.
+func (p Product) EffectiveTaxClass() string {
+	if p.TaxClass == "" {
+		return DefaultTaxClass
+	}
+	return p.TaxClass
+}
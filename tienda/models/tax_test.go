@@ -0,0 +1,87 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseTaxRate(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    TaxRate
+		str     string
+		wantErr bool
+	}{
+		{input: "15", want: 1500, str: "15"},
+		{input: "12.5", want: 1250, str: "12.5"},
+		{input: "7.25", want: 725, str: "7.25"},
+		{input: "0", want: 0, str: "0"},
+		{input: "quince", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTaxRate(tt.input)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidTaxRate) {
+				t.Errorf("ParseTaxRate(%q) error = %v, se esperaba ErrInvalidTaxRate", tt.input, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || got.String() != tt.str {
+			t.Errorf("ParseTaxRate(%q) = %d (%s), %v; se esperaba %d (%s)", tt.input, got, got, err, tt.want, tt.str)
+		}
+	}
+}
+
+func TestTaxRuleCompute(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      TaxRate
+		inclusive bool
+		base      int64
+		want      int64
+	}{
+		{name: "se suma al precio", rate: 1500, base: 10000, want: 1500},
+		{name: "redondea al centavo más cercano", rate: 1250, base: 999, want: 125},
+		{name: "la mitad redondea hacia arriba", rate: 1000, base: 5, want: 1},
+		{name: "incluido en el precio", rate: 1500, inclusive: true, base: 11500, want: 1500},
+		{name: "incluido con redondeo", rate: 2100, inclusive: true, base: 1000, want: 174},
+		{name: "tasa cero", rate: 0, base: 10000, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := TaxRule{Rate: tt.rate, Inclusive: tt.inclusive}
+			if got := rule.Compute(NewMoney(tt.base)); got.Amount != tt.want {
+				t.Errorf("Compute(%d) = %d, se esperaba %d", tt.base, got.Amount, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindTaxRule(t *testing.T) {
+	rules := []TaxRule{
+		{ID: "general", TaxClass: "standard"},
+		{ID: "us", TaxClass: "standard", Region: "US"},
+		{ID: "us-ca", TaxClass: "standard", Region: "US-CA"},
+		{ID: "libros-ec", TaxClass: "books", Region: "EC"},
+	}
+	tests := []struct {
+		taxClass, region string
+		want             string // ID de la regla; vacío si ninguna aplica.
+	}{
+		{taxClass: "standard", region: "US-CA", want: "us-ca"},
+		{taxClass: "standard", region: "US-NY", want: "us"},
+		{taxClass: "standard", region: "US", want: "us"},
+		{taxClass: "standard", region: "EC", want: "general"},
+		{taxClass: "standard", region: "", want: "general"},
+		{taxClass: "books", region: "EC", want: "libros-ec"},
+		{taxClass: "books", region: "EC-P", want: "libros-ec"},
+		{taxClass: "books", region: "US", want: ""},
+		{taxClass: "food", region: "EC", want: ""},
+	}
+	for _, tt := range tests {
+		rule, ok := FindTaxRule(rules, tt.taxClass, tt.region)
+		if got := map[bool]string{true: rule.ID}[ok]; got != tt.want {
+			t.Errorf("FindTaxRule(%s, %q) = %q, se esperaba %q", tt.taxClass, tt.region, got, tt.want)
+		}
+	}
+}
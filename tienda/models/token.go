@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// RefreshToken representa un token de refresco emitido a un usuario.
+// Solo se guarda el hash del token; el valor original se entrega una única vez al cliente.
+type RefreshToken struct {
+	TokenHash string    `json:"-"`
+	UserID    string    `json:"userId"`
+	FamilyID  string    `json:"familyId"` // Agrupa todos los tokens derivados de un mismo inicio de sesión.
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+	Used      bool      `json:"used"`    // Ya fue canjeado por un token nuevo (rotación).
+	Revoked   bool      `json:"revoked"` // Invalidado por logout o por detección de reutilización.
+}
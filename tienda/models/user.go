@@ -1,8 +1,27 @@
 package models
 
+// Role define el nivel de acceso de un usuario.
+type Role string
+
+const (
+	RoleCustomer Role = "customer" // Cliente de la tienda (rol por defecto).
+	RoleStaff    Role = "staff"    // Personal que consulta reportes y gestiona carritos.
+	RoleAdmin    Role = "admin"    // Administrador con control total del catálogo y usuarios.
+)
+
+// Valid indica si el rol es uno de los reconocidos por el sistema.
+func (r Role) Valid() bool {
+	switch r {
+	case RoleCustomer, RoleStaff, RoleAdmin:
+		return true
+	}
+	return false
+}
+
 // User define la estructura de un usuario.
 type User struct {
 	ID       string `json:"id"`
 	Username string `json:"username"`
 	Password string `json:"-"` // No se expone en respuestas JSON.
+	Role     Role   `json:"role"`
 }
@@ -0,0 +1,121 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"tienda/models"
+
+	"github.com/google/uuid"
+)
+
+// DefaultDeclineCards son las tarjetas de prueba que el proveedor falso rechaza, con el
+// código de rechazo de cada una. Cualquier otra tarjeta válida se aprueba.
+var DefaultDeclineCards = map[string]string{
+	"4000000000000002": "card_declined",
+	"4000000000009995": "insufficient_funds",
+	"4000000000000069": "expired_card",
+	"4000000000000119": "processing_error",
+}
+
+// declineMessages traduce los códigos de rechazo conocidos; los demás usan un mensaje genérico.
+var declineMessages = map[string]string{
+	"card_declined":      "la tarjeta fue rechazada",
+	"insufficient_funds": "fondos insuficientes",
+	"expired_card":       "la tarjeta está vencida",
+	"processing_error":   "error al procesar la tarjeta, intente de nuevo",
+}
+
+// Prefijos de los IDs que genera el proveedor falso, para reconocer sus propias transacciones.
+const (
+	fakeAuthPrefix    = "fake_auth_"
+	fakeCapturePrefix = "fake_cap_"
+)
+
+// FakeProvider es un proveedor de pagos local para desarrollo y pruebas. Es determinista:
+// el resultado depende solo de la tarjeta (las de su lista de rechazos se rechazan con su
+// código y las demás se aprueban) y no guarda estado, así que sigue funcionando tras
+// reiniciar el servidor: las transacciones con clave de idempotencia toman su ID de la
+// clave, así que repetirla devuelve la misma transacción. Los montos a capturar o reembolsar los valida quien lo llama.
+type FakeProvider struct {
+	declines map[string]string
+}
+
+// NewFakeProvider crea el proveedor falso con la lista de tarjetas a rechazar
+// (número → código de rechazo). Con nil usa DefaultDeclineCards.
+func NewFakeProvider(declines map[string]string) *FakeProvider {
+	if declines == nil {
+		declines = DefaultDeclineCards
+	}
+	return &FakeProvider{declines: declines}
+}
+
+// ParseDeclineCards interpreta una lista "número:código,número:código". Sin código se usa card_declined.
+func ParseDeclineCards(s string) (map[string]string, error) {
+	cards := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		number, code, _ := strings.Cut(entry, ":")
+		card := Card{Number: number}
+		card.Normalize()
+		if !digitsOnly(card.Number) {
+			return nil, fmt.Errorf("número de tarjeta inválido: %q", number)
+		}
+		if code = strings.TrimSpace(code); code == "" {
+			code = "card_declined"
+		}
+		cards[card.Number] = code
+	}
+	return cards, nil
+}
+
+func (p *FakeProvider) Name() string { return "fake" }
+
+func (p *FakeProvider) Authorize(ctx context.Context, req AuthorizeRequest) (Transaction, error) {
+	if code, ok := p.declines[req.Card.Number]; ok {
+		return Transaction{}, newDecline(code)
+	}
+	return Transaction{ID: fakeAuthPrefix + uuid.NewString(), Amount: req.Amount}, nil
+}
+
+func (p *FakeProvider) Capture(ctx context.Context, authorizationID string, amount models.Money, key string) (Transaction, error) {
+	if !strings.HasPrefix(authorizationID, fakeAuthPrefix) {
+		return Transaction{}, &DeclineError{Code: "unknown_authorization", Message: "autorización desconocida"}
+	}
+	return Transaction{ID: fakeCapturePrefix + transactionID(key), Amount: amount}, nil
+}
+
+func (p *FakeProvider) Void(ctx context.Context, authorizationID string, key string) (Transaction, error) {
+	if !strings.HasPrefix(authorizationID, fakeAuthPrefix) {
+		return Transaction{}, &DeclineError{Code: "unknown_authorization", Message: "autorización desconocida"}
+	}
+	return Transaction{ID: "fake_void_" + transactionID(key)}, nil
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, captureID string, amount models.Money, key string) (Transaction, error) {
+	if !strings.HasPrefix(captureID, fakeCapturePrefix) {
+		return Transaction{}, &DeclineError{Code: "unknown_capture", Message: "cobro desconocido"}
+	}
+	return Transaction{ID: "fake_ref_" + transactionID(key), Amount: amount}, nil
+}
+
+// transactionID deriva el ID de una transacción de su clave de idempotencia; sin clave
+// genera uno nuevo.
+func transactionID(key string) string {
+	if key == "" {
+		return uuid.NewString()
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(key)).String()
+}
+
+// newDecline crea el rechazo para un código, con su mensaje en español si se conoce.
+func newDecline(code string) *DeclineError {
+	message, ok := declineMessages[code]
+	if !ok {
+		message = "la tarjeta fue rechazada (" + code + ")"
+	}
+	return &DeclineError{Code: code, Message: message}
+}
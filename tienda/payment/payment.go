@@ -0,0 +1,150 @@
+// Package payment define la interfaz con los proveedores de pago. El checkout autoriza
+// el total de la compra y lo captura al confirmar la orden; las cancelaciones anulan la
+// autorización o reembolsan lo capturado. Para usar un proveedor real basta con
+// implementar Provider.
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"tienda/models"
+	"time"
+)
+
+// Provider es un proveedor de pagos con tarjeta.
+type Provider interface {
+	// Name identifica al proveedor en los intentos de pago registrados en la orden.
+	Name() string
+	// Authorize reserva el monto en la tarjeta sin cobrarlo todavía.
+	Authorize(ctx context.Context, req AuthorizeRequest) (Transaction, error)
+	// Capture cobra una autorización previa (por el monto indicado, que no puede superarla).
+	Capture(ctx context.Context, authorizationID string, amount models.Money, key string) (Transaction, error)
+	// Void anula una autorización que todavía no se capturó.
+	Void(ctx context.Context, authorizationID string, key string) (Transaction, error)
+	// Refund devuelve total o parcialmente un cobro ya capturado.
+	Refund(ctx context.Context, captureID string, amount models.Money, key string) (Transaction, error)
+}
+
+// En Capture, Void y Refund, key es la clave de idempotencia de la operación: si el
+// proveedor ya aceptó una operación con esa clave devuelve la misma transacción sin
+// repetirla, de modo que reintentar un pago cuyo resultado no llegó a registrarse no cobra
+// ni reembolsa dos veces.
+
+// AuthorizeRequest son los datos de una autorización.
+type AuthorizeRequest struct {
+	Amount    models.Money
+	Card      Card
+	Reference string // Identificador propio de la compra, p. ej. el ID del carrito.
+}
+
+// Transaction es el resultado de una operación aceptada por el proveedor.
+type Transaction struct {
+	ID     string
+	Amount models.Money
+}
+
+// DeclineError indica que el proveedor rechazó la operación, p. ej. por fondos
+// insuficientes. Los demás errores indican que no se pudo completar la llamada.
+type DeclineError struct {
+	Code    string // Código del proveedor, p. ej. "insufficient_funds".
+	Message string
+}
+
+func (e *DeclineError) Error() string { return e.Message }
+
+// IsDecline indica si err es un rechazo del proveedor y lo devuelve.
+func IsDecline(err error) (*DeclineError, bool) {
+	var decline *DeclineError
+	ok := errors.As(err, &decline)
+	return decline, ok
+}
+
+// Card son los datos de la tarjeta con la que se paga. Nunca se guardan: la orden solo
+// conserva la marca y los últimos cuatro dígitos.
+type Card struct {
+	Number   string `json:"number"`
+	ExpMonth int    `json:"expMonth"`
+	ExpYear  int    `json:"expYear"`
+	CVC      string `json:"cvc"`
+	Holder   string `json:"holder,omitempty"`
+}
+
+// Normalize quita los espacios y guiones con que suele escribirse el número.
+func (c *Card) Normalize() {
+	c.Number = strings.NewReplacer(" ", "", "-", "").Replace(c.Number)
+	c.CVC = strings.TrimSpace(c.CVC)
+	c.Holder = strings.TrimSpace(c.Holder)
+}
+
+// Validate comprueba el formato de la tarjeta (dígito de control incluido) y que no esté vencida.
+func (c Card) Validate(now time.Time) error {
+	switch {
+	case len(c.Number) < 12 || len(c.Number) > 19 || !digitsOnly(c.Number) || !luhn(c.Number):
+		return errors.New("número de tarjeta inválido")
+	case c.ExpMonth < 1 || c.ExpMonth > 12 || c.ExpYear < 2000:
+		return errors.New("fecha de vencimiento inválida")
+	case (len(c.CVC) != 3 && len(c.CVC) != 4) || !digitsOnly(c.CVC):
+		return errors.New("código de seguridad (cvc) inválido")
+	}
+	// La tarjeta vale hasta el último día de su mes de vencimiento.
+	if !now.Before(time.Date(c.ExpYear, time.Month(c.ExpMonth)+1, 1, 0, 0, 0, 0, time.UTC)) {
+		return errors.New("la tarjeta está vencida")
+	}
+	return nil
+}
+
+// Last4 devuelve los últimos cuatro dígitos del número.
+func (c Card) Last4() string {
+	if len(c.Number) < 4 {
+		return c.Number
+	}
+	return c.Number[len(c.Number)-4:]
+}
+
+// Brand deduce la marca de la tarjeta por su prefijo.
+func (c Card) Brand() string {
+	n := c.Number
+	switch {
+	case strings.HasPrefix(n, "4"):
+		return "visa"
+	case len(n) >= 2 && n[:2] >= "51" && n[:2] <= "55", len(n) >= 2 && n[:2] >= "22" && n[:2] <= "27":
+		return "mastercard"
+	case strings.HasPrefix(n, "34"), strings.HasPrefix(n, "37"):
+		return "amex"
+	}
+	return "desconocida"
+}
+
+// String evita que el número completo termine en un log por descuido.
+func (c Card) String() string {
+	return fmt.Sprintf("%s ****%s", c.Brand(), c.Last4())
+}
+
+func digitsOnly(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// luhn verifica el dígito de control de un número de tarjeta.
+func luhn(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
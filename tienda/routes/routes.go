@@ -3,34 +3,111 @@ package routes
 import (
 	"net/http"
 	"tienda/handlers"
+	"tienda/storage"
+	"tienda/utils"
 
 	"github.com/gorilla/mux"
 )
 
 // RegisterRoutes define todos los endpoints de la API.
-func RegisterRoutes(r *mux.Router, ph *handlers.ProductHandlers, ch *handlers.CartHandlers, uh *handlers.UserHandlers, rh *handlers.ReportHandlers) {
+func RegisterRoutes(r *mux.Router, ph *handlers.ProductHandlers, ih *handlers.ImageHandlers, cth *handlers.CategoryHandlers, cph *handlers.CouponHandlers, th *handlers.TaxHandlers, ah *handlers.AddressHandlers, ch *handlers.CartHandlers, uh *handlers.UserHandlers, rh *handlers.ReportHandlers, oh *handlers.OrderHandlers, rth *handlers.ReturnHandlers, users storage.UserStorer, tm *utils.TokenManager, idempotent mux.MiddlewareFunc) {
+	auth := utils.AuthMiddleware(tm, users)
+	// withPermission exige un token válido y además el permiso indicado.
+	// idempotent solo actúa sobre los POST que envían la cabecera Idempotency-Key.
+	withPermission := func(perm utils.Permission, h http.HandlerFunc) http.Handler {
+		return auth(utils.RequirePermission(perm)(idempotent(h)))
+	}
+
 	// Rutas de Usuario
 	r.HandleFunc("/register", uh.RegisterHandler).Methods("POST")
 	r.HandleFunc("/login", uh.LoginHandler).Methods("POST")
+	r.HandleFunc("/token/refresh", uh.RefreshHandler).Methods("POST")
+	r.HandleFunc("/logout", uh.LogoutHandler).Methods("POST")
+	r.Handle("/api/users/{id}/role", withPermission(utils.PermUsersManage, uh.UpdateUserRoleHandler)).Methods("PUT")
+
+	// Rutas que requieren un token de acceso válido.
+	protected := r.PathPrefix("/api/me").Subrouter()
+	protected.Use(auth, idempotent)
+	protected.HandleFunc("", uh.MeHandler).Methods("GET")
+	protected.HandleFunc("/cart", ch.GetMyCartHandler).Methods("GET")
+	protected.HandleFunc("/orders", oh.GetMyOrdersHandler).Methods("GET")
+	protected.HandleFunc("/returns", rth.GetMyReturnsHandler).Methods("GET")
+	protected.HandleFunc("/addresses", ah.GetAddressesHandler).Methods("GET")
+	protected.HandleFunc("/addresses", ah.CreateAddressHandler).Methods("POST")
+	protected.HandleFunc("/addresses/{id}", ah.GetAddressHandler).Methods("GET")
+	protected.HandleFunc("/addresses/{id}", ah.UpdateAddressHandler).Methods("PUT")
+	protected.HandleFunc("/addresses/{id}", ah.DeleteAddressHandler).Methods("DELETE")
 
-	// Rutas de Productos
+	// Rutas de Productos (la lectura es pública, la modificación requiere permisos de catálogo)
 	r.HandleFunc("/api/products", ph.GetProductsHandler).Methods("GET")
-	r.HandleFunc("/api/products", ph.CreateProductHandler).Methods("POST")
-	r.HandleFunc("/api/products/batch", ph.CreateProductsBatchHandler).Methods("POST")
+	r.Handle("/api/products", withPermission(utils.PermCatalogWrite, ph.CreateProductHandler)).Methods("POST")
+	r.Handle("/api/products/batch", withPermission(utils.PermCatalogWrite, ph.CreateProductsBatchHandler)).Methods("POST")
 	r.HandleFunc("/api/products/{id}", ph.GetProductHandler).Methods("GET")
-	r.HandleFunc("/api/products/{id}", ph.UpdateProductHandler).Methods("PUT")
-	r.HandleFunc("/api/products/{id}", ph.DeleteProductHandler).Methods("DELETE")
-
-	// Rutas de Carrito
-	r.HandleFunc("/api/cart", ch.CreateCartHandler).Methods("POST")
-	r.HandleFunc("/api/cart/{cartId}", ch.GetCartHandler).Methods("GET")
-	r.HandleFunc("/api/cart/{cartId}/add", ch.AddItemToCartHandler).Methods("POST")
-	r.HandleFunc("/api/cart/{cartId}", ch.DeleteCartHandler).Methods("DELETE")
-	r.HandleFunc("/api/cart/{cartId}/item/{productId}", ch.RemoveItemFromCartHandler).Methods("DELETE")
-	r.HandleFunc("/api/cart/{cartId}/checkout", ch.CheckoutHandler).Methods("POST")
-
-	// Ruta de Reportes
-	r.HandleFunc("/api/reports/top-selling", rh.TopSellingHandler).Methods("GET")
+	r.Handle("/api/products/{id}", withPermission(utils.PermCatalogWrite, ph.UpdateProductHandler)).Methods("PUT")
+	r.Handle("/api/products/{id}", withPermission(utils.PermCatalogWrite, ph.DeleteProductHandler)).Methods("DELETE")
+
+	// Rutas de Imágenes de producto (los archivos se sirven públicamente con caché larga)
+	r.Handle("/api/products/{id}/images", withPermission(utils.PermCatalogWrite, ih.UploadProductImagesHandler)).Methods("POST")
+	r.Handle("/api/products/{id}/images/order", withPermission(utils.PermCatalogWrite, ih.ReorderProductImagesHandler)).Methods("PUT")
+	r.Handle("/api/products/{id}/images/{imageId}", withPermission(utils.PermCatalogWrite, ih.DeleteProductImageHandler)).Methods("DELETE")
+	r.HandleFunc("/api/images/{key}", ih.ServeImageHandler).Methods("GET", "HEAD")
+
+	// Rutas de Categorías (la lectura es pública, la modificación requiere permisos de catálogo)
+	r.HandleFunc("/api/categories", cth.GetCategoriesHandler).Methods("GET")
+	r.Handle("/api/categories", withPermission(utils.PermCatalogWrite, cth.CreateCategoryHandler)).Methods("POST")
+	r.HandleFunc("/api/categories/{id}", cth.GetCategoryHandler).Methods("GET")
+	r.Handle("/api/categories/{id}", withPermission(utils.PermCatalogWrite, cth.UpdateCategoryHandler)).Methods("PUT")
+	r.Handle("/api/categories/{id}", withPermission(utils.PermCatalogWrite, cth.DeleteCategoryHandler)).Methods("DELETE")
+
+	// Rutas de Cupones (solo administración; los clientes los aplican desde el carrito)
+	r.Handle("/api/coupons", withPermission(utils.PermCouponsManage, cph.GetCouponsHandler)).Methods("GET")
+	r.Handle("/api/coupons", withPermission(utils.PermCouponsManage, cph.CreateCouponHandler)).Methods("POST")
+	r.Handle("/api/coupons/{id}", withPermission(utils.PermCouponsManage, cph.GetCouponHandler)).Methods("GET")
+	r.Handle("/api/coupons/{id}", withPermission(utils.PermCouponsManage, cph.UpdateCouponHandler)).Methods("PUT")
+	r.Handle("/api/coupons/{id}", withPermission(utils.PermCouponsManage, cph.DeleteCouponHandler)).Methods("DELETE")
+
+	// Rutas de Impuestos (solo administración)
+	r.Handle("/api/tax-rules", withPermission(utils.PermTaxesManage, th.GetTaxRulesHandler)).Methods("GET")
+	r.Handle("/api/tax-rules", withPermission(utils.PermTaxesManage, th.CreateTaxRuleHandler)).Methods("POST")
+	r.Handle("/api/tax-rules/{id}", withPermission(utils.PermTaxesManage, th.GetTaxRuleHandler)).Methods("GET")
+	r.Handle("/api/tax-rules/{id}", withPermission(utils.PermTaxesManage, th.UpdateTaxRuleHandler)).Methods("PUT")
+	r.Handle("/api/tax-rules/{id}", withPermission(utils.PermTaxesManage, th.DeleteTaxRuleHandler)).Methods("DELETE")
+
+	// Rutas de Carrito (admiten invitados; el token, si se envía, identifica al dueño)
+	cart := r.PathPrefix("/api/cart").Subrouter()
+	cart.Use(utils.OptionalAuthMiddleware(tm, users), idempotent)
+	cart.HandleFunc("", ch.CreateCartHandler).Methods("POST")
+	cart.HandleFunc("/{cartId}", ch.GetCartHandler).Methods("GET")
+	cart.HandleFunc("/{cartId}/add", ch.AddItemToCartHandler).Methods("POST")
+	cart.HandleFunc("/{cartId}", ch.DeleteCartHandler).Methods("DELETE")
+	cart.HandleFunc("/{cartId}/item/{productId}", ch.UpdateItemQuantityHandler).Methods("PUT")
+	cart.HandleFunc("/{cartId}/item/{productId}", ch.RemoveItemFromCartHandler).Methods("DELETE")
+	cart.HandleFunc("/{cartId}/items", ch.ReplaceItemsHandler).Methods("PUT")
+	cart.HandleFunc("/{cartId}/coupon", ch.ApplyCouponHandler).Methods("POST")
+	cart.HandleFunc("/{cartId}/coupon", ch.RemoveCouponHandler).Methods("DELETE")
+	cart.HandleFunc("/{cartId}/region", ch.SetCartRegionHandler).Methods("PUT")
+	cart.HandleFunc("/{cartId}/shipping-rates", ch.ShippingRatesHandler).Methods("POST")
+	cart.HandleFunc("/{cartId}/checkout", ch.CheckoutHandler).Methods("POST")
+
+	// Rutas de Órdenes
+	r.Handle("/api/orders", withPermission(utils.PermOrdersManage, oh.GetOrdersHandler)).Methods("GET")
+	r.Handle("/api/orders/{id}", auth(http.HandlerFunc(oh.GetOrderHandler))).Methods("GET")
+	r.Handle("/api/orders/{id}/status", withPermission(utils.PermOrdersManage, oh.UpdateOrderStatusHandler)).Methods("PUT")
+	r.Handle("/api/orders/{id}/cancel", auth(idempotent(http.HandlerFunc(oh.CancelOrderHandler)))).Methods("POST")
+
+	// Rutas de Devoluciones (el cliente las solicita; el personal las gestiona)
+	r.Handle("/api/orders/{id}/returns", auth(idempotent(http.HandlerFunc(rth.RequestReturnHandler)))).Methods("POST")
+	r.Handle("/api/orders/{id}/returns", auth(http.HandlerFunc(rth.GetOrderReturnsHandler))).Methods("GET")
+	r.Handle("/api/returns", withPermission(utils.PermOrdersManage, rth.GetReturnsHandler)).Methods("GET")
+	r.Handle("/api/returns/{id}", auth(http.HandlerFunc(rth.GetReturnHandler))).Methods("GET")
+	r.Handle("/api/returns/{id}/approve", withPermission(utils.PermOrdersManage, rth.ApproveReturnHandler)).Methods("POST")
+	r.Handle("/api/returns/{id}/reject", withPermission(utils.PermOrdersManage, rth.RejectReturnHandler)).Methods("POST")
+	r.Handle("/api/returns/{id}/receive", withPermission(utils.PermOrdersManage, rth.ReceiveReturnHandler)).Methods("POST")
+	r.Handle("/api/returns/{id}/refund", withPermission(utils.PermOrdersManage, rth.RefundReturnHandler)).Methods("POST")
+
+	// Rutas de Reportes
+	r.Handle("/api/reports/top-selling", withPermission(utils.PermReportsRead, rh.TopSellingHandler)).Methods("GET")
+	r.Handle("/api/reports/abandoned-carts", withPermission(utils.PermReportsRead, rh.AbandonedCartsHandler)).Methods("GET")
 
 	// Ruta de bienvenida
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,114 @@
+package shipping
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"tienda/models"
+)
+
+// methodConfig es la forma en JSON de un método de envío en el archivo de configuración.
+type methodConfig struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Type      string          `json:"type"`      // "flat" o "weight".
+	Amount    *models.Money   `json:"amount"`    // Para "flat".
+	Brackets  []WeightBracket `json:"brackets"`  // Para "weight", ordenados por peso.
+	FreeAbove *models.Money   `json:"freeAbove"` // Opcional: envío gratis desde este subtotal.
+	Countries []string        `json:"countries"`
+}
+
+// DefaultMethods son los métodos que se usan si no se indica un archivo de configuración:
+// envío estándar con tarifa plana (gratis desde 50) y envío exprés según el peso.
+func DefaultMethods() Methods {
+	return Methods{
+		{
+			ID:   "standard",
+			Name: "Envío estándar",
+			Calculator: FreeAbove{
+				Threshold: models.NewMoney(5000),
+				Next:      FlatRate{Amount: models.NewMoney(500)},
+			},
+		},
+		{
+			ID:   "express",
+			Name: "Envío exprés",
+			Calculator: WeightTable{Brackets: []WeightBracket{
+				{UpToGrams: 1000, Amount: models.NewMoney(800)},
+				{UpToGrams: 5000, Amount: models.NewMoney(1500)},
+				{UpToGrams: 20000, Amount: models.NewMoney(3000)},
+			}},
+		},
+	}
+}
+
+// LoadMethods lee los métodos de envío de un archivo JSON con un arreglo de métodos.
+// Con path vacío devuelve DefaultMethods.
+func LoadMethods(path string) (Methods, error) {
+	if path == "" {
+		return DefaultMethods(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error al leer %s: %w", path, err)
+	}
+	var configs []methodConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("configuración de envíos inválida en %s: %w", path, err)
+	}
+	methods := make(Methods, 0, len(configs))
+	for _, c := range configs {
+		m, err := c.method()
+		if err != nil {
+			return nil, fmt.Errorf("método de envío %q: %w", c.ID, err)
+		}
+		if _, dup := methods.Find(m.ID); dup {
+			return nil, fmt.Errorf("método de envío %q repetido", m.ID)
+		}
+		methods = append(methods, m)
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("%s no define ningún método de envío", path)
+	}
+	return methods, nil
+}
+
+// method valida la configuración y construye la calculadora correspondiente.
+func (c methodConfig) method() (Method, error) {
+	if c.ID == "" || c.Name == "" {
+		return Method{}, fmt.Errorf("id y name son obligatorios")
+	}
+	var calc Calculator
+	switch c.Type {
+	case "flat":
+		if c.Amount == nil || c.Amount.IsNegative() {
+			return Method{}, fmt.Errorf("una tarifa plana requiere amount no negativo")
+		}
+		calc = FlatRate{Amount: *c.Amount}
+	case "weight":
+		if len(c.Brackets) == 0 {
+			return Method{}, fmt.Errorf("una tabla por peso requiere brackets")
+		}
+		if !slices.IsSortedFunc(c.Brackets, func(a, b WeightBracket) int { return a.UpToGrams - b.UpToGrams }) {
+			return Method{}, fmt.Errorf("los tramos deben estar ordenados por upToGrams")
+		}
+		for _, b := range c.Brackets {
+			if b.Amount.IsNegative() {
+				return Method{}, fmt.Errorf("los tramos no pueden tener montos negativos")
+			}
+		}
+		calc = WeightTable{Brackets: c.Brackets}
+	default:
+		return Method{}, fmt.Errorf("type debe ser 'flat' o 'weight'")
+	}
+	if c.FreeAbove != nil {
+		calc = FreeAbove{Threshold: *c.FreeAbove, Next: calc}
+	}
+	countries := make([]string, len(c.Countries))
+	for i, country := range c.Countries {
+		countries[i] = strings.ToUpper(strings.TrimSpace(country))
+	}
+	return Method{ID: c.ID, Name: c.Name, Countries: countries, Calculator: calc}, nil
+}
@@ -0,0 +1,127 @@
+// Package shipping calcula el costo de envío de una compra. Cada método de envío combina
+// un Calculator (tarifa plana, tabla por peso, gratis desde cierto monto...) con las
+// condiciones en las que está disponible; se pueden añadir calculadoras nuevas
+// implementando la interfaz.
+package shipping
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"tienda/models"
+)
+
+// ErrUnavailable indica que el método no atiende el envío (destino o peso fuera de cobertura).
+var ErrUnavailable = errors.New("el método de envío no está disponible para este envío")
+
+// Shipment reúne los datos del envío que usan las calculadoras.
+type Shipment struct {
+	Destination models.Address
+	Subtotal    models.Money // Monto de los productos tras descuentos, sin impuestos.
+	WeightGrams int
+}
+
+// Calculator calcula la tarifa de un envío.
+type Calculator interface {
+	// Rate devuelve el costo del envío, o ErrUnavailable si no puede atenderlo.
+	Rate(s Shipment) (models.Money, error)
+}
+
+// FlatRate cobra el mismo monto por cualquier envío.
+type FlatRate struct {
+	Amount models.Money
+}
+
+func (f FlatRate) Rate(Shipment) (models.Money, error) {
+	return f.Amount, nil
+}
+
+// WeightBracket es un tramo de una tabla por peso: envíos de hasta UpToGrams cuestan Amount.
+type WeightBracket struct {
+	UpToGrams int          `json:"upToGrams"`
+	Amount    models.Money `json:"amount"`
+}
+
+// WeightTable cobra según el primer tramo que cubre el peso del envío. Los tramos deben
+// estar ordenados de menor a mayor; un envío más pesado que el último no está disponible.
+type WeightTable struct {
+	Brackets []WeightBracket
+}
+
+func (t WeightTable) Rate(s Shipment) (models.Money, error) {
+	for _, b := range t.Brackets {
+		if s.WeightGrams <= b.UpToGrams {
+			return b.Amount, nil
+		}
+	}
+	return models.Money{}, ErrUnavailable
+}
+
+// FreeAbove envuelve otra calculadora y no cobra el envío si el subtotal alcanza Threshold.
+type FreeAbove struct {
+	Threshold models.Money
+	Next      Calculator
+}
+
+func (f FreeAbove) Rate(s Shipment) (models.Money, error) {
+	cost, err := f.Next.Rate(s)
+	if err != nil {
+		return models.Money{}, err
+	}
+	if s.Subtotal.Amount >= f.Threshold.Amount {
+		return models.NewMoney(0), nil
+	}
+	return cost, nil
+}
+
+// Method es un método de envío que el cliente puede elegir al comprar.
+type Method struct {
+	ID         string
+	Name       string
+	Countries  []string // Países atendidos; vacío atiende cualquier país.
+	Calculator Calculator
+}
+
+// Quote calcula el costo del envío con este método.
+func (m Method) Quote(s Shipment) (models.Money, error) {
+	if len(m.Countries) > 0 && !slices.Contains(m.Countries, s.Destination.Country) {
+		return models.Money{}, ErrUnavailable
+	}
+	return m.Calculator.Rate(s)
+}
+
+// Quote es la tarifa de un método para un envío concreto.
+type Quote struct {
+	MethodID string       `json:"id"`
+	Name     string       `json:"name"`
+	Amount   models.Money `json:"amount"`
+}
+
+// Methods es el conjunto de métodos de envío configurados.
+type Methods []Method
+
+// Find busca un método por su ID.
+func (ms Methods) Find(id string) (Method, bool) {
+	for _, m := range ms {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return Method{}, false
+}
+
+// Quotes devuelve la tarifa de cada método disponible para el envío, en el orden configurado.
+func (ms Methods) Quotes(s Shipment) ([]Quote, error) {
+	quotes := []Quote{}
+	for _, m := range ms {
+		cost, err := m.Quote(s)
+		if errors.Is(err, ErrUnavailable) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("método %s: %w", m.ID, err)
+		}
+		quotes = append(quotes, Quote{MethodID: m.ID, Name: m.Name, Amount: cost})
+	}
+	return quotes, nil
+}
@@ -0,0 +1,121 @@
+package shipping
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"tienda/models"
+)
+
+func TestDefaultMethodsQuote(t *testing.T) {
+	methods := DefaultMethods()
+	tests := []struct {
+		name     string
+		method   string
+		subtotal int64
+		weight   int
+		want     int64
+		wantErr  error
+	}{
+		{name: "estándar con tarifa plana", method: "standard", subtotal: 4999, weight: 500, want: 500},
+		{name: "estándar gratis desde 50", method: "standard", subtotal: 5000, weight: 500, want: 0},
+		{name: "exprés primer tramo", method: "express", subtotal: 1000, weight: 1000, want: 800},
+		{name: "exprés segundo tramo", method: "express", subtotal: 1000, weight: 1001, want: 1500},
+		{name: "exprés último tramo", method: "express", subtotal: 1000, weight: 20000, want: 3000},
+		{name: "exprés demasiado pesado", method: "express", subtotal: 1000, weight: 20001, wantErr: ErrUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, ok := methods.Find(tt.method)
+			if !ok {
+				t.Fatalf("no existe el método %s", tt.method)
+			}
+			got, err := m.Quote(Shipment{Subtotal: models.NewMoney(tt.subtotal), WeightGrams: tt.weight})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Quote() error = %v, se esperaba %v", err, tt.wantErr)
+			}
+			if err == nil && got.Amount != tt.want {
+				t.Errorf("Quote() = %d, se esperaba %d", got.Amount, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotesSkipsUnavailableMethods(t *testing.T) {
+	methods := Methods{
+		{ID: "local", Name: "Local", Countries: []string{"EC"}, Calculator: FlatRate{Amount: models.NewMoney(300)}},
+		{ID: "mundial", Name: "Mundial", Calculator: FlatRate{Amount: models.NewMoney(2500)}},
+	}
+	tests := []struct {
+		country string
+		want    []string
+	}{
+		{country: "EC", want: []string{"local", "mundial"}},
+		{country: "PE", want: []string{"mundial"}},
+	}
+	for _, tt := range tests {
+		quotes, err := methods.Quotes(Shipment{Destination: models.Address{Country: tt.country}, Subtotal: models.NewMoney(1000)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, q := range quotes {
+			got = append(got, q.MethodID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("métodos para %s = %v, se esperaba %v", tt.country, got, tt.want)
+		}
+	}
+}
+
+func TestLoadMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{name: "tarifa plana con envío gratis", config: `[{"id":"std","name":"Estándar","type":"flat","amount":4.5,"freeAbove":"60","countries":[" ec "]}]`},
+		{name: "tabla por peso", config: `[{"id":"exp","name":"Exprés","type":"weight","brackets":[{"upToGrams":1000,"amount":8},{"upToGrams":5000,"amount":15}]}]`},
+		{name: "sin id", config: `[{"name":"Estándar","type":"flat","amount":4.5}]`, wantErr: true},
+		{name: "tipo desconocido", config: `[{"id":"std","name":"Estándar","type":"gratis"}]`, wantErr: true},
+		{name: "monto negativo", config: `[{"id":"std","name":"Estándar","type":"flat","amount":-1}]`, wantErr: true},
+		{name: "tramos desordenados", config: `[{"id":"exp","name":"Exprés","type":"weight","brackets":[{"upToGrams":5000,"amount":15},{"upToGrams":1000,"amount":8}]}]`, wantErr: true},
+		{name: "método repetido", config: `[{"id":"std","name":"A","type":"flat","amount":1},{"id":"std","name":"B","type":"flat","amount":2}]`, wantErr: true},
+		{name: "sin métodos", config: `[]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "envios.json")
+			if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			methods, err := LoadMethods(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadMethods() error = %v, se esperaba error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(methods) != 1 {
+				t.Fatalf("se cargaron %d métodos, se esperaba 1", len(methods))
+			}
+		})
+	}
+	// El envío gratis y los países normalizados se aplican al cotizar.
+	path := filepath.Join(t.TempDir(), "envios.json")
+	if err := os.WriteFile(path, []byte(tests[0].config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	methods, err := LoadMethods(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for subtotal, want := range map[int64]int64{5999: 450, 6000: 0} {
+		got, err := methods[0].Quote(Shipment{Destination: models.Address{Country: "EC"}, Subtotal: models.NewMoney(subtotal)})
+		if err != nil || got.Amount != want {
+			t.Errorf("Quote(subtotal %d) = %d, %v; se esperaba %d", subtotal, got.Amount, err, want)
+		}
+	}
+}
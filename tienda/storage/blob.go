@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// ErrBlobNotFound se devuelve cuando no existe un archivo con la clave indicada.
+var ErrBlobNotFound = errors.New("archivo no encontrado")
+
+// BlobInfo describe un archivo guardado en el almacén de archivos.
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore guarda archivos binarios (imágenes) identificados por una clave.
+// Permite cambiar el disco local por otro almacenamiento sin tocar los handlers.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get devuelve el contenido listo para http.ServeContent; el llamador debe cerrarlo.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// blobKeyPattern limita las claves a nombres de archivo simples, sin rutas.
+var blobKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// LocalBlobStore implementa BlobStore sobre una carpeta del disco local.
+type LocalBlobStore struct {
+	dir string
+}
+
+var _ BlobStore = (*LocalBlobStore)(nil)
+
+// NewLocalBlobStore crea (si no existe) la carpeta donde se guardan los archivos.
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error al crear la carpeta de archivos %s: %w", dir, err)
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+// path valida la clave y devuelve la ruta del archivo dentro de la carpeta.
+func (b *LocalBlobStore) path(key string) (string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("clave de archivo inválida: %q", key)
+	}
+	return filepath.Join(b.dir, key), nil
+}
+
+// Put escribe el archivo en uno temporal y lo renombra, para no servir nunca uno a medias.
+func (b *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(b.dir, ".subida-*")
+	if err != nil {
+		return fmt.Errorf("error al crear el archivo temporal: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No hace nada si el rename ya se realizó.
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error al escribir %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error al guardar %s: %w", key, err)
+	}
+	return nil
+}
+
+func (b *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, err
+	}
+	return f, BlobInfo{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (b *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// CartSweeper expira en segundo plano los carritos de invitado inactivos, para que los
+// carritos creados y olvidados no se acumulen. Los que tenían productos quedan
+// registrados como abandonados.
+type CartSweeper struct {
+	store CartStorer
+	ttl   time.Duration
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// StartCartSweeper expira al arrancar y después cada interval (0 = 10 minutos) los
+// carritos de invitado que llevan más de ttl sin cambios. Stop lo detiene.
+func StartCartSweeper(store CartStorer, ttl, interval time.Duration) *CartSweeper {
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	sw := &CartSweeper{store: store, ttl: ttl, stop: make(chan struct{}), done: make(chan struct{})}
+	go sw.loop(interval)
+	return sw
+}
+
+// Stop detiene el barrido y espera a que termine el que esté en curso, de modo que el
+// almacén puede cerrarse a continuación.
+func (sw *CartSweeper) Stop() {
+	close(sw.stop)
+	<-sw.done
+}
+
+// loop barre los carritos periódicamente hasta que se llame a Stop.
+func (sw *CartSweeper) loop(interval time.Duration) {
+	defer close(sw.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sw.sweep()
+		select {
+		case <-sw.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep expira los carritos de invitado inactivos desde hace más de ttl.
+func (sw *CartSweeper) sweep() {
+	now := time.Now().UTC()
+	n, err := sw.store.ExpireCarts(context.Background(), now.Add(-sw.ttl), now)
+	if err != nil {
+		log.Printf("Error al expirar los carritos inactivos: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("🧹 %d carritos de invitado expirados por inactividad", n)
+	}
+}
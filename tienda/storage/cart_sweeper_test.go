@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"tienda/models"
+	"time"
+)
+
+// testBackends abre un almacén vacío de cada tipo.
+var testBackends = []struct {
+	name string
+	open func(t *testing.T) Storer
+}{
+	{name: "memoria", open: func(t *testing.T) Storer { return NewMemoryStore() }},
+	{name: "sqlite", open: func(t *testing.T) Storer {
+		s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "tienda.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}},
+}
+
+func TestExpireCarts(t *testing.T) {
+	tests := []struct {
+		name          string
+		userID        string
+		items         bool
+		reserved      bool
+		reservedUntil time.Duration // Vencimiento de la reserva relativo al barrido.
+		touched       bool          // Se usó después del límite de inactividad (p. ej. al comprar).
+		wantExpired   bool
+		wantAbandoned bool
+	}{
+		{name: "invitado vacío", wantExpired: true},
+		{name: "invitado con productos", items: true, wantExpired: true, wantAbandoned: true},
+		{name: "usuario registrado", userID: "u1", items: true},
+		{name: "reserva vigente", items: true, reserved: true, reservedUntil: time.Hour},
+		{name: "reserva vencida", items: true, reserved: true, reservedUntil: -time.Hour, wantExpired: true, wantAbandoned: true},
+		{name: "reserva que vence al barrer", items: true, reserved: true, wantExpired: true, wantAbandoned: true},
+		{name: "compra en curso", items: true, touched: true},
+	}
+	for _, backend := range testBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				s := backend.open(t)
+				product, err := s.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: 5})
+				if err != nil {
+					t.Fatal(err)
+				}
+				cart := models.Cart{UserID: tt.userID, Items: []models.CartItem{}}
+				if tt.items {
+					cart.Items = []models.CartItem{{ProductID: product.ID, Quantity: 2, Price: product.Price}}
+				}
+				if cart, err = s.CreateCart(ctx, cart); err != nil {
+					t.Fatal(err)
+				}
+				now := time.Now().UTC().Add(time.Minute)
+				if tt.reserved {
+					if err := s.ReserveStock(ctx, cart.ID, product.ID, "", 2, now.Add(tt.reservedUntil)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				time.Sleep(time.Millisecond)
+				idleSince := time.Now().UTC()
+				if tt.touched {
+					if err := s.TouchCart(ctx, cart.ID); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				n, err := s.ExpireCarts(ctx, idleSince, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expired := n == 1; expired != tt.wantExpired {
+					t.Errorf("expirados = %d, se esperaba expirar: %v", n, tt.wantExpired)
+				}
+				if _, err := s.GetCartByID(ctx, cart.ID); (err != nil) != tt.wantExpired {
+					t.Errorf("GetCartByID() error = %v, se esperaba eliminado: %v", err, tt.wantExpired)
+				}
+				abandoned, err := s.QueryAbandonedCarts(ctx, time.Time{}, time.Time{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := len(abandoned) == 1; got != tt.wantAbandoned {
+					t.Errorf("abandonados = %d, se esperaba registrar: %v", len(abandoned), tt.wantAbandoned)
+				}
+			})
+		}
+	}
+}
+
+func TestCartSweeperExpiresOnStart(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := backend.open(t)
+			idle, err := s.CreateCart(ctx, models.Cart{Items: []models.CartItem{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(5 * time.Millisecond)
+			fresh, err := s.CreateCart(ctx, models.Cart{Items: []models.CartItem{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// El primer barrido ocurre al arrancar; Stop espera a que termine.
+			StartCartSweeper(s, 5*time.Millisecond, time.Hour).Stop()
+			if _, err := s.GetCartByID(ctx, idle.ID); err == nil {
+				t.Error("el carrito inactivo no se eliminó")
+			}
+			if _, err := s.GetCartByID(ctx, fresh.ID); err != nil {
+				t.Errorf("se eliminó el carrito reciente: %v", err)
+			}
+		})
+	}
+}
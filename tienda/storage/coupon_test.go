@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"tienda/models"
+)
+
+func TestRedeemCouponLimits(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) Storer
+	}{
+		{name: "memoria", open: func(t *testing.T) Storer { return NewMemoryStore() }},
+		{name: "sqlite", open: func(t *testing.T) Storer {
+			s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "tienda.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		}},
+	}
+	tests := []struct {
+		name           string
+		maxUses        int
+		maxUsesPerUser int
+		users          []string // Usuario de cada compra, en orden.
+		want           []error  // Resultado esperado de cada compra.
+	}{
+		{name: "sin límites", users: []string{"ana", "ana", "luis"}, want: []error{nil, nil, nil}},
+		{name: "límite total", maxUses: 2, users: []string{"ana", "luis", "eva"}, want: []error{nil, nil, ErrCouponUsageLimit}},
+		{name: "límite por usuario", maxUsesPerUser: 1, users: []string{"ana", "luis", "ana"}, want: []error{nil, nil, ErrCouponUsageLimit}},
+		{name: "ambos límites", maxUses: 3, maxUsesPerUser: 2, users: []string{"ana", "ana", "ana", "luis", "eva"}, want: []error{nil, nil, ErrCouponUsageLimit, nil, ErrCouponUsageLimit}},
+	}
+	for _, backend := range backends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				s := backend.open(t)
+				coupon, err := s.CreateCoupon(ctx, models.Coupon{Code: "VERANO", Type: models.CouponPercentage, Percent: 10, MaxUses: tt.maxUses, MaxUsesPerUser: tt.maxUsesPerUser})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, user := range tt.users {
+					err := s.RedeemCoupon(ctx, models.CouponRedemption{CouponID: coupon.ID, UserID: user, OrderID: string(rune('a' + i))})
+					if !errors.Is(err, tt.want[i]) {
+						t.Errorf("compra %d de %s: %v, se esperaba %v", i+1, user, err, tt.want[i])
+					}
+				}
+				accepted := 0
+				for _, err := range tt.want {
+					if err == nil {
+						accepted++
+					}
+				}
+				got, err := s.GetCouponByID(ctx, coupon.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Uses != accepted {
+					t.Errorf("usos = %d, se esperaban %d", got.Uses, accepted)
+				}
+			})
+		}
+	}
+}
+
+func TestRedeemCouponReplayIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewPersistentMemoryStore(PersistenceOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coupon, err := s.CreateCoupon(ctx, models.Coupon{Code: "UNAVEZ", Type: models.CouponPercentage, Percent: 10, MaxUsesPerUser: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RedeemCoupon(ctx, models.CouponRedemption{CouponID: coupon.ID, UserID: "ana", OrderID: "o1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Caída entre escribir el snapshot y vaciar el journal: el uso se reaplica sobre un
+	// snapshot que ya lo incluye.
+	journalPath := filepath.Join(dir, journalFileName)
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(journalPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewPersistentMemoryStore(PersistenceOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	uses, err := reopened.CountCouponUses(ctx, coupon.ID, "ana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uses != 1 {
+		t.Errorf("usos de ana = %d, se esperaba 1", uses)
+	}
+	got, err := reopened.GetCouponByID(ctx, coupon.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Uses != 1 {
+		t.Errorf("usos del cupón = %d, se esperaba 1", got.Uses)
+	}
+}
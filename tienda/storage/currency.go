@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"tienda/models"
+)
+
+// ErrCurrencyMismatch indica que los montos guardados están en una moneda distinta de la configurada.
+var ErrCurrencyMismatch = errors.New("la moneda configurada no coincide con la de los datos guardados")
+
+// checkCurrency verifica que los montos guardados en la moneda stored se puedan leer con
+// la moneda de la tienda. Los montos se guardan en unidades mínimas (o como decimales con
+// esos dígitos) sin indicar su moneda, así que leerlos con otra cambiaría su valor.
+// Si stored está vacío y hay datos (hasData), son anteriores a registrar la moneda y se
+// guardaron con dos decimales (ver la migración 5 de SQLite): solo se aceptan si la moneda
+// configurada también usa dos.
+func checkCurrency(stored string, hasData bool) error {
+	configured := models.DefaultCurrency
+	switch {
+	case stored == configured:
+		return nil
+	case stored != "":
+		return fmt.Errorf("%w: los montos están en %s y CURRENCY es %s", ErrCurrencyMismatch, stored, configured)
+	case hasData && models.CurrencyDigits(configured) != 2:
+		return fmt.Errorf("%w: los montos guardados sin moneda usan dos decimales y %s usa %d",
+			ErrCurrencyMismatch, configured, models.CurrencyDigits(configured))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"tienda/models"
+)
+
+// setCurrency cambia la moneda de la tienda durante el test.
+func setCurrency(t *testing.T, currency string) {
+	t.Helper()
+	previous := models.DefaultCurrency
+	models.DefaultCurrency = currency
+	t.Cleanup(func() { models.DefaultCurrency = previous })
+}
+
+func TestStoreCurrencyCheck(t *testing.T) {
+	type store interface {
+		ProductStorer
+		Close() error
+	}
+	backends := []struct {
+		name string
+		open func(dir string) (store, error)
+	}{
+		{name: "memoria", open: func(dir string) (store, error) {
+			return NewPersistentMemoryStore(PersistenceOptions{Dir: dir})
+		}},
+		{name: "sqlite", open: func(dir string) (store, error) {
+			return NewSQLiteStore(filepath.Join(dir, "tienda.db"))
+		}},
+	}
+	tests := []struct {
+		name      string
+		saved     string // Moneda con la que se guardó el producto.
+		reopened  string // Moneda configurada al reabrir.
+		wantError bool
+	}{
+		{name: "misma moneda", saved: "EUR", reopened: "EUR"},
+		{name: "otra moneda con los mismos decimales", saved: "USD", reopened: "EUR", wantError: true},
+		{name: "otra moneda con otros decimales", saved: "USD", reopened: "JPY", wantError: true},
+	}
+	for _, backend := range backends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				dir := t.TempDir()
+				setCurrency(t, tt.saved)
+				s, err := backend.open(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				product, err := s.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(1250), Stock: 1})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				setCurrency(t, tt.reopened)
+				s, err = backend.open(dir)
+				if tt.wantError {
+					if !errors.Is(err, ErrCurrencyMismatch) {
+						t.Fatalf("al reabrir: %v, se esperaba ErrCurrencyMismatch", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				got, err := s.GetProductByID(ctx, product.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Price != product.Price {
+					t.Errorf("precio = %+v, se esperaba %+v", got.Price, product.Price)
+				}
+			})
+		}
+	}
+}
+
+func TestCheckCurrencyLegacyData(t *testing.T) {
+	tests := []struct {
+		configured string
+		hasData    bool
+		wantError  bool
+	}{
+		{configured: "USD", hasData: true},
+		{configured: "EUR", hasData: true},
+		{configured: "JPY", hasData: true, wantError: true},
+		{configured: "KWD", hasData: true, wantError: true},
+		{configured: "JPY", hasData: false},
+	}
+	for _, tt := range tests {
+		setCurrency(t, tt.configured)
+		err := checkCurrency("", tt.hasData)
+		if gotError := errors.Is(err, ErrCurrencyMismatch); gotError != tt.wantError {
+			t.Errorf("checkCurrency(\"\", %v) con %s = %v", tt.hasData, tt.configured, err)
+		}
+	}
+}
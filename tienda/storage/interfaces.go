@@ -1,41 +1,310 @@
 package storage
 
-import "tienda/models"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"tienda/models"
+	"time"
+)
+
+// Errores comunes que los handlers pueden distinguir con errors.Is.
+var (
+	ErrRefreshTokenNotFound   = errors.New("token de refresco no encontrado")
+	ErrRefreshTokenReused     = errors.New("token de refresco reutilizado")
+	ErrRefreshTokenInvalid    = errors.New("token de refresco expirado o revocado")
+	ErrProductNotFound        = errors.New("producto no encontrado")
+	ErrOrderNotFound          = errors.New("orden no encontrada")
+	ErrInvalidTransition      = errors.New("transición de estado no permitida")
+	ErrOrderBusy              = errors.New("la orden tiene otro cambio de estado en curso")
+	ErrCategoryNotFound       = errors.New("categoría no encontrada")
+	ErrCategorySlugTaken      = errors.New("ya existe una categoría con ese slug")
+	ErrParentCategoryNotFound = errors.New("la categoría padre no existe")
+	ErrCategoryCycle          = errors.New("una categoría no puede ser descendiente de sí misma")
+	ErrCategoryHasChildren    = errors.New("la categoría tiene subcategorías")
+	ErrDuplicateSKU           = errors.New("el SKU ya está en uso")
+	ErrCouponNotFound         = errors.New("cupón no encontrado")
+	ErrCouponCodeTaken        = errors.New("ya existe un cupón con ese código")
+	ErrCouponUsageLimit       = errors.New("el cupón alcanzó su límite de usos")
+	ErrTaxRuleNotFound        = errors.New("regla de impuesto no encontrada")
+	ErrTaxRuleConflict        = errors.New("ya existe una regla de impuesto para esa clase y región")
+	ErrAddressNotFound        = errors.New("dirección no encontrada")
+	ErrReturnNotFound         = errors.New("devolución no encontrada")
+	ErrReturnQuantity         = errors.New("la cantidad devuelta supera la comprada")
+)
+
+// StockShortage describe una línea que no puede atenderse con el stock disponible.
+type StockShortage struct {
+	ProductID string `json:"productId"`
+	VariantID string `json:"variantId,omitempty"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+// InsufficientStockError se devuelve cuando una o más líneas superan el stock disponible.
+type InsufficientStockError struct {
+	Items []StockShortage
+}
+
+func (e *InsufficientStockError) Error() string {
+	ids := make([]string, 0, len(e.Items))
+	for _, item := range e.Items {
+		ids = append(ids, fmt.Sprintf("%s (pedido %d, disponible %d)", item.ProductID, item.Requested, item.Available))
+	}
+	return "stock insuficiente para: " + strings.Join(ids, ", ")
+}
 
 // Storer agrupa todas las interfaces de almacenamiento para una fácil inyección.
 type Storer interface {
+	Transactor
 	ProductStorer
+	CategoryStorer
+	CouponStorer
+	TaxStorer
 	CartStorer
+	InventoryStorer
 	UserStorer
+	AddressStorer
+	RefreshTokenStorer
+	IdempotencyStorer
 	OrderStorer
+	ReturnStorer
+}
+
+// Transactor permite agrupar varias operaciones en una unidad de trabajo atómica.
+type Transactor interface {
+	// WithTx ejecuta fn dentro de una transacción: si fn devuelve error ningún cambio
+	// hecho a través de tx se conserva. Dentro de fn solo debe usarse tx, nunca el
+	// almacén original. Una llamada anidada se une a la transacción en curso.
+	WithTx(ctx context.Context, fn func(tx Storer) error) error
+}
+
+// ProductSort indica el campo por el que se ordenan los productos.
+type ProductSort string
+
+const (
+	SortByName  ProductSort = "name"
+	SortByPrice ProductSort = "price"
+	SortByStock ProductSort = "stock"
+)
+
+// Valid indica si el campo de ordenamiento es uno de los admitidos.
+func (s ProductSort) Valid() bool {
+	switch s {
+	case SortByName, SortByPrice, SortByStock:
+		return true
+	}
+	return false
+}
+
+// ProductFilter agrupa los criterios de búsqueda de productos. Los campos vacíos no filtran.
+type ProductFilter struct {
+	Query    string        // Texto buscado en el nombre o la descripción, sin distinguir mayúsculas.
+	MinPrice *models.Money // Precio mínimo, inclusive.
+	MaxPrice *models.Money // Precio máximo, inclusive.
+	InStock  bool          // Solo productos con stock mayor que 0.
+	Category string        // ID de categoría; incluye los productos de sus subcategorías.
+	Sort     ProductSort
+	Desc     bool
+	Offset   int
+	Limit    int // 0 significa sin límite.
 }
 
 // ProductStorer define el contrato para el almacenamiento de productos.
 type ProductStorer interface {
-	GetProducts() ([]models.Product, error)
-	GetProductByID(id string) (models.Product, error)
-	CreateProduct(p models.Product) (models.Product, error)
-	UpdateProduct(id string, p models.Product) (models.Product, error)
-	DeleteProduct(id string) error
-	CreateBatchProducts(products []models.Product) ([]models.Product, error)
+	GetProducts(ctx context.Context) ([]models.Product, error)
+	// QueryProducts devuelve la página de productos que cumple el filtro en el orden
+	// solicitado, junto con el total de coincidencias sin paginar.
+	QueryProducts(ctx context.Context, f ProductFilter) ([]models.Product, int, error)
+	GetProductByID(ctx context.Context, id string) (models.Product, error)
+	CreateProduct(ctx context.Context, p models.Product) (models.Product, error)
+	UpdateProduct(ctx context.Context, id string, p models.Product) (models.Product, error)
+	DeleteProduct(ctx context.Context, id string) error
+	CreateBatchProducts(ctx context.Context, products []models.Product) ([]models.Product, error)
+	// SetProductImages reemplaza la lista ordenada de imágenes de un producto.
+	// CreateProduct y UpdateProduct ignoran las imágenes recibidas y conservan las guardadas.
+	SetProductImages(ctx context.Context, productID string, images []models.ProductImage) (models.Product, error)
+}
+
+// CategoryStorer define el contrato para el árbol de categorías.
+type CategoryStorer interface {
+	GetCategories(ctx context.Context) ([]models.Category, error)
+	GetCategoryByID(ctx context.Context, id string) (models.Category, error)
+	GetCategoryBySlug(ctx context.Context, slug string) (models.Category, error)
+	// CreateCategory y UpdateCategory validan que el padre exista, que el slug sea único
+	// y que el padre no sea la propia categoría ni uno de sus descendientes.
+	CreateCategory(ctx context.Context, c models.Category) (models.Category, error)
+	UpdateCategory(ctx context.Context, id string, c models.Category) (models.Category, error)
+	// DeleteCategory rechaza categorías con hijos y quita la categoría de sus productos.
+	DeleteCategory(ctx context.Context, id string) error
 }
 
 // CartStorer define el contrato para el almacenamiento de carritos.
 type CartStorer interface {
-	GetCartByID(id string) (models.Cart, error)
-	CreateCart(c models.Cart) (models.Cart, error)
-	UpdateCart(id string, c models.Cart) (models.Cart, error)
-	DeleteCart(id string) error
+	GetCartByID(ctx context.Context, id string) (models.Cart, error)
+	GetCartByUserID(ctx context.Context, userID string) (models.Cart, error)
+	// CreateCart y UpdateCart fijan CreatedAt y UpdatedAt; UpdateCart conserva CreatedAt.
+	CreateCart(ctx context.Context, c models.Cart) (models.Cart, error)
+	UpdateCart(ctx context.Context, id string, c models.Cart) (models.Cart, error)
+	DeleteCart(ctx context.Context, id string) error
+	// TouchCart marca el carrito como activo ahora sin cambiar su contenido, para que
+	// ExpireCarts no lo elimine mientras se usa (p. ej. durante la compra).
+	TouchCart(ctx context.Context, id string) error
+	// ExpireCarts elimina los carritos de invitado sin cambios desde idleSince y libera sus
+	// reservas; conserva los que tienen reservas vigentes en now. Los que tenían productos
+	// quedan registrados como abandonados con fecha now. Devuelve cuántos carritos eliminó.
+	ExpireCarts(ctx context.Context, idleSince, now time.Time) (int, error)
+	// QueryAbandonedCarts lista los carritos abandonados que expiraron en [from, to), del
+	// más reciente al más antiguo. Un instante cero no limita.
+	QueryAbandonedCarts(ctx context.Context, from, to time.Time) ([]models.AbandonedCart, error)
+}
+
+// InventoryStorer define el contrato para reservar y descontar stock.
+// El stock disponible de un producto es su Stock menos las reservas vigentes de otros carritos.
+type InventoryStorer interface {
+	// ReserveStock fija en quantity las unidades reservadas de un producto (o de una de sus
+	// variantes) para un carrito hasta expiresAt. Una cantidad 0 libera la reserva.
+	// Devuelve *InsufficientStockError si no hay unidades suficientes.
+	ReserveStock(ctx context.Context, cartID, productID, variantID string, quantity int, expiresAt time.Time) error
+	// CommitStock descuenta el stock de todas las líneas, por variante cuando la tienen,
+	// de forma atómica (todo o nada)
+	// y libera las reservas del carrito. Devuelve *InsufficientStockError con las líneas faltantes.
+	CommitStock(ctx context.Context, cartID string, items []models.CartItem) error
+	// RestockItems devuelve al inventario las unidades de las líneas indicadas.
+	RestockItems(ctx context.Context, items []models.CartItem) error
 }
 
 // UserStorer define el contrato para el almacenamiento de usuarios.
 type UserStorer interface {
-	CreateUser(u models.User) (models.User, error)
-	GetUserByUsername(username string) (models.User, error)
+	CreateUser(ctx context.Context, u models.User) (models.User, error)
+	GetUserByUsername(ctx context.Context, username string) (models.User, error)
+	GetUserByID(ctx context.Context, id string) (models.User, error)
+	UpdateUserRole(ctx context.Context, id string, role models.Role) (models.User, error)
+}
+
+// AddressStorer define el contrato para las direcciones de envío de los usuarios.
+// Todas las operaciones se limitan a las direcciones del usuario indicado: una dirección
+// de otro usuario se trata como inexistente (ErrAddressNotFound).
+type AddressStorer interface {
+	// GetAddresses devuelve las direcciones del usuario en el orden en que se crearon.
+	GetAddresses(ctx context.Context, userID string) ([]models.Address, error)
+	GetAddress(ctx context.Context, userID, id string) (models.Address, error)
+	CreateAddress(ctx context.Context, a models.Address) (models.Address, error)
+	// UpdateAddress conserva el dueño y la fecha de creación.
+	UpdateAddress(ctx context.Context, userID, id string, a models.Address) (models.Address, error)
+	DeleteAddress(ctx context.Context, userID, id string) error
+}
+
+// RefreshTokenStorer define el contrato para los tokens de refresco.
+type RefreshTokenStorer interface {
+	SaveRefreshToken(ctx context.Context, t models.RefreshToken) error
+	// ConsumeRefreshToken marca el token como usado de forma atómica y lo devuelve.
+	// Si ya había sido usado devuelve ErrRefreshTokenReused junto con el token, para
+	// que el llamador pueda revocar toda la familia.
+	ConsumeRefreshToken(ctx context.Context, tokenHash string) (models.RefreshToken, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+}
+
+// IdempotencyStorer define el contrato para las respuestas guardadas por Idempotency-Key.
+// Las claves se identifican por su ámbito (Scope) y su valor (Key).
+type IdempotencyStorer interface {
+	// ReserveIdempotencyKey guarda rec como petición en curso si la clave está libre (no
+	// existe o su registro expiró) y devuelve true. Si la clave está ocupada no modifica
+	// nada y devuelve el registro existente, en curso o completado, con false.
+	// Aprovecha para descartar los registros expirados de cualquier clave.
+	ReserveIdempotencyKey(ctx context.Context, rec models.IdempotencyRecord) (models.IdempotencyRecord, bool, error)
+	// CompleteIdempotencyKey reemplaza la reserva por el registro con la respuesta final.
+	CompleteIdempotencyKey(ctx context.Context, rec models.IdempotencyRecord) error
+	// ReleaseIdempotencyKey elimina la reserva para que la petición pueda reintentarse.
+	ReleaseIdempotencyKey(ctx context.Context, scope, key string) error
+}
+
+// OrderFilter agrupa los criterios de búsqueda de órdenes. Los campos vacíos no filtran.
+type OrderFilter struct {
+	Status models.OrderStatus
+	UserID string
+	From   time.Time // Creadas en o después de este instante.
+	To     time.Time // Creadas antes de este instante.
+	Offset int
+	Limit  int // 0 significa sin límite.
 }
 
-// OrderStorer define el contrato para las órdenes completadas.
+// CouponStorer define el contrato para los cupones de descuento y sus usos.
+type CouponStorer interface {
+	GetCoupons(ctx context.Context) ([]models.Coupon, error)
+	GetCouponByID(ctx context.Context, id string) (models.Coupon, error)
+	// GetCouponByCode busca sin distinguir mayúsculas.
+	GetCouponByCode(ctx context.Context, code string) (models.Coupon, error)
+	// CreateCoupon y UpdateCoupon devuelven ErrCouponCodeTaken si el código ya existe.
+	// UpdateCoupon conserva el contador de usos y la fecha de creación.
+	CreateCoupon(ctx context.Context, c models.Coupon) (models.Coupon, error)
+	UpdateCoupon(ctx context.Context, id string, c models.Coupon) (models.Coupon, error)
+	DeleteCoupon(ctx context.Context, id string) error
+	// CountCouponUses devuelve cuántas compras del usuario usaron el cupón.
+	CountCouponUses(ctx context.Context, couponID, userID string) (int, error)
+	// RedeemCoupon registra un uso verificando, de forma atómica, los límites total y por
+	// usuario. Devuelve ErrCouponUsageLimit si ya se alcanzó alguno.
+	RedeemCoupon(ctx context.Context, r models.CouponRedemption) error
+}
+
+// TaxStorer define el contrato para las reglas de impuestos.
+type TaxStorer interface {
+	// GetTaxRules devuelve las reglas ordenadas por clase y región.
+	GetTaxRules(ctx context.Context) ([]models.TaxRule, error)
+	GetTaxRuleByID(ctx context.Context, id string) (models.TaxRule, error)
+	// CreateTaxRule y UpdateTaxRule devuelven ErrTaxRuleConflict si ya hay otra regla
+	// para la misma clase y región.
+	CreateTaxRule(ctx context.Context, t models.TaxRule) (models.TaxRule, error)
+	UpdateTaxRule(ctx context.Context, id string, t models.TaxRule) (models.TaxRule, error)
+	DeleteTaxRule(ctx context.Context, id string) error
+}
+
+// OrderStorer define el contrato para las órdenes.
 type OrderStorer interface {
-	CreateOrderFromCart(c models.Cart) error
-	GetAllOrders() ([]models.Cart, error)
+	CreateOrder(ctx context.Context, o models.Order) (models.Order, error)
+	GetOrderByID(ctx context.Context, id string) (models.Order, error)
+	GetOrdersByUserID(ctx context.Context, userID string) ([]models.Order, error)
+	GetAllOrders(ctx context.Context) ([]models.Order, error)
+	// QueryOrders devuelve la página de órdenes que cumple el filtro, de la más reciente
+	// a la más antigua, junto con el total de coincidencias sin paginar.
+	QueryOrders(ctx context.Context, f OrderFilter) ([]models.Order, int, error)
+	// UpdateOrderStatus aplica un cambio de estado validado por la máquina de estados y
+	// libera la reserva de la orden. Devuelve ErrOrderNotFound, ErrInvalidTransition o,
+	// si hay vigente una reserva hacia otro estado, ErrOrderBusy.
+	UpdateOrderStatus(ctx context.Context, id string, status models.OrderStatus) (models.Order, error)
+	// ClaimOrderStatus reserva el cambio de la orden a status hasta until, sin aplicarlo,
+	// para liquidar el pago con el proveedor antes de confirmarlo. Devuelve ErrOrderNotFound,
+	// ErrInvalidTransition si el estado actual no lo permite y ErrOrderBusy si ya hay otra
+	// reserva vigente.
+	ClaimOrderStatus(ctx context.Context, id string, status models.OrderStatus, until time.Time) (models.Order, error)
+	// ReleaseOrderStatus libera la reserva de la orden sin cambiar su estado.
+	ReleaseOrderStatus(ctx context.Context, id string) (models.Order, error)
+	// RecordPayment añade un intento de pago a la orden (ver models.Order.RecordPayment).
+	RecordPayment(ctx context.Context, id string, a models.PaymentAttempt) (models.Order, error)
+	// RecordReturnedItems suma las unidades devueltas a las líneas de la orden. Devuelve
+	// ErrReturnQuantity si alguna línea no existe o quedaría con más devueltas que compradas.
+	RecordReturnedItems(ctx context.Context, id string, items []models.ReturnItem) (models.Order, error)
+}
+
+// ReturnFilter agrupa los criterios de búsqueda de devoluciones. Los campos vacíos no filtran.
+type ReturnFilter struct {
+	Status  models.ReturnStatus
+	UserID  string
+	OrderID string
+	Offset  int
+	Limit   int // 0 significa sin límite.
+}
+
+// ReturnStorer define el contrato para las devoluciones de órdenes.
+type ReturnStorer interface {
+	CreateReturn(ctx context.Context, r models.Return) (models.Return, error)
+	GetReturnByID(ctx context.Context, id string) (models.Return, error)
+	// QueryReturns devuelve la página de devoluciones que cumple el filtro, de la más
+	// reciente a la más antigua, junto con el total de coincidencias sin paginar.
+	QueryReturns(ctx context.Context, f ReturnFilter) ([]models.Return, int, error)
+	// UpdateReturn guarda el estado, la nota, la reposición y el reembolso de la devolución,
+	// validando el cambio de estado. Conserva la orden, el dueño, las líneas y el motivo.
+	// Devuelve ErrReturnNotFound o ErrInvalidTransition según corresponda.
+	UpdateReturn(ctx context.Context, id string, r models.Return) (models.Return, error)
 }
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"tienda/models"
+)
+
+// journalFixture son los datos que el escenario escribe antes de reiniciar el almacén.
+type journalFixture struct {
+	product models.Product
+	cart    models.Cart
+	order   models.Order
+}
+
+// writeFixture registra en el almacén un producto, un usuario, un carrito y una orden
+// que descuenta stock.
+func writeFixture(t *testing.T, s *MemoryStore) journalFixture {
+	t.Helper()
+	ctx := context.Background()
+	product, err := s.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateUser(ctx, models.User{Username: "ana", Password: "hash-de-ana"}); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := s.CreateCart(ctx, models.Cart{Items: []models.CartItem{{ProductID: product.ID, Quantity: 2, Price: product.Price}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order models.Order
+	err = s.WithTx(ctx, func(tx Storer) error {
+		if err := tx.CommitStock(ctx, cart.ID, cart.Items); err != nil {
+			return err
+		}
+		order, err = tx.CreateOrder(ctx, models.Order{Items: []models.OrderItem{{ProductID: product.ID, Quantity: 2}}, Status: models.OrderPending})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return journalFixture{product: product, cart: cart, order: order}
+}
+
+func TestPersistentMemoryStoreReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		restart func(t *testing.T, dir string, s *MemoryStore)
+	}{
+		{
+			// Caída sin snapshot: todo se recupera del journal.
+			name:    "solo journal",
+			restart: func(t *testing.T, dir string, s *MemoryStore) {},
+		},
+		{
+			name: "snapshot al cerrar",
+			restart: func(t *testing.T, dir string, s *MemoryStore) {
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			// Caída entre escribir el snapshot y vaciar el journal: los registros se reaplican
+			// sobre un snapshot que ya los incluye.
+			name: "journal ya incluido en el snapshot",
+			restart: func(t *testing.T, dir string, s *MemoryStore) {
+				journalPath := filepath.Join(dir, journalFileName)
+				data, err := os.ReadFile(journalPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(journalPath, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			// Caída a mitad de una escritura: el registro incompleto se descarta.
+			name: "registro final incompleto",
+			restart: func(t *testing.T, dir string, s *MemoryStore) {
+				f, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				if _, err := f.WriteString(`00000000 {"op":"DeleteProduct","id":`); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			s, err := NewPersistentMemoryStore(PersistenceOptions{Dir: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fixture := writeFixture(t, s)
+			tt.restart(t, dir, s)
+
+			reopened, err := NewPersistentMemoryStore(PersistenceOptions{Dir: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			product, err := reopened.GetProductByID(ctx, fixture.product.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if product.Stock != 3 {
+				t.Errorf("stock = %d, se esperaba 3", product.Stock)
+			}
+			user, err := reopened.GetUserByUsername(ctx, "ana")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Password != "hash-de-ana" {
+				t.Errorf("hash de la contraseña = %q, se esperaba conservarlo", user.Password)
+			}
+			if _, err := reopened.GetCartByID(ctx, fixture.cart.ID); err != nil {
+				t.Errorf("carrito perdido: %v", err)
+			}
+			orders, err := reopened.GetAllOrders(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(orders) != 1 || orders[0].ID != fixture.order.ID {
+				t.Errorf("órdenes = %v, se esperaba solo %s", orders, fixture.order.ID)
+			}
+		})
+	}
+}
+
+func TestRolledBackTransactionIsNotJournaled(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewPersistentMemoryStore(PersistenceOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	product, err := s.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.WithTx(ctx, func(tx Storer) error {
+		if err := tx.CommitStock(ctx, "c1", []models.CartItem{{ProductID: product.ID, Quantity: 2}}); err != nil {
+			return err
+		}
+		return os.ErrInvalid
+	})
+	if err != os.ErrInvalid {
+		t.Fatalf("WithTx() = %v, se esperaba el error de la función", err)
+	}
+
+	reopened, err := NewPersistentMemoryStore(PersistenceOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for name, store := range map[string]*MemoryStore{"en memoria": s, "tras reiniciar": reopened} {
+		p, err := store.GetProductByID(ctx, product.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Stock != 5 {
+			t.Errorf("%s: stock = %d, se esperaba 5", name, p.Stock)
+		}
+	}
+}
+
+// faultyFile simula un disco con problemas: la próxima escritura guarda solo la mitad de
+// los bytes y falla, y truncate puede fallar también.
+type faultyFile struct {
+	*os.File
+	tornWrite    bool
+	failTruncate bool
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if !f.tornWrite {
+		return f.File.Write(p)
+	}
+	f.tornWrite = false
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, errors.New("no queda espacio en el disco")
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errors.New("error de E/S")
+	}
+	return f.File.Truncate(size)
+}
+
+func TestFailedJournalWrite(t *testing.T) {
+	tests := []struct {
+		name         string
+		failTruncate bool
+		wantRejected bool // Las escrituras siguientes se rechazan hasta compactar.
+	}{
+		{name: "se descarta la escritura parcial"},
+		{name: "sin poder truncar se rechazan las escrituras", failTruncate: true, wantRejected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			s, err := NewPersistentMemoryStore(PersistenceOptions{Dir: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := &faultyFile{File: s.journal.file.(*os.File), tornWrite: true, failTruncate: tt.failTruncate}
+			s.journal.file = file
+			if _, err := s.CreateProduct(ctx, models.Product{Name: "Perdido", Price: models.NewMoney(100)}); err == nil {
+				t.Fatal("CreateProduct() sin error con el disco lleno")
+			}
+			file.failTruncate = false
+			after, err := s.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: 5})
+			if rejected := err != nil; rejected != tt.wantRejected {
+				t.Fatalf("CreateProduct() tras el fallo = %v, se esperaba rechazo: %v", err, tt.wantRejected)
+			}
+			if tt.wantRejected {
+				// Compactar deja el journal vacío y vuelve a aceptar escrituras.
+				s.mutex.Lock()
+				err := s.compact()
+				s.mutex.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if after, err = s.CreateProduct(ctx, models.Product{Name: "Taza", Price: models.NewMoney(500), Stock: 5}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Caída sin cerrar el almacén: lo escrito tras el fallo se recupera al reiniciar.
+			reopened, err := NewPersistentMemoryStore(PersistenceOptions{Dir: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			products, err := reopened.GetProducts(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(products) != 1 || products[0].ID != after.ID {
+				t.Errorf("productos = %+v, se esperaba solo %s", products, after.ID)
+			}
+		})
+	}
+}
@@ -1,159 +1,1406 @@
 package storage
 
 import (
+	"cmp"
+	"context"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"tienda/models"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // MemoryStore implementa todas las interfaces de almacenamiento en memoria.
+// Dentro de WithTx se usa una copia con tx != nil que comparte el mismo estado.
 type MemoryStore struct {
-	productsData    map[string]models.Product
-	cartsData       map[string]models.Cart
-	usersData       map[string]models.User
-	completedOrders []models.Cart
-	mutex           sync.Mutex // Previene errores de concurrencia al modificar los mapas.
+	*memoryState
+	tx *memoryTx
+}
+
+// memoryState contiene los datos compartidos por el almacén y sus transacciones.
+type memoryState struct {
+	productsData  map[string]models.Product
+	categories    map[string]models.Category
+	coupons       map[string]models.Coupon
+	redemptions   []models.CouponRedemption // Usos de cupones, en orden de registro.
+	taxRules      map[string]models.TaxRule
+	cartsData     map[string]models.Cart
+	abandoned     []models.AbandonedCart              // Carritos de invitado expirados, en orden de expiración.
+	reservations  map[string]map[stockKey]reservation // cartID -> producto/variante -> reserva.
+	usersData     map[string]models.User
+	addresses     map[string]models.Address
+	refreshTokens map[string]models.RefreshToken              // Indexado por el hash del token.
+	idempotency   map[idempotencyKey]models.IdempotencyRecord // Respuestas guardadas por Idempotency-Key.
+	ordersData    []models.Order                              // En orden de creación.
+	returns       map[string]models.Return                    // Devoluciones de órdenes.
+	journal       *journal                                    // Persistencia opcional en disco; nil si es solo memoria.
+	mutex         sync.Mutex                                  // Previene errores de concurrencia al modificar los mapas.
+}
+
+// idempotencyKey identifica una clave de idempotencia dentro de su ámbito.
+type idempotencyKey struct {
+	scope, key string
+}
+
+// reservation guarda unidades apartadas por un carrito hasta su expiración.
+type reservation struct {
+	quantity  int
+	expiresAt time.Time
 }
 
 // NewMemoryStore es el constructor para crear nuestro almacén.
 func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{
-		productsData:    make(map[string]models.Product),
-		cartsData:       make(map[string]models.Cart),
-		usersData:       make(map[string]models.User),
-		completedOrders: []models.Cart{},
+	return &MemoryStore{memoryState: &memoryState{
+		productsData:  make(map[string]models.Product),
+		categories:    make(map[string]models.Category),
+		coupons:       make(map[string]models.Coupon),
+		taxRules:      make(map[string]models.TaxRule),
+		cartsData:     make(map[string]models.Cart),
+		reservations:  make(map[string]map[stockKey]reservation),
+		usersData:     make(map[string]models.User),
+		addresses:     make(map[string]models.Address),
+		refreshTokens: make(map[string]models.RefreshToken),
+		idempotency:   make(map[idempotencyKey]models.IdempotencyRecord),
+		ordersData:    []models.Order{},
+		returns:       make(map[string]models.Return),
+	}}
+}
+
+// --- TRANSACCIONES ---
+
+// memoryTx acumula lo necesario para confirmar o deshacer una transacción en memoria.
+type memoryTx struct {
+	pending []journalRecord // Registros que se escriben en el journal al confirmar.
+	undo    []func()        // Acciones que restauran el estado previo, en orden de aplicación.
+}
+
+// WithTx toma el mutex durante toda la unidad de trabajo, de modo que ninguna otra
+// petición observa estados intermedios. Si fn falla se deshacen sus cambios en orden inverso.
+func (s *MemoryStore) WithTx(ctx context.Context, fn func(tx Storer) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer s.lock()()
+	txStore := &MemoryStore{memoryState: s.memoryState, tx: &memoryTx{}}
+	if err := fn(txStore); err != nil {
+		txStore.tx.rollback()
+		return err
+	}
+	if err := s.writeRecords(txStore.tx.pending); err != nil {
+		txStore.tx.rollback()
+		return err
+	}
+	s.maybeCompact()
+	return nil
+}
+
+// rollback restaura el estado previo a la transacción.
+func (t *memoryTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
 	}
 }
 
+// lock toma el mutex y devuelve la función para liberarlo. Dentro de una
+// transacción el mutex ya está tomado por WithTx, así que no hace nada.
+func (s *MemoryStore) lock() func() {
+	if s.tx != nil {
+		return func() {}
+	}
+	s.mutex.Lock()
+	return s.mutex.Unlock
+}
+
+// onRollback registra cómo deshacer un cambio si la transacción en curso falla.
+func (s *MemoryStore) onRollback(undo func()) {
+	if s.tx != nil {
+		s.tx.undo = append(s.tx.undo, undo)
+	}
+}
+
+// setEntry guarda un valor en un mapa registrando cómo deshacerlo.
+func setEntry[K comparable, V any](s *MemoryStore, m map[K]V, key K, value V) {
+	prev, existed := m[key]
+	s.onRollback(func() {
+		if existed {
+			m[key] = prev
+		} else {
+			delete(m, key)
+		}
+	})
+	m[key] = value
+}
+
+// deleteEntry elimina un valor de un mapa registrando cómo deshacerlo.
+func deleteEntry[K comparable, V any](s *MemoryStore, m map[K]V, key K) {
+	if prev, existed := m[key]; existed {
+		s.onRollback(func() { m[key] = prev })
+		delete(m, key)
+	}
+}
+
+// touchReservations guarda una copia de las reservas de un carrito antes de modificarlas.
+func (s *MemoryStore) touchReservations(cartID string) {
+	if s.tx == nil {
+		return
+	}
+	prev, existed := s.reservations[cartID]
+	saved := make(map[stockKey]reservation, len(prev))
+	for k, v := range prev {
+		saved[k] = v
+	}
+	s.onRollback(func() {
+		if existed {
+			s.reservations[cartID] = saved
+		} else {
+			delete(s.reservations, cartID)
+		}
+	})
+}
+
 // --- MÉTODOS PARA PRODUCTOS ---
 // El patrón Lock/Unlock se repite en todos los métodos para seguridad en la concurrencia.
-func (s *MemoryStore) GetProducts() ([]models.Product, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// Los métodos que modifican datos llaman a persist antes de aplicar el cambio, de modo que
+// con persistencia activa nada queda en memoria sin estar antes en el journal.
+func (s *MemoryStore) GetProducts(ctx context.Context) ([]models.Product, error) {
+	defer s.lock()()
 	list := make([]models.Product, 0, len(s.productsData))
 	for _, prod := range s.productsData {
 		list = append(list, prod)
 	}
 	return list, nil
 }
-func (s *MemoryStore) GetProductByID(id string) (models.Product, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *MemoryStore) QueryProducts(ctx context.Context, f ProductFilter) ([]models.Product, int, error) {
+	defer s.lock()()
+	query := strings.ToLower(f.Query)
+	var inCategory map[string]bool
+	if f.Category != "" {
+		inCategory = s.categorySubtree(f.Category)
+	}
+	matches := []models.Product{}
+	for _, p := range s.productsData {
+		if query != "" && !strings.Contains(strings.ToLower(p.Name), query) && !strings.Contains(strings.ToLower(p.Description), query) {
+			continue
+		}
+		if f.MinPrice != nil && p.Price.Amount < f.MinPrice.Amount {
+			continue
+		}
+		if f.MaxPrice != nil && p.Price.Amount > f.MaxPrice.Amount {
+			continue
+		}
+		if f.InStock && p.Stock <= 0 {
+			continue
+		}
+		if inCategory != nil && !slices.ContainsFunc(p.CategoryIDs, func(id string) bool { return inCategory[id] }) {
+			continue
+		}
+		matches = append(matches, p)
+	}
+	// El ID desempata para que el orden sea estable entre peticiones.
+	slices.SortFunc(matches, func(a, b models.Product) int {
+		var c int
+		switch f.Sort {
+		case SortByPrice:
+			c = cmp.Compare(a.Price.Amount, b.Price.Amount)
+		case SortByStock:
+			c = cmp.Compare(a.Stock, b.Stock)
+		default:
+			c = cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		}
+		c = cmp.Or(c, cmp.Compare(a.ID, b.ID))
+		if f.Desc {
+			c = -c
+		}
+		return c
+	})
+	total := len(matches)
+	start := min(max(f.Offset, 0), total)
+	end := total
+	if f.Limit > 0 {
+		end = min(start+f.Limit, total)
+	}
+	return matches[start:end], total, nil
+}
+func (s *MemoryStore) GetProductByID(ctx context.Context, id string) (models.Product, error) {
+	defer s.lock()()
 	p, ok := s.productsData[id]
 	if !ok {
-		return models.Product{}, fmt.Errorf("producto con id %s no encontrado", id)
+		return models.Product{}, fmt.Errorf("%w: %s", ErrProductNotFound, id)
 	}
 	return p, nil
 }
-func (s *MemoryStore) CreateProduct(p models.Product) (models.Product, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *MemoryStore) CreateProduct(ctx context.Context, p models.Product) (models.Product, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
 	p.ID = uuid.NewString()
-	s.productsData[p.ID] = p
+	p.Images = nil
+	if err := s.checkProduct(&p); err != nil {
+		return models.Product{}, err
+	}
+	if err := s.persist(journalRecord{Op: "CreateProduct", Product: &p}); err != nil {
+		return models.Product{}, err
+	}
+	setEntry(s, s.productsData, p.ID, p)
 	return p, nil
 }
-func (s *MemoryStore) UpdateProduct(id string, p models.Product) (models.Product, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	if _, ok := s.productsData[id]; !ok {
-		return models.Product{}, fmt.Errorf("producto no encontrado para actualizar")
+func (s *MemoryStore) UpdateProduct(ctx context.Context, id string, p models.Product) (models.Product, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	current, ok := s.productsData[id]
+	if !ok {
+		return models.Product{}, fmt.Errorf("%w: %s", ErrProductNotFound, id)
 	}
 	p.ID = id
-	s.productsData[id] = p
+	p.Images = current.Images
+	if err := s.checkProduct(&p); err != nil {
+		return models.Product{}, err
+	}
+	if err := s.persist(journalRecord{Op: "UpdateProduct", Product: &p}); err != nil {
+		return models.Product{}, err
+	}
+	setEntry(s, s.productsData, id, p)
 	return p, nil
 }
-func (s *MemoryStore) DeleteProduct(id string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *MemoryStore) DeleteProduct(ctx context.Context, id string) error {
+	defer s.lock()()
+	defer s.maybeCompact()
 	if _, ok := s.productsData[id]; !ok {
-		return fmt.Errorf("producto no encontrado para eliminar")
+		return fmt.Errorf("%w: %s", ErrProductNotFound, id)
 	}
-	delete(s.productsData, id)
+	if err := s.persist(journalRecord{Op: "DeleteProduct", ID: id}); err != nil {
+		return err
+	}
+	deleteEntry(s, s.productsData, id)
 	return nil
 }
-func (s *MemoryStore) CreateBatchProducts(products []models.Product) ([]models.Product, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *MemoryStore) CreateBatchProducts(ctx context.Context, products []models.Product) ([]models.Product, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
 	created := make([]models.Product, 0)
 	for _, p := range products {
 		p.ID = uuid.NewString()
-		s.productsData[p.ID] = p
+		p.Images = nil
+		if err := s.checkProduct(&p); err != nil {
+			return nil, err
+		}
+		// Los SKU también deben ser únicos entre los productos del mismo lote.
+		for _, other := range created {
+			if sku, dup := sharedSKU(p, other); dup {
+				return nil, fmt.Errorf("%w: %s", ErrDuplicateSKU, sku)
+			}
+		}
 		created = append(created, p)
 	}
+	if err := s.persist(journalRecord{Op: "CreateBatchProducts", Products: created}); err != nil {
+		return nil, err
+	}
+	for _, p := range created {
+		setEntry(s, s.productsData, p.ID, p)
+	}
 	return created, nil
 }
 
+func (s *MemoryStore) SetProductImages(ctx context.Context, productID string, images []models.ProductImage) (models.Product, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	p, ok := s.productsData[productID]
+	if !ok {
+		return models.Product{}, fmt.Errorf("producto con id %s no encontrado", productID)
+	}
+	p.Images = slices.Clone(images)
+	if err := s.persist(journalRecord{Op: "SetProductImages", Product: &p}); err != nil {
+		return models.Product{}, err
+	}
+	setEntry(s, s.productsData, productID, p)
+	return p, nil
+}
+
+// checkProduct prepara las variantes y verifica que existan sus categorías y que
+// ningún otro producto use los mismos SKU.
+func (s *MemoryStore) checkProduct(p *models.Product) error {
+	if err := prepareVariants(p); err != nil {
+		return err
+	}
+	for _, id := range p.CategoryIDs {
+		if _, ok := s.categories[id]; !ok {
+			return fmt.Errorf("%w: %s", ErrCategoryNotFound, id)
+		}
+	}
+	for _, other := range s.productsData {
+		if other.ID == p.ID {
+			continue
+		}
+		if sku, dup := sharedSKU(*p, other); dup {
+			return fmt.Errorf("%w: %s", ErrDuplicateSKU, sku)
+		}
+	}
+	return nil
+}
+
+// sharedSKU indica si dos productos tienen alguna variante con el mismo SKU.
+func sharedSKU(a, b models.Product) (string, bool) {
+	for _, va := range a.Variants {
+		for _, vb := range b.Variants {
+			if va.SKU == vb.SKU {
+				return va.SKU, true
+			}
+		}
+	}
+	return "", false
+}
+
+// --- MÉTODOS PARA CATEGORÍAS ---
+func (s *MemoryStore) GetCategories(ctx context.Context) ([]models.Category, error) {
+	defer s.lock()()
+	list := make([]models.Category, 0, len(s.categories))
+	for _, c := range s.categories {
+		list = append(list, c)
+	}
+	slices.SortFunc(list, func(a, b models.Category) int {
+		return cmp.Or(cmp.Compare(a.Position, b.Position), cmp.Compare(a.Name, b.Name), cmp.Compare(a.ID, b.ID))
+	})
+	return list, nil
+}
+func (s *MemoryStore) GetCategoryByID(ctx context.Context, id string) (models.Category, error) {
+	defer s.lock()()
+	c, ok := s.categories[id]
+	if !ok {
+		return models.Category{}, ErrCategoryNotFound
+	}
+	return c, nil
+}
+func (s *MemoryStore) GetCategoryBySlug(ctx context.Context, slug string) (models.Category, error) {
+	defer s.lock()()
+	for _, c := range s.categories {
+		if c.Slug == slug {
+			return c, nil
+		}
+	}
+	return models.Category{}, ErrCategoryNotFound
+}
+func (s *MemoryStore) CreateCategory(ctx context.Context, c models.Category) (models.Category, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	c.ID = uuid.NewString()
+	if err := s.checkCategory(c); err != nil {
+		return models.Category{}, err
+	}
+	if err := s.persist(journalRecord{Op: "CreateCategory", Category: &c}); err != nil {
+		return models.Category{}, err
+	}
+	setEntry(s, s.categories, c.ID, c)
+	return c, nil
+}
+func (s *MemoryStore) UpdateCategory(ctx context.Context, id string, c models.Category) (models.Category, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	if _, ok := s.categories[id]; !ok {
+		return models.Category{}, ErrCategoryNotFound
+	}
+	c.ID = id
+	if err := s.checkCategory(c); err != nil {
+		return models.Category{}, err
+	}
+	if err := s.persist(journalRecord{Op: "UpdateCategory", Category: &c}); err != nil {
+		return models.Category{}, err
+	}
+	setEntry(s, s.categories, id, c)
+	return c, nil
+}
+func (s *MemoryStore) DeleteCategory(ctx context.Context, id string) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	if _, ok := s.categories[id]; !ok {
+		return ErrCategoryNotFound
+	}
+	for _, c := range s.categories {
+		if c.ParentID == id {
+			return ErrCategoryHasChildren
+		}
+	}
+	if err := s.persist(journalRecord{Op: "DeleteCategory", ID: id}); err != nil {
+		return err
+	}
+	s.removeCategory(id)
+	return nil
+}
+
+// checkCategory valida el padre y la unicidad del slug de una categoría.
+func (s *MemoryStore) checkCategory(c models.Category) error {
+	for _, other := range s.categories {
+		if other.Slug == c.Slug && other.ID != c.ID {
+			return ErrCategorySlugTaken
+		}
+	}
+	if c.ParentID == "" {
+		return nil
+	}
+	if _, ok := s.categories[c.ParentID]; !ok {
+		return ErrParentCategoryNotFound
+	}
+	if s.categorySubtree(c.ID)[c.ParentID] {
+		return ErrCategoryCycle
+	}
+	return nil
+}
+
+// categorySubtree devuelve el conjunto formado por una categoría y todos sus descendientes.
+func (s *MemoryStore) categorySubtree(id string) map[string]bool {
+	subtree := map[string]bool{id: true}
+	for grew := true; grew; {
+		grew = false
+		for _, c := range s.categories {
+			if c.ParentID != "" && subtree[c.ParentID] && !subtree[c.ID] {
+				subtree[c.ID] = true
+				grew = true
+			}
+		}
+	}
+	return subtree
+}
+
+// removeCategory elimina la categoría y la quita de los productos que la tenían.
+// Se usa tanto al borrar como al reaplicar el journal.
+func (s *MemoryStore) removeCategory(id string) {
+	deleteEntry(s, s.categories, id)
+	for _, p := range s.productsData {
+		if !slices.Contains(p.CategoryIDs, id) {
+			continue
+		}
+		p.CategoryIDs = slices.DeleteFunc(slices.Clone(p.CategoryIDs), func(c string) bool { return c == id })
+		setEntry(s, s.productsData, p.ID, p)
+	}
+}
+
+// --- MÉTODOS PARA CUPONES ---
+func (s *MemoryStore) GetCoupons(ctx context.Context) ([]models.Coupon, error) {
+	defer s.lock()()
+	list := make([]models.Coupon, 0, len(s.coupons))
+	for _, c := range s.coupons {
+		list = append(list, c)
+	}
+	slices.SortFunc(list, func(a, b models.Coupon) int { return cmp.Compare(a.Code, b.Code) })
+	return list, nil
+}
+func (s *MemoryStore) GetCouponByID(ctx context.Context, id string) (models.Coupon, error) {
+	defer s.lock()()
+	c, ok := s.coupons[id]
+	if !ok {
+		return models.Coupon{}, ErrCouponNotFound
+	}
+	return c, nil
+}
+func (s *MemoryStore) GetCouponByCode(ctx context.Context, code string) (models.Coupon, error) {
+	defer s.lock()()
+	code = models.NormalizeCouponCode(code)
+	for _, c := range s.coupons {
+		if c.Code == code {
+			return c, nil
+		}
+	}
+	return models.Coupon{}, ErrCouponNotFound
+}
+func (s *MemoryStore) CreateCoupon(ctx context.Context, c models.Coupon) (models.Coupon, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	c.ID = uuid.NewString()
+	c.Code = models.NormalizeCouponCode(c.Code)
+	c.Uses = 0
+	c.CreatedAt = time.Now().UTC()
+	if err := s.checkCouponCode(c); err != nil {
+		return models.Coupon{}, err
+	}
+	if err := s.persist(journalRecord{Op: "CreateCoupon", Coupon: &c}); err != nil {
+		return models.Coupon{}, err
+	}
+	setEntry(s, s.coupons, c.ID, c)
+	return c, nil
+}
+func (s *MemoryStore) UpdateCoupon(ctx context.Context, id string, c models.Coupon) (models.Coupon, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	current, ok := s.coupons[id]
+	if !ok {
+		return models.Coupon{}, ErrCouponNotFound
+	}
+	c.ID, c.Uses, c.CreatedAt = id, current.Uses, current.CreatedAt
+	c.Code = models.NormalizeCouponCode(c.Code)
+	if err := s.checkCouponCode(c); err != nil {
+		return models.Coupon{}, err
+	}
+	if err := s.persist(journalRecord{Op: "UpdateCoupon", Coupon: &c}); err != nil {
+		return models.Coupon{}, err
+	}
+	setEntry(s, s.coupons, id, c)
+	return c, nil
+}
+func (s *MemoryStore) DeleteCoupon(ctx context.Context, id string) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	if _, ok := s.coupons[id]; !ok {
+		return ErrCouponNotFound
+	}
+	if err := s.persist(journalRecord{Op: "DeleteCoupon", ID: id}); err != nil {
+		return err
+	}
+	s.removeCoupon(id)
+	return nil
+}
+func (s *MemoryStore) CountCouponUses(ctx context.Context, couponID, userID string) (int, error) {
+	defer s.lock()()
+	return s.countCouponUses(couponID, userID), nil
+}
+func (s *MemoryStore) RedeemCoupon(ctx context.Context, r models.CouponRedemption) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	c, ok := s.coupons[r.CouponID]
+	if !ok {
+		return ErrCouponNotFound
+	}
+	if c.MaxUses > 0 && c.Uses >= c.MaxUses {
+		return ErrCouponUsageLimit
+	}
+	if c.MaxUsesPerUser > 0 && s.countCouponUses(c.ID, r.UserID) >= c.MaxUsesPerUser {
+		return ErrCouponUsageLimit
+	}
+	c.Uses++
+	if err := s.persist(journalRecord{Op: "RedeemCoupon", Coupon: &c, Redemption: &r}); err != nil {
+		return err
+	}
+	setEntry(s, s.coupons, c.ID, c)
+	s.appendRedemption(r)
+	return nil
+}
+
+// checkCouponCode verifica que ningún otro cupón use el mismo código.
+func (s *MemoryStore) checkCouponCode(c models.Coupon) error {
+	for _, other := range s.coupons {
+		if other.ID != c.ID && other.Code == c.Code {
+			return ErrCouponCodeTaken
+		}
+	}
+	return nil
+}
+
+// countCouponUses cuenta los usos del cupón por el usuario. Requiere el mutex tomado.
+func (s *MemoryStore) countCouponUses(couponID, userID string) int {
+	n := 0
+	for _, r := range s.redemptions {
+		if r.CouponID == couponID && r.UserID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+// appendRedemption añade un uso de cupón registrando cómo deshacerlo.
+func (s *MemoryStore) appendRedemption(r models.CouponRedemption) {
+	n := len(s.redemptions)
+	s.onRollback(func() { s.redemptions = s.redemptions[:n] })
+	s.redemptions = append(s.redemptions, r)
+}
+
+// removeCoupon elimina un cupón junto con su historial de usos.
+func (s *MemoryStore) removeCoupon(id string) {
+	deleteEntry(s, s.coupons, id)
+	prev := s.redemptions
+	s.onRollback(func() { s.redemptions = prev })
+	s.redemptions = slices.DeleteFunc(slices.Clone(prev), func(r models.CouponRedemption) bool { return r.CouponID == id })
+}
+
+// --- MÉTODOS PARA IMPUESTOS ---
+func (s *MemoryStore) GetTaxRules(ctx context.Context) ([]models.TaxRule, error) {
+	defer s.lock()()
+	list := make([]models.TaxRule, 0, len(s.taxRules))
+	for _, t := range s.taxRules {
+		list = append(list, t)
+	}
+	slices.SortFunc(list, func(a, b models.TaxRule) int {
+		return cmp.Or(cmp.Compare(a.TaxClass, b.TaxClass), cmp.Compare(a.Region, b.Region))
+	})
+	return list, nil
+}
+func (s *MemoryStore) GetTaxRuleByID(ctx context.Context, id string) (models.TaxRule, error) {
+	defer s.lock()()
+	t, ok := s.taxRules[id]
+	if !ok {
+		return models.TaxRule{}, ErrTaxRuleNotFound
+	}
+	return t, nil
+}
+func (s *MemoryStore) CreateTaxRule(ctx context.Context, t models.TaxRule) (models.TaxRule, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	t.ID = uuid.NewString()
+	if err := s.checkTaxRule(t); err != nil {
+		return models.TaxRule{}, err
+	}
+	if err := s.persist(journalRecord{Op: "CreateTaxRule", TaxRule: &t}); err != nil {
+		return models.TaxRule{}, err
+	}
+	setEntry(s, s.taxRules, t.ID, t)
+	return t, nil
+}
+func (s *MemoryStore) UpdateTaxRule(ctx context.Context, id string, t models.TaxRule) (models.TaxRule, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	if _, ok := s.taxRules[id]; !ok {
+		return models.TaxRule{}, ErrTaxRuleNotFound
+	}
+	t.ID = id
+	if err := s.checkTaxRule(t); err != nil {
+		return models.TaxRule{}, err
+	}
+	if err := s.persist(journalRecord{Op: "UpdateTaxRule", TaxRule: &t}); err != nil {
+		return models.TaxRule{}, err
+	}
+	setEntry(s, s.taxRules, id, t)
+	return t, nil
+}
+func (s *MemoryStore) DeleteTaxRule(ctx context.Context, id string) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	if _, ok := s.taxRules[id]; !ok {
+		return ErrTaxRuleNotFound
+	}
+	if err := s.persist(journalRecord{Op: "DeleteTaxRule", ID: id}); err != nil {
+		return err
+	}
+	deleteEntry(s, s.taxRules, id)
+	return nil
+}
+
+// checkTaxRule verifica que ninguna otra regla cubra la misma clase y región.
+func (s *MemoryStore) checkTaxRule(t models.TaxRule) error {
+	for _, other := range s.taxRules {
+		if other.ID != t.ID && other.TaxClass == t.TaxClass && other.Region == t.Region {
+			return ErrTaxRuleConflict
+		}
+	}
+	return nil
+}
+
 // --- MÉTODOS PARA CARRITOS ---
-func (s *MemoryStore) GetCartByID(id string) (models.Cart, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *MemoryStore) GetCartByID(ctx context.Context, id string) (models.Cart, error) {
+	defer s.lock()()
 	c, ok := s.cartsData[id]
 	if !ok {
 		return models.Cart{}, fmt.Errorf("carrito con id %s no encontrado", id)
 	}
 	return c, nil
 }
-func (s *MemoryStore) CreateCart(c models.Cart) (models.Cart, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *MemoryStore) GetCartByUserID(ctx context.Context, userID string) (models.Cart, error) {
+	defer s.lock()()
+	// Si hubiera más de uno (datos anteriores a crear el carrito en una transacción), se
+	// devuelve siempre el de actividad más reciente.
+	var found *models.Cart
+	for _, c := range s.cartsData {
+		if c.UserID != "" && c.UserID == userID && (found == nil || c.UpdatedAt.After(found.UpdatedAt)) {
+			found = &c
+		}
+	}
+	if found == nil {
+		return models.Cart{}, fmt.Errorf("el usuario %s no tiene un carrito activo", userID)
+	}
+	return *found, nil
+}
+func (s *MemoryStore) CreateCart(ctx context.Context, c models.Cart) (models.Cart, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
 	c.ID = uuid.NewString()
-	s.cartsData[c.ID] = c
+	c.CreatedAt = time.Now().UTC()
+	c.UpdatedAt = c.CreatedAt
+	if err := s.persist(journalRecord{Op: "CreateCart", Cart: &c}); err != nil {
+		return models.Cart{}, err
+	}
+	setEntry(s, s.cartsData, c.ID, c)
 	return c, nil
 }
-func (s *MemoryStore) UpdateCart(id string, c models.Cart) (models.Cart, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	if _, ok := s.cartsData[id]; !ok {
+func (s *MemoryStore) UpdateCart(ctx context.Context, id string, c models.Cart) (models.Cart, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	existing, ok := s.cartsData[id]
+	if !ok {
 		return models.Cart{}, fmt.Errorf("carrito no encontrado para actualizar")
 	}
-	c.ID = id
-	s.cartsData[id] = c
+	c.ID, c.CreatedAt, c.UpdatedAt = id, existing.CreatedAt, time.Now().UTC()
+	if err := s.persist(journalRecord{Op: "UpdateCart", Cart: &c}); err != nil {
+		return models.Cart{}, err
+	}
+	setEntry(s, s.cartsData, id, c)
 	return c, nil
 }
-func (s *MemoryStore) DeleteCart(id string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *MemoryStore) DeleteCart(ctx context.Context, id string) error {
+	defer s.lock()()
+	defer s.maybeCompact()
 	if _, ok := s.cartsData[id]; !ok {
 		return fmt.Errorf("carrito no encontrado para eliminar")
 	}
-	delete(s.cartsData, id)
+	if err := s.persist(journalRecord{Op: "DeleteCart", ID: id}); err != nil {
+		return err
+	}
+	deleteEntry(s, s.cartsData, id)
+	deleteEntry(s, s.reservations, id) // Un carrito eliminado no conserva sus reservas.
+	return nil
+}
+func (s *MemoryStore) TouchCart(ctx context.Context, id string) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	c, ok := s.cartsData[id]
+	if !ok {
+		return fmt.Errorf("carrito no encontrado para actualizar")
+	}
+	c.UpdatedAt = time.Now().UTC()
+	if err := s.persist(journalRecord{Op: "UpdateCart", Cart: &c}); err != nil {
+		return err
+	}
+	setEntry(s, s.cartsData, id, c)
 	return nil
 }
+func (s *MemoryStore) ExpireCarts(ctx context.Context, idleSince, now time.Time) (int, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	var ids []string
+	var abandoned []models.AbandonedCart
+	for id, c := range s.cartsData {
+		if c.UserID == "" && c.UpdatedAt.Before(idleSince) && !s.hasLiveReservations(id, now) {
+			ids = append(ids, id)
+			if len(c.Items) > 0 {
+				abandoned = append(abandoned, models.NewAbandonedCart(c, now))
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	slices.SortFunc(abandoned, func(a, b models.AbandonedCart) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+	if err := s.persist(journalRecord{Op: "ExpireCarts", IDs: ids, Abandoned: abandoned}); err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		deleteEntry(s, s.cartsData, id)
+		deleteEntry(s, s.reservations, id)
+	}
+	prev := len(s.abandoned)
+	s.abandoned = append(s.abandoned, abandoned...)
+	s.onRollback(func() { s.abandoned = s.abandoned[:prev] })
+	return len(ids), nil
+}
+func (s *MemoryStore) QueryAbandonedCarts(ctx context.Context, from, to time.Time) ([]models.AbandonedCart, error) {
+	defer s.lock()()
+	list := []models.AbandonedCart{}
+	for i := len(s.abandoned) - 1; i >= 0; i-- {
+		a := s.abandoned[i]
+		if (!from.IsZero() && a.ExpiredAt.Before(from)) || (!to.IsZero() && !a.ExpiredAt.Before(to)) {
+			continue
+		}
+		list = append(list, a)
+	}
+	return list, nil
+}
+
+// hasLiveReservations indica si el carrito tiene reservas vigentes en now. Debe llamarse
+// con el mutex tomado.
+func (s *memoryState) hasLiveReservations(cartID string, now time.Time) bool {
+	for _, res := range s.reservations[cartID] {
+		if now.Before(res.expiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// stampLegacyCarts da como fecha de actividad now a los carritos guardados antes de que
+// se registraran fechas, para que no expiren en el primer barrido. No se registra en el
+// journal: el siguiente snapshot guarda la fecha. Debe llamarse con el mutex tomado.
+func (s *memoryState) stampLegacyCarts(now time.Time) {
+	for id, c := range s.cartsData {
+		if c.UpdatedAt.IsZero() {
+			c.UpdatedAt = now
+			s.cartsData[id] = c
+		}
+	}
+}
+
+// --- MÉTODOS PARA INVENTARIO ---
+func (s *MemoryStore) ReserveStock(ctx context.Context, cartID, productID, variantID string, quantity int, expiresAt time.Time) error {
+	defer s.lock()()
+	s.touchReservations(cartID)
+	key := stockKey{productID, variantID}
+	if quantity <= 0 {
+		delete(s.reservations[cartID], key)
+		return nil
+	}
+	p, ok := s.productsData[productID]
+	if !ok {
+		return fmt.Errorf("producto con id %s no encontrado", productID)
+	}
+	stock, ok := p.StockFor(variantID)
+	if !ok {
+		return fmt.Errorf("variante %s no encontrada en el producto %s", variantID, productID)
+	}
+	available := stock - s.reservedByOthers(key, cartID, time.Now())
+	if quantity > available {
+		return &InsufficientStockError{Items: []StockShortage{{ProductID: productID, VariantID: variantID, Requested: quantity, Available: max(available, 0)}}}
+	}
+	if s.reservations[cartID] == nil {
+		s.reservations[cartID] = make(map[stockKey]reservation)
+	}
+	s.reservations[cartID][key] = reservation{quantity: quantity, expiresAt: expiresAt}
+	return nil
+}
+func (s *MemoryStore) CommitStock(ctx context.Context, cartID string, items []models.CartItem) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	now := time.Now()
+	// Primero se validan todas las líneas; solo si todas alcanzan se descuenta el stock.
+	order, requested := stockRequest(items)
+	var shortages []StockShortage
+	for _, key := range order {
+		available := 0
+		// Una variante inexistente, o un producto con variantes pedido sin indicar cuál, no tiene stock.
+		if p, ok := s.productsData[key.productID]; ok {
+			if stock, ok := p.StockFor(key.variantID); ok {
+				available = max(stock-s.reservedByOthers(key, cartID, now), 0)
+			}
+		}
+		if requested[key] > available {
+			shortages = append(shortages, StockShortage{ProductID: key.productID, VariantID: key.variantID, Requested: requested[key], Available: available})
+		}
+	}
+	if len(shortages) > 0 {
+		return &InsufficientStockError{Items: shortages}
+	}
+	updated := make(map[string]models.Product)
+	for _, key := range order {
+		p, ok := updated[key.productID]
+		if !ok {
+			p = s.productsData[key.productID]
+		}
+		p.AdjustStock(key.variantID, -requested[key])
+		updated[key.productID] = p
+	}
+	products := changedProducts(order, updated)
+	if err := s.persist(journalRecord{Op: "CommitStock", Products: products}); err != nil {
+		return err
+	}
+	for _, p := range products {
+		setEntry(s, s.productsData, p.ID, p)
+	}
+	deleteEntry(s, s.reservations, cartID)
+	return nil
+}
+func (s *MemoryStore) RestockItems(ctx context.Context, items []models.CartItem) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	order, requested := stockRequest(items)
+	updated := make(map[string]models.Product)
+	for _, key := range order {
+		p, ok := updated[key.productID]
+		if !ok {
+			if p, ok = s.productsData[key.productID]; !ok {
+				continue
+			}
+		}
+		p.AdjustStock(key.variantID, requested[key])
+		updated[key.productID] = p
+	}
+	products := changedProducts(order, updated)
+	if err := s.persist(journalRecord{Op: "RestockItems", Products: products}); err != nil {
+		return err
+	}
+	for _, p := range products {
+		setEntry(s, s.productsData, p.ID, p)
+	}
+	return nil
+}
+
+// changedProducts lista los productos modificados en el orden en que aparecieron.
+func changedProducts(order []stockKey, updated map[string]models.Product) []models.Product {
+	products := make([]models.Product, 0, len(updated))
+	for _, key := range order {
+		if p, ok := updated[key.productID]; ok && !slices.ContainsFunc(products, func(q models.Product) bool { return q.ID == p.ID }) {
+			products = append(products, p)
+		}
+	}
+	return products
+}
+
+// reservedByOthers suma las reservas vigentes de una unidad de inventario hechas por otros
+// carritos y purga las que ya expiraron (la purga no se deshace: una reserva vencida no
+// vuelve a ser válida). Debe llamarse con el mutex tomado.
+func (s *MemoryStore) reservedByOthers(key stockKey, cartID string, now time.Time) int {
+	total := 0
+	for otherCartID, byKey := range s.reservations {
+		res, ok := byKey[key]
+		if !ok {
+			continue
+		}
+		if !now.Before(res.expiresAt) {
+			delete(byKey, key)
+			continue
+		}
+		if otherCartID != cartID {
+			total += res.quantity
+		}
+	}
+	return total
+}
 
 // --- MÉTODOS PARA USUARIOS ---
-func (s *MemoryStore) CreateUser(u models.User) (models.User, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *MemoryStore) CreateUser(ctx context.Context, u models.User) (models.User, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
 	if _, exists := s.usersData[u.Username]; exists {
 		return models.User{}, fmt.Errorf("el usuario '%s' ya existe", u.Username)
 	}
 	u.ID = uuid.NewString()
-	s.usersData[u.Username] = u
+	if u.Role == "" {
+		u.Role = models.RoleCustomer
+	}
+	if err := s.persist(journalRecord{Op: "CreateUser", User: newStoredUser(u)}); err != nil {
+		return models.User{}, err
+	}
+	setEntry(s, s.usersData, u.Username, u)
 	return u, nil
 }
-func (s *MemoryStore) GetUserByUsername(username string) (models.User, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *MemoryStore) GetUserByUsername(ctx context.Context, username string) (models.User, error) {
+	defer s.lock()()
 	user, ok := s.usersData[username]
 	if !ok {
 		return models.User{}, fmt.Errorf("usuario '%s' no encontrado", username)
 	}
 	return user, nil
 }
+func (s *MemoryStore) GetUserByID(ctx context.Context, id string) (models.User, error) {
+	defer s.lock()()
+	for _, user := range s.usersData {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return models.User{}, fmt.Errorf("usuario con id %s no encontrado", id)
+}
+func (s *MemoryStore) UpdateUserRole(ctx context.Context, id string, role models.Role) (models.User, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	for username, user := range s.usersData {
+		if user.ID == id {
+			user.Role = role
+			if err := s.persist(journalRecord{Op: "UpdateUserRole", User: newStoredUser(user)}); err != nil {
+				return models.User{}, err
+			}
+			setEntry(s, s.usersData, username, user)
+			return user, nil
+		}
+	}
+	return models.User{}, fmt.Errorf("usuario con id %s no encontrado", id)
+}
 
-// --- MÉTODOS PARA ÓRDENES ---
-func (s *MemoryStore) CreateOrderFromCart(c models.Cart) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	s.completedOrders = append(s.completedOrders, c)
+// --- MÉTODOS PARA DIRECCIONES ---
+func (s *MemoryStore) GetAddresses(ctx context.Context, userID string) ([]models.Address, error) {
+	defer s.lock()()
+	list := []models.Address{}
+	for _, a := range s.addresses {
+		if a.UserID == userID {
+			list = append(list, a)
+		}
+	}
+	slices.SortFunc(list, func(a, b models.Address) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return list, nil
+}
+func (s *MemoryStore) GetAddress(ctx context.Context, userID, id string) (models.Address, error) {
+	defer s.lock()()
+	a, ok := s.addresses[id]
+	if !ok || a.UserID != userID {
+		return models.Address{}, ErrAddressNotFound
+	}
+	return a, nil
+}
+func (s *MemoryStore) CreateAddress(ctx context.Context, a models.Address) (models.Address, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	a.ID = uuid.NewString()
+	a.CreatedAt = time.Now().UTC()
+	if err := s.persist(journalRecord{Op: "CreateAddress", Address: &a}); err != nil {
+		return models.Address{}, err
+	}
+	setEntry(s, s.addresses, a.ID, a)
+	return a, nil
+}
+func (s *MemoryStore) UpdateAddress(ctx context.Context, userID, id string, a models.Address) (models.Address, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	existing, ok := s.addresses[id]
+	if !ok || existing.UserID != userID {
+		return models.Address{}, ErrAddressNotFound
+	}
+	a.ID, a.UserID, a.CreatedAt = id, userID, existing.CreatedAt
+	if err := s.persist(journalRecord{Op: "UpdateAddress", Address: &a}); err != nil {
+		return models.Address{}, err
+	}
+	setEntry(s, s.addresses, id, a)
+	return a, nil
+}
+func (s *MemoryStore) DeleteAddress(ctx context.Context, userID, id string) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	if a, ok := s.addresses[id]; !ok || a.UserID != userID {
+		return ErrAddressNotFound
+	}
+	if err := s.persist(journalRecord{Op: "DeleteAddress", ID: id}); err != nil {
+		return err
+	}
+	deleteEntry(s, s.addresses, id)
 	return nil
 }
-func (s *MemoryStore) GetAllOrders() ([]models.Cart, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	ordersCopy := make([]models.Cart, len(s.completedOrders))
-	copy(ordersCopy, s.completedOrders)
+
+// --- MÉTODOS PARA TOKENS DE REFRESCO ---
+func (s *MemoryStore) SaveRefreshToken(ctx context.Context, t models.RefreshToken) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	if _, exists := s.refreshTokens[t.TokenHash]; exists {
+		return fmt.Errorf("el token de refresco ya existe")
+	}
+	if err := s.persist(journalRecord{Op: "SaveRefreshToken", ID: t.TokenHash, Token: &t}); err != nil {
+		return err
+	}
+	setEntry(s, s.refreshTokens, t.TokenHash, t)
+	return nil
+}
+func (s *MemoryStore) ConsumeRefreshToken(ctx context.Context, tokenHash string) (models.RefreshToken, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	t, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return models.RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	if t.Used {
+		return t, ErrRefreshTokenReused
+	}
+	if t.Revoked || time.Now().After(t.ExpiresAt) {
+		return t, ErrRefreshTokenInvalid
+	}
+	t.Used = true
+	if err := s.persist(journalRecord{Op: "ConsumeRefreshToken", ID: tokenHash, Token: &t}); err != nil {
+		return models.RefreshToken{}, err
+	}
+	setEntry(s, s.refreshTokens, tokenHash, t)
+	return t, nil
+}
+func (s *MemoryStore) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	if err := s.persist(journalRecord{Op: "RevokeRefreshTokenFamily", ID: familyID}); err != nil {
+		return err
+	}
+	for hash, t := range s.refreshTokens {
+		if t.FamilyID == familyID {
+			t.Revoked = true
+			setEntry(s, s.refreshTokens, hash, t)
+		}
+	}
+	return nil
+}
+
+// --- MÉTODOS PARA IDEMPOTENCIA ---
+// Los registros expirados se descartan sin pasar por el journal: si reaparecen al reiniciar
+// siguen expirados, así que se tratan igual que una clave libre.
+func (s *MemoryStore) ReserveIdempotencyKey(ctx context.Context, rec models.IdempotencyRecord) (models.IdempotencyRecord, bool, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	now := time.Now()
+	for k, existing := range s.idempotency {
+		if existing.Expired(now) {
+			deleteEntry(s, s.idempotency, k)
+		}
+	}
+	k := idempotencyKey{rec.Scope, rec.Key}
+	if existing, ok := s.idempotency[k]; ok {
+		return existing, false, nil
+	}
+	if err := s.persist(journalRecord{Op: "ReserveIdempotencyKey", Idempotency: &rec}); err != nil {
+		return models.IdempotencyRecord{}, false, err
+	}
+	setEntry(s, s.idempotency, k, rec)
+	return rec, true, nil
+}
+func (s *MemoryStore) CompleteIdempotencyKey(ctx context.Context, rec models.IdempotencyRecord) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	if err := s.persist(journalRecord{Op: "CompleteIdempotencyKey", Idempotency: &rec}); err != nil {
+		return err
+	}
+	setEntry(s, s.idempotency, idempotencyKey{rec.Scope, rec.Key}, rec)
+	return nil
+}
+func (s *MemoryStore) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	defer s.lock()()
+	defer s.maybeCompact()
+	k := idempotencyKey{scope, key}
+	if _, ok := s.idempotency[k]; !ok {
+		return nil
+	}
+	rec := models.IdempotencyRecord{Scope: scope, Key: key}
+	if err := s.persist(journalRecord{Op: "ReleaseIdempotencyKey", Idempotency: &rec}); err != nil {
+		return err
+	}
+	deleteEntry(s, s.idempotency, k)
+	return nil
+}
+
+// --- MÉTODOS PARA ÓRDENES ---
+func (s *MemoryStore) CreateOrder(ctx context.Context, o models.Order) (models.Order, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	now := time.Now()
+	o.ID = uuid.NewString()
+	o.CreatedAt, o.UpdatedAt = now, now
+	if o.Status == "" {
+		o.Status = models.OrderPending
+	}
+	if err := s.persist(journalRecord{Op: "CreateOrder", Order: &o}); err != nil {
+		return models.Order{}, err
+	}
+	prevLen := len(s.ordersData)
+	s.onRollback(func() { s.ordersData = s.ordersData[:prevLen] })
+	s.ordersData = append(s.ordersData, o)
+	return o, nil
+}
+func (s *MemoryStore) GetOrderByID(ctx context.Context, id string) (models.Order, error) {
+	defer s.lock()()
+	for _, o := range s.ordersData {
+		if o.ID == id {
+			return o, nil
+		}
+	}
+	return models.Order{}, ErrOrderNotFound
+}
+func (s *MemoryStore) GetOrdersByUserID(ctx context.Context, userID string) ([]models.Order, error) {
+	defer s.lock()()
+	list := []models.Order{}
+	for _, o := range s.ordersData {
+		if o.UserID == userID {
+			list = append(list, o)
+		}
+	}
+	return list, nil
+}
+func (s *MemoryStore) GetAllOrders(ctx context.Context) ([]models.Order, error) {
+	defer s.lock()()
+	ordersCopy := make([]models.Order, len(s.ordersData))
+	copy(ordersCopy, s.ordersData)
 	return ordersCopy, nil
 }
+func (s *MemoryStore) QueryOrders(ctx context.Context, f OrderFilter) ([]models.Order, int, error) {
+	defer s.lock()()
+	matches := []models.Order{}
+	// Se recorre al revés para devolver primero las más recientes.
+	for i := len(s.ordersData) - 1; i >= 0; i-- {
+		o := s.ordersData[i]
+		if f.Status != "" && o.Status != f.Status {
+			continue
+		}
+		if f.UserID != "" && o.UserID != f.UserID {
+			continue
+		}
+		if !f.From.IsZero() && o.CreatedAt.Before(f.From) {
+			continue
+		}
+		if !f.To.IsZero() && !o.CreatedAt.Before(f.To) {
+			continue
+		}
+		matches = append(matches, o)
+	}
+	total := len(matches)
+	start := min(max(f.Offset, 0), total)
+	end := total
+	if f.Limit > 0 {
+		end = min(start+f.Limit, total)
+	}
+	return matches[start:end], total, nil
+}
+func (s *MemoryStore) UpdateOrderStatus(ctx context.Context, id string, status models.OrderStatus) (models.Order, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	for i, o := range s.ordersData {
+		if o.ID != id {
+			continue
+		}
+		if !o.Status.CanTransitionTo(status) {
+			return o, fmt.Errorf("%w: de %s a %s", ErrInvalidTransition, o.Status, status)
+		}
+		now := time.Now()
+		if o.Busy(now) && o.PendingStatus != status {
+			return o, fmt.Errorf("%w: hacia %s", ErrOrderBusy, o.PendingStatus)
+		}
+		o.Status = status
+		o.PendingStatus, o.PendingUntil = "", time.Time{}
+		o.UpdatedAt = now
+		if err := s.persist(journalRecord{Op: "UpdateOrderStatus", Order: &o}); err != nil {
+			return models.Order{}, err
+		}
+		prev := s.ordersData[i]
+		s.onRollback(func() { s.ordersData[i] = prev })
+		s.ordersData[i] = o
+		return o, nil
+	}
+	return models.Order{}, ErrOrderNotFound
+}
+func (s *MemoryStore) ClaimOrderStatus(ctx context.Context, id string, status models.OrderStatus, until time.Time) (models.Order, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	for i, o := range s.ordersData {
+		if o.ID != id {
+			continue
+		}
+		if !o.Status.CanTransitionTo(status) {
+			return o, fmt.Errorf("%w: de %s a %s", ErrInvalidTransition, o.Status, status)
+		}
+		now := time.Now()
+		if o.Busy(now) {
+			return o, fmt.Errorf("%w: hacia %s", ErrOrderBusy, o.PendingStatus)
+		}
+		o.PendingStatus, o.PendingUntil = status, until
+		o.UpdatedAt = now
+		if err := s.persist(journalRecord{Op: "ClaimOrderStatus", Order: &o}); err != nil {
+			return models.Order{}, err
+		}
+		prev := s.ordersData[i]
+		s.onRollback(func() { s.ordersData[i] = prev })
+		s.ordersData[i] = o
+		return o, nil
+	}
+	return models.Order{}, ErrOrderNotFound
+}
+func (s *MemoryStore) ReleaseOrderStatus(ctx context.Context, id string) (models.Order, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	for i, o := range s.ordersData {
+		if o.ID != id {
+			continue
+		}
+		o.PendingStatus, o.PendingUntil = "", time.Time{}
+		o.UpdatedAt = time.Now()
+		if err := s.persist(journalRecord{Op: "ReleaseOrderStatus", Order: &o}); err != nil {
+			return models.Order{}, err
+		}
+		prev := s.ordersData[i]
+		s.onRollback(func() { s.ordersData[i] = prev })
+		s.ordersData[i] = o
+		return o, nil
+	}
+	return models.Order{}, ErrOrderNotFound
+}
+func (s *MemoryStore) RecordPayment(ctx context.Context, id string, a models.PaymentAttempt) (models.Order, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	for i, o := range s.ordersData {
+		if o.ID != id {
+			continue
+		}
+		o.Payments = slices.Clone(o.Payments)
+		o.RecordPayment(a)
+		o.UpdatedAt = time.Now()
+		if err := s.persist(journalRecord{Op: "RecordPayment", Order: &o}); err != nil {
+			return models.Order{}, err
+		}
+		prev := s.ordersData[i]
+		s.onRollback(func() { s.ordersData[i] = prev })
+		s.ordersData[i] = o
+		return o, nil
+	}
+	return models.Order{}, ErrOrderNotFound
+}
+func (s *MemoryStore) RecordReturnedItems(ctx context.Context, id string, items []models.ReturnItem) (models.Order, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	for i, o := range s.ordersData {
+		if o.ID != id {
+			continue
+		}
+		if !o.AddReturned(items) {
+			return models.Order{}, ErrReturnQuantity
+		}
+		o.UpdatedAt = time.Now()
+		if err := s.persist(journalRecord{Op: "RecordReturnedItems", Order: &o}); err != nil {
+			return models.Order{}, err
+		}
+		prev := s.ordersData[i]
+		s.onRollback(func() { s.ordersData[i] = prev })
+		s.ordersData[i] = o
+		return o, nil
+	}
+	return models.Order{}, ErrOrderNotFound
+}
+
+// --- MÉTODOS PARA DEVOLUCIONES ---
+func (s *MemoryStore) CreateReturn(ctx context.Context, r models.Return) (models.Return, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	now := time.Now()
+	r.ID = uuid.NewString()
+	r.CreatedAt, r.UpdatedAt = now, now
+	if r.Status == "" {
+		r.Status = models.ReturnRequested
+	}
+	if err := s.persist(journalRecord{Op: "CreateReturn", Return: &r}); err != nil {
+		return models.Return{}, err
+	}
+	setEntry(s, s.returns, r.ID, r)
+	return r, nil
+}
+func (s *MemoryStore) GetReturnByID(ctx context.Context, id string) (models.Return, error) {
+	defer s.lock()()
+	r, ok := s.returns[id]
+	if !ok {
+		return models.Return{}, ErrReturnNotFound
+	}
+	return r, nil
+}
+func (s *MemoryStore) QueryReturns(ctx context.Context, f ReturnFilter) ([]models.Return, int, error) {
+	defer s.lock()()
+	matches := []models.Return{}
+	for _, r := range s.returns {
+		if (f.Status != "" && r.Status != f.Status) || (f.UserID != "" && r.UserID != f.UserID) || (f.OrderID != "" && r.OrderID != f.OrderID) {
+			continue
+		}
+		matches = append(matches, r)
+	}
+	slices.SortFunc(matches, func(a, b models.Return) int {
+		return cmp.Or(b.CreatedAt.Compare(a.CreatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	total := len(matches)
+	start := min(max(f.Offset, 0), total)
+	end := total
+	if f.Limit > 0 {
+		end = min(start+f.Limit, total)
+	}
+	return matches[start:end], total, nil
+}
+func (s *MemoryStore) UpdateReturn(ctx context.Context, id string, r models.Return) (models.Return, error) {
+	defer s.lock()()
+	defer s.maybeCompact()
+	existing, ok := s.returns[id]
+	if !ok {
+		return models.Return{}, ErrReturnNotFound
+	}
+	if r.Status != existing.Status && !existing.Status.CanTransitionTo(r.Status) {
+		return existing, fmt.Errorf("%w: de %s a %s", ErrInvalidTransition, existing.Status, r.Status)
+	}
+	r.ID, r.OrderID, r.UserID, r.Items, r.Reason, r.CreatedAt = existing.ID, existing.OrderID, existing.UserID, existing.Items, existing.Reason, existing.CreatedAt
+	r.UpdatedAt = time.Now()
+	if err := s.persist(journalRecord{Op: "UpdateReturn", Return: &r}); err != nil {
+		return models.Return{}, err
+	}
+	setEntry(s, s.returns, id, r)
+	return r, nil
+}
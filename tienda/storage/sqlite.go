@@ -0,0 +1,1845 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"tienda/models"
+	"time"
+
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite" // Driver SQLite en Go puro, sin cgo ni servidor externo.
+)
+
+// SQLiteStore implementa todas las interfaces de almacenamiento sobre una base SQLite embebida.
+// Dentro de WithTx se usa una copia cuyas consultas van por la transacción abierta.
+type SQLiteStore struct {
+	db *sql.DB
+	q  dbtx    // *sql.DB fuera de una transacción, *sql.Tx dentro de ella.
+	tx *sql.Tx // Transacción en curso, nil si no hay ninguna.
+}
+
+// dbtx agrupa los métodos comunes a *sql.DB y *sql.Tx.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+var _ Storer = (*SQLiteStore)(nil)
+
+// NewSQLiteStore abre (o crea) la base de datos en path y aplica las migraciones pendientes.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir la base de datos: %w", err)
+	}
+	// SQLite admite un único escritor; una sola conexión serializa las operaciones y evita SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	s := &SQLiteStore{db: db, q: db}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.checkCurrency(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close libera la conexión con la base de datos.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// migrations contiene el esquema en orden; cada entrada se aplica una sola vez.
+// Nunca se modifica una migración ya publicada: los cambios se agregan al final.
+var migrations = []string{
+	// 1: esquema inicial.
+	`CREATE TABLE products (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL,
+		price REAL NOT NULL,
+		stock INTEGER NOT NULL
+	);
+	CREATE TABLE carts (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL DEFAULT '',
+		data TEXT NOT NULL
+	);
+	CREATE INDEX carts_user_id ON carts(user_id);
+	CREATE TABLE reservations (
+		cart_id TEXT NOT NULL,
+		product_id TEXT NOT NULL,
+		quantity INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		PRIMARY KEY (cart_id, product_id)
+	);
+	CREATE TABLE users (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL,
+		role TEXT NOT NULL
+	);
+	CREATE TABLE refresh_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		family_id TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		used INTEGER NOT NULL DEFAULT 0,
+		revoked INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX refresh_tokens_family ON refresh_tokens(family_id);
+	CREATE TABLE orders (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX orders_user_id ON orders(user_id);
+	CREATE INDEX orders_created_at ON orders(created_at);`,
+	// 2: árbol de categorías y relación de productos con categorías.
+	`CREATE TABLE categories (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		slug TEXT NOT NULL UNIQUE,
+		parent_id TEXT REFERENCES categories(id),
+		position INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX categories_parent_id ON categories(parent_id);
+	CREATE TABLE product_categories (
+		product_id TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+		category_id TEXT NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+		PRIMARY KEY (product_id, category_id)
+	);
+	CREATE INDEX product_categories_category_id ON product_categories(category_id);`,
+	// 3: variantes de producto; las reservas pasan a identificarse también por variante.
+	`CREATE TABLE product_variants (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		product_id TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+		sku TEXT NOT NULL UNIQUE,
+		options TEXT NOT NULL DEFAULT '{}',
+		price REAL,
+		stock INTEGER NOT NULL
+	);
+	CREATE INDEX product_variants_product_id ON product_variants(product_id);
+	CREATE TABLE reservations_v3 (
+		cart_id TEXT NOT NULL,
+		product_id TEXT NOT NULL,
+		variant_id TEXT NOT NULL DEFAULT '',
+		quantity INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		PRIMARY KEY (cart_id, product_id, variant_id)
+	);
+	INSERT INTO reservations_v3 (cart_id, product_id, quantity, expires_at)
+		SELECT cart_id, product_id, quantity, expires_at FROM reservations;
+	DROP TABLE reservations;
+	ALTER TABLE reservations_v3 RENAME TO reservations;`,
+	// 4: imágenes de producto; los archivos viven en el almacén de archivos, aquí solo sus datos.
+	`CREATE TABLE product_images (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		product_id TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		thumbnail_url TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL
+	);
+	CREATE INDEX product_images_product_id ON product_images(product_id, position);`,
+	// 5: los precios pasan a guardarse como enteros en unidades mínimas de la moneda.
+	// Los precios existentes se interpretan con dos decimales.
+	`ALTER TABLE products ADD COLUMN price_minor INTEGER NOT NULL DEFAULT 0;
+	UPDATE products SET price_minor = CAST(ROUND(price * 100) AS INTEGER);
+	ALTER TABLE products DROP COLUMN price;
+	ALTER TABLE product_variants ADD COLUMN price_minor INTEGER;
+	UPDATE product_variants SET price_minor = CAST(ROUND(price * 100) AS INTEGER) WHERE price IS NOT NULL;
+	ALTER TABLE product_variants DROP COLUMN price;`,
+	// 6: ajustes del almacén; "currency" es la moneda en que están guardados los montos.
+	`CREATE TABLE settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+	// 7: cupones de descuento y el registro de sus usos.
+	`CREATE TABLE coupons (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		code TEXT NOT NULL UNIQUE,
+		uses INTEGER NOT NULL DEFAULT 0,
+		data TEXT NOT NULL
+	);
+	CREATE TABLE coupon_redemptions (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		coupon_id TEXT NOT NULL REFERENCES coupons(id) ON DELETE CASCADE,
+		user_id TEXT NOT NULL DEFAULT '',
+		order_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX coupon_redemptions_coupon_user ON coupon_redemptions(coupon_id, user_id);`,
+	// 8: clase de impuesto de cada producto y reglas de impuestos por clase y región.
+	`ALTER TABLE products ADD COLUMN tax_class TEXT NOT NULL DEFAULT '';
+	CREATE TABLE tax_rules (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		tax_class TEXT NOT NULL,
+		region TEXT NOT NULL,
+		data TEXT NOT NULL,
+		UNIQUE (tax_class, region)
+	);`,
+	// 9: peso de cada producto y direcciones de envío de los usuarios.
+	`ALTER TABLE products ADD COLUMN weight_grams INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE addresses (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX addresses_user ON addresses(user_id);`,
+	// 10: respuestas guardadas por Idempotency-Key.
+	`CREATE TABLE idempotency_keys (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (scope, key)
+	);
+	CREATE INDEX idempotency_keys_expires ON idempotency_keys(expires_at);`,
+	// 11: devoluciones de órdenes.
+	`CREATE TABLE returns (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		order_id TEXT NOT NULL,
+		user_id TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX returns_order ON returns(order_id);
+	CREATE INDEX returns_user ON returns(user_id);`,
+	// 12: fecha de la última modificación de cada carrito y registro de carritos abandonados.
+	// Los carritos existentes cuentan como modificados al aplicar la migración.
+	`ALTER TABLE carts ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE carts SET updated_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000000000;
+	CREATE INDEX carts_updated ON carts(user_id, updated_at);
+	CREATE TABLE abandoned_carts (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		cart_id TEXT NOT NULL,
+		expired_at INTEGER NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX abandoned_carts_expired ON abandoned_carts(expired_at);`,
+}
+
+// migrate crea la tabla de versiones y aplica en una transacción cada migración pendiente.
+func (s *SQLiteStore) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("error al crear la tabla de migraciones: %w", err)
+	}
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("error al leer la versión del esquema: %w", err)
+	}
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error al aplicar la migración %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// checkCurrency compara la moneda registrada de los montos con la configurada y, si la base
+// aún no tiene una, registra la configurada (ver checkCurrency).
+func (s *SQLiteStore) checkCurrency(ctx context.Context) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var stored string
+		err := tx.QueryRowContext(ctx, `SELECT value FROM settings WHERE key = 'currency'`).Scan(&stored)
+		if err == nil {
+			return checkCurrency(stored, true)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		var hasData bool
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM products) OR EXISTS (SELECT 1 FROM carts)
+			OR EXISTS (SELECT 1 FROM orders) OR EXISTS (SELECT 1 FROM coupons)
+			OR EXISTS (SELECT 1 FROM returns) OR EXISTS (SELECT 1 FROM abandoned_carts)`).Scan(&hasData)
+		if err != nil {
+			return err
+		}
+		if err := checkCurrency("", hasData); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO settings (key, value) VALUES ('currency', ?)`, models.DefaultCurrency)
+		return err
+	})
+}
+
+// WithTx abre una transacción y entrega a fn un almacén ligado a ella. Como la base
+// usa una sola conexión, fn debe usar únicamente tx: usar s provocaría un bloqueo.
+func (s *SQLiteStore) WithTx(ctx context.Context, fn func(tx Storer) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return fn(&SQLiteStore{db: s.db, q: tx, tx: tx})
+	})
+}
+
+// inTx ejecuta fn dentro de una transacción, haciendo rollback si devuelve error.
+// Si ya hay una transacción en curso, fn se une a ella.
+func (s *SQLiteStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// --- MÉTODOS PARA PRODUCTOS ---
+// Las categorías de cada producto se leen con una subconsulta como lista separada por comas
+// y las variantes y las imágenes como arreglos JSON.
+const productColumns = `id, name, description, price_minor, stock, tax_class, weight_grams,
+	(SELECT group_concat(category_id, ',' ORDER BY rowid) FROM product_categories WHERE product_id = products.id),
+	(SELECT json_group_array(json_object('id', id, 'sku', sku, 'options', json(options), 'priceMinor', price_minor, 'stock', stock) ORDER BY seq)
+		FROM product_variants WHERE product_id = products.id),
+	(SELECT json_group_array(json_object('id', id, 'url', url, 'thumbnailUrl', thumbnail_url, 'contentType', content_type,
+		'width', width, 'height', height) ORDER BY position) FROM product_images WHERE product_id = products.id)`
+
+// variantRow es una variante tal como la devuelve la subconsulta JSON de productColumns.
+type variantRow struct {
+	models.ProductVariant
+	PriceMinor *int64 `json:"priceMinor"`
+}
+
+// rowScanner permite reutilizar las funciones de lectura con *sql.Row y *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProduct(row rowScanner) (models.Product, error) {
+	var p models.Product
+	var categoryIDs sql.NullString
+	var variants, images string
+	var priceMinor int64
+	if err := row.Scan(&p.ID, &p.Name, &p.Description, &priceMinor, &p.Stock, &p.TaxClass, &p.WeightGrams, &categoryIDs, &variants, &images); err != nil {
+		return models.Product{}, err
+	}
+	if categoryIDs.String != "" {
+		p.CategoryIDs = strings.Split(categoryIDs.String, ",")
+	}
+	p.Price = models.NewMoney(priceMinor)
+	var rows []variantRow
+	if err := json.Unmarshal([]byte(variants), &rows); err != nil {
+		return models.Product{}, err
+	}
+	for _, row := range rows {
+		if row.PriceMinor != nil {
+			price := models.NewMoney(*row.PriceMinor)
+			row.Price = &price
+		}
+		p.Variants = append(p.Variants, row.ProductVariant)
+	}
+	if err := json.Unmarshal([]byte(images), &p.Images); err != nil {
+		return models.Product{}, err
+	}
+	if len(p.Images) == 0 {
+		p.Images = nil
+	}
+	return p, nil
+}
+
+func (s *SQLiteStore) GetProducts(ctx context.Context) ([]models.Product, error) {
+	rows, err := s.q.QueryContext(ctx, `SELECT `+productColumns+` FROM products ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []models.Product{}
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+func (s *SQLiteStore) QueryProducts(ctx context.Context, f ProductFilter) ([]models.Product, int, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+	if f.Query != "" {
+		// Se escapan los comodines de LIKE para buscar el texto literal.
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(f.Query)) + "%"
+		where = append(where, `(lower(name) LIKE ? ESCAPE '\' OR lower(description) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	if f.MinPrice != nil {
+		where = append(where, "price_minor >= ?")
+		args = append(args, f.MinPrice.Amount)
+	}
+	if f.MaxPrice != nil {
+		where = append(where, "price_minor <= ?")
+		args = append(args, f.MaxPrice.Amount)
+	}
+	if f.InStock {
+		where = append(where, "stock > 0")
+	}
+	if f.Category != "" {
+		where = append(where, "id IN (SELECT product_id FROM product_categories WHERE category_id IN ("+categorySubtreeSQL+"))")
+		args = append(args, f.Category)
+	}
+	clause := strings.Join(where, " AND ")
+	var total int
+	if err := s.q.QueryRowContext(ctx, `SELECT COUNT(*) FROM products WHERE `+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	// El campo de orden proviene de una lista cerrada, nunca del texto de la petición.
+	column := "lower(name)"
+	switch f.Sort {
+	case SortByPrice:
+		column = "price_minor"
+	case SortByStock:
+		column = "stock"
+	}
+	direction := "ASC"
+	if f.Desc {
+		direction = "DESC"
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = -1 // En SQLite, LIMIT -1 significa sin límite.
+	}
+	rows, err := s.q.QueryContext(ctx, `SELECT `+productColumns+` FROM products WHERE `+clause+
+		` ORDER BY `+column+` `+direction+`, id `+direction+` LIMIT ? OFFSET ?`, append(args, limit, max(f.Offset, 0))...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	list := []models.Product{}
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, p)
+	}
+	return list, total, rows.Err()
+}
+func (s *SQLiteStore) GetProductByID(ctx context.Context, id string) (models.Product, error) {
+	p, err := scanProduct(s.q.QueryRowContext(ctx, `SELECT `+productColumns+` FROM products WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Product{}, fmt.Errorf("%w: %s", ErrProductNotFound, id)
+	}
+	return p, err
+}
+func (s *SQLiteStore) CreateProduct(ctx context.Context, p models.Product) (models.Product, error) {
+	p.ID = uuid.NewString()
+	p.Images = nil
+	if err := prepareVariants(&p); err != nil {
+		return models.Product{}, err
+	}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO products (id, name, description, price_minor, stock, tax_class, weight_grams) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			p.ID, p.Name, p.Description, p.Price.Amount, p.Stock, p.TaxClass, p.WeightGrams)
+		if err != nil {
+			return err
+		}
+		if err := setProductCategories(ctx, tx, p.ID, p.CategoryIDs); err != nil {
+			return err
+		}
+		return setProductVariants(ctx, tx, p.ID, p.Variants)
+	})
+	if err != nil {
+		return models.Product{}, err
+	}
+	return p, nil
+}
+func (s *SQLiteStore) UpdateProduct(ctx context.Context, id string, p models.Product) (models.Product, error) {
+	if err := prepareVariants(&p); err != nil {
+		return models.Product{}, err
+	}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE products SET name = ?, description = ?, price_minor = ?, stock = ?, tax_class = ?, weight_grams = ? WHERE id = ?`,
+			p.Name, p.Description, p.Price.Amount, p.Stock, p.TaxClass, p.WeightGrams, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("%w: %s", ErrProductNotFound, id)
+		}
+		if err := setProductCategories(ctx, tx, id, p.CategoryIDs); err != nil {
+			return err
+		}
+		if err := setProductVariants(ctx, tx, id, p.Variants); err != nil {
+			return err
+		}
+		// Las imágenes no se tocan; se devuelven las ya guardadas.
+		p, err = scanProduct(tx.QueryRowContext(ctx, `SELECT `+productColumns+` FROM products WHERE id = ?`, id))
+		return err
+	})
+	if err != nil {
+		return models.Product{}, err
+	}
+	return p, nil
+}
+func (s *SQLiteStore) DeleteProduct(ctx context.Context, id string) error {
+	res, err := s.q.ExecContext(ctx, `DELETE FROM products WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %s", ErrProductNotFound, id)
+	}
+	return nil
+}
+func (s *SQLiteStore) CreateBatchProducts(ctx context.Context, products []models.Product) ([]models.Product, error) {
+	created := make([]models.Product, 0, len(products))
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, p := range products {
+			p.ID = uuid.NewString()
+			p.Images = nil
+			if err := prepareVariants(&p); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO products (id, name, description, price_minor, stock, tax_class, weight_grams) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				p.ID, p.Name, p.Description, p.Price.Amount, p.Stock, p.TaxClass, p.WeightGrams)
+			if err != nil {
+				return err
+			}
+			if err := setProductCategories(ctx, tx, p.ID, p.CategoryIDs); err != nil {
+				return err
+			}
+			if err := setProductVariants(ctx, tx, p.ID, p.Variants); err != nil {
+				return err
+			}
+			created = append(created, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *SQLiteStore) SetProductImages(ctx context.Context, productID string, images []models.ProductImage) (models.Product, error) {
+	var p models.Product
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM product_images WHERE product_id = ?`, productID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var exists int
+			err := tx.QueryRowContext(ctx, `SELECT 1 FROM products WHERE id = ?`, productID).Scan(&exists)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("producto con id %s no encontrado", productID)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for i, img := range images {
+			_, err := tx.ExecContext(ctx, `INSERT INTO product_images (id, product_id, position, url, thumbnail_url, content_type, width, height)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, img.ID, productID, i, img.URL, img.ThumbnailURL, img.ContentType, img.Width, img.Height)
+			if err != nil {
+				return err
+			}
+		}
+		p, err = scanProduct(tx.QueryRowContext(ctx, `SELECT `+productColumns+` FROM products WHERE id = ?`, productID))
+		return err
+	})
+	if err != nil {
+		return models.Product{}, err
+	}
+	return p, nil
+}
+
+// setProductCategories reemplaza las categorías de un producto.
+func setProductCategories(ctx context.Context, tx *sql.Tx, productID string, categoryIDs []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM product_categories WHERE product_id = ?`, productID); err != nil {
+		return err
+	}
+	for _, categoryID := range categoryIDs {
+		_, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO product_categories (product_id, category_id) VALUES (?, ?)`, productID, categoryID)
+		if err != nil {
+			if strings.Contains(err.Error(), "FOREIGN KEY") {
+				return fmt.Errorf("%w: %s", ErrCategoryNotFound, categoryID)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// setProductVariants reemplaza las variantes de un producto conservando sus IDs.
+func setProductVariants(ctx context.Context, tx *sql.Tx, productID string, variants []models.ProductVariant) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM product_variants WHERE product_id = ?`, productID); err != nil {
+		return err
+	}
+	for _, v := range variants {
+		options, err := json.Marshal(v.Options)
+		if err != nil {
+			return err
+		}
+		if v.Options == nil {
+			options = []byte("{}")
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO product_variants (id, product_id, sku, options, price_minor, stock) VALUES (?, ?, ?, ?, ?, ?)`,
+			v.ID, productID, v.SKU, string(options), minorUnits(v.Price), v.Stock)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				return fmt.Errorf("%w: %s", ErrDuplicateSKU, v.SKU)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// minorUnits devuelve las unidades mínimas de un precio opcional, o NULL si no tiene.
+func minorUnits(m *models.Money) sql.NullInt64 {
+	if m == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: m.Amount, Valid: true}
+}
+
+// --- MÉTODOS PARA CATEGORÍAS ---
+const categoryColumns = `id, name, slug, parent_id, position`
+
+// categorySubtreeSQL selecciona el ID recibido como parámetro y los de todos sus descendientes.
+const categorySubtreeSQL = `WITH RECURSIVE subtree(id) AS (
+	SELECT ? UNION SELECT c.id FROM categories c JOIN subtree ON c.parent_id = subtree.id
+) SELECT id FROM subtree`
+
+func scanCategory(row rowScanner) (models.Category, error) {
+	var c models.Category
+	var parentID sql.NullString
+	err := row.Scan(&c.ID, &c.Name, &c.Slug, &parentID, &c.Position)
+	c.ParentID = parentID.String
+	return c, err
+}
+
+func (s *SQLiteStore) GetCategories(ctx context.Context) ([]models.Category, error) {
+	rows, err := s.q.QueryContext(ctx, `SELECT `+categoryColumns+` FROM categories ORDER BY position, name, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []models.Category{}
+	for rows.Next() {
+		c, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+func (s *SQLiteStore) GetCategoryByID(ctx context.Context, id string) (models.Category, error) {
+	c, err := scanCategory(s.q.QueryRowContext(ctx, `SELECT `+categoryColumns+` FROM categories WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Category{}, ErrCategoryNotFound
+	}
+	return c, err
+}
+func (s *SQLiteStore) GetCategoryBySlug(ctx context.Context, slug string) (models.Category, error) {
+	c, err := scanCategory(s.q.QueryRowContext(ctx, `SELECT `+categoryColumns+` FROM categories WHERE slug = ?`, slug))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Category{}, ErrCategoryNotFound
+	}
+	return c, err
+}
+func (s *SQLiteStore) CreateCategory(ctx context.Context, c models.Category) (models.Category, error) {
+	c.ID = uuid.NewString()
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := checkCategory(ctx, tx, c); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO categories (id, name, slug, parent_id, position) VALUES (?, ?, ?, ?, ?)`,
+			c.ID, c.Name, c.Slug, nullString(c.ParentID), c.Position)
+		return err
+	})
+	if err != nil {
+		return models.Category{}, err
+	}
+	return c, nil
+}
+func (s *SQLiteStore) UpdateCategory(ctx context.Context, id string, c models.Category) (models.Category, error) {
+	c.ID = id
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := scanCategory(tx.QueryRowContext(ctx, `SELECT `+categoryColumns+` FROM categories WHERE id = ?`, id)); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrCategoryNotFound
+			}
+			return err
+		}
+		if err := checkCategory(ctx, tx, c); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE categories SET name = ?, slug = ?, parent_id = ?, position = ? WHERE id = ?`,
+			c.Name, c.Slug, nullString(c.ParentID), c.Position, id)
+		return err
+	})
+	if err != nil {
+		return models.Category{}, err
+	}
+	return c, nil
+}
+func (s *SQLiteStore) DeleteCategory(ctx context.Context, id string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var children int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM categories WHERE parent_id = ?`, id).Scan(&children); err != nil {
+			return err
+		}
+		if children > 0 {
+			return ErrCategoryHasChildren
+		}
+		// La relación con productos se borra en cascada.
+		res, err := tx.ExecContext(ctx, `DELETE FROM categories WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrCategoryNotFound
+		}
+		return nil
+	})
+}
+
+// checkCategory valida el padre y la unicidad del slug de una categoría.
+func checkCategory(ctx context.Context, tx *sql.Tx, c models.Category) error {
+	var taken int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM categories WHERE slug = ? AND id != ?`, c.Slug, c.ID).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrCategorySlugTaken
+	}
+	if c.ParentID == "" {
+		return nil
+	}
+	var parents int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM categories WHERE id = ?`, c.ParentID).Scan(&parents); err != nil {
+		return err
+	}
+	if parents == 0 {
+		return ErrParentCategoryNotFound
+	}
+	var cycle int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM (`+categorySubtreeSQL+`) WHERE id = ?`, c.ID, c.ParentID).Scan(&cycle)
+	if err != nil {
+		return err
+	}
+	if cycle > 0 {
+		return ErrCategoryCycle
+	}
+	return nil
+}
+
+// nullString guarda las cadenas vacías como NULL, necesario en columnas con clave foránea.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// --- MÉTODOS PARA CUPONES ---
+// Cada cupón se guarda como JSON; el código y el contador de usos tienen columna propia
+// para garantizar la unicidad y actualizar los usos sin reescribir el documento.
+func scanCoupon(row rowScanner) (models.Coupon, error) {
+	var data string
+	var uses int
+	if err := row.Scan(&data, &uses); err != nil {
+		return models.Coupon{}, err
+	}
+	var c models.Coupon
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		return models.Coupon{}, err
+	}
+	c.Uses = uses
+	return c, nil
+}
+
+func (s *SQLiteStore) GetCoupons(ctx context.Context) ([]models.Coupon, error) {
+	rows, err := s.q.QueryContext(ctx, `SELECT data, uses FROM coupons ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []models.Coupon{}
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+func (s *SQLiteStore) GetCouponByID(ctx context.Context, id string) (models.Coupon, error) {
+	c, err := scanCoupon(s.q.QueryRowContext(ctx, `SELECT data, uses FROM coupons WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Coupon{}, ErrCouponNotFound
+	}
+	return c, err
+}
+func (s *SQLiteStore) GetCouponByCode(ctx context.Context, code string) (models.Coupon, error) {
+	c, err := scanCoupon(s.q.QueryRowContext(ctx, `SELECT data, uses FROM coupons WHERE code = ?`, models.NormalizeCouponCode(code)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Coupon{}, ErrCouponNotFound
+	}
+	return c, err
+}
+func (s *SQLiteStore) CreateCoupon(ctx context.Context, c models.Coupon) (models.Coupon, error) {
+	c.ID = uuid.NewString()
+	c.Code = models.NormalizeCouponCode(c.Code)
+	c.Uses = 0
+	c.CreatedAt = time.Now().UTC()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return models.Coupon{}, err
+	}
+	_, err = s.q.ExecContext(ctx, `INSERT INTO coupons (id, code, data) VALUES (?, ?, ?)`, c.ID, c.Code, string(data))
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return models.Coupon{}, ErrCouponCodeTaken
+		}
+		return models.Coupon{}, err
+	}
+	return c, nil
+}
+func (s *SQLiteStore) UpdateCoupon(ctx context.Context, id string, c models.Coupon) (models.Coupon, error) {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		current, err := scanCoupon(tx.QueryRowContext(ctx, `SELECT data, uses FROM coupons WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCouponNotFound
+		}
+		if err != nil {
+			return err
+		}
+		c.ID, c.Uses, c.CreatedAt = id, current.Uses, current.CreatedAt
+		c.Code = models.NormalizeCouponCode(c.Code)
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE coupons SET code = ?, data = ? WHERE id = ?`, c.Code, string(data), id)
+		if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+			return ErrCouponCodeTaken
+		}
+		return err
+	})
+	if err != nil {
+		return models.Coupon{}, err
+	}
+	return c, nil
+}
+func (s *SQLiteStore) DeleteCoupon(ctx context.Context, id string) error {
+	res, err := s.q.ExecContext(ctx, `DELETE FROM coupons WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCouponNotFound
+	}
+	return nil
+}
+func (s *SQLiteStore) CountCouponUses(ctx context.Context, couponID, userID string) (int, error) {
+	return countCouponUses(ctx, s.q, couponID, userID)
+}
+func (s *SQLiteStore) RedeemCoupon(ctx context.Context, r models.CouponRedemption) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		c, err := scanCoupon(tx.QueryRowContext(ctx, `SELECT data, uses FROM coupons WHERE id = ?`, r.CouponID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCouponNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if c.MaxUses > 0 && c.Uses >= c.MaxUses {
+			return ErrCouponUsageLimit
+		}
+		if c.MaxUsesPerUser > 0 {
+			n, err := countCouponUses(ctx, tx, c.ID, r.UserID)
+			if err != nil {
+				return err
+			}
+			if n >= c.MaxUsesPerUser {
+				return ErrCouponUsageLimit
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE coupons SET uses = uses + 1 WHERE id = ?`, c.ID); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO coupon_redemptions (coupon_id, user_id, order_id, created_at) VALUES (?, ?, ?, ?)`,
+			r.CouponID, r.UserID, r.OrderID, r.CreatedAt.UnixNano())
+		return err
+	})
+}
+
+// countCouponUses cuenta los usos de un cupón por un usuario.
+func countCouponUses(ctx context.Context, q dbtx, couponID, userID string) (int, error) {
+	var n int
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = ? AND user_id = ?`, couponID, userID).Scan(&n)
+	return n, err
+}
+
+// --- MÉTODOS PARA IMPUESTOS ---
+// Cada regla se guarda como JSON; la clase y la región se replican en columnas para
+// que la base garantice que no haya dos reglas para la misma combinación.
+func scanTaxRule(row rowScanner) (models.TaxRule, error) {
+	var data string
+	if err := row.Scan(&data); err != nil {
+		return models.TaxRule{}, err
+	}
+	var t models.TaxRule
+	err := json.Unmarshal([]byte(data), &t)
+	return t, err
+}
+
+func (s *SQLiteStore) GetTaxRules(ctx context.Context) ([]models.TaxRule, error) {
+	rows, err := s.q.QueryContext(ctx, `SELECT data FROM tax_rules ORDER BY tax_class, region`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []models.TaxRule{}
+	for rows.Next() {
+		t, err := scanTaxRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+func (s *SQLiteStore) GetTaxRuleByID(ctx context.Context, id string) (models.TaxRule, error) {
+	t, err := scanTaxRule(s.q.QueryRowContext(ctx, `SELECT data FROM tax_rules WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.TaxRule{}, ErrTaxRuleNotFound
+	}
+	return t, err
+}
+func (s *SQLiteStore) CreateTaxRule(ctx context.Context, t models.TaxRule) (models.TaxRule, error) {
+	t.ID = uuid.NewString()
+	data, err := json.Marshal(t)
+	if err != nil {
+		return models.TaxRule{}, err
+	}
+	_, err = s.q.ExecContext(ctx, `INSERT INTO tax_rules (id, tax_class, region, data) VALUES (?, ?, ?, ?)`,
+		t.ID, t.TaxClass, t.Region, string(data))
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return models.TaxRule{}, ErrTaxRuleConflict
+		}
+		return models.TaxRule{}, err
+	}
+	return t, nil
+}
+func (s *SQLiteStore) UpdateTaxRule(ctx context.Context, id string, t models.TaxRule) (models.TaxRule, error) {
+	t.ID = id
+	data, err := json.Marshal(t)
+	if err != nil {
+		return models.TaxRule{}, err
+	}
+	res, err := s.q.ExecContext(ctx, `UPDATE tax_rules SET tax_class = ?, region = ?, data = ? WHERE id = ?`,
+		t.TaxClass, t.Region, string(data), id)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return models.TaxRule{}, ErrTaxRuleConflict
+		}
+		return models.TaxRule{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.TaxRule{}, ErrTaxRuleNotFound
+	}
+	return t, nil
+}
+func (s *SQLiteStore) DeleteTaxRule(ctx context.Context, id string) error {
+	res, err := s.q.ExecContext(ctx, `DELETE FROM tax_rules WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTaxRuleNotFound
+	}
+	return nil
+}
+
+// --- MÉTODOS PARA CARRITOS ---
+// El carrito completo se guarda como JSON; user_id y updated_at se replican en columnas para
+// buscar por dueño y para expirar los carritos de invitado inactivos.
+func scanCart(row rowScanner) (models.Cart, error) {
+	var data string
+	if err := row.Scan(&data); err != nil {
+		return models.Cart{}, err
+	}
+	var c models.Cart
+	err := json.Unmarshal([]byte(data), &c)
+	return c, err
+}
+
+func (s *SQLiteStore) GetCartByID(ctx context.Context, id string) (models.Cart, error) {
+	c, err := scanCart(s.q.QueryRowContext(ctx, `SELECT data FROM carts WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Cart{}, fmt.Errorf("carrito con id %s no encontrado", id)
+	}
+	return c, err
+}
+func (s *SQLiteStore) GetCartByUserID(ctx context.Context, userID string) (models.Cart, error) {
+	c, err := scanCart(s.q.QueryRowContext(ctx, `SELECT data FROM carts WHERE user_id = ? AND user_id != '' ORDER BY updated_at DESC LIMIT 1`, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Cart{}, fmt.Errorf("el usuario %s no tiene un carrito activo", userID)
+	}
+	return c, err
+}
+func (s *SQLiteStore) CreateCart(ctx context.Context, c models.Cart) (models.Cart, error) {
+	c.ID = uuid.NewString()
+	c.CreatedAt = time.Now().UTC()
+	c.UpdatedAt = c.CreatedAt
+	data, err := json.Marshal(c)
+	if err != nil {
+		return models.Cart{}, err
+	}
+	if _, err := s.q.ExecContext(ctx, `INSERT INTO carts (id, user_id, updated_at, data) VALUES (?, ?, ?, ?)`,
+		c.ID, c.UserID, c.UpdatedAt.UnixNano(), string(data)); err != nil {
+		return models.Cart{}, err
+	}
+	return c, nil
+}
+func (s *SQLiteStore) UpdateCart(ctx context.Context, id string, c models.Cart) (models.Cart, error) {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		existing, err := scanCart(tx.QueryRowContext(ctx, `SELECT data FROM carts WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("carrito no encontrado para actualizar")
+		}
+		if err != nil {
+			return err
+		}
+		c.ID, c.CreatedAt, c.UpdatedAt = id, existing.CreatedAt, time.Now().UTC()
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE carts SET user_id = ?, updated_at = ?, data = ? WHERE id = ?`,
+			c.UserID, c.UpdatedAt.UnixNano(), string(data), id)
+		return err
+	})
+	if err != nil {
+		return models.Cart{}, err
+	}
+	return c, nil
+}
+func (s *SQLiteStore) DeleteCart(ctx context.Context, id string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM carts WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("carrito no encontrado para eliminar")
+		}
+		// Un carrito eliminado no conserva sus reservas.
+		_, err = tx.ExecContext(ctx, `DELETE FROM reservations WHERE cart_id = ?`, id)
+		return err
+	})
+}
+func (s *SQLiteStore) TouchCart(ctx context.Context, id string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		c, err := scanCart(tx.QueryRowContext(ctx, `SELECT data FROM carts WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("carrito no encontrado para actualizar")
+		}
+		if err != nil {
+			return err
+		}
+		c.UpdatedAt = time.Now().UTC()
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE carts SET updated_at = ?, data = ? WHERE id = ?`, c.UpdatedAt.UnixNano(), string(data), id)
+		return err
+	})
+}
+func (s *SQLiteStore) ExpireCarts(ctx context.Context, idleSince, now time.Time) (int, error) {
+	// Inactivos y sin reservas vigentes; los parámetros son idleSince y now.
+	const idle = `user_id = '' AND updated_at < ?
+		AND NOT EXISTS (SELECT 1 FROM reservations r WHERE r.cart_id = carts.id AND r.expires_at > ?)`
+	var expired int
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT data FROM carts WHERE `+idle+` ORDER BY updated_at`, idleSince.UnixNano(), now.UnixNano())
+		if err != nil {
+			return err
+		}
+		var carts []models.Cart
+		for rows.Next() {
+			c, err := scanCart(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			carts = append(carts, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, c := range carts {
+			if len(c.Items) == 0 {
+				continue
+			}
+			data, err := json.Marshal(models.NewAbandonedCart(c, now))
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO abandoned_carts (cart_id, expired_at, data) VALUES (?, ?, ?)`,
+				c.ID, now.UnixNano(), string(data)); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM reservations WHERE cart_id IN (SELECT id FROM carts WHERE `+idle+`)`, idleSince.UnixNano(), now.UnixNano()); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM carts WHERE `+idle, idleSince.UnixNano(), now.UnixNano())
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		expired = int(n)
+		return nil
+	})
+	return expired, err
+}
+func (s *SQLiteStore) QueryAbandonedCarts(ctx context.Context, from, to time.Time) ([]models.AbandonedCart, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+	if !from.IsZero() {
+		where = append(where, "expired_at >= ?")
+		args = append(args, from.UnixNano())
+	}
+	if !to.IsZero() {
+		where = append(where, "expired_at < ?")
+		args = append(args, to.UnixNano())
+	}
+	rows, err := s.q.QueryContext(ctx, `SELECT data FROM abandoned_carts WHERE `+strings.Join(where, " AND ")+` ORDER BY seq DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []models.AbandonedCart{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var a models.AbandonedCart
+		if err := json.Unmarshal([]byte(data), &a); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// --- MÉTODOS PARA INVENTARIO ---
+
+// availableStock calcula el stock libre de un producto o variante descontando las reservas
+// vigentes de otros carritos. Un producto con variantes no tiene stock propio: debe pedirse por variante.
+func availableStock(ctx context.Context, tx dbtx, key stockKey, cartID string, now time.Time) (int, bool, error) {
+	var stock int
+	var err error
+	if key.variantID == "" {
+		err = tx.QueryRowContext(ctx, `SELECT stock FROM products WHERE id = ?
+			AND NOT EXISTS (SELECT 1 FROM product_variants WHERE product_id = products.id)`, key.productID).Scan(&stock)
+	} else {
+		err = tx.QueryRowContext(ctx, `SELECT stock FROM product_variants WHERE id = ? AND product_id = ?`,
+			key.variantID, key.productID).Scan(&stock)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var reserved int
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(SUM(quantity), 0) FROM reservations
+		WHERE product_id = ? AND variant_id = ? AND cart_id != ? AND expires_at > ?`,
+		key.productID, key.variantID, cartID, now.UnixNano()).Scan(&reserved)
+	if err != nil {
+		return 0, false, err
+	}
+	return stock - reserved, true, nil
+}
+
+// adjustStock suma delta al stock de un producto y, si corresponde, al de su variante.
+func adjustStock(ctx context.Context, tx *sql.Tx, key stockKey, delta int) error {
+	if key.variantID != "" {
+		res, err := tx.ExecContext(ctx, `UPDATE product_variants SET stock = stock + ? WHERE id = ? AND product_id = ?`,
+			delta, key.variantID, key.productID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+	}
+	_, err := tx.ExecContext(ctx, `UPDATE products SET stock = stock + ? WHERE id = ?`, delta, key.productID)
+	return err
+}
+
+func (s *SQLiteStore) ReserveStock(ctx context.Context, cartID, productID, variantID string, quantity int, expiresAt time.Time) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if quantity <= 0 {
+			_, err := tx.ExecContext(ctx, `DELETE FROM reservations WHERE cart_id = ? AND product_id = ? AND variant_id = ?`,
+				cartID, productID, variantID)
+			return err
+		}
+		now := time.Now()
+		if _, err := tx.ExecContext(ctx, `DELETE FROM reservations WHERE expires_at <= ?`, now.UnixNano()); err != nil {
+			return err
+		}
+		available, found, err := availableStock(ctx, tx, stockKey{productID, variantID}, cartID, now)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("producto con id %s no encontrado", productID)
+		}
+		if quantity > available {
+			return &InsufficientStockError{Items: []StockShortage{{ProductID: productID, VariantID: variantID, Requested: quantity, Available: max(available, 0)}}}
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO reservations (cart_id, product_id, variant_id, quantity, expires_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (cart_id, product_id, variant_id) DO UPDATE SET quantity = excluded.quantity, expires_at = excluded.expires_at`,
+			cartID, productID, variantID, quantity, expiresAt.UnixNano())
+		return err
+	})
+}
+func (s *SQLiteStore) CommitStock(ctx context.Context, cartID string, items []models.CartItem) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		order, requested := stockRequest(items)
+		var shortages []StockShortage
+		for _, key := range order {
+			available, _, err := availableStock(ctx, tx, key, cartID, now)
+			if err != nil {
+				return err
+			}
+			available = max(available, 0)
+			if requested[key] > available {
+				shortages = append(shortages, StockShortage{ProductID: key.productID, VariantID: key.variantID, Requested: requested[key], Available: available})
+			}
+		}
+		if len(shortages) > 0 {
+			return &InsufficientStockError{Items: shortages}
+		}
+		for _, key := range order {
+			if err := adjustStock(ctx, tx, key, -requested[key]); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM reservations WHERE cart_id = ?`, cartID)
+		return err
+	})
+}
+func (s *SQLiteStore) RestockItems(ctx context.Context, items []models.CartItem) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		order, requested := stockRequest(items)
+		for _, key := range order {
+			if err := adjustStock(ctx, tx, key, requested[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// --- MÉTODOS PARA USUARIOS ---
+const userColumns = `id, username, password, role`
+
+func scanUser(row rowScanner) (models.User, error) {
+	var u models.User
+	err := row.Scan(&u.ID, &u.Username, &u.Password, &u.Role)
+	return u, err
+}
+
+func (s *SQLiteStore) CreateUser(ctx context.Context, u models.User) (models.User, error) {
+	u.ID = uuid.NewString()
+	if u.Role == "" {
+		u.Role = models.RoleCustomer
+	}
+	_, err := s.q.ExecContext(ctx, `INSERT INTO users (id, username, password, role) VALUES (?, ?, ?, ?)`, u.ID, u.Username, u.Password, u.Role)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return models.User{}, fmt.Errorf("el usuario '%s' ya existe", u.Username)
+		}
+		return models.User{}, err
+	}
+	return u, nil
+}
+func (s *SQLiteStore) GetUserByUsername(ctx context.Context, username string) (models.User, error) {
+	u, err := scanUser(s.q.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, fmt.Errorf("usuario '%s' no encontrado", username)
+	}
+	return u, err
+}
+func (s *SQLiteStore) GetUserByID(ctx context.Context, id string) (models.User, error) {
+	u, err := scanUser(s.q.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, fmt.Errorf("usuario con id %s no encontrado", id)
+	}
+	return u, err
+}
+func (s *SQLiteStore) UpdateUserRole(ctx context.Context, id string, role models.Role) (models.User, error) {
+	res, err := s.q.ExecContext(ctx, `UPDATE users SET role = ? WHERE id = ?`, role, id)
+	if err != nil {
+		return models.User{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.User{}, fmt.Errorf("usuario con id %s no encontrado", id)
+	}
+	return s.GetUserByID(ctx, id)
+}
+
+// --- MÉTODOS PARA DIRECCIONES ---
+// La dirección completa se guarda como JSON; user_id se replica en una columna para buscar por dueño.
+func scanAddress(row rowScanner) (models.Address, error) {
+	var data string
+	if err := row.Scan(&data); err != nil {
+		return models.Address{}, err
+	}
+	var a models.Address
+	err := json.Unmarshal([]byte(data), &a)
+	return a, err
+}
+
+func (s *SQLiteStore) GetAddresses(ctx context.Context, userID string) ([]models.Address, error) {
+	rows, err := s.q.QueryContext(ctx, `SELECT data FROM addresses WHERE user_id = ? ORDER BY seq`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []models.Address{}
+	for rows.Next() {
+		a, err := scanAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+func (s *SQLiteStore) GetAddress(ctx context.Context, userID, id string) (models.Address, error) {
+	a, err := scanAddress(s.q.QueryRowContext(ctx, `SELECT data FROM addresses WHERE id = ? AND user_id = ?`, id, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Address{}, ErrAddressNotFound
+	}
+	return a, err
+}
+func (s *SQLiteStore) CreateAddress(ctx context.Context, a models.Address) (models.Address, error) {
+	a.ID = uuid.NewString()
+	a.CreatedAt = time.Now().UTC()
+	data, err := json.Marshal(a)
+	if err != nil {
+		return models.Address{}, err
+	}
+	_, err = s.q.ExecContext(ctx, `INSERT INTO addresses (id, user_id, data) VALUES (?, ?, ?)`, a.ID, a.UserID, string(data))
+	if err != nil {
+		return models.Address{}, err
+	}
+	return a, nil
+}
+func (s *SQLiteStore) UpdateAddress(ctx context.Context, userID, id string, a models.Address) (models.Address, error) {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		existing, err := scanAddress(tx.QueryRowContext(ctx, `SELECT data FROM addresses WHERE id = ? AND user_id = ?`, id, userID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAddressNotFound
+		}
+		if err != nil {
+			return err
+		}
+		a.ID, a.UserID, a.CreatedAt = id, userID, existing.CreatedAt
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE addresses SET data = ? WHERE id = ?`, string(data), id)
+		return err
+	})
+	if err != nil {
+		return models.Address{}, err
+	}
+	return a, nil
+}
+func (s *SQLiteStore) DeleteAddress(ctx context.Context, userID, id string) error {
+	res, err := s.q.ExecContext(ctx, `DELETE FROM addresses WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAddressNotFound
+	}
+	return nil
+}
+
+// --- MÉTODOS PARA TOKENS DE REFRESCO ---
+func (s *SQLiteStore) SaveRefreshToken(ctx context.Context, t models.RefreshToken) error {
+	_, err := s.q.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at, created_at, used, revoked) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.TokenHash, t.UserID, t.FamilyID, t.ExpiresAt.UnixNano(), t.CreatedAt.UnixNano(), t.Used, t.Revoked)
+	return err
+}
+func (s *SQLiteStore) ConsumeRefreshToken(ctx context.Context, tokenHash string) (models.RefreshToken, error) {
+	var t models.RefreshToken
+	var result error
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var expiresAt, createdAt int64
+		err := tx.QueryRowContext(ctx, `SELECT token_hash, user_id, family_id, expires_at, created_at, used, revoked FROM refresh_tokens WHERE token_hash = ?`, tokenHash).
+			Scan(&t.TokenHash, &t.UserID, &t.FamilyID, &expiresAt, &createdAt, &t.Used, &t.Revoked)
+		if errors.Is(err, sql.ErrNoRows) {
+			result = ErrRefreshTokenNotFound
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		t.ExpiresAt, t.CreatedAt = time.Unix(0, expiresAt), time.Unix(0, createdAt)
+		switch {
+		case t.Used:
+			result = ErrRefreshTokenReused
+		case t.Revoked || time.Now().After(t.ExpiresAt):
+			result = ErrRefreshTokenInvalid
+		default:
+			t.Used = true
+			_, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET used = 1 WHERE token_hash = ?`, tokenHash)
+		}
+		return err
+	})
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+	return t, result
+}
+func (s *SQLiteStore) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	_, err := s.q.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE family_id = ?`, familyID)
+	return err
+}
+
+// --- MÉTODOS PARA IDEMPOTENCIA ---
+// El registro se guarda como JSON; la clave primaria (scope, key) impide dos reservas simultáneas.
+func (s *SQLiteStore) ReserveIdempotencyKey(ctx context.Context, rec models.IdempotencyRecord) (models.IdempotencyRecord, bool, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return models.IdempotencyRecord{}, false, err
+	}
+	existing := rec
+	reserved := false
+	err = s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= ?`, time.Now().UnixNano()); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO idempotency_keys (scope, key, expires_at, data) VALUES (?, ?, ?, ?) ON CONFLICT (scope, key) DO NOTHING`,
+			rec.Scope, rec.Key, rec.ExpiresAt.UnixNano(), string(data))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			reserved = true
+			return nil
+		}
+		var stored string
+		if err := tx.QueryRowContext(ctx, `SELECT data FROM idempotency_keys WHERE scope = ? AND key = ?`, rec.Scope, rec.Key).Scan(&stored); err != nil {
+			return err
+		}
+		existing = models.IdempotencyRecord{}
+		return json.Unmarshal([]byte(stored), &existing)
+	})
+	if err != nil {
+		return models.IdempotencyRecord{}, false, err
+	}
+	return existing, reserved, nil
+}
+func (s *SQLiteStore) CompleteIdempotencyKey(ctx context.Context, rec models.IdempotencyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.q.ExecContext(ctx, `INSERT INTO idempotency_keys (scope, key, expires_at, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (scope, key) DO UPDATE SET expires_at = excluded.expires_at, data = excluded.data`,
+		rec.Scope, rec.Key, rec.ExpiresAt.UnixNano(), string(data))
+	return err
+}
+func (s *SQLiteStore) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	_, err := s.q.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE scope = ? AND key = ?`, scope, key)
+	return err
+}
+
+// --- MÉTODOS PARA ÓRDENES ---
+// Igual que los carritos, la orden se guarda como JSON y se replican las columnas usadas en filtros.
+func scanOrder(row rowScanner) (models.Order, error) {
+	var data string
+	if err := row.Scan(&data); err != nil {
+		return models.Order{}, err
+	}
+	var o models.Order
+	err := json.Unmarshal([]byte(data), &o)
+	return o, err
+}
+
+func (s *SQLiteStore) queryOrders(ctx context.Context, query string, args ...any) ([]models.Order, error) {
+	rows, err := s.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []models.Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, o)
+	}
+	return list, rows.Err()
+}
+
+func (s *SQLiteStore) CreateOrder(ctx context.Context, o models.Order) (models.Order, error) {
+	now := time.Now()
+	o.ID = uuid.NewString()
+	o.CreatedAt, o.UpdatedAt = now, now
+	if o.Status == "" {
+		o.Status = models.OrderPending
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return models.Order{}, err
+	}
+	_, err = s.q.ExecContext(ctx, `INSERT INTO orders (id, user_id, status, created_at, data) VALUES (?, ?, ?, ?, ?)`,
+		o.ID, o.UserID, o.Status, o.CreatedAt.UnixNano(), string(data))
+	if err != nil {
+		return models.Order{}, err
+	}
+	return o, nil
+}
+func (s *SQLiteStore) GetOrderByID(ctx context.Context, id string) (models.Order, error) {
+	o, err := scanOrder(s.q.QueryRowContext(ctx, `SELECT data FROM orders WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Order{}, ErrOrderNotFound
+	}
+	return o, err
+}
+func (s *SQLiteStore) GetOrdersByUserID(ctx context.Context, userID string) ([]models.Order, error) {
+	return s.queryOrders(ctx, `SELECT data FROM orders WHERE user_id = ? ORDER BY seq`, userID)
+}
+func (s *SQLiteStore) GetAllOrders(ctx context.Context) ([]models.Order, error) {
+	return s.queryOrders(ctx, `SELECT data FROM orders ORDER BY seq`)
+}
+func (s *SQLiteStore) QueryOrders(ctx context.Context, f OrderFilter) ([]models.Order, int, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.UserID != "" {
+		where = append(where, "user_id = ?")
+		args = append(args, f.UserID)
+	}
+	if !f.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.From.UnixNano())
+	}
+	if !f.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.To.UnixNano())
+	}
+	clause := strings.Join(where, " AND ")
+	var total int
+	if err := s.q.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders WHERE `+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = -1 // En SQLite, LIMIT -1 significa sin límite.
+	}
+	list, err := s.queryOrders(ctx, `SELECT data FROM orders WHERE `+clause+` ORDER BY seq DESC LIMIT ? OFFSET ?`,
+		append(args, limit, max(f.Offset, 0))...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return list, total, nil
+}
+func (s *SQLiteStore) UpdateOrderStatus(ctx context.Context, id string, status models.OrderStatus) (models.Order, error) {
+	var o models.Order
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		o, err = scanOrder(tx.QueryRowContext(ctx, `SELECT data FROM orders WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !o.Status.CanTransitionTo(status) {
+			return fmt.Errorf("%w: de %s a %s", ErrInvalidTransition, o.Status, status)
+		}
+		now := time.Now()
+		if o.Busy(now) && o.PendingStatus != status {
+			return fmt.Errorf("%w: hacia %s", ErrOrderBusy, o.PendingStatus)
+		}
+		o.Status = status
+		o.PendingStatus, o.PendingUntil = "", time.Time{}
+		o.UpdatedAt = now
+		data, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET status = ?, data = ? WHERE id = ?`, o.Status, string(data), id)
+		return err
+	})
+	if err != nil {
+		return models.Order{}, err
+	}
+	return o, nil
+}
+func (s *SQLiteStore) ClaimOrderStatus(ctx context.Context, id string, status models.OrderStatus, until time.Time) (models.Order, error) {
+	var o models.Order
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		o, err = scanOrder(tx.QueryRowContext(ctx, `SELECT data FROM orders WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !o.Status.CanTransitionTo(status) {
+			return fmt.Errorf("%w: de %s a %s", ErrInvalidTransition, o.Status, status)
+		}
+		now := time.Now()
+		if o.Busy(now) {
+			return fmt.Errorf("%w: hacia %s", ErrOrderBusy, o.PendingStatus)
+		}
+		o.PendingStatus, o.PendingUntil = status, until
+		o.UpdatedAt = now
+		data, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET data = ? WHERE id = ?`, string(data), id)
+		return err
+	})
+	if err != nil {
+		return models.Order{}, err
+	}
+	return o, nil
+}
+func (s *SQLiteStore) ReleaseOrderStatus(ctx context.Context, id string) (models.Order, error) {
+	var o models.Order
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		o, err = scanOrder(tx.QueryRowContext(ctx, `SELECT data FROM orders WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		o.PendingStatus, o.PendingUntil = "", time.Time{}
+		o.UpdatedAt = time.Now()
+		data, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET data = ? WHERE id = ?`, string(data), id)
+		return err
+	})
+	if err != nil {
+		return models.Order{}, err
+	}
+	return o, nil
+}
+func (s *SQLiteStore) RecordPayment(ctx context.Context, id string, a models.PaymentAttempt) (models.Order, error) {
+	var o models.Order
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		o, err = scanOrder(tx.QueryRowContext(ctx, `SELECT data FROM orders WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		o.RecordPayment(a)
+		o.UpdatedAt = time.Now()
+		data, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET data = ? WHERE id = ?`, string(data), id)
+		return err
+	})
+	if err != nil {
+		return models.Order{}, err
+	}
+	return o, nil
+}
+func (s *SQLiteStore) RecordReturnedItems(ctx context.Context, id string, items []models.ReturnItem) (models.Order, error) {
+	var o models.Order
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		o, err = scanOrder(tx.QueryRowContext(ctx, `SELECT data FROM orders WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !o.AddReturned(items) {
+			return ErrReturnQuantity
+		}
+		o.UpdatedAt = time.Now()
+		data, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET data = ? WHERE id = ?`, string(data), id)
+		return err
+	})
+	if err != nil {
+		return models.Order{}, err
+	}
+	return o, nil
+}
+
+// --- MÉTODOS PARA DEVOLUCIONES ---
+// Como las órdenes, la devolución se guarda como JSON con las columnas de los filtros replicadas.
+func scanReturn(row rowScanner) (models.Return, error) {
+	var data string
+	if err := row.Scan(&data); err != nil {
+		return models.Return{}, err
+	}
+	var r models.Return
+	err := json.Unmarshal([]byte(data), &r)
+	return r, err
+}
+
+func (s *SQLiteStore) CreateReturn(ctx context.Context, r models.Return) (models.Return, error) {
+	now := time.Now()
+	r.ID = uuid.NewString()
+	r.CreatedAt, r.UpdatedAt = now, now
+	if r.Status == "" {
+		r.Status = models.ReturnRequested
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return models.Return{}, err
+	}
+	_, err = s.q.ExecContext(ctx, `INSERT INTO returns (id, order_id, user_id, status, created_at, data) VALUES (?, ?, ?, ?, ?, ?)`,
+		r.ID, r.OrderID, r.UserID, r.Status, r.CreatedAt.UnixNano(), string(data))
+	if err != nil {
+		return models.Return{}, err
+	}
+	return r, nil
+}
+func (s *SQLiteStore) GetReturnByID(ctx context.Context, id string) (models.Return, error) {
+	r, err := scanReturn(s.q.QueryRowContext(ctx, `SELECT data FROM returns WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Return{}, ErrReturnNotFound
+	}
+	return r, err
+}
+func (s *SQLiteStore) QueryReturns(ctx context.Context, f ReturnFilter) ([]models.Return, int, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.UserID != "" {
+		where = append(where, "user_id = ?")
+		args = append(args, f.UserID)
+	}
+	if f.OrderID != "" {
+		where = append(where, "order_id = ?")
+		args = append(args, f.OrderID)
+	}
+	clause := strings.Join(where, " AND ")
+	var total int
+	if err := s.q.QueryRowContext(ctx, `SELECT COUNT(*) FROM returns WHERE `+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.q.QueryContext(ctx, `SELECT data FROM returns WHERE `+clause+` ORDER BY seq DESC LIMIT ? OFFSET ?`,
+		append(args, limit, max(f.Offset, 0))...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	list := []models.Return{}
+	for rows.Next() {
+		r, err := scanReturn(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, r)
+	}
+	return list, total, rows.Err()
+}
+func (s *SQLiteStore) UpdateReturn(ctx context.Context, id string, r models.Return) (models.Return, error) {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		existing, err := scanReturn(tx.QueryRowContext(ctx, `SELECT data FROM returns WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrReturnNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if r.Status != existing.Status && !existing.Status.CanTransitionTo(r.Status) {
+			return fmt.Errorf("%w: de %s a %s", ErrInvalidTransition, existing.Status, r.Status)
+		}
+		r.ID, r.OrderID, r.UserID, r.Items, r.Reason, r.CreatedAt = existing.ID, existing.OrderID, existing.UserID, existing.Items, existing.Reason, existing.CreatedAt
+		r.UpdatedAt = time.Now()
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE returns SET status = ?, data = ? WHERE id = ?`, r.Status, string(data), id)
+		return err
+	})
+	if err != nil {
+		return models.Return{}, err
+	}
+	return r, nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"fmt"
+	"tienda/models"
+
+	"github.com/google/uuid"
+)
+
+// stockKey identifica una unidad de inventario: un producto o una de sus variantes.
+type stockKey struct {
+	productID string
+	variantID string
+}
+
+// stockRequest suma las cantidades pedidas por unidad de inventario, conservando el
+// orden de aparición para que los errores se reporten de forma estable.
+func stockRequest(items []models.CartItem) ([]stockKey, map[stockKey]int) {
+	requested := make(map[stockKey]int)
+	order := []stockKey{}
+	for _, item := range items {
+		key := stockKey{item.ProductID, item.VariantID}
+		if _, seen := requested[key]; !seen {
+			order = append(order, key)
+		}
+		requested[key] += item.Quantity
+	}
+	return order, requested
+}
+
+// prepareVariants asigna ID a las variantes nuevas, verifica que los SKU no se repitan
+// dentro del producto y recalcula el stock total.
+func prepareVariants(p *models.Product) error {
+	seen := make(map[string]bool, len(p.Variants))
+	variants := make([]models.ProductVariant, len(p.Variants))
+	for i, v := range p.Variants {
+		if v.ID == "" {
+			v.ID = uuid.NewString()
+		}
+		if seen[v.SKU] {
+			return fmt.Errorf("%w: %s", ErrDuplicateSKU, v.SKU)
+		}
+		seen[v.SKU] = true
+		variants[i] = v
+	}
+	p.Variants = variants
+	p.SyncStock()
+	return nil
+}
@@ -1 +1,215 @@
 package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"tienda/models"
+	"tienda/storage"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// ErrInvalidToken se devuelve cuando un token no es válido o ha expirado.
+var ErrInvalidToken = errors.New("token inválido o expirado")
+
+// AuthConfig agrupa los parámetros configurables para firmar tokens.
+type AuthConfig struct {
+	Secret          string        // Clave HMAC usada para firmar los tokens.
+	Issuer          string        // Emisor registrado en el claim "iss".
+	AccessTokenTTL  time.Duration // Tiempo de vida de los tokens de acceso.
+	RefreshTokenTTL time.Duration // Tiempo de vida de los tokens de refresco.
+}
+
+// Claims define el contenido de un token de acceso.
+type Claims struct {
+	UserID   string      `json:"uid"`
+	Username string      `json:"username"`
+	Role     models.Role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// AuthUser representa al usuario autenticado de la petición actual.
+type AuthUser struct {
+	ID       string
+	Username string
+	Role     models.Role
+}
+
+// TokenManager emite y valida tokens de acceso firmados (JWT HS256).
+type TokenManager struct {
+	secret     []byte
+	issuer     string
+	ttl        time.Duration
+	refreshTTL time.Duration
+}
+
+// NewTokenManager es el constructor del gestor de tokens.
+func NewTokenManager(cfg AuthConfig) (*TokenManager, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("la clave secreta de JWT no puede estar vacía")
+	}
+	if cfg.AccessTokenTTL <= 0 {
+		return nil, errors.New("la duración del token de acceso debe ser positiva")
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		return nil, errors.New("la duración del token de refresco debe ser positiva")
+	}
+	return &TokenManager{
+		secret:     []byte(cfg.Secret),
+		issuer:     cfg.Issuer,
+		ttl:        cfg.AccessTokenTTL,
+		refreshTTL: cfg.RefreshTokenTTL,
+	}, nil
+}
+
+// GenerateAccessToken firma un token de acceso para el usuario y devuelve su fecha de expiración.
+func (m *TokenManager) GenerateAccessToken(u models.User) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(m.ttl)
+	claims := Claims{
+		UserID:   u.ID,
+		Username: u.Username,
+		Role:     u.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.issuer,
+			Subject:   u.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString(m.secret)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error al firmar el token: %w", err)
+	}
+	return signed, expiresAt, nil
+}
+
+// ParseAccessToken valida la firma, el emisor y la expiración de un token.
+func (m *TokenManager) ParseAccessToken(tokenString string) (*Claims, error) {
+	opts := []jwt.ParserOption{jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired()}
+	if m.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(m.issuer))
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return m.secret, nil
+	}, opts...)
+	if err != nil || !token.Valid || claims.UserID == "" {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// NewRefreshToken genera un token de refresco opaco y aleatorio.
+// Devuelve el valor que se entrega al cliente, su hash para almacenarlo y su expiración.
+func (m *TokenManager) NewRefreshToken() (token, tokenHash string, expiresAt time.Time, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", time.Time{}, fmt.Errorf("error al generar el token de refresco: %w", err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashRefreshToken(token), time.Now().Add(m.refreshTTL), nil
+}
+
+// HashRefreshToken calcula el hash SHA-256 con el que se guarda un token de refresco.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// --- CONTEXTO DE LA PETICIÓN ---
+
+type contextKey string
+
+const authUserKey contextKey = "authUser"
+
+// WithAuthUser devuelve una copia del contexto que incluye al usuario autenticado.
+func WithAuthUser(ctx context.Context, u AuthUser) context.Context {
+	return context.WithValue(ctx, authUserKey, u)
+}
+
+// UserFromContext obtiene el usuario autenticado guardado por el middleware.
+func UserFromContext(ctx context.Context) (AuthUser, bool) {
+	u, ok := ctx.Value(authUserKey).(AuthUser)
+	return u, ok
+}
+
+// bearerToken extrae el token de la cabecera "Authorization: Bearer <token>".
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// AuthMiddleware exige un token de acceso válido y guarda al usuario en el contexto.
+// El rol se lee del almacén en cada petición y no del token, que puede haberse emitido
+// antes de un cambio de rol.
+func AuthMiddleware(tm *TokenManager, users storage.UserStorer) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+				return
+			}
+			claims, err := tm.ParseAccessToken(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			user, err := users.GetUserByID(r.Context(), claims.UserID)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+				http.Error(w, "Usuario no encontrado", http.StatusUnauthorized)
+				return
+			}
+			ctx := WithAuthUser(r.Context(), AuthUser{ID: user.ID, Username: user.Username, Role: user.Role})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// OptionalAuthMiddleware identifica al usuario si envía un token, pero permite peticiones anónimas.
+// Un token presente pero inválido se rechaza con 401 para no tratarlo silenciosamente como invitado.
+func OptionalAuthMiddleware(tm *TokenManager, users storage.UserStorer) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			claims, err := tm.ParseAccessToken(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			user, err := users.GetUserByID(r.Context(), claims.UserID)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+				http.Error(w, "Usuario no encontrado", http.StatusUnauthorized)
+				return
+			}
+			ctx := WithAuthUser(r.Context(), AuthUser{ID: user.ID, Username: user.Username, Role: user.Role})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
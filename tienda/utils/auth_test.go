@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tienda/models"
+	"tienda/storage"
+	"time"
+)
+
+func TestAuthMiddlewareReloadsRole(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     models.Role // Rol al emitir el token.
+		newRole  models.Role // Rol guardado al hacer la petición.
+		deleted  bool        // El usuario ya no existe.
+		wantCode int
+	}{
+		{name: "rol sin cambios", role: models.RoleAdmin, newRole: models.RoleAdmin, wantCode: http.StatusOK},
+		{name: "rol retirado", role: models.RoleAdmin, newRole: models.RoleCustomer, wantCode: http.StatusForbidden},
+		{name: "rol concedido", role: models.RoleCustomer, newRole: models.RoleAdmin, wantCode: http.StatusOK},
+		{name: "usuario inexistente", role: models.RoleAdmin, deleted: true, wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			tm, err := NewTokenManager(AuthConfig{Secret: "secreto", AccessTokenTTL: time.Minute, RefreshTokenTTL: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := models.User{ID: "nadie", Username: "ana", Role: tt.role}
+			if !tt.deleted {
+				if user, err = store.CreateUser(ctx, user); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := store.UpdateUserRole(ctx, user.ID, tt.newRole); err != nil {
+					t.Fatal(err)
+				}
+			}
+			token, _, err := tm.GenerateAccessToken(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler := AuthMiddleware(tm, store)(RequirePermission(PermCatalogWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			req := httptest.NewRequest(http.MethodPost, "/api/products", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("código = %d, se esperaba %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"tienda/models"
+	"tienda/storage"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// IdempotencyKeyHeader es la cabecera con la que el cliente identifica una petición
+	// que puede reintentar sin riesgo de ejecutarla dos veces.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader marca las respuestas repetidas a partir de una guardada.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+	// Los cuerpos de hasta maxIdempotentBodyBytes se guardan en memoria para repetirlos al
+	// handler; los mayores (p. ej. subidas de imágenes) se vuelcan a un archivo temporal,
+	// hasta maxIdempotentSpoolBytes.
+	maxIdempotentBodyBytes  = 1 << 20
+	maxIdempotentSpoolBytes = 32 << 20
+	// idempotencyLockTTL es cuánto se reserva la clave mientras la petición original está
+	// en curso; pasado ese plazo se considera abandonada y la clave queda libre.
+	idempotencyLockTTL = time.Minute
+)
+
+// IdempotencyMiddleware hace que las peticiones POST con cabecera Idempotency-Key se
+// ejecuten una sola vez por dueño y clave (ver idempotencyScope): la primera respuesta se
+// guarda durante ttl y los reintentos reciben esa misma respuesta. Mientras la primera sigue
+// en curso, un duplicado recibe 409; reutilizar la clave con otro método, ruta o cuerpo
+// recibe 400.
+// Las respuestas 5xx no se guardan, para que el cliente pueda reintentar.
+// Debe encadenarse después de AuthMiddleware u OptionalAuthMiddleware.
+func IdempotencyMiddleware(store storage.IdempotencyStorer, ttl time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if r.Method != http.MethodPost || key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				http.Error(w, "La cabecera Idempotency-Key es demasiado larga", http.StatusBadRequest)
+				return
+			}
+			fingerprint := requestHash(r)
+			body, err := spoolBody(http.MaxBytesReader(w, r.Body, maxIdempotentSpoolBytes), fingerprint)
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				var fileErr *os.PathError
+				switch {
+				case errors.As(err, &tooLarge):
+					http.Error(w, "El cuerpo es demasiado grande para una petición con Idempotency-Key", http.StatusRequestEntityTooLarge)
+				case errors.As(err, &fileErr):
+					log.Printf("Error al guardar el cuerpo de la petición idempotente: %v", err)
+					http.Error(w, "Error interno al verificar la clave de idempotencia", http.StatusInternalServerError)
+				default:
+					http.Error(w, "Cuerpo de la petición inválido", http.StatusBadRequest)
+				}
+				return
+			}
+			defer body.Close()
+			r.Body = body
+
+			now := time.Now().UTC()
+			rec := models.IdempotencyRecord{
+				Key:         key,
+				Fingerprint: hex.EncodeToString(fingerprint.Sum(nil)),
+				CreatedAt:   now,
+				ExpiresAt:   now.Add(idempotencyLockTTL),
+			}
+			rec.Scope = idempotencyScope(r, rec.Fingerprint)
+			existing, reserved, err := store.ReserveIdempotencyKey(r.Context(), rec)
+			if err != nil {
+				log.Printf("Error al reservar la clave de idempotencia: %v", err)
+				http.Error(w, "Error interno al verificar la clave de idempotencia", http.StatusInternalServerError)
+				return
+			}
+			if !reserved {
+				switch {
+				case existing.Fingerprint != rec.Fingerprint:
+					http.Error(w, "La clave de idempotencia ya se usó con otra petición", http.StatusBadRequest)
+				case !existing.Completed:
+					http.Error(w, "Ya hay una petición en curso con esta clave de idempotencia", http.StatusConflict)
+				default:
+					replayResponse(w, existing)
+				}
+				return
+			}
+
+			// Si el handler no termina con una respuesta guardable (error 5xx o pánico) se
+			// libera la clave. Se usa un contexto sin cancelación porque el cliente pudo irse.
+			ctx := context.WithoutCancel(r.Context())
+			saved := false
+			defer func() {
+				if !saved {
+					if err := store.ReleaseIdempotencyKey(ctx, rec.Scope, rec.Key); err != nil {
+						log.Printf("Error al liberar la clave de idempotencia: %v", err)
+					}
+				}
+			}()
+			rw := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r)
+			if rw.status >= http.StatusInternalServerError {
+				return
+			}
+			rec.Completed = true
+			rec.StatusCode = rw.status
+			rec.ContentType = rw.Header().Get("Content-Type")
+			rec.Body = rw.body.Bytes()
+			rec.ExpiresAt = time.Now().UTC().Add(ttl)
+			if err := store.CompleteIdempotencyKey(ctx, rec); err != nil {
+				log.Printf("Error al guardar la respuesta idempotente: %v", err)
+				return
+			}
+			saved = true
+		})
+	}
+}
+
+// idempotencyScope devuelve el dueño de la clave: el usuario autenticado o, para un
+// invitado, el carrito de la ruta. Así dos clientes no pueden ver la respuesta del otro.
+// Sin ninguno de los dos (un invitado que crea su carrito) la clave se asocia a la huella de
+// la petición: solo quien repite la misma petición recibe la respuesta guardada.
+// Las rutas de sesión no deben usar este middleware: guardaría la huella del cuerpo, con la
+// contraseña, y la respuesta, con los tokens.
+func idempotencyScope(r *http.Request, fingerprint string) string {
+	if user, ok := UserFromContext(r.Context()); ok {
+		return "user:" + user.ID
+	}
+	if cartID := mux.Vars(r)["cartId"]; cartID != "" {
+		return "cart:" + cartID
+	}
+	return "request:" + fingerprint
+}
+
+// requestHash empieza la huella de la petición, que detecta una clave reutilizada con otra
+// petición: el método y la ruta, seguidos del cuerpo que escribe spoolBody.
+func requestHash(r *http.Request) hash.Hash {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	return h
+}
+
+// spooledBody es una copia del cuerpo de la petición para entregársela al handler.
+type spooledBody struct {
+	io.Reader
+	file *os.File // Archivo temporal con lo que excede maxIdempotentBodyBytes, si lo hay.
+}
+
+// Close elimina el archivo temporal.
+func (b *spooledBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	err := os.Remove(b.file.Name())
+	b.file = nil
+	return err
+}
+
+// spoolBody lee el cuerpo completo escribiéndolo en h y devuelve una copia para el handler.
+// Los primeros maxIdempotentBodyBytes quedan en memoria y el resto en un archivo temporal,
+// que se elimina al cerrar la copia.
+func spoolBody(body io.Reader, h hash.Hash) (*spooledBody, error) {
+	var head bytes.Buffer
+	_, err := io.CopyN(io.MultiWriter(&head, h), body, maxIdempotentBodyBytes)
+	if errors.Is(err, io.EOF) {
+		return &spooledBody{Reader: &head}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp("", "idempotency-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledBody{file: file}
+	if _, err := io.Copy(io.MultiWriter(file, h), body); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	spooled.Reader = io.MultiReader(&head, file)
+	return spooled, nil
+}
+
+// replayResponse repite una respuesta guardada.
+func replayResponse(w http.ResponseWriter, rec models.IdempotencyRecord) {
+	if rec.ContentType != "" {
+		w.Header().Set("Content-Type", rec.ContentType)
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(rec.StatusCode)
+	w.Write(rec.Body)
+}
+
+// recordingResponseWriter envía la respuesta al cliente y a la vez guarda una copia.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap permite a http.ResponseController llegar al ResponseWriter original.
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
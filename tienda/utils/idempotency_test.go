@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"tienda/storage"
+	"time"
+)
+
+func TestIdempotencyMiddlewareReplay(t *testing.T) {
+	type call struct {
+		user     string // Usuario autenticado; vacío para un invitado.
+		body     string
+		wantCode int
+		replayed bool
+	}
+	large := strings.Repeat("x", 3<<20)
+	tests := []struct {
+		name     string
+		status   int // Respuesta del handler.
+		calls    []call
+		wantRuns int
+	}{
+		{
+			name:   "el reintento repite la respuesta",
+			status: http.StatusCreated,
+			calls: []call{
+				{user: "u1", body: "a", wantCode: http.StatusCreated},
+				{user: "u1", body: "a", wantCode: http.StatusCreated, replayed: true},
+			},
+			wantRuns: 1,
+		},
+		{
+			name:   "la clave con otro cuerpo se rechaza",
+			status: http.StatusCreated,
+			calls: []call{
+				{user: "u1", body: "a", wantCode: http.StatusCreated},
+				{user: "u1", body: "b", wantCode: http.StatusBadRequest},
+			},
+			wantRuns: 1,
+		},
+		{
+			name:   "los errores 5xx no se guardan",
+			status: http.StatusBadGateway,
+			calls: []call{
+				{user: "u1", body: "a", wantCode: http.StatusBadGateway},
+				{user: "u1", body: "a", wantCode: http.StatusBadGateway},
+			},
+			wantRuns: 2,
+		},
+		{
+			name:   "cada usuario tiene sus claves",
+			status: http.StatusCreated,
+			calls: []call{
+				{user: "u1", body: "a", wantCode: http.StatusCreated},
+				{user: "u2", body: "a", wantCode: http.StatusCreated},
+			},
+			wantRuns: 2,
+		},
+		{
+			name:   "invitados sin carrito con otra petición no comparten la respuesta",
+			status: http.StatusOK,
+			calls: []call{
+				{body: `{"region":"ES"}`, wantCode: http.StatusOK},
+				{body: `{"region":"MX"}`, wantCode: http.StatusOK},
+			},
+			wantRuns: 2,
+		},
+		{
+			name:   "el invitado que repite la petición recibe la respuesta guardada",
+			status: http.StatusOK,
+			calls: []call{
+				{body: `{"region":"ES"}`, wantCode: http.StatusOK},
+				{body: `{"region":"ES"}`, wantCode: http.StatusOK, replayed: true},
+			},
+			wantRuns: 1,
+		},
+		{
+			name:   "cuerpo mayor a 1 MiB",
+			status: http.StatusCreated,
+			calls: []call{
+				{user: "u1", body: large, wantCode: http.StatusCreated},
+				{user: "u1", body: large, wantCode: http.StatusCreated, replayed: true},
+			},
+			wantRuns: 1,
+		},
+		{
+			name:     "cuerpo demasiado grande",
+			status:   http.StatusCreated,
+			calls:    []call{{user: "u1", body: strings.Repeat("x", maxIdempotentSpoolBytes+1), wantCode: http.StatusRequestEntityTooLarge}},
+			wantRuns: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				runs++
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Errorf("el handler no pudo leer el cuerpo: %v", err)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, strconv.Itoa(len(body)))
+			})
+			mw := IdempotencyMiddleware(storage.NewMemoryStore(), time.Hour)(handler)
+			for i, c := range tt.calls {
+				req := httptest.NewRequest(http.MethodPost, "/api/recurso", strings.NewReader(c.body))
+				req.Header.Set(IdempotencyKeyHeader, "clave-1")
+				if c.user != "" {
+					req = req.WithContext(WithAuthUser(req.Context(), AuthUser{ID: c.user}))
+				}
+				rec := httptest.NewRecorder()
+				mw.ServeHTTP(rec, req)
+				if rec.Code != c.wantCode {
+					t.Fatalf("petición %d: código = %d, se esperaba %d: %s", i+1, rec.Code, c.wantCode, rec.Body)
+				}
+				if replayed := rec.Header().Get(IdempotentReplayedHeader) == "true"; replayed != c.replayed {
+					t.Errorf("petición %d: repetida = %v, se esperaba %v", i+1, replayed, c.replayed)
+				}
+				if c.wantCode < http.StatusBadRequest && rec.Body.String() != strconv.Itoa(len(c.body)) {
+					t.Errorf("petición %d: el handler leyó %s bytes, se esperaban %d", i+1, rec.Body, len(c.body))
+				}
+			}
+			if runs != tt.wantRuns {
+				t.Errorf("el handler se ejecutó %d veces, se esperaban %d", runs, tt.wantRuns)
+			}
+		})
+	}
+}
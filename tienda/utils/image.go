@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+
+	"golang.org/x/image/draw"
+
+	// Registran los decodificadores de los formatos de imagen aceptados.
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// ImageFormats asocia los tipos MIME aceptados con la extensión con la que se guardan.
+var ImageFormats = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Errores de validación de las imágenes subidas.
+var (
+	ErrUnsupportedImage = errors.New("formato de imagen no soportado (JPEG, PNG, GIF o WebP)")
+	ErrImageTooLarge    = errors.New("la imagen supera las dimensiones máximas permitidas")
+)
+
+// maxImagePixels limita el tamaño de las imágenes decodificadas (unos 40 megapíxeles).
+const maxImagePixels = 40_000_000
+
+// DecodedImage es una imagen subida ya validada.
+type DecodedImage struct {
+	ContentType string
+	Image       image.Image
+}
+
+// DecodeImage detecta el tipo real del contenido (sin fiarse del nombre ni de la cabecera
+// enviada por el cliente) y decodifica la imagen.
+func DecodeImage(data []byte) (DecodedImage, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := ImageFormats[contentType]; !ok {
+		return DecodedImage{}, ErrUnsupportedImage
+	}
+	// Se revisan las dimensiones antes de decodificar para no reservar memoria
+	// desproporcionada con imágenes pequeñas en bytes pero enormes en píxeles.
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return DecodedImage{}, ErrUnsupportedImage
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return DecodedImage{}, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return DecodedImage{}, ErrUnsupportedImage
+	}
+	return DecodedImage{ContentType: contentType, Image: img}, nil
+}
+
+// Thumbnail reduce la imagen para que su lado mayor mida como mucho maxSize píxeles,
+// conservando la proporción, y la codifica como JPEG sobre fondo blanco.
+func Thumbnail(src image.Image, maxSize int) ([]byte, error) {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > maxSize || h > maxSize {
+		if w >= h {
+			w, h = maxSize, max(1, h*maxSize/w)
+		} else {
+			w, h = max(1, w*maxSize/h), maxSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	// JPEG no admite transparencia: se rellena de blanco antes de dibujar.
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
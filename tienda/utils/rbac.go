@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"net/http"
+	"tienda/models"
+
+	"github.com/gorilla/mux"
+)
+
+// Permission identifica una acción protegida de la API.
+type Permission string
+
+const (
+	PermCatalogWrite  Permission = "catalog:write"  // Crear, editar y eliminar productos.
+	PermReportsRead   Permission = "reports:read"   // Consultar reportes de ventas.
+	PermUsersManage   Permission = "users:manage"   // Cambiar el rol de otros usuarios.
+	PermCartsManage   Permission = "carts:manage"   // Ver y modificar carritos de otros usuarios.
+	PermOrdersManage  Permission = "orders:manage"  // Ver todas las órdenes, cambiar su estado y gestionar devoluciones.
+	PermCouponsManage Permission = "coupons:manage" // Crear, editar y eliminar cupones.
+	PermTaxesManage   Permission = "taxes:manage"   // Configurar las reglas de impuestos.
+)
+
+// rolePermissions asigna a cada rol los permisos que posee.
+var rolePermissions = map[models.Role][]Permission{
+	models.RoleCustomer: {},
+	models.RoleStaff:    {PermReportsRead, PermCartsManage, PermOrdersManage},
+	models.RoleAdmin:    {PermCatalogWrite, PermReportsRead, PermUsersManage, PermCartsManage, PermOrdersManage, PermCouponsManage, PermTaxesManage},
+}
+
+// HasPermission indica si un rol concede el permiso solicitado.
+func HasPermission(role models.Role, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission rechaza la petición si el usuario autenticado no tiene el permiso.
+// Debe encadenarse después de AuthMiddleware: sin usuario en el contexto responde 401,
+// con usuario pero sin permiso responde 403.
+func RequirePermission(perm Permission) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := UserFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Se requiere autenticación", http.StatusUnauthorized)
+				return
+			}
+			if !HasPermission(user.Role, perm) {
+				http.Error(w, "No tienes permisos para realizar esta acción", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}